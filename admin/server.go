@@ -1,11 +1,13 @@
 package admin
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,16 +15,23 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 
+	cmm "github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/ledger"
 	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/observer"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/screening"
 	"github.com/binance-chain/bsc-eth-swap/swap"
 	"github.com/binance-chain/bsc-eth-swap/util"
-	cmm "github.com/binance-chain/bsc-eth-swap/common"
 )
 
 const (
 	DefaultListenAddr = "0.0.0.0:8080"
 
 	MaxIconUrlLength = 400
+
+	// the name of the admin key when it approves swaps or edits the screening lists
+	DefaultApprover = "admin"
 )
 
 type Admin struct {
@@ -31,15 +40,29 @@ type Admin struct {
 	cfg *util.Config
 
 	hmacSigner *util.HmacSigner
+	// the signers of the approvers by their names
+	approvers  map[string]*util.HmacSigner
 	swapEngine *swap.SwapEngine
+	pools      []*provider.Pool
+	observers  []*observer.Observer
+
+	srv *http.Server
 }
 
-func NewAdmin(config *util.Config, db *gorm.DB, signer *util.HmacSigner, swapEngine *swap.SwapEngine) *Admin {
+func NewAdmin(config *util.Config, db *gorm.DB, signer *util.HmacSigner, swapEngine *swap.SwapEngine, pools []*provider.Pool,
+	observers []*observer.Observer) *Admin {
+	approvers := make(map[string]*util.HmacSigner, len(config.AdminConfig.Approvers))
+	for _, approver := range config.AdminConfig.Approvers {
+		approvers[approver.Name] = util.NewHmacSigner(approver.ApiKey, approver.SecretKey)
+	}
 	return &Admin{
 		DB:         db,
 		cfg:        config,
 		hmacSigner: signer,
+		approvers:  approvers,
 		swapEngine: swapEngine,
+		pools:      pools,
+		observers:  observers,
 	}
 }
 
@@ -57,6 +80,11 @@ func updateCheck(update *updateSwapPairRequest) error {
 			return fmt.Errorf("invalid lowerBound amount: %s", update.LowerBound)
 		}
 	}
+	if update.ApprovalThreshold != nil && *update.ApprovalThreshold != "" {
+		if _, ok := big.NewInt(0).SetString(*update.ApprovalThreshold, 10); !ok {
+			return fmt.Errorf("invalid approval threshold: %s", *update.ApprovalThreshold)
+		}
+	}
 	if len(update.IconUrl) > MaxIconUrlLength {
 		return fmt.Errorf("icon length exceed limit")
 	}
@@ -102,6 +130,9 @@ func (admin *Admin) UpdateSwapPairHandler(w http.ResponseWriter, r *http.Request
 	if updateSwapPair.IconUrl != "" {
 		toUpdate["icon_url"] = updateSwapPair.IconUrl
 	}
+	if updateSwapPair.ApprovalThreshold != nil {
+		toUpdate["approval_threshold"] = *updateSwapPair.ApprovalThreshold
+	}
 
 	err = admin.DB.Model(model.SwapPair{}).Where("erc20_addr = ?", updateSwapPair.ERC20Addr).Updates(toUpdate).Error
 	if err != nil {
@@ -153,6 +184,32 @@ func (admin *Admin) Endpoints(w http.ResponseWriter, r *http.Request) {
 		Endpoints: []string{
 			"/update_swap_pair",
 			"/healthz",
+			"/provider_health",
+			"/withdraw_token",
+			"/retry_failed_swaps",
+			"/rescan",
+			"/rescan_job",
+			"/nonce_status",
+			"/replace_nonce",
+			"/fill_metrics",
+			"/velocity_limits",
+			"/update_velocity_limit",
+			"/pending_approval_swaps",
+			"/approve_swap",
+			"/reject_swap",
+			"/screened_addresses",
+			"/update_screened_address",
+			"/remove_screened_address",
+			"/import_screened_addresses",
+			"/blocked_swaps",
+			"/release_blocked_swap",
+			"/liquidity",
+			"/balances",
+			"/ledger_report",
+			"/swap_timeline",
+			"/refund_candidates",
+			"/refunds",
+			"/approve_refund",
 		},
 	}
 
@@ -170,6 +227,30 @@ func (admin *Admin) Endpoints(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (admin *Admin) ProviderHealth(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	health := make(map[string][]provider.EndpointHealth, len(admin.pools))
+	for _, pool := range admin.pools {
+		health[pool.GetChainName()] = pool.Health()
+	}
+
+	jsonBytes, err := json.MarshalIndent(health, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
 func (admin *Admin) WithdrawToken(w http.ResponseWriter, r *http.Request) {
 	reqBody, err := admin.checkAuth(r)
 	if err != nil {
@@ -247,7 +328,7 @@ func (admin *Admin) RetryFailedSwaps(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var retryFailedSwapsResp retryFailedSwapsResponse
-	retryFailedSwapsResp.SwapIDList, retryFailedSwapsResp.RejectedSwapIDList, err = admin.swapEngine.InsertRetryFailedSwaps(retryFailedSwaps.SwapIDList)
+	retryFailedSwapsResp.SwapIDList, retryFailedSwapsResp.RejectedSwapIDList, err = admin.swapEngine.InsertRetryFailedSwaps(retryFailedSwaps.SwapIDList, DefaultApprover)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		retryFailedSwapsResp.ErrMsg = err.Error()
@@ -269,53 +350,908 @@ func (admin *Admin) RetryFailedSwaps(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (admin *Admin) Healthz(w http.ResponseWriter, r *http.Request) {
+// Rescan starts a historical rescan of the range on the chain, the progress is queried by the returned job id
+func (admin *Admin) Rescan(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := admin.checkAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rescan rescanRequest
+	err = json.Unmarshal(reqBody, &rescan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var chainObserver *observer.Observer
+	for _, ob := range admin.observers {
+		if ob.Executor.GetChainName() == strings.ToUpper(rescan.Chain) {
+			chainObserver = ob
+		}
+	}
+	if chainObserver == nil {
+		http.Error(w, fmt.Sprintf("unsupported chain %s", rescan.Chain), http.StatusBadRequest)
+		return
+	}
+
+	job, err := chainObserver.NewRescanJob(rescan.FromHeight, rescan.ToHeight)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chainObserver.StartRescan(job)
+
+	admin.writeJob(w, job)
+}
+
+// RescanJob returns the progress of the rescan job
+func (admin *Admin) RescanJob(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid job id, err=%s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	job := model.RescanJob{}
+	err = admin.DB.Where("id = ?", id).First(&job).Error
+	if err != nil {
+		http.Error(w, fmt.Sprintf("rescan job %d is not found", id), http.StatusNotFound)
+		return
+	}
+
+	admin.writeJob(w, &job)
+}
+
+func (admin *Admin) writeJob(w http.ResponseWriter, job *model.RescanJob) {
+	jsonBytes, err := json.MarshalIndent(job, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
 }
 
-func (admin *Admin) checkAuth(r *http.Request) ([]byte, error) {
-	apiKey := r.Header.Get("ApiKey")
-	hash := r.Header.Get("Authorization")
+// FillMetrics returns the throughput of the fill workers and the fills in flight of both directions
+func (admin *Admin) FillMetrics(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jsonBytes, err := json.MarshalIndent(admin.swapEngine.FillMetrics(), "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	payload, err := ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
 	if err != nil {
-		return nil, err
+		util.Logger.Errorf("write response error, err=%s", err.Error())
 	}
+}
 
-	if admin.hmacSigner.ApiKey != apiKey {
-		return nil, fmt.Errorf("api key mismatch")
+// VelocityLimits returns all velocity limits including the disabled ones
+func (admin *Admin) VelocityLimits(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limits := make([]model.VelocityLimit, 0)
+	err := admin.DB.Order("id asc").Find(&limits).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if !admin.hmacSigner.Verify(payload, hash) {
-		return nil, fmt.Errorf("invalud auth")
+	jsonBytes, err := json.MarshalIndent(limits, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
 	}
-	return payload, nil
 }
 
-func (admin *Admin) Serve() {
-	router := mux.NewRouter()
+func velocityLimitCheck(update *updateVelocityLimitRequest) error {
+	switch model.VelocityScope(update.Scope) {
+	case model.VelocityScopeToken, model.VelocityScopeSponsor:
+	case model.VelocityScopeDirection:
+		if update.MaxAmount != "" && update.ERC20Addr == "" {
+			return fmt.Errorf("max_amount of the direction scope requires erc20_addr")
+		}
+	default:
+		return fmt.Errorf("unknown scope: %s", update.Scope)
+	}
+	if update.ERC20Addr != "" && !common.IsHexAddress(update.ERC20Addr) {
+		return fmt.Errorf("invalid erc20_addr: %s", update.ERC20Addr)
+	}
+	if update.Direction != "" && update.Direction != string(swap.SwapEth2BSC) && update.Direction != string(swap.SwapBSC2Eth) {
+		return fmt.Errorf("unknown direction: %s", update.Direction)
+	}
+	if update.WindowSeconds <= 0 {
+		return fmt.Errorf("window_seconds should be positive")
+	}
+	if update.MaxAmount != "" {
+		if amount, ok := big.NewInt(0).SetString(update.MaxAmount, 10); !ok || amount.Sign() < 0 {
+			return fmt.Errorf("invalid max_amount: %s", update.MaxAmount)
+		}
+	}
+	if update.MaxCount < 0 {
+		return fmt.Errorf("max_count should not be negative")
+	}
+	if update.MaxAmount == "" && update.MaxCount == 0 {
+		return fmt.Errorf("either max_amount or max_count should be set")
+	}
+	return nil
+}
 
-	router.HandleFunc("/", admin.Endpoints).Methods("GET")
-	router.HandleFunc("/healthz", admin.Healthz).Methods("GET")
-	router.HandleFunc("/update_swap_pair", admin.UpdateSwapPairHandler).Methods("PUT")
-	router.HandleFunc("/withdraw_token", admin.WithdrawToken).Methods("POST")
-	router.HandleFunc("/retry_failed_swaps", admin.RetryFailedSwaps).Methods("POST")
+// UpdateVelocityLimit creates or updates a velocity limit, it takes effect on the next swap to fill
+func (admin *Admin) UpdateVelocityLimit(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := admin.checkAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	listenAddr := DefaultListenAddr
-	if admin.cfg.AdminConfig.ListenAddr != "" {
-		listenAddr = admin.cfg.AdminConfig.ListenAddr
+	var updateLimit updateVelocityLimitRequest
+	err = json.Unmarshal(reqBody, &updateLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	srv := &http.Server{
-		Handler:      router,
-		Addr:         listenAddr,
-		WriteTimeout: 3 * time.Second,
-		ReadTimeout:  3 * time.Second,
+
+	if err := velocityLimitCheck(&updateLimit); err != nil {
+		http.Error(w, fmt.Sprintf("parameters is invalid, %v", err), http.StatusBadRequest)
+		return
+	}
+
+	limit := model.VelocityLimit{}
+	if updateLimit.ID != 0 {
+		err = admin.DB.Where("id = ?", updateLimit.ID).First(&limit).Error
+		if err != nil {
+			http.Error(w, fmt.Sprintf("velocity limit %d is not found", updateLimit.ID), http.StatusBadRequest)
+			return
+		}
+	}
+	limit.Scope = model.VelocityScope(updateLimit.Scope)
+	limit.ERC20Addr = ""
+	if updateLimit.ERC20Addr != "" {
+		limit.ERC20Addr = common.HexToAddress(updateLimit.ERC20Addr).String()
+	}
+	limit.Direction = cmm.SwapDirection(updateLimit.Direction)
+	limit.WindowSeconds = updateLimit.WindowSeconds
+	limit.MaxAmount = updateLimit.MaxAmount
+	limit.MaxCount = updateLimit.MaxCount
+	limit.Enabled = updateLimit.Enabled
+
+	err = admin.DB.Save(&limit).Error
+	if err != nil {
+		http.Error(w, fmt.Sprintf("save velocity limit error, err=%s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(limit, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// PendingApprovalSwaps returns the swaps waiting for the approvers with the decisions made so far
+func (admin *Admin) PendingApprovalSwaps(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pendingSwaps, err := admin.swapEngine.GetPendingApprovalSwaps()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(pendingSwaps, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+func (admin *Admin) ApproveSwap(w http.ResponseWriter, r *http.Request) {
+	admin.decideSwap(w, r, admin.swapEngine.ApproveSwap)
+}
+
+func (admin *Admin) RejectSwap(w http.ResponseWriter, r *http.Request) {
+	admin.decideSwap(w, r, admin.swapEngine.RejectSwap)
+}
+
+func (admin *Admin) decideSwap(w http.ResponseWriter, r *http.Request, decide func(swapID uint, approver, comment string) (*model.Swap, error)) {
+	approver, reqBody, err := admin.checkApproverAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var decision swapDecisionRequest
+	err = json.Unmarshal(reqBody, &decision)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if decision.SwapID == 0 {
+		http.Error(w, "swap_id can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	decidedSwap, err := decide(decision.SwapID, approver, decision.Comment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(decidedSwap, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// ScreenedAddresses returns the entries of the address screening lists, the list is chosen by the list parameter
+func (admin *Admin) ScreenedAddresses(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := admin.DB.Order("id asc")
+	if list := r.FormValue("list"); list != "" {
+		query = query.Where("list = ?", list)
+	}
+	entries := make([]model.ScreenedAddress, 0)
+	if err := query.Find(&entries).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(entries, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
 	}
+}
 
-	util.Logger.Infof("start admin server at %s", srv.Addr)
+// UpdateScreenedAddress puts the address on the blocklist or the allowlist
+func (admin *Admin) UpdateScreenedAddress(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := admin.checkAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	err := srv.ListenAndServe()
+	var updateAddress updateScreenedAddressRequest
+	err = json.Unmarshal(reqBody, &updateAddress)
 	if err != nil {
-		panic(fmt.Sprintf("start admin server error, err=%s", err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !common.IsHexAddress(updateAddress.Address) {
+		http.Error(w, fmt.Sprintf("invalid address: %s", updateAddress.Address), http.StatusBadRequest)
+		return
+	}
+	list := model.AddressList(updateAddress.List)
+	if list != model.AddressBlocked && list != model.AddressAllowed {
+		http.Error(w, fmt.Sprintf("invalid list %s, block or allow", updateAddress.List), http.StatusBadRequest)
+		return
+	}
+
+	entry := model.ScreenedAddress{
+		Address: common.HexToAddress(updateAddress.Address).String(),
+		List:    list,
+		Reason:  updateAddress.Reason,
+		Source:  DefaultApprover,
+	}
+	err = screening.SaveAddresses(admin.DB, []model.ScreenedAddress{entry})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("save screened address error, err=%s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	util.Logger.Infof("address %s is put on the %s list, reason: %s", entry.Address, entry.List, entry.Reason)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// RemoveScreenedAddress removes the address from the list it is on
+func (admin *Admin) RemoveScreenedAddress(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := admin.checkAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var removeAddress removeScreenedAddressRequest
+	err = json.Unmarshal(reqBody, &removeAddress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !common.IsHexAddress(removeAddress.Address) {
+		http.Error(w, fmt.Sprintf("invalid address: %s", removeAddress.Address), http.StatusBadRequest)
+		return
+	}
+
+	err = screening.RemoveAddress(admin.DB, removeAddress.Address)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("remove screened address error, err=%s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	util.Logger.Infof("address %s is removed from the screening lists", removeAddress.Address)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ImportScreenedAddresses adds the entries of a csv or json file to the screening lists
+func (admin *Admin) ImportScreenedAddresses(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := admin.checkAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var importAddresses importScreenedAddressesRequest
+	err = json.Unmarshal(reqBody, &importAddresses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := screening.ParseAddresses([]byte(importAddresses.Content), importAddresses.Format,
+		model.AddressList(importAddresses.List), importAddresses.Source)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parameters is invalid, %v", err), http.StatusBadRequest)
+		return
+	}
+	err = screening.SaveAddresses(admin.DB, entries)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("save screened addresses error, err=%s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	util.Logger.Infof("%d addresses are imported from %s", len(entries), importAddresses.Source)
+
+	jsonBytes, err := json.MarshalIndent(importScreenedAddressesResponse{Imported: len(entries)}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// BlockedSwaps returns the swaps blocked by the address screening
+func (admin *Admin) BlockedSwaps(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	swaps := make([]model.Swap, 0)
+	err := admin.DB.Where("status = ?", swap.SwapBlocked).Order("id asc").Find(&swaps).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(swaps, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// ReleaseBlockedSwap lets the swap blocked by the address screening be filled
+func (admin *Admin) ReleaseBlockedSwap(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := admin.checkAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var release releaseBlockedSwapRequest
+	err = json.Unmarshal(reqBody, &release)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if release.SwapID == 0 || release.Reason == "" {
+		http.Error(w, "swap_id and reason can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	releasedSwap, err := admin.swapEngine.ReleaseBlockedSwap(release.SwapID, DefaultApprover, release.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(releasedSwap, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// Liquidity returns the erc20 locked in the eth swap agent against the bep20 minted for every swap pair
+func (admin *Admin) Liquidity(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jsonBytes, err := json.MarshalIndent(admin.swapEngine.LiquidityReports(), "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// Balances returns the native balances of the tss accounts and how many fills they cover
+func (admin *Admin) Balances(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jsonBytes, err := json.MarshalIndent(admin.swapEngine.BalanceReports(), "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// LedgerReport returns the fees collected and the gas spent in the days [from, to), grouped by the group_by
+// parameter. The report is exported as csv if the format parameter is csv.
+func (admin *Admin) LedgerReport(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var options ledger.ReportOptions
+	var err error
+	if from := r.FormValue("from"); from != "" {
+		if options.From, err = ledger.ParseDay(from); err != nil {
+			http.Error(w, fmt.Sprintf("invalid from, err=%s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	if to := r.FormValue("to"); to != "" {
+		if options.To, err = ledger.ParseDay(to); err != nil {
+			http.Error(w, fmt.Sprintf("invalid to, err=%s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	if options.GroupBy, err = ledger.ParseGroupBy(r.FormValue("group_by")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := ledger.Report(admin.DB, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if strings.ToLower(r.FormValue("format")) == ledger.FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=ledger_report.csv")
+		w.WriteHeader(http.StatusOK)
+		if err := ledger.WriteCSV(w, rows); err != nil {
+			util.Logger.Errorf("write response error, err=%s", err.Error())
+		}
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(rows, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// SwapTimeline returns the status transitions of the swap of the id, its retry swaps and its refunds
+func (admin *Admin) SwapTimeline(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	swapID, err := strconv.ParseUint(r.FormValue("swap_id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid swap id, err=%s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	swap, timeline, err := admin.swapEngine.GetSwapTimeline(uint(swapID))
+	if gorm.IsRecordNotFoundError(err) {
+		http.Error(w, fmt.Sprintf("swap %d is not found", swapID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(swapTimelineResponse{Swap: swap, Timeline: timeline}, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// RefundCandidates returns the rejected swaps whose token can be refunded to the sponsor
+func (admin *Admin) RefundCandidates(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	swaps, err := admin.swapEngine.GetRefundCandidates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(swaps, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// Refunds returns the refunds of the status, or all of them if the status parameter is empty
+func (admin *Admin) Refunds(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	refunds := make([]model.SwapRefund, 0)
+	query := admin.DB.Order("id asc")
+	if status := r.FormValue("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Find(&refunds).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(refunds, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// ApproveRefund lets the token of the rejected swap be sent back to the sponsor
+func (admin *Admin) ApproveRefund(w http.ResponseWriter, r *http.Request) {
+	approver, reqBody, err := admin.checkApproverAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var approve approveRefundRequest
+	err = json.Unmarshal(reqBody, &approve)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if approve.SwapID == 0 || approve.Reason == "" {
+		http.Error(w, "swap_id and reason can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	refund, err := admin.swapEngine.ApproveRefund(approve.SwapID, approver, approve.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(refund, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// NonceStatus returns the nonces of the tx senders and the reservations which are not consumed yet
+func (admin *Admin) NonceStatus(w http.ResponseWriter, r *http.Request) {
+	if _, err := admin.checkAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reports, err := admin.swapEngine.NonceReports()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(reports, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+// ReplaceNonce fills a nonce gap or replaces a stuck tx of the tx sender with a self transfer
+func (admin *Admin) ReplaceNonce(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := admin.checkAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var replaceNonce replaceNonceRequest
+	err = json.Unmarshal(reqBody, &replaceNonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chain := strings.ToUpper(replaceNonce.Chain)
+	if chain != cmm.ChainBSC && chain != cmm.ChainETH {
+		http.Error(w, fmt.Sprintf("unsupported chain %s", replaceNonce.Chain), http.StatusBadRequest)
+		return
+	}
+	if replaceNonce.Nonce < 0 {
+		http.Error(w, fmt.Sprintf("invalid nonce %d", replaceNonce.Nonce), http.StatusBadRequest)
+		return
+	}
+
+	var replaceNonceResp replaceNonceResponse
+	replaceNonceResp.TxHash, err = admin.swapEngine.ReplaceNonce(chain, replaceNonce.Nonce)
+	if err != nil {
+		replaceNonceResp.ErrMsg = err.Error()
+	}
+
+	jsonBytes, err := json.MarshalIndent(replaceNonceResp, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(jsonBytes)
+	if err != nil {
+		util.Logger.Errorf("write response error, err=%s", err.Error())
+	}
+}
+
+func (admin *Admin) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (admin *Admin) checkAuth(r *http.Request) ([]byte, error) {
+	apiKey := r.Header.Get("ApiKey")
+	hash := r.Header.Get("Authorization")
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if admin.hmacSigner.ApiKey != apiKey {
+		return nil, fmt.Errorf("api key mismatch")
+	}
+
+	if !admin.hmacSigner.Verify(payload, hash) {
+		return nil, fmt.Errorf("invalud auth")
+	}
+	return payload, nil
+}
+
+// checkApproverAuth authenticates the request by the key of an approver and returns the name of the approver,
+// the admin key is the only approver if no approver is configured
+func (admin *Admin) checkApproverAuth(r *http.Request) (string, []byte, error) {
+	if len(admin.approvers) == 0 {
+		payload, err := admin.checkAuth(r)
+		return DefaultApprover, payload, err
+	}
+
+	apiKey := r.Header.Get("ApiKey")
+	hash := r.Header.Get("Authorization")
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for name, signer := range admin.approvers {
+		if signer.ApiKey != apiKey {
+			continue
+		}
+		if !signer.Verify(payload, hash) {
+			return "", nil, fmt.Errorf("invalud auth")
+		}
+		return name, payload, nil
+	}
+	return "", nil, fmt.Errorf("api key mismatch")
+}
+
+// Start starts serving the admin requests, the server keeps serving until Stop is called so that the requests
+// in flight are drained by Shutdown rather than cut off by the cancellation of ctx
+func (admin *Admin) Start(ctx context.Context) {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/", admin.Endpoints).Methods("GET")
+	router.HandleFunc("/healthz", admin.Healthz).Methods("GET")
+	router.HandleFunc("/provider_health", admin.ProviderHealth).Methods("GET")
+	router.HandleFunc("/update_swap_pair", admin.UpdateSwapPairHandler).Methods("PUT")
+	router.HandleFunc("/withdraw_token", admin.WithdrawToken).Methods("POST")
+	router.HandleFunc("/retry_failed_swaps", admin.RetryFailedSwaps).Methods("POST")
+	router.HandleFunc("/rescan", admin.Rescan).Methods("POST")
+	router.HandleFunc("/rescan_job", admin.RescanJob).Methods("GET")
+	router.HandleFunc("/nonce_status", admin.NonceStatus).Methods("GET")
+	router.HandleFunc("/replace_nonce", admin.ReplaceNonce).Methods("POST")
+	router.HandleFunc("/fill_metrics", admin.FillMetrics).Methods("GET")
+	router.HandleFunc("/velocity_limits", admin.VelocityLimits).Methods("GET")
+	router.HandleFunc("/update_velocity_limit", admin.UpdateVelocityLimit).Methods("PUT")
+	router.HandleFunc("/pending_approval_swaps", admin.PendingApprovalSwaps).Methods("GET")
+	router.HandleFunc("/approve_swap", admin.ApproveSwap).Methods("POST")
+	router.HandleFunc("/reject_swap", admin.RejectSwap).Methods("POST")
+	router.HandleFunc("/screened_addresses", admin.ScreenedAddresses).Methods("GET")
+	router.HandleFunc("/update_screened_address", admin.UpdateScreenedAddress).Methods("PUT")
+	router.HandleFunc("/remove_screened_address", admin.RemoveScreenedAddress).Methods("POST")
+	router.HandleFunc("/import_screened_addresses", admin.ImportScreenedAddresses).Methods("POST")
+	router.HandleFunc("/blocked_swaps", admin.BlockedSwaps).Methods("GET")
+	router.HandleFunc("/release_blocked_swap", admin.ReleaseBlockedSwap).Methods("POST")
+	router.HandleFunc("/liquidity", admin.Liquidity).Methods("GET")
+	router.HandleFunc("/balances", admin.Balances).Methods("GET")
+	router.HandleFunc("/ledger_report", admin.LedgerReport).Methods("GET")
+	router.HandleFunc("/swap_timeline", admin.SwapTimeline).Methods("GET")
+	router.HandleFunc("/refund_candidates", admin.RefundCandidates).Methods("GET")
+	router.HandleFunc("/refunds", admin.Refunds).Methods("GET")
+	router.HandleFunc("/approve_refund", admin.ApproveRefund).Methods("POST")
+
+	listenAddr := DefaultListenAddr
+	if admin.cfg.AdminConfig.ListenAddr != "" {
+		listenAddr = admin.cfg.AdminConfig.ListenAddr
+	}
+	admin.srv = &http.Server{
+		Handler:      router,
+		Addr:         listenAddr,
+		WriteTimeout: 3 * time.Second,
+		ReadTimeout:  3 * time.Second,
+	}
+
+	util.Logger.Infof("start admin server at %s", admin.srv.Addr)
+
+	go func() {
+		err := admin.srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			panic(fmt.Sprintf("start admin server error, err=%s", err.Error()))
+		}
+	}()
+}
+
+// Stop stops accepting new requests and waits for the requests being handled
+func (admin *Admin) Stop() error {
+	if admin.srv == nil {
+		return nil
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), cmm.ShutdownTimeout)
+	defer cancel()
+	return admin.srv.Shutdown(ctx)
 }
@@ -1,11 +1,17 @@
 package admin
 
+import (
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
 type updateSwapPairRequest struct {
 	ERC20Addr  string `json:"erc20_addr"`
 	Available  bool   `json:"available"`
 	LowerBound string `json:"lower_bound"`
 	UpperBound string `json:"upper_bound"`
 	IconUrl    string `json:"icon_url"`
+	// the approval threshold is left unchanged if it is null, and removed if it is empty
+	ApprovalThreshold *string `json:"approval_threshold"`
 }
 
 type withdrawTokenRequest struct {
@@ -29,3 +35,75 @@ type retryFailedSwapsResponse struct {
 	RejectedSwapIDList []uint `json:"rejected_swap_id_list"`
 	ErrMsg             string `json:"err_msg"`
 }
+
+type rescanRequest struct {
+	Chain      string `json:"chain"`
+	FromHeight int64  `json:"from_height"`
+	ToHeight   int64  `json:"to_height"`
+}
+
+type replaceNonceRequest struct {
+	Chain string `json:"chain"`
+	Nonce int64  `json:"nonce"`
+}
+
+type replaceNonceResponse struct {
+	TxHash string `json:"tx_hash"`
+	ErrMsg string `json:"err_msg"`
+}
+
+type updateVelocityLimitRequest struct {
+	// the limit to update, a new limit is created if it is zero
+	ID            uint   `json:"id"`
+	Scope         string `json:"scope"`
+	ERC20Addr     string `json:"erc20_addr"`
+	Direction     string `json:"direction"`
+	WindowSeconds int64  `json:"window_seconds"`
+	MaxAmount     string `json:"max_amount"`
+	MaxCount      int64  `json:"max_count"`
+	Enabled       bool   `json:"enabled"`
+}
+
+type swapDecisionRequest struct {
+	SwapID  uint   `json:"swap_id"`
+	Comment string `json:"comment"`
+}
+
+type updateScreenedAddressRequest struct {
+	Address string `json:"address"`
+	List    string `json:"list"`
+	Reason  string `json:"reason"`
+}
+
+type removeScreenedAddressRequest struct {
+	Address string `json:"address"`
+}
+
+type importScreenedAddressesRequest struct {
+	// csv or json
+	Format string `json:"format"`
+	// the list of the entries without one
+	List    string `json:"list"`
+	Source  string `json:"source"`
+	Content string `json:"content"`
+}
+
+type importScreenedAddressesResponse struct {
+	Imported int `json:"imported"`
+}
+
+type releaseBlockedSwapRequest struct {
+	SwapID uint   `json:"swap_id"`
+	Reason string `json:"reason"`
+}
+
+type approveRefundRequest struct {
+	SwapID uint   `json:"swap_id"`
+	Reason string `json:"reason"`
+}
+
+type swapTimelineResponse struct {
+	Swap *model.Swap `json:"swap"`
+	// the transitions of the swap, its retry swaps and its refunds in the order they are made
+	Timeline []model.SwapStatusHistory `json:"timeline"`
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/binance-chain/bsc-eth-swap/swap"
+)
+
+const (
+	flagListenAddr = "listen-addr"
+	flagPrivateKey = "private-key"
+	flagKeystore   = "keystore"
+	flagPassword   = "password"
+	flagTLSCert    = "tls-cert"
+	flagTLSKey     = "tls-key"
+	flagClientCA   = "client-ca"
+)
+
+func initFlags() {
+	flag.String(flagListenAddr, "127.0.0.1:8550", "listen address")
+	flag.String(flagPrivateKey, "", "comma separated hex private keys to sign with")
+	flag.String(flagKeystore, "", "keystore file to sign with")
+	flag.String(flagPassword, "", "password of the keystore file")
+	flag.String(flagTLSCert, "", "server certificate, the server listens on http without it")
+	flag.String(flagTLSKey, "", "server key")
+	flag.String(flagClientCA, "", "ca of the client certificates, the clients must present one signed by it if set")
+
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	err := viper.BindPFlags(pflag.CommandLine)
+	if err != nil {
+		panic(fmt.Sprintf("bind flags error, err=%s", err))
+	}
+}
+
+func printUsage() {
+	fmt.Print("usage: ./signer --private-key hex_private_key [--tls-cert server_cert --tls-key server_key --client-ca client_ca]\n")
+	fmt.Print("       ./signer --keystore keystore_file --password password [--tls-cert server_cert --tls-key server_key --client-ca client_ca]\n")
+}
+
+// SignerService serves eth_accounts and eth_signTransaction like web3signer, it stands in for a remote signer in the
+// tests and must not hold a key of value
+type SignerService struct {
+	keys map[ethcom.Address]*ecdsa.PrivateKey
+}
+
+func (s *SignerService) Accounts() []ethcom.Address {
+	accounts := make([]ethcom.Address, 0, len(s.keys))
+	for account := range s.keys {
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+func (s *SignerService) SignTransaction(args swap.RemoteSignTxArgs) (hexutil.Bytes, error) {
+	key, ok := s.keys[args.From]
+	if !ok {
+		return nil, fmt.Errorf("unknown account %s", args.From.String())
+	}
+	if args.To == nil || args.GasPrice == nil || args.Value == nil || args.ChainID == nil {
+		return nil, fmt.Errorf("missing to, gasPrice, value or chainId")
+	}
+	tx := types.NewTransaction(uint64(args.Nonce), *args.To, args.Value.ToInt(), uint64(args.Gas), args.GasPrice.ToInt(), args.Data)
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(args.ChainID.ToInt()), key)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("signed tx %s of %s, nonce %d, chain id %s\n", signedTx.Hash().String(), args.From.String(), args.Nonce, args.ChainID.ToInt().String())
+	return rlp.EncodeToBytes(signedTx)
+}
+
+func loadKeys() (map[ethcom.Address]*ecdsa.PrivateKey, error) {
+	keys := make(map[ethcom.Address]*ecdsa.PrivateKey)
+	if privateKeys := viper.GetString(flagPrivateKey); privateKeys != "" {
+		for _, privateKey := range strings.Split(privateKeys, ",") {
+			key, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(privateKey), "0x"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid private key, err=%s", err.Error())
+			}
+			keys[crypto.PubkeyToAddress(key.PublicKey)] = key
+		}
+	}
+	if keystorePath := viper.GetString(flagKeystore); keystorePath != "" {
+		keyJson, err := ioutil.ReadFile(keystorePath)
+		if err != nil {
+			return nil, fmt.Errorf("read keystore error, err=%s", err.Error())
+		}
+		key, err := keystore.DecryptKey(keyJson, viper.GetString(flagPassword))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt keystore error, err=%s", err.Error())
+		}
+		keys[key.Address] = key.PrivateKey
+	}
+	return keys, nil
+}
+
+func main() {
+	initFlags()
+
+	keys, err := loadKeys()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if len(keys) == 0 {
+		printUsage()
+		return
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &SignerService{keys: keys}); err != nil {
+		fmt.Printf("register service error, err=%s\n", err.Error())
+		return
+	}
+	httpServer := &http.Server{
+		Addr:    viper.GetString(flagListenAddr),
+		Handler: server,
+	}
+	for account := range keys {
+		fmt.Printf("signing for %s\n", account.String())
+	}
+
+	certPath, keyPath := viper.GetString(flagTLSCert), viper.GetString(flagTLSKey)
+	if certPath == "" {
+		fmt.Printf("listening on http://%s\n", httpServer.Addr)
+		err = httpServer.ListenAndServe()
+	} else {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if clientCA := viper.GetString(flagClientCA); clientCA != "" {
+			caPem, err := ioutil.ReadFile(clientCA)
+			if err != nil {
+				fmt.Printf("read client ca error, err=%s\n", err.Error())
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPem) {
+				fmt.Printf("no certificate is found in the client ca %s\n", clientCA)
+				return
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		httpServer.TLSConfig = tlsConfig
+		fmt.Printf("listening on https://%s\n", httpServer.Addr)
+		err = httpServer.ListenAndServeTLS(certPath, keyPath)
+	}
+	if err != nil {
+		fmt.Printf("serve error, err=%s\n", err.Error())
+	}
+}
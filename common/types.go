@@ -7,21 +7,42 @@ const (
 	ObserverPruneInterval  = 10 * time.Second
 	ObserverAlertInterval  = 5 * time.Second
 
+	// the max time to wait for a pushed block before polling the provider in subscription mode
+	ObserverSubscribeWaitTimeout = 30 * time.Second
+
+	ObserverDefaultFetchRangeSize = 1000
+	ObserverMinFetchRangeSize     = 1
+
+	// the max time for a component to finish its in-flight work on shutdown
+	ShutdownTimeout = 60 * time.Second
+
 	ChainBSC = "BSC" // binance smart chain
 	ChainETH = "ETH" // ethereum
 
+	// the block tags of post-merge ethereum
+	FinalityTagSafe      = "safe"
+	FinalityTagFinalized = "finalized"
+
 	VaultName = "BSC_ETH_SWAP"
 
 	DBDialectMysql   = "mysql"
 	DBDialectSqlite3 = "sqlite3"
 
+	// the txs are signed by the TSS server, the keys talking to it are in the config or the aws secret
 	LocalPrivateKey = "local_private_key"
 	AWSPrivateKey   = "aws_private_key"
+	// the txs are signed by the key of a keystore file
+	KeystoreKey = "keystore"
+	// the txs are signed by a plain private key in the config, for the tests only
+	MemoryKey = "memory"
+	// the txs are signed by a remote signer serving eth_signTransaction, e.g. web3signer or Clef
+	RemoteKey = "remote"
 )
 
 type SwapStatus string
 type SwapPairStatus string
 type RetrySwapStatus string
+type RefundStatus string
 type SwapDirection string
 
 type BlockAndEventLogs struct {
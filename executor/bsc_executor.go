@@ -6,15 +6,15 @@ import (
 	"strings"
 	"time"
 
-	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	ethcmm "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 
 	agent "github.com/binance-chain/bsc-eth-swap/abi"
 	contractabi "github.com/binance-chain/bsc-eth-swap/abi"
 	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
@@ -23,30 +23,63 @@ type BscExecutor struct {
 	Config *util.Config
 
 	SwapAgentAddr    ethcmm.Address
-	BSCSwapAgentInst *contractabi.ETHSwapAgent
+	BSCSwapAgentInst *contractabi.BSCSwapAgent
 	SwapAgentAbi     abi.ABI
-	Client           *ethclient.Client
+	Client           provider.Client
+	Subscriber       *Subscriber
+	Registry         *EventRegistry
 }
 
-func NewBSCExecutor(ethClient *ethclient.Client, swapAddr string, config *util.Config) *BscExecutor {
+func NewBSCExecutor(ethClient provider.Client, swapAddr string, config *util.Config) *BscExecutor {
 	agentAbi, err := abi.JSON(strings.NewReader(agent.BSCSwapAgentABI))
 	if err != nil {
 		panic("marshal abi error")
 	}
 
-	bscSwapAgentInst, err := contractabi.NewETHSwapAgent(ethcmm.HexToAddress(swapAddr), ethClient)
+	bscSwapAgentInst, err := contractabi.NewBSCSwapAgent(ethcmm.HexToAddress(swapAddr), ethClient)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	return &BscExecutor{
+	executor := &BscExecutor{
 		Chain:            common.ChainBSC,
 		Config:           config,
 		SwapAgentAddr:    ethcmm.HexToAddress(swapAddr),
 		BSCSwapAgentInst: bscSwapAgentInst,
 		SwapAgentAbi:     agentAbi,
 		Client:           ethClient,
+		Registry:         NewEventRegistry(common.ChainBSC),
 	}
+	executor.registerEvents()
+
+	if HasWebsocketProvider(config.ChainConfig.GetBSCProviders()) {
+		executor.Subscriber = NewSubscriber(common.ChainBSC, ethClient, executor.SwapAgentAddr, executor.Registry.Topics())
+	}
+	return executor
+}
+
+// registerEvents registers the BSCSwapAgent events indexed by the observer
+func (e *BscExecutor) registerEvents() {
+	e.Registry.Register(SwapStartedEventName, BSC2ETHSwapStartedEventHash, func(log *types.Log) (interface{}, error) {
+		return ParseBSC2ETHSwapStartEvent(&e.SwapAgentAbi, log)
+	}, SwapStartTxLogFactory, &model.SwapStartTxLog{})
+
+	e.Registry.Register(SwapFilledEventName, SwapFilledEventHash, func(log *types.Log) (interface{}, error) {
+		ev, err := e.BSCSwapAgentInst.ParseSwapFilled(*log)
+		if err != nil {
+			return nil, err
+		}
+		return &SwapFilledEvent{
+			TokenAddr:   ev.Bep20Addr,
+			StartTxHash: ev.EthTxHash,
+			ToAddress:   ev.ToAddress,
+			Amount:      ev.Amount,
+		}, nil
+	}, SwapFillTxLogFactory, &model.SwapFillTxLog{})
+
+	e.Registry.Register(OwnershipTransferredEventName, OwnershipTransferredEventHash, func(log *types.Log) (interface{}, error) {
+		return e.BSCSwapAgentInst.ParseOwnershipTransferred(*log)
+	}, NewContractEventLogFactory(OwnershipTransferredEventName), &model.ContractEventLog{})
 }
 
 func (e *BscExecutor) GetChainName() string {
@@ -62,7 +95,7 @@ func (e *BscExecutor) GetBlockAndTxEvents(height int64) (*common.BlockAndEventLo
 		return nil, err
 	}
 
-	packageLogs, err := e.GetLogs(header)
+	packageLogs, err := e.Registry.GetBlockLogs(e.Client, e.SwapAgentAddr, header)
 	if err != nil {
 		return nil, err
 	}
@@ -76,43 +109,32 @@ func (e *BscExecutor) GetBlockAndTxEvents(height int64) (*common.BlockAndEventLo
 		Events:          packageLogs,
 	}, nil
 }
-func (e *BscExecutor) GetLogs(header *types.Header) ([]interface{}, error) {
-	return e.GetSwapStartLogs(header)
+
+func (e *BscExecutor) GetLatestHeight() (int64, error) {
+	return getLatestHeight(e.Client)
 }
 
-func (e *BscExecutor) GetSwapStartLogs(header *types.Header) ([]interface{}, error) {
-	topics := [][]ethcmm.Hash{{BSC2ETHSwapStartedEventHash}}
+// GetEventRegistry returns the registry of the events indexed by the executor
+func (e *BscExecutor) GetEventRegistry() *EventRegistry {
+	return e.Registry
+}
 
-	blockHash := header.Hash()
+// GetSubscriber returns the subscriber of the executor, it is nil if the provider doesn't support subscriptions
+func (e *BscExecutor) GetSubscriber() *Subscriber {
+	return e.Subscriber
+}
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// GetBlockHash returns the hash of the canonical block at the given height
+func (e *BscExecutor) GetBlockHash(height int64) (string, error) {
+	return getBlockHash(e.Client, height)
+}
 
-	logs, err := e.Client.FilterLogs(ctxWithTimeout, ethereum.FilterQuery{
-		BlockHash: &blockHash,
-		Topics:    topics,
-		Addresses: []ethcmm.Address{e.SwapAgentAddr},
-	})
+// GetBlockAndTxEventsByRange returns the swap agent events between fromHeight and toHeight with range queries,
+// it is used to catch up with the chain when the observer lags far behind
+func (e *BscExecutor) GetBlockAndTxEventsByRange(fromHeight, toHeight int64) ([]*common.BlockAndEventLogs, error) {
+	logs, err := filterLogsByRange(e.Client, e.SwapAgentAddr, e.Registry.Topics(), fromHeight, toHeight)
 	if err != nil {
 		return nil, err
 	}
-
-	eventModels := make([]interface{}, 0, len(logs))
-	for _, log := range logs {
-		event, err := ParseBSC2ETHSwapStartEvent(&e.SwapAgentAbi, &log)
-		if err != nil {
-			util.Logger.Errorf("parse event log error, er=%s", err.Error())
-			continue
-		}
-		if event == nil {
-			continue
-		}
-
-		eventModel := event.ToSwapStartTxLog(&log)
-		eventModel.Chain = e.Chain
-		util.Logger.Debugf("Found BSC2ETH swap, txHash: %s, token address: %s, amount: %s, fee amount: %s",
-			eventModel.TxHash, eventModel.TokenAddr, eventModel.Amount, eventModel.FeeAmount)
-		eventModels = append(eventModels, eventModel)
-	}
-	return eventModels, nil
+	return buildBlockAndEventLogsByRange(e.Client, e.Chain, logs, toHeight, e.Registry.Decode)
 }
@@ -2,7 +2,6 @@ package executor
 
 import (
 	"context"
-	"github.com/ethereum/go-ethereum"
 	"math/big"
 	"strings"
 	"time"
@@ -10,11 +9,12 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	ethcmm "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 
 	agent "github.com/binance-chain/bsc-eth-swap/abi"
 	contractabi "github.com/binance-chain/bsc-eth-swap/abi"
 	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
@@ -25,10 +25,12 @@ type EthExecutor struct {
 	SwapAgentAddr    ethcmm.Address
 	ethSwapAgentInst *contractabi.ETHSwapAgent
 	SwapAgentAbi     abi.ABI
-	Client           *ethclient.Client
+	Client           provider.Client
+	Subscriber       *Subscriber
+	Registry         *EventRegistry
 }
 
-func NewEthExecutor(ethClient *ethclient.Client, swapAddr string, config *util.Config) *EthExecutor {
+func NewEthExecutor(ethClient provider.Client, swapAddr string, config *util.Config) *EthExecutor {
 	agentAbi, err := abi.JSON(strings.NewReader(agent.ETHSwapAgentABI))
 	if err != nil {
 		panic("marshal abi error")
@@ -38,14 +40,49 @@ func NewEthExecutor(ethClient *ethclient.Client, swapAddr string, config *util.C
 		panic(err.Error())
 	}
 
-	return &EthExecutor{
+	executor := &EthExecutor{
 		Chain:            common.ChainETH,
 		Config:           config,
 		SwapAgentAddr:    ethcmm.HexToAddress(swapAddr),
 		ethSwapAgentInst: ethSwapAgentInst,
 		SwapAgentAbi:     agentAbi,
 		Client:           ethClient,
+		Registry:         NewEventRegistry(common.ChainETH),
 	}
+	executor.registerEvents()
+
+	if HasWebsocketProvider(config.ChainConfig.GetETHProviders()) {
+		executor.Subscriber = NewSubscriber(common.ChainETH, ethClient, executor.SwapAgentAddr, executor.Registry.Topics())
+	}
+	return executor
+}
+
+// registerEvents registers the ETHSwapAgent events indexed by the observer
+func (e *EthExecutor) registerEvents() {
+	e.Registry.Register(SwapStartedEventName, ETH2BSCSwapStartedEventHash, func(log *types.Log) (interface{}, error) {
+		return ParseETH2BSCSwapStartEvent(&e.SwapAgentAbi, log)
+	}, SwapStartTxLogFactory, &model.SwapStartTxLog{})
+
+	e.Registry.Register(SwapPairRegisterEventName, SwapPairRegisterEventHash, func(log *types.Log) (interface{}, error) {
+		return ParseSwapPairRegisterEvent(&e.SwapAgentAbi, log)
+	}, SwapPairRegisterTxLogFactory, &model.SwapPairRegisterTxLog{})
+
+	e.Registry.Register(SwapFilledEventName, SwapFilledEventHash, func(log *types.Log) (interface{}, error) {
+		ev, err := e.ethSwapAgentInst.ParseSwapFilled(*log)
+		if err != nil {
+			return nil, err
+		}
+		return &SwapFilledEvent{
+			TokenAddr:   ev.Erc20Addr,
+			StartTxHash: ev.BscTxHash,
+			ToAddress:   ev.ToAddress,
+			Amount:      ev.Amount,
+		}, nil
+	}, SwapFillTxLogFactory, &model.SwapFillTxLog{})
+
+	e.Registry.Register(OwnershipTransferredEventName, OwnershipTransferredEventHash, func(log *types.Log) (interface{}, error) {
+		return e.ethSwapAgentInst.ParseOwnershipTransferred(*log)
+	}, NewContractEventLogFactory(OwnershipTransferredEventName), &model.ContractEventLog{})
 }
 
 func (e *EthExecutor) GetChainName() string {
@@ -61,7 +98,7 @@ func (e *EthExecutor) GetBlockAndTxEvents(height int64) (*common.BlockAndEventLo
 		return nil, err
 	}
 
-	packageLogs, err := e.GetLogs(header)
+	packageLogs, err := e.Registry.GetBlockLogs(e.Client, e.SwapAgentAddr, header)
 	if err != nil {
 		return nil, err
 	}
@@ -76,92 +113,31 @@ func (e *EthExecutor) GetBlockAndTxEvents(height int64) (*common.BlockAndEventLo
 	}, nil
 }
 
-func (e *EthExecutor) GetLogs(header *types.Header) ([]interface{}, error) {
-	startEvs, err := e.GetSwapStartLogs(header)
-	if err != nil {
-		return nil, err
-	}
-	regiserEvs, err := e.GetSwapPairRegisterLogs(header)
-	if err != nil {
-		return nil, err
-	}
-	var res = make([]interface{}, 0, len(startEvs)+len(regiserEvs))
-	res = append(append(res, startEvs...), regiserEvs...)
-	return res, nil
-
+func (e *EthExecutor) GetLatestHeight() (int64, error) {
+	return getLatestHeight(e.Client)
 }
 
-func (e *EthExecutor) GetSwapPairRegisterLogs(header *types.Header) ([]interface{}, error) {
-	topics := [][]ethcmm.Hash{{SwapPairRegisterEventHash}}
-
-	blockHash := header.Hash()
-
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	logs, err := e.Client.FilterLogs(ctxWithTimeout, ethereum.FilterQuery{
-		BlockHash: &blockHash,
-		Topics:    topics,
-		Addresses: []ethcmm.Address{e.SwapAgentAddr},
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	eventModels := make([]interface{}, 0, len(logs))
-	for _, log := range logs {
-		event, err := ParseSwapPairRegisterEvent(&e.SwapAgentAbi, &log)
-		if err != nil {
-			util.Logger.Errorf("parse event log error, er=%s", err.Error())
-			continue
-		}
-		if event == nil {
-			continue
-		}
-
-		eventModel := event.ToSwapPairRegisterLog(&log)
-		eventModel.Chain = e.Chain
-		util.Logger.Debugf("Found register event, erc20 address: %d, name: %s, symbol: %s, decimals: %d",
-			eventModel.ERC20Addr, eventModel.Name, eventModel.Symbol, eventModel.Decimals)
-		eventModels = append(eventModels, eventModel)
-	}
-	return eventModels, nil
+// GetEventRegistry returns the registry of the events indexed by the executor
+func (e *EthExecutor) GetEventRegistry() *EventRegistry {
+	return e.Registry
 }
 
-func (e *EthExecutor) GetSwapStartLogs(header *types.Header) ([]interface{}, error) {
-	topics := [][]ethcmm.Hash{{ETH2BSCSwapStartedEventHash}}
-
-	blockHash := header.Hash()
+// GetSubscriber returns the subscriber of the executor, it is nil if the provider doesn't support subscriptions
+func (e *EthExecutor) GetSubscriber() *Subscriber {
+	return e.Subscriber
+}
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// GetBlockHash returns the hash of the canonical block at the given height
+func (e *EthExecutor) GetBlockHash(height int64) (string, error) {
+	return getBlockHash(e.Client, height)
+}
 
-	logs, err := e.Client.FilterLogs(ctxWithTimeout, ethereum.FilterQuery{
-		BlockHash: &blockHash,
-		Topics:    topics,
-		Addresses: []ethcmm.Address{e.SwapAgentAddr},
-	})
+// GetBlockAndTxEventsByRange returns the swap agent events between fromHeight and toHeight with range queries,
+// it is used to catch up with the chain when the observer lags far behind
+func (e *EthExecutor) GetBlockAndTxEventsByRange(fromHeight, toHeight int64) ([]*common.BlockAndEventLogs, error) {
+	logs, err := filterLogsByRange(e.Client, e.SwapAgentAddr, e.Registry.Topics(), fromHeight, toHeight)
 	if err != nil {
 		return nil, err
 	}
-
-	eventModels := make([]interface{}, 0, len(logs))
-	for _, log := range logs {
-		event, err := ParseETH2BSCSwapStartEvent(&e.SwapAgentAbi, &log)
-		if err != nil {
-			util.Logger.Errorf("parse event log error, er=%s", err.Error())
-			continue
-		}
-
-		if event == nil {
-			continue
-		}
-
-		eventModel := event.ToSwapStartTxLog(&log)
-		eventModel.Chain = e.Chain
-		util.Logger.Debugf("Found ETH2BSC swap, txHash: %s, token address: %s, amount: %s, fee amount: %s",
-			eventModel.TxHash, eventModel.TokenAddr, eventModel.Amount, eventModel.FeeAmount)
-		eventModels = append(eventModels, eventModel)
-	}
-	return eventModels, nil
+	return buildBlockAndEventLogsByRange(e.Client, e.Chain, logs, toHeight, e.Registry.Decode)
 }
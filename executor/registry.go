@@ -0,0 +1,131 @@
+package executor
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	ethcmm "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// EventDecoder decodes a swap agent log into the event struct
+type EventDecoder func(log *types.Log) (interface{}, error)
+
+// EventModelFactory converts a decoded event into the db model saved by the observer, nil means the event is
+// skipped. The model must have the chain and height columns so that it can be rolled back on reorg.
+type EventModelFactory func(chain string, event interface{}, log *types.Log) interface{}
+
+type eventRegistration struct {
+	name    string
+	decode  EventDecoder
+	factory EventModelFactory
+	model   interface{}
+}
+
+// EventRegistry maps the topics of the swap agent events to their decoders and model factories. The executors
+// query all the registered topics with one FilterLogs call and dispatch the logs by the topic.
+type EventRegistry struct {
+	chain         string
+	registrations map[ethcmm.Hash]*eventRegistration
+	topics        []ethcmm.Hash
+}
+
+func NewEventRegistry(chain string) *EventRegistry {
+	return &EventRegistry{
+		chain:         chain,
+		registrations: make(map[ethcmm.Hash]*eventRegistration),
+	}
+}
+
+// Register registers the event of the topic, model is a zero value of the db model created by the factory. It
+// panics if the topic is registered twice.
+func (r *EventRegistry) Register(name string, topic ethcmm.Hash, decode EventDecoder, factory EventModelFactory, model interface{}) {
+	if _, ok := r.registrations[topic]; ok {
+		panic("duplicate event topic " + topic.String() + " of event " + name)
+	}
+	r.registrations[topic] = &eventRegistration{
+		name:    name,
+		decode:  decode,
+		factory: factory,
+		model:   model,
+	}
+	r.topics = append(r.topics, topic)
+}
+
+// Topics returns the filter topics matching any of the registered events
+func (r *EventRegistry) Topics() [][]ethcmm.Hash {
+	topics := make([]ethcmm.Hash, len(r.topics))
+	copy(topics, r.topics)
+	return [][]ethcmm.Hash{topics}
+}
+
+// Models returns the zero values of the db models of the registered events, without duplicates
+func (r *EventRegistry) Models() []interface{} {
+	models := make([]interface{}, 0, len(r.topics))
+	for _, topic := range r.topics {
+		model := r.registrations[topic].model
+		duplicate := false
+		for _, m := range models {
+			if m == model {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// Decode converts the log into the db model of its event, nil is returned if the log is not a registered event
+// or can't be decoded
+func (r *EventRegistry) Decode(log *types.Log) interface{} {
+	if len(log.Topics) == 0 {
+		return nil
+	}
+	registration, ok := r.registrations[log.Topics[0]]
+	if !ok {
+		return nil
+	}
+	event, err := registration.decode(log)
+	if err != nil {
+		util.Logger.Errorf("parse %s event log error, tx hash=%s, err=%s", registration.name, log.TxHash.String(), err.Error())
+		return nil
+	}
+	return registration.factory(r.chain, event, log)
+}
+
+// GetBlockLogs returns the db models of the registered events in the block
+func (r *EventRegistry) GetBlockLogs(client provider.Client, swapAgentAddr ethcmm.Address, header *types.Header) ([]interface{}, error) {
+	blockHash := header.Hash()
+
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	logs, err := client.FilterLogs(ctxWithTimeout, ethereum.FilterQuery{
+		BlockHash: &blockHash,
+		Topics:    r.Topics(),
+		Addresses: []ethcmm.Address{swapAgentAddr},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	eventModels := make([]interface{}, 0, len(logs))
+	for idx := range logs {
+		if logs[idx].Removed {
+			continue
+		}
+		eventModel := r.Decode(&logs[idx])
+		if eventModel == nil {
+			continue
+		}
+		eventModels = append(eventModels, eventModel)
+	}
+	return eventModels, nil
+}
@@ -0,0 +1,182 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	ethcmm "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+const (
+	SubscribeMaxFailures          = 5
+	SubscribeRetryInterval        = 5 * time.Second
+	SubscribeFallbackInterval     = 10 * time.Minute
+	SubscribeNotifyChannelSize    = 1
+	SubscribeHeaderChannelSize    = 16
+	SubscribeLogChannelSize       = 64
+	SubscribeRequestTimeout       = 10 * time.Second
+	WebsocketProviderPrefix       = "ws://"
+	SecureWebsocketProviderPrefix = "wss://"
+)
+
+// IsWebsocketProvider returns true if the provider supports subscriptions
+func IsWebsocketProvider(url string) bool {
+	url = strings.ToLower(url)
+	return strings.HasPrefix(url, WebsocketProviderPrefix) || strings.HasPrefix(url, SecureWebsocketProviderPrefix)
+}
+
+// HasWebsocketProvider returns true if any of the providers supports subscriptions, the provider pool routes the
+// subscriptions to it
+func HasWebsocketProvider(urls []string) bool {
+	for _, url := range urls {
+		if IsWebsocketProvider(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriber subscribes to the new heads and the swap agent logs of a websocket provider, and notifies the
+// observer as soon as a new block is pushed. The observer backfills the blocks it missed through the per-height
+// path, so the notification only carries the height of the pushed block.
+type Subscriber struct {
+	chain         string
+	client        provider.Client
+	swapAgentAddr ethcmm.Address
+	topics        [][]ethcmm.Hash
+
+	notifyCh chan int64
+
+	mutex    sync.RWMutex
+	active   bool
+	failures int
+
+	lifecycle util.Lifecycle
+}
+
+func NewSubscriber(chain string, client provider.Client, swapAgentAddr ethcmm.Address, topics [][]ethcmm.Hash) *Subscriber {
+	return &Subscriber{
+		chain:         chain,
+		client:        client,
+		swapAgentAddr: swapAgentAddr,
+		topics:        topics,
+		notifyCh:      make(chan int64, SubscribeNotifyChannelSize),
+	}
+}
+
+// Start starts the subscription routine
+func (s *Subscriber) Start(ctx context.Context) {
+	s.lifecycle.Start(ctx)
+	s.lifecycle.Go(s.run)
+}
+
+// Stop closes the subscriptions
+func (s *Subscriber) Stop() error {
+	return s.lifecycle.Stop(common.ShutdownTimeout)
+}
+
+// NotifyCh returns the channel which receives the height of the pushed blocks
+func (s *Subscriber) NotifyCh() <-chan int64 {
+	return s.notifyCh
+}
+
+// IsActive returns true if the subscriptions are alive, otherwise the observer should poll the provider
+func (s *Subscriber) IsActive() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.active
+}
+
+func (s *Subscriber) setActive(active bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active = active
+}
+
+func (s *Subscriber) run() {
+	for !s.lifecycle.Stopping() {
+		err := s.subscribe()
+		s.setActive(false)
+		if err == nil {
+			return
+		}
+
+		s.failures++
+		util.Logger.Errorf("%s subscription error, failures=%d, err=%s", s.chain, s.failures, err.Error())
+		if s.failures < SubscribeMaxFailures {
+			s.lifecycle.Sleep(SubscribeRetryInterval)
+			continue
+		}
+
+		msg := fmt.Sprintf("%s subscription failed %d times, fall back to polling for %s", s.chain, s.failures, SubscribeFallbackInterval.String())
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+		s.failures = 0
+		s.lifecycle.Sleep(SubscribeFallbackInterval)
+	}
+}
+
+// subscribe blocks until one of the subscriptions fails, or returns nil when the subscriber is stopped
+func (s *Subscriber) subscribe() error {
+	heads := make(chan *types.Header, SubscribeHeaderChannelSize)
+	headCtx, headCancel := context.WithTimeout(context.Background(), SubscribeRequestTimeout)
+	defer headCancel()
+	headSub, err := s.client.SubscribeNewHead(headCtx, heads)
+	if err != nil {
+		return fmt.Errorf("subscribe new head error, err=%s", err.Error())
+	}
+	defer headSub.Unsubscribe()
+
+	logs := make(chan types.Log, SubscribeLogChannelSize)
+	logCtx, logCancel := context.WithTimeout(context.Background(), SubscribeRequestTimeout)
+	defer logCancel()
+	logSub, err := s.client.SubscribeFilterLogs(logCtx, ethereum.FilterQuery{
+		Topics:    s.topics,
+		Addresses: []ethcmm.Address{s.swapAgentAddr},
+	}, logs)
+	if err != nil {
+		return fmt.Errorf("subscribe filter logs error, err=%s", err.Error())
+	}
+	defer logSub.Unsubscribe()
+
+	util.Logger.Infof("%s subscriptions established", s.chain)
+	s.setActive(true)
+	// wake up the observer to backfill the blocks produced while the subscriptions were down
+	s.notify(0)
+
+	// the failures are counted until a head is pushed, an endpoint which accepts the subscriptions and drops them at
+	// once still falls back to polling
+	for {
+		select {
+		case <-s.lifecycle.Context().Done():
+			return nil
+		case header := <-heads:
+			s.failures = 0
+			s.notify(header.Number.Int64())
+		case log := <-logs:
+			util.Logger.Debugf("%s swap agent log pushed, height=%d, tx hash=%s, removed=%t", s.chain, log.BlockNumber, log.TxHash.String(), log.Removed)
+			s.notify(int64(log.BlockNumber))
+		case err := <-headSub.Err():
+			return fmt.Errorf("new head subscription dropped, err=%v", err)
+		case err := <-logSub.Err():
+			return fmt.Errorf("filter logs subscription dropped, err=%v", err)
+		}
+	}
+}
+
+// notify never blocks, a pending notification is enough to wake up the observer
+func (s *Subscriber) notify(height int64) {
+	select {
+	case s.notifyCh <- height:
+	default:
+	}
+}
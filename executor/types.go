@@ -1,6 +1,7 @@
 package executor
 
 import (
+	"encoding/json"
 	common "github.com/binance-chain/bsc-eth-swap/common"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	ethcmm "github.com/ethereum/go-ethereum/common"
@@ -8,10 +9,16 @@ import (
 	"math/big"
 
 	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
 type Executor interface {
 	GetBlockAndTxEvents(height int64) (*common.BlockAndEventLogs, error)
+	GetBlockAndTxEventsByRange(fromHeight, toHeight int64) ([]*common.BlockAndEventLogs, error)
+	GetLatestHeight() (int64, error)
+	GetBlockHash(height int64) (string, error)
+	GetSubscriber() *Subscriber
+	GetEventRegistry() *EventRegistry
 	GetChainName() string
 }
 
@@ -38,6 +45,7 @@ func (ev *ETH2BSCSwapStartedEvent) ToSwapStartTxLog(log *types.Log) *model.SwapS
 		FeeAmount: ev.FeeAmount.String(),
 		BlockHash: log.BlockHash.Hex(),
 		TxHash:    log.TxHash.String(),
+		LogIndex:  logIndex(log),
 		Height:    int64(log.BlockNumber),
 	}
 	return pack
@@ -74,6 +82,7 @@ func (ev *BSC2ETHSwapStartedEvent) ToSwapStartTxLog(log *types.Log) *model.SwapS
 		FeeAmount: ev.FeeAmount.String(),
 		BlockHash: log.BlockHash.Hex(),
 		TxHash:    log.TxHash.String(),
+		LogIndex:  logIndex(log),
 		Height:    int64(log.BlockNumber),
 	}
 	return pack
@@ -94,6 +103,27 @@ func ParseBSC2ETHSwapStartEvent(abi *abi.ABI, log *types.Log) (*BSC2ETHSwapStart
 	return &ev, nil
 }
 
+func logIndex(log *types.Log) *int64 {
+	index := int64(log.Index)
+	return &index
+}
+
+// SwapStartTxLogFactory is the model factory of the SwapStarted events of both chains
+func SwapStartTxLogFactory(chain string, event interface{}, log *types.Log) interface{} {
+	var eventModel *model.SwapStartTxLog
+	switch ev := event.(type) {
+	case *ETH2BSCSwapStartedEvent:
+		eventModel = ev.ToSwapStartTxLog(log)
+	case *BSC2ETHSwapStartedEvent:
+		eventModel = ev.ToSwapStartTxLog(log)
+	default:
+		return nil
+	}
+	eventModel.Chain = chain
+	util.Logger.Debugf("Found %s swap, txHash: %s, token address: %s, amount: %s, fee amount: %s",
+		chain, eventModel.TxHash, eventModel.TokenAddr, eventModel.Amount, eventModel.FeeAmount)
+	return eventModel
+}
 
 // =================  SwapPairRegister ===================
 var (
@@ -119,6 +149,7 @@ func (ev *SwapPairRegisterEvent) ToSwapPairRegisterLog(log *types.Log) *model.Sw
 
 		BlockHash: log.BlockHash.Hex(),
 		TxHash:    log.TxHash.String(),
+		LogIndex:  logIndex(log),
 		Height:    int64(log.BlockNumber),
 	}
 	return pack
@@ -136,3 +167,104 @@ func ParseSwapPairRegisterEvent(abi *abi.ABI, log *types.Log) (*SwapPairRegister
 
 	return &ev, nil
 }
+
+// SwapPairRegisterTxLogFactory is the model factory of the SwapPairRegister events
+func SwapPairRegisterTxLogFactory(chain string, event interface{}, log *types.Log) interface{} {
+	ev, ok := event.(*SwapPairRegisterEvent)
+	if !ok {
+		return nil
+	}
+	eventModel := ev.ToSwapPairRegisterLog(log)
+	eventModel.Chain = chain
+	util.Logger.Debugf("Found register event, erc20 address: %s, name: %s, symbol: %s, decimals: %d",
+		eventModel.ERC20Addr, eventModel.Name, eventModel.Symbol, eventModel.Decimals)
+	return eventModel
+}
+
+// =================  SwapFilled ===================
+var (
+	SwapFilledEventName = "SwapFilled"
+	SwapFilledEventHash = ethcmm.HexToHash("0x3bebd9a738291e69898b5dbfadb6329b4b09fc648bdef68762928e521463abd9")
+)
+
+// SwapFilledEvent is the SwapFilled event of both swap agents, the token is the erc20 on ETH and the bep20 on BSC,
+// the start tx hash is the hash of the SwapStarted tx on the other chain
+type SwapFilledEvent struct {
+	TokenAddr   ethcmm.Address
+	StartTxHash ethcmm.Hash
+	ToAddress   ethcmm.Address
+	Amount      *big.Int
+}
+
+func (ev *SwapFilledEvent) ToSwapFillTxLog(log *types.Log) *model.SwapFillTxLog {
+	pack := &model.SwapFillTxLog{
+		TokenAddr:   ev.TokenAddr.String(),
+		ToAddress:   ev.ToAddress.String(),
+		Amount:      ev.Amount.String(),
+		StartTxHash: ev.StartTxHash.String(),
+
+		BlockHash: log.BlockHash.Hex(),
+		TxHash:    log.TxHash.String(),
+		Height:    int64(log.BlockNumber),
+	}
+	return pack
+}
+
+// SwapFillTxLogFactory is the model factory of the SwapFilled events of both chains
+func SwapFillTxLogFactory(chain string, event interface{}, log *types.Log) interface{} {
+	ev, ok := event.(*SwapFilledEvent)
+	if !ok {
+		return nil
+	}
+	eventModel := ev.ToSwapFillTxLog(log)
+	eventModel.Chain = chain
+	util.Logger.Debugf("Found %s swap fill, txHash: %s, start txHash: %s, token address: %s, amount: %s",
+		chain, eventModel.TxHash, eventModel.StartTxHash, eventModel.TokenAddr, eventModel.Amount)
+	return eventModel
+}
+
+// =================  Recorded events ===================
+var (
+	OwnershipTransferredEventName = "OwnershipTransferred"
+	OwnershipTransferredEventHash = ethcmm.HexToHash("0x8be0079c531659141344cd1fd0a4f28419497f9722a3daafe3b4186f6b6457e0")
+)
+
+// NewContractEventLogFactory returns the model factory which records the decoded event in json, it is used by
+// the events which are not processed by the engines
+func NewContractEventLogFactory(name string) EventModelFactory {
+	return func(chain string, event interface{}, log *types.Log) interface{} {
+		payload, err := contractEventPayload(event)
+		if err != nil {
+			util.Logger.Errorf("marshal %s event error, tx hash=%s, err=%s", name, log.TxHash.String(), err.Error())
+			return nil
+		}
+		util.Logger.Infof("Found %s %s event, txHash: %s, payload: %s", chain, name, log.TxHash.String(), payload)
+		return &model.ContractEventLog{
+			Chain:     chain,
+			EventName: name,
+			Contract:  log.Address.String(),
+			Payload:   payload,
+			TxHash:    log.TxHash.String(),
+			BlockHash: log.BlockHash.Hex(),
+			Height:    int64(log.BlockNumber),
+		}
+	}
+}
+
+// contractEventPayload marshals the event without the raw log attached by the generated bindings
+func contractEventPayload(event interface{}) (string, error) {
+	bz, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(bz, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "Raw")
+	bz, err = json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(bz), nil
+}
@@ -0,0 +1,113 @@
+package executor
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	ethcmm "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+)
+
+const (
+	RangeFilterLogsTimeout = 30 * time.Second
+	RequestTimeout         = 5 * time.Second
+)
+
+func getLatestHeight(client provider.Client) (int64, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	header, err := client.HeaderByNumber(ctxWithTimeout, nil)
+	if err != nil {
+		return 0, err
+	}
+	return header.Number.Int64(), nil
+}
+
+func getBlockHash(client provider.Client, height int64) (string, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	header, err := client.HeaderByNumber(ctxWithTimeout, big.NewInt(height))
+	if err != nil {
+		return "", err
+	}
+	return header.Hash().String(), nil
+}
+
+func filterLogsByRange(client provider.Client, swapAgentAddr ethcmm.Address, topics [][]ethcmm.Hash, fromHeight, toHeight int64) ([]types.Log, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), RangeFilterLogsTimeout)
+	defer cancel()
+
+	return client.FilterLogs(ctxWithTimeout, ethereum.FilterQuery{
+		FromBlock: big.NewInt(fromHeight),
+		ToBlock:   big.NewInt(toHeight),
+		Topics:    topics,
+		Addresses: []ethcmm.Address{swapAgentAddr},
+	})
+}
+
+// buildBlockAndEventLogsByRange groups the range logs by block. Only the blocks containing logs and the block
+// at toHeight are returned, the headers of the blocks in between are not needed because the whole range is
+// expected to be deeper than the confirm number.
+func buildBlockAndEventLogsByRange(client provider.Client, chain string, logs []types.Log, toHeight int64,
+	parseEventLog func(log *types.Log) interface{}) ([]*common.BlockAndEventLogs, error) {
+	blockAndEventLogsList := make([]*common.BlockAndEventLogs, 0)
+
+	var current *common.BlockAndEventLogs
+	for idx := range logs {
+		log := logs[idx]
+		if log.Removed {
+			continue
+		}
+		if current == nil || current.BlockHash != log.BlockHash.String() {
+			header, err := getHeaderByHash(client, log.BlockHash)
+			if err != nil {
+				return nil, err
+			}
+			current = newBlockAndEventLogs(chain, header)
+			blockAndEventLogsList = append(blockAndEventLogsList, current)
+		}
+
+		eventModel := parseEventLog(&log)
+		if eventModel == nil {
+			continue
+		}
+		current.Events = append(current.Events, eventModel)
+	}
+
+	if current == nil || current.Height != toHeight {
+		ctxWithTimeout, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		defer cancel()
+
+		header, err := client.HeaderByNumber(ctxWithTimeout, big.NewInt(toHeight))
+		if err != nil {
+			return nil, err
+		}
+		blockAndEventLogsList = append(blockAndEventLogsList, newBlockAndEventLogs(chain, header))
+	}
+	return blockAndEventLogsList, nil
+}
+
+func getHeaderByHash(client provider.Client, blockHash ethcmm.Hash) (*types.Header, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	return client.HeaderByHash(ctxWithTimeout, blockHash)
+}
+
+func newBlockAndEventLogs(chain string, header *types.Header) *common.BlockAndEventLogs {
+	return &common.BlockAndEventLogs{
+		Height:          header.Number.Int64(),
+		Chain:           chain,
+		BlockHash:       header.Hash().String(),
+		ParentBlockHash: header.ParentHash.String(),
+		BlockTime:       int64(header.Time),
+		Events:          make([]interface{}, 0),
+	}
+}
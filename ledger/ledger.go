@@ -0,0 +1,102 @@
+package ledger
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+// Record is a fee collected or a gas spent, it is booked as a debit entry and a credit entry of the same amount
+type Record struct {
+	Category model.LedgerCategory
+	// the id of the row the record is booked from, e.g. the SwapFillTx of the fill gas
+	SourceID  uint
+	Chain     string
+	Token     string
+	Symbol    string
+	Direction common.SwapDirection
+	// in the native token of the chain
+	Amount   string
+	TxHash   string
+	BookTime int64
+}
+
+// Key identifies the record. The swap fee is keyed by the start tx, for the swap of a start tx is created again
+// when the start tx is reorged and mined again.
+func (r *Record) Key() string {
+	if r.Category == model.LedgerSwapFee {
+		return fmt.Sprintf("%s:%s", r.Category, r.TxHash)
+	}
+	return fmt.Sprintf("%s:%d", r.Category, r.SourceID)
+}
+
+// the accounts debited and credited by the records of the category
+func accounts(category model.LedgerCategory) (string, string) {
+	if category == model.LedgerSwapFee {
+		return model.LedgerAccountSwapAgent, model.LedgerAccountFeeIncome
+	}
+	return model.LedgerAccountGasExpense, model.LedgerAccountTSS
+}
+
+// Book writes the entries of the records, the records already booked are skipped
+func Book(db *gorm.DB, records ...*Record) error {
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var booked int
+		if err := tx.Model(model.LedgerEntry{}).Where("record_key = ?", record.Key()).Count(&booked).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if booked > 0 {
+			continue
+		}
+
+		// the amount is missing on the rows tracked before it is recorded
+		if record.Amount == "" {
+			record.Amount = "0"
+		}
+		debitAccount, creditAccount := accounts(record.Category)
+		for _, side := range []model.LedgerSide{model.LedgerDebit, model.LedgerCredit} {
+			entry := &model.LedgerEntry{
+				RecordKey: record.Key(),
+				Side:      side,
+				Category:  record.Category,
+				SourceID:  record.SourceID,
+				Account:   debitAccount,
+				Chain:     record.Chain,
+				Token:     record.Token,
+				Symbol:    record.Symbol,
+				Direction: record.Direction,
+				Amount:    record.Amount,
+				TxHash:    record.TxHash,
+				BookTime:  record.BookTime,
+			}
+			if side == model.LedgerCredit {
+				entry.Account = creditAccount
+			}
+			if err := tx.Create(entry).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// BookedSources returns the sub query of the ids of the rows whose records of the category are booked
+func BookedSources(db *gorm.DB, category model.LedgerCategory) interface{} {
+	return db.Model(model.LedgerEntry{}).Select("source_id").Where("category = ?", category).QueryExpr()
+}
+
+// BookedTxHashes returns the sub query of the tx hashes of the records of the category which are booked
+func BookedTxHashes(db *gorm.DB, category model.LedgerCategory) interface{} {
+	return db.Model(model.LedgerEntry{}).Select("tx_hash").Where("category = ?", category).QueryExpr()
+}
@@ -0,0 +1,196 @@
+package ledger
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+const (
+	GroupByDay       = "day"
+	GroupByToken     = "token"
+	GroupByDirection = "direction"
+
+	DayLayout = "2006-01-02"
+
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// ReportOptions selects the entries booked in [From, To) and how they are grouped, the rows are always grouped by
+// the chain for the amounts are in the native token of the chain
+type ReportOptions struct {
+	From    int64
+	To      int64
+	GroupBy []string
+}
+
+// ReportRow is the fees collected and the gas spent of a group, the amounts are in the native token of the chain
+type ReportRow struct {
+	Day           string               `json:"day,omitempty"`
+	Chain         string               `json:"chain"`
+	Token         string               `json:"token,omitempty"`
+	Symbol        string               `json:"symbol,omitempty"`
+	Direction     common.SwapDirection `json:"direction,omitempty"`
+	Swaps         int64                `json:"swaps"`
+	SwapFee       string               `json:"swap_fee"`
+	FillGas       string               `json:"fill_gas"`
+	RetryGas      string               `json:"retry_gas"`
+	CreatePairGas string               `json:"create_pair_gas"`
+	WithdrawGas   string               `json:"withdraw_gas"`
+	RefundGas     string               `json:"refund_gas"`
+	// the swap fee less the gas
+	Net string `json:"net"`
+}
+
+// ParseGroupBy parses the comma separated dimensions, all the dimensions are used if it is empty
+func ParseGroupBy(groupBy string) ([]string, error) {
+	if groupBy == "" {
+		return []string{GroupByDay, GroupByToken, GroupByDirection}, nil
+	}
+	dimensions := make([]string, 0)
+	for _, dimension := range strings.Split(groupBy, ",") {
+		dimension = strings.ToLower(strings.TrimSpace(dimension))
+		if dimension != GroupByDay && dimension != GroupByToken && dimension != GroupByDirection {
+			return nil, fmt.Errorf("invalid group by %s, day, token or direction", dimension)
+		}
+		dimensions = append(dimensions, dimension)
+	}
+	return dimensions, nil
+}
+
+// ParseDay parses the day in the layout of 2006-01-02 to the unix time of its start in utc
+func ParseDay(day string) (int64, error) {
+	t, err := time.Parse(DayLayout, day)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+type reportAmounts struct {
+	row     *ReportRow
+	amounts map[model.LedgerCategory]*big.Int
+}
+
+// Report aggregates the income and the expense entries, which are a side of every record
+func Report(db *gorm.DB, options ReportOptions) ([]*ReportRow, error) {
+	query := db.Where("account in (?)", []string{model.LedgerAccountFeeIncome, model.LedgerAccountGasExpense})
+	if options.From > 0 {
+		query = query.Where("book_time >= ?", options.From)
+	}
+	if options.To > 0 {
+		query = query.Where("book_time < ?", options.To)
+	}
+	entries := make([]model.LedgerEntry, 0)
+	if err := query.Order("book_time asc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	grouped := make(map[string]bool)
+	for _, dimension := range options.GroupBy {
+		grouped[dimension] = true
+	}
+
+	groups := make(map[string]*reportAmounts)
+	for _, entry := range entries {
+		row := &ReportRow{Chain: entry.Chain}
+		if grouped[GroupByDay] {
+			row.Day = time.Unix(entry.BookTime, 0).UTC().Format(DayLayout)
+		}
+		if grouped[GroupByToken] {
+			row.Token, row.Symbol = entry.Token, entry.Symbol
+		}
+		if grouped[GroupByDirection] {
+			row.Direction = entry.Direction
+		}
+		key := strings.Join([]string{row.Day, row.Chain, row.Token, string(row.Direction)}, "#")
+		group, ok := groups[key]
+		if !ok {
+			group = &reportAmounts{
+				row:     row,
+				amounts: make(map[model.LedgerCategory]*big.Int),
+			}
+			groups[key] = group
+		}
+
+		amount, ok := big.NewInt(0).SetString(entry.Amount, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid amount %s of ledger entry %d", entry.Amount, entry.ID)
+		}
+		if _, ok := group.amounts[entry.Category]; !ok {
+			group.amounts[entry.Category] = big.NewInt(0)
+		}
+		group.amounts[entry.Category].Add(group.amounts[entry.Category], amount)
+		if entry.Category == model.LedgerSwapFee {
+			group.row.Swaps++
+		}
+	}
+
+	rows := make([]*ReportRow, 0, len(groups))
+	for _, group := range groups {
+		amountOf := func(category model.LedgerCategory) *big.Int {
+			if amount, ok := group.amounts[category]; ok {
+				return amount
+			}
+			return big.NewInt(0)
+		}
+		net := big.NewInt(0).Set(amountOf(model.LedgerSwapFee))
+		for _, category := range []model.LedgerCategory{model.LedgerFillGas, model.LedgerRetryGas, model.LedgerCreatePairGas, model.LedgerWithdrawGas, model.LedgerRefundGas} {
+			net.Sub(net, amountOf(category))
+		}
+		group.row.SwapFee = amountOf(model.LedgerSwapFee).String()
+		group.row.FillGas = amountOf(model.LedgerFillGas).String()
+		group.row.RetryGas = amountOf(model.LedgerRetryGas).String()
+		group.row.CreatePairGas = amountOf(model.LedgerCreatePairGas).String()
+		group.row.WithdrawGas = amountOf(model.LedgerWithdrawGas).String()
+		group.row.RefundGas = amountOf(model.LedgerRefundGas).String()
+		group.row.Net = net.String()
+		rows = append(rows, group.row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Day != rows[j].Day {
+			return rows[i].Day < rows[j].Day
+		}
+		if rows[i].Chain != rows[j].Chain {
+			return rows[i].Chain < rows[j].Chain
+		}
+		if rows[i].Symbol != rows[j].Symbol {
+			return rows[i].Symbol < rows[j].Symbol
+		}
+		if rows[i].Token != rows[j].Token {
+			return rows[i].Token < rows[j].Token
+		}
+		return rows[i].Direction < rows[j].Direction
+	})
+	return rows, nil
+}
+
+// WriteCSV writes the rows of the report with a header
+func WriteCSV(w io.Writer, rows []*ReportRow) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"day", "chain", "token", "symbol", "direction", "swaps", "swap_fee", "fill_gas",
+		"retry_gas", "create_pair_gas", "withdraw_gas", "refund_gas", "net"})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err := writer.Write([]string{row.Day, row.Chain, row.Token, row.Symbol, string(row.Direction),
+			strconv.FormatInt(row.Swaps, 10), row.SwapFee, row.FillGas, row.RetryGas, row.CreatePairGas, row.WithdrawGas, row.RefundGas, row.Net})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -1,21 +1,33 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/binance-chain/bsc-eth-swap/admin"
 
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
+	"github.com/binance-chain/bsc-eth-swap/common"
 	"github.com/binance-chain/bsc-eth-swap/executor"
+	"github.com/binance-chain/bsc-eth-swap/ledger"
 	"github.com/binance-chain/bsc-eth-swap/model"
 	"github.com/binance-chain/bsc-eth-swap/observer"
+	"github.com/binance-chain/bsc-eth-swap/policy"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/screening"
 	"github.com/binance-chain/bsc-eth-swap/swap"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
@@ -25,6 +37,15 @@ const (
 	flagConfigAwsRegion    = "aws-region"
 	flagConfigAwsSecretKey = "aws-secret-key"
 	flagConfigPath         = "config-path"
+	flagRescanChain        = "rescan-chain"
+	flagRescanFrom         = "rescan-from"
+	flagRescanTo           = "rescan-to"
+	flagImportAddresses    = "import-addresses"
+	flagImportList         = "import-list"
+	flagLedgerReport       = "ledger-report"
+	flagLedgerFrom         = "ledger-from"
+	flagLedgerTo           = "ledger-to"
+	flagLedgerGroupBy      = "ledger-group-by"
 )
 
 const (
@@ -37,6 +58,15 @@ func initFlags() {
 	flag.String(flagConfigType, "", "config type, local or aws")
 	flag.String(flagConfigAwsRegion, "", "aws s3 region")
 	flag.String(flagConfigAwsSecretKey, "", "aws s3 secret key")
+	flag.String(flagRescanChain, "", "rescan the swap agent events of the chain, BSC or ETH, and exit")
+	flag.Int64(flagRescanFrom, 0, "the first height of the rescan")
+	flag.Int64(flagRescanTo, 0, "the last height of the rescan")
+	flag.String(flagImportAddresses, "", "import the screened addresses of the csv or json file and exit")
+	flag.String(flagImportList, string(model.AddressBlocked), "the list of the imported addresses without one, block or allow")
+	flag.String(flagLedgerReport, "", "export the ledger report to the csv or json file and exit")
+	flag.String(flagLedgerFrom, "", "the first day of the ledger report, e.g. 2021-01-01")
+	flag.String(flagLedgerTo, "", "the day after the last day of the ledger report")
+	flag.String(flagLedgerGroupBy, "", "the comma separated dimensions the ledger report is grouped by, day, token or direction")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
@@ -48,6 +78,9 @@ func initFlags() {
 
 func printUsage() {
 	fmt.Print("usage: ./swap --config-type [local or aws] --config-path config_file_path\n")
+	fmt.Print("       ./swap --config-type [local or aws] --config-path config_file_path --rescan-chain [BSC or ETH] --rescan-from from_height --rescan-to to_height\n")
+	fmt.Print("       ./swap --config-type [local or aws] --config-path config_file_path --import-addresses [csv or json file] --import-list [block or allow]\n")
+	fmt.Print("       ./swap --config-type [local or aws] --config-path config_file_path --ledger-report [csv or json file] --ledger-from from_day --ledger-to to_day --ledger-group-by day,token,direction\n")
 }
 
 func main() {
@@ -105,43 +138,236 @@ func main() {
 	defer db.Close()
 	model.InitTables(db)
 
-	bscClient, err := ethclient.Dial(config.ChainConfig.BSCProvider)
+	if rescanChain := viper.GetString(flagRescanChain); rescanChain != "" {
+		rescan(config, db, strings.ToUpper(rescanChain), viper.GetInt64(flagRescanFrom), viper.GetInt64(flagRescanTo))
+		return
+	}
+
+	if importPath := viper.GetString(flagImportAddresses); importPath != "" {
+		importAddresses(db, importPath, model.AddressList(viper.GetString(flagImportList)))
+		return
+	}
+
+	if reportPath := viper.GetString(flagLedgerReport); reportPath != "" {
+		exportLedgerReport(db, reportPath, viper.GetString(flagLedgerFrom), viper.GetString(flagLedgerTo), viper.GetString(flagLedgerGroupBy))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bscClient, err := provider.NewPool(common.ChainBSC, config.ChainConfig.GetBSCProviders(), config.ChainConfig.BSCProviderQuorum)
 	if err != nil {
-		panic("new eth client error")
+		panic(fmt.Sprintf("new bsc provider pool error, err=%s", err.Error()))
 	}
+	bscClient.Start(ctx)
 
-	ethClient, err := ethclient.Dial(config.ChainConfig.ETHProvider)
+	ethClient, err := provider.NewPool(common.ChainETH, config.ChainConfig.GetETHProviders(), config.ChainConfig.ETHProviderQuorum)
 	if err != nil {
-		panic("new eth client error")
+		panic(fmt.Sprintf("new eth provider pool error, err=%s", err.Error()))
+	}
+	ethClient.Start(ctx)
+
+	bscConfirmPolicy, err := policy.NewConfirmPolicy(common.ChainBSC, db, config, bscClient)
+	if err != nil {
+		panic(fmt.Sprintf("new bsc confirm policy error, err=%s", err.Error()))
+	}
+	ethConfirmPolicy, err := policy.NewConfirmPolicy(common.ChainETH, db, config, ethClient)
+	if err != nil {
+		panic(fmt.Sprintf("new eth confirm policy error, err=%s", err.Error()))
 	}
 
 	bscExecutor := executor.NewBSCExecutor(bscClient, config.ChainConfig.BSCSwapAgentAddr, config)
-	bscObserver := observer.NewObserver(db, config.ChainConfig.BSCStartHeight, config.ChainConfig.BSCConfirmNum, config, bscExecutor)
-	bscObserver.Start()
+	bscObserver := observer.NewObserver(db, config.ChainConfig.BSCStartHeight, bscConfirmPolicy, config, bscExecutor)
+	bscObserver.Start(ctx)
 
 	ethExecutor := executor.NewEthExecutor(ethClient, config.ChainConfig.ETHSwapAgentAddr, config)
-	ethObserver := observer.NewObserver(db, config.ChainConfig.ETHStartHeight, config.ChainConfig.ETHConfirmNum, config, ethExecutor)
-	ethObserver.Start()
+	ethObserver := observer.NewObserver(db, config.ChainConfig.ETHStartHeight, ethConfirmPolicy, config, ethExecutor)
+	ethObserver.Start(ctx)
 
-	swapEngine, err := swap.NewSwapEngine(db, config, bscClient, ethClient)
+	swapEngine, err := swap.NewSwapEngine(db, config, bscClient, ethClient, bscConfirmPolicy, ethConfirmPolicy)
 	if err != nil {
 		panic(fmt.Sprintf("create swap engine error, err=%s", err.Error()))
 	}
 
-	swapEngine.Start()
+	swapEngine.Start(ctx)
 
-	swapPairEngine, err := swap.NewSwapPairEngine(db, config, bscClient, swapEngine)
+	swapPairEngine, err := swap.NewSwapPairEngine(db, config, bscClient, bscConfirmPolicy, swapEngine)
 	if err != nil {
 		panic(fmt.Sprintf("create swap pair engine error, err=%s", err.Error()))
 	}
-	swapPairEngine.Start()
+	swapPairEngine.Start(ctx)
 
 	signer, err := util.NewHmacSignerFromConfig(config)
 	if err != nil {
 		panic(fmt.Sprintf("new hmac singer error, err=%s", err.Error()))
 	}
-	admin := admin.NewAdmin(config, db, signer, swapEngine)
-	go admin.Serve()
+	admin := admin.NewAdmin(config, db, signer, swapEngine, []*provider.Pool{bscClient, ethClient},
+		[]*observer.Observer{bscObserver, ethObserver})
+	admin.Start(ctx)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	util.Logger.Infof("received signal %s, shutting down", sig.String())
+	cancel()
+
+	// the components are stopped from the upstream to the downstream, so that nothing feeds a stopped component
+	components := []struct {
+		name      string
+		component stopper
+	}{
+		{"admin server", admin},
+		{"bsc observer", bscObserver},
+		{"eth observer", ethObserver},
+		{"swap pair engine", swapPairEngine},
+		{"swap engine", swapEngine},
+		{"bsc provider pool", bscClient},
+		{"eth provider pool", ethClient},
+	}
+	clean := true
+	for _, c := range components {
+		if err := c.component.Stop(); err != nil {
+			util.Logger.Errorf("stop %s error, err=%s", c.name, err.Error())
+			clean = false
+			continue
+		}
+		util.Logger.Infof("%s stopped", c.name)
+	}
+
+	if clean {
+		util.Logger.Infof("clean exit, no swap was interrupted in flight")
+	} else {
+		msg := "unclean exit, some swaps may be interrupted in flight, check the swaps in sending status"
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+	}
+}
+
+// rescan runs a historical rescan of the chain in the foreground and prints its progress, the live block cursor
+// is untouched so it can run alongside the daemon
+func rescan(config *util.Config, db *gorm.DB, chain string, fromHeight, toHeight int64) {
+	var urls []string
+	var quorum int
+	var startHeight int64
+	var swapAgentAddr string
+	switch chain {
+	case common.ChainBSC:
+		urls, quorum = config.ChainConfig.GetBSCProviders(), config.ChainConfig.BSCProviderQuorum
+		startHeight, swapAgentAddr = config.ChainConfig.BSCStartHeight, config.ChainConfig.BSCSwapAgentAddr
+	case common.ChainETH:
+		urls, quorum = config.ChainConfig.GetETHProviders(), config.ChainConfig.ETHProviderQuorum
+		startHeight, swapAgentAddr = config.ChainConfig.ETHStartHeight, config.ChainConfig.ETHSwapAgentAddr
+	default:
+		fmt.Printf("unsupported rescan chain %s\n", chain)
+		return
+	}
+
+	client, err := provider.NewPool(chain, urls, quorum)
+	if err != nil {
+		panic(fmt.Sprintf("new %s provider pool error, err=%s", chain, err.Error()))
+	}
+	confirmPolicy, err := policy.NewConfirmPolicy(chain, db, config, client)
+	if err != nil {
+		panic(fmt.Sprintf("new %s confirm policy error, err=%s", chain, err.Error()))
+	}
+	var chainExecutor executor.Executor
+	if chain == common.ChainBSC {
+		chainExecutor = executor.NewBSCExecutor(client, swapAgentAddr, config)
+	} else {
+		chainExecutor = executor.NewEthExecutor(client, swapAgentAddr, config)
+	}
+	ob := observer.NewObserver(db, startHeight, confirmPolicy, config, chainExecutor)
+
+	job, err := ob.NewRescanJob(fromHeight, toHeight)
+	if err != nil {
+		fmt.Printf("create rescan job error, err=%s\n", err.Error())
+		return
+	}
+	err = ob.Rescan(job, func(job *model.RescanJob) {
+		fmt.Printf("%s rescan job %d, status %s, scanned to %d of [%d, %d], found %d logs, inserted %d logs\n",
+			job.Chain, job.Id, job.Status, job.ScannedHeight, job.FromHeight, job.ToHeight, job.FoundLogs, job.InsertedLogs)
+	})
+	if err != nil {
+		fmt.Printf("rescan error, err=%s\n", err.Error())
+	}
+}
+
+// importAddresses adds the entries of the csv or json file to the address screening lists, the format is told by
+// the file extension
+func importAddresses(db *gorm.DB, path string, defaultList model.AddressList) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("read file error, err=%s\n", err.Error())
+		return
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	entries, err := screening.ParseAddresses(content, format, defaultList, filepath.Base(path))
+	if err != nil {
+		fmt.Printf("parse file error, err=%s\n", err.Error())
+		return
+	}
+	if err := screening.SaveAddresses(db, entries); err != nil {
+		fmt.Printf("save addresses error, err=%s\n", err.Error())
+		return
+	}
+	fmt.Printf("imported %d addresses from %s\n", len(entries), path)
+}
+
+// exportLedgerReport writes the ledger report of the days [from, to) to the csv or json file, the format is told by
+// the file extension
+func exportLedgerReport(db *gorm.DB, path, from, to, groupBy string) {
+	var options ledger.ReportOptions
+	var err error
+	if from != "" {
+		if options.From, err = ledger.ParseDay(from); err != nil {
+			fmt.Printf("invalid from day, err=%s\n", err.Error())
+			return
+		}
+	}
+	if to != "" {
+		if options.To, err = ledger.ParseDay(to); err != nil {
+			fmt.Printf("invalid to day, err=%s\n", err.Error())
+			return
+		}
+	}
+	if options.GroupBy, err = ledger.ParseGroupBy(groupBy); err != nil {
+		fmt.Printf("invalid group by, err=%s\n", err.Error())
+		return
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if format != ledger.FormatCSV && format != ledger.FormatJSON {
+		fmt.Printf("unsupported file extension of %s, csv or json\n", path)
+		return
+	}
+
+	rows, err := ledger.Report(db, options)
+	if err != nil {
+		fmt.Printf("report ledger error, err=%s\n", err.Error())
+		return
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("create file error, err=%s\n", err.Error())
+		return
+	}
+	defer file.Close()
+
+	if format == ledger.FormatCSV {
+		err = ledger.WriteCSV(file, rows)
+	} else {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "    ")
+		err = encoder.Encode(rows)
+	}
+	if err != nil {
+		fmt.Printf("write file error, err=%s\n", err.Error())
+		return
+	}
+	fmt.Printf("exported %d ledger report rows to %s\n", len(rows), path)
+}
 
-	select {}
+type stopper interface {
+	Stop() error
 }
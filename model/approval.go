@@ -0,0 +1,30 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+type ApprovalDecision string
+
+const (
+	ApprovalApproved ApprovalDecision = "approved"
+	ApprovalRejected ApprovalDecision = "rejected"
+)
+
+// SwapApproval is the decision of an approver on a swap above the approval threshold of its pair, an approver
+// decides once on a swap for the unique index
+type SwapApproval struct {
+	gorm.Model
+
+	SwapID      uint             `gorm:"not null;unique_index:swap_approval_swap_id_approver"`
+	StartTxHash string           `gorm:"not null"`
+	Approver    string           `gorm:"not null;unique_index:swap_approval_swap_id_approver"`
+	Decision    ApprovalDecision `gorm:"not null"`
+	Comment     string
+
+	RecordHash string `gorm:"not null"`
+}
+
+func (SwapApproval) TableName() string {
+	return "swap_approvals"
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+)
+
+type LedgerCategory string
+type LedgerSide string
+
+const (
+	// the fee paid by the sponsor to the swap agent
+	LedgerSwapFee LedgerCategory = "swap_fee"
+	// the gas paid by the tss account for the txs it sends
+	LedgerFillGas       LedgerCategory = "fill_gas"
+	LedgerRetryGas      LedgerCategory = "retry_gas"
+	LedgerCreatePairGas LedgerCategory = "create_pair_gas"
+	LedgerWithdrawGas   LedgerCategory = "withdraw_gas"
+	LedgerRefundGas     LedgerCategory = "refund_gas"
+
+	LedgerDebit  LedgerSide = "debit"
+	LedgerCredit LedgerSide = "credit"
+
+	// the native token held by the swap agent, the swap fees are collected there
+	LedgerAccountSwapAgent = "swap_agent"
+	// the native token held by the tss account, the gas is paid from there
+	LedgerAccountTSS        = "tss_account"
+	LedgerAccountFeeIncome  = "fee_income"
+	LedgerAccountGasExpense = "gas_expense"
+)
+
+// LedgerEntry is a side of a double-entry record of the fees collected and the gas spent by the bridge. The debit and
+// the credit entries of a record share the record key and the amount, which is in the native token of the chain.
+type LedgerEntry struct {
+	gorm.Model
+
+	// the category and the id of the row the record is booked from, e.g. fill_gas:12
+	RecordKey string         `gorm:"not null;unique_index:ledger_entry_record_key_side"`
+	Side      LedgerSide     `gorm:"not null;unique_index:ledger_entry_record_key_side"`
+	Category  LedgerCategory `gorm:"not null;index:ledger_entry_category"`
+	SourceID  uint           `gorm:"not null;index:ledger_entry_source_id"`
+	Account   string         `gorm:"not null"`
+	Chain     string         `gorm:"not null"`
+
+	// the erc20 addr of the swap pair the record is for, or the token withdrawn, it is empty for the native token
+	Token     string `gorm:"not null;index:ledger_entry_token"`
+	Symbol    string
+	Direction common.SwapDirection
+	Amount    string `gorm:"not null"`
+	TxHash    string `gorm:"not null"`
+
+	// the time the fee is collected or the gas is spent
+	BookTime int64 `gorm:"not null;index:ledger_entry_book_time"`
+}
+
+func (LedgerEntry) TableName() string {
+	return "ledger_entries"
+}
@@ -8,6 +8,7 @@ import (
 
 type TxPhase int
 type TxStatus int
+type RescanJobStatus string
 type FillTxStatus int
 type FillRetryTxStatus int
 
@@ -30,6 +31,10 @@ const (
 	FillRetryTxSuccess FillRetryTxStatus = 2
 	FillRetryTxFailed  FillRetryTxStatus = 3
 	FillRetryTxMissing FillRetryTxStatus = 4
+
+	RescanJobRunning RescanJobStatus = "running"
+	RescanJobDone    RescanJobStatus = "done"
+	RescanJobFailed  RescanJobStatus = "failed"
 )
 
 type BlockLog struct {
@@ -51,15 +56,121 @@ func (l *BlockLog) BeforeCreate() (err error) {
 	return nil
 }
 
+// ReorgEvent records a chain reorganization handled by the observer
+type ReorgEvent struct {
+	Id    int64
+	Chain string `gorm:"not null;index:reorg_event_chain"`
+
+	// the highest block which is still on the canonical chain
+	AncestorHeight int64  `gorm:"not null"`
+	AncestorHash   string `gorm:"not null"`
+	TipHeight      int64  `gorm:"not null"`
+	Depth          int64  `gorm:"not null"`
+
+	DeletedBlockLogs              int64
+	DeletedSwapStartTxLogs        int64
+	DeletedSwaps                  int64
+	DeletedRetrySwaps             int64
+	DeletedSwapPairRegisterTxLogs int64
+	DeletedSwapPairSMs            int64
+	DeletedSwapFillTxLogs         int64
+	// the other registered event logs, e.g. the contract event logs
+	DeletedEventLogs int64
+
+	// start tx hashes of the swaps which have already been filled or are being filled
+	AffectedSwaps string `gorm:"type:text"`
+	// register tx hashes of the swap pairs which have already been created or are being created
+	AffectedSwapPairs string `gorm:"type:text"`
+
+	CreateTime int64
+}
+
+func (ReorgEvent) TableName() string {
+	return "reorg_events"
+}
+
+func (l *ReorgEvent) BeforeCreate() (err error) {
+	l.CreateTime = time.Now().Unix()
+	return nil
+}
+
+// ContractEventLog records a swap agent event which is not processed by the engines, e.g. the ownership transfers
+type ContractEventLog struct {
+	Id        int64
+	Chain     string `gorm:"not null;index:contract_event_log_chain"`
+	EventName string `gorm:"not null;index:contract_event_log_event_name"`
+	Contract  string `gorm:"not null"`
+	// the decoded event fields in json
+	Payload string `gorm:"type:text"`
+
+	TxHash    string `gorm:"not null;index:contract_event_log_tx_hash"`
+	BlockHash string `gorm:"not null"`
+	Height    int64  `gorm:"not null;index:contract_event_log_height"`
+
+	CreateTime int64
+}
+
+func (ContractEventLog) TableName() string {
+	return "contract_event_logs"
+}
+
+func (l *ContractEventLog) BeforeCreate() (err error) {
+	l.CreateTime = time.Now().Unix()
+	return nil
+}
+
+// RescanJob records the progress of a historical rescan, which inserts the swap start and swap pair register
+// logs missed by the observer without moving the block cursor
+type RescanJob struct {
+	Id         int64
+	Chain      string `gorm:"not null;index:rescan_job_chain"`
+	FromHeight int64  `gorm:"not null"`
+	ToHeight   int64  `gorm:"not null"`
+
+	// the highest height which has been scanned
+	ScannedHeight int64 `gorm:"not null"`
+	FoundLogs     int64 `gorm:"not null"`
+	InsertedLogs  int64 `gorm:"not null"`
+
+	Status   RescanJobStatus `gorm:"not null"`
+	ErrorMsg string
+
+	UpdateTime int64
+	CreateTime int64
+}
+
+func (RescanJob) TableName() string {
+	return "rescan_jobs"
+}
+
+func (j *RescanJob) BeforeCreate() (err error) {
+	j.CreateTime = time.Now().Unix()
+	j.UpdateTime = time.Now().Unix()
+	return nil
+}
+
 func InitTables(db *gorm.DB) {
 	db.AutoMigrate(&SwapPair{})
 	db.AutoMigrate(&SwapFillTx{})
+	db.AutoMigrate(&SwapFillTxAttempt{})
 	db.AutoMigrate(&Swap{})
 	db.AutoMigrate(&SwapStartTxLog{})
+	db.AutoMigrate(&SwapFillTxLog{})
 	db.AutoMigrate(&BlockLog{})
 	db.AutoMigrate(&SwapPairCreatTx{})
 	db.AutoMigrate(&SwapPairRegisterTxLog{})
 	db.AutoMigrate(&SwapPairStateMachine{})
 	db.AutoMigrate(&RetrySwap{})
 	db.AutoMigrate(&RetrySwapTx{})
+	db.AutoMigrate(&ReorgEvent{})
+	db.AutoMigrate(&ContractEventLog{})
+	db.AutoMigrate(&RescanJob{})
+	db.AutoMigrate(&TxNonce{})
+	db.AutoMigrate(&VelocityLimit{})
+	db.AutoMigrate(&SwapApproval{})
+	db.AutoMigrate(&ScreenedAddress{})
+	db.AutoMigrate(&ScreeningRelease{})
+	db.AutoMigrate(&LedgerEntry{})
+	db.AutoMigrate(&SwapStatusHistory{})
+	db.AutoMigrate(&SwapRefund{})
 }
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"time"
+)
+
+type NonceStatus string
+
+const (
+	// the nonce is used by a tx being built and sent
+	NonceReserved NonceStatus = "reserved"
+	// the tx of the nonce is broadcast
+	NonceSent NonceStatus = "sent"
+	// the tx of the nonce was not sent, the nonce is reused by the next reservation
+	NonceReleased NonceStatus = "released"
+	// the nonce is below the latest nonce of the sender on chain
+	NonceConsumed NonceStatus = "consumed"
+)
+
+// TxNonce is a nonce reservation of a sender account, a nonce is never reserved twice for the unique index
+type TxNonce struct {
+	Id     int64
+	Chain  string      `gorm:"not null;unique_index:tx_nonce_chain_sender_nonce"`
+	Sender string      `gorm:"not null;unique_index:tx_nonce_chain_sender_nonce"`
+	Nonce  int64       `gorm:"not null;unique_index:tx_nonce_chain_sender_nonce"`
+	Status NonceStatus `gorm:"not null;index:tx_nonce_status"`
+
+	// what the tx does, e.g. fill_swap or withdraw
+	Purpose string `gorm:"not null"`
+	// the hash of the last tx sent with the nonce
+	TxHash string `gorm:"not null"`
+
+	UpdateTime int64
+	CreateTime int64
+}
+
+func (TxNonce) TableName() string {
+	return "tx_nonces"
+}
+
+func (n *TxNonce) BeforeCreate() (err error) {
+	n.CreateTime = time.Now().Unix()
+	n.UpdateTime = time.Now().Unix()
+	return nil
+}
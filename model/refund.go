@@ -0,0 +1,43 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+)
+
+// SwapRefund sends the token of a rejected swap back to the sponsor on the chain the swap starts on. The refund tx
+// fills the start tx on the swap agent of that chain, so the swap agent refunds a start tx once at most.
+type SwapRefund struct {
+	gorm.Model
+
+	Status      common.RefundStatus  `gorm:"not null;index:swap_refund_status"`
+	SwapID      uint                 `gorm:"not null;index:swap_refund_swap_id"`
+	Direction   common.SwapDirection `gorm:"not null"`
+	StartTxHash string               `gorm:"not null;index:swap_refund_start_tx_hash"`
+	// the chain the swap starts on and the refund is sent to
+	Chain   string `gorm:"not null"`
+	Sponsor string `gorm:"not null;index:swap_refund_sponsor"`
+	// the token locked or burned by the start tx, and the erc20 of its swap pair the swap agent is called with
+	TokenAddr string `gorm:"not null"`
+	ERC20Addr string `gorm:"not null"`
+	Symbol    string
+	Amount    string `gorm:"not null"`
+
+	// the approver of the refund and why
+	Approver string `gorm:"not null"`
+	Reason   string
+
+	RefundTxHash      string `gorm:"not null;index:swap_refund_refund_tx_hash"`
+	GasPrice          string
+	ConsumedFeeAmount string
+	Height            int64
+	TrackRetryCounter int64
+
+	RecordHash string `gorm:"not null"`
+	ErrorMsg   string
+}
+
+func (SwapRefund) TableName() string {
+	return "swap_refunds"
+}
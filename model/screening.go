@@ -0,0 +1,46 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+type AddressList string
+
+const (
+	// the swaps from or to the address are blocked
+	AddressBlocked AddressList = "block"
+	// the address passes the screening without asking the screening providers
+	AddressAllowed AddressList = "allow"
+)
+
+// ScreenedAddress is an entry of the blocklist or the allowlist of the address screening
+type ScreenedAddress struct {
+	gorm.Model
+
+	// the checksummed address
+	Address string      `gorm:"not null;unique_index:screened_address_address"`
+	List    AddressList `gorm:"not null;index:screened_address_list"`
+	Reason  string
+	// where the entry comes from, e.g. the file it is imported from
+	Source string
+}
+
+func (ScreenedAddress) TableName() string {
+	return "screened_addresses"
+}
+
+// ScreeningRelease records the admin releasing a blocked swap, the released swap is not screened again
+type ScreeningRelease struct {
+	gorm.Model
+
+	SwapID      uint   `gorm:"not null;unique_index:screening_release_swap_id"`
+	StartTxHash string `gorm:"not null"`
+	Releaser    string `gorm:"not null"`
+	Reason      string
+
+	RecordHash string `gorm:"not null"`
+}
+
+func (ScreeningRelease) TableName() string {
+	return "screening_releases"
+}
@@ -0,0 +1,42 @@
+package model
+
+import (
+	"time"
+)
+
+type StatusEntity string
+
+const (
+	StatusEntitySwap      StatusEntity = "swap"
+	StatusEntityRetrySwap StatusEntity = "retry_swap"
+	StatusEntitySwapPair  StatusEntity = "swap_pair"
+	StatusEntityRefund    StatusEntity = "refund"
+)
+
+// SwapStatusHistory is a transition of the status of a swap, a retry swap, a swap pair or a refund. The from status is empty for
+// the transition creating the entity.
+type SwapStatusHistory struct {
+	Id       int64
+	Entity   StatusEntity `gorm:"not null;index:swap_status_history_entity"`
+	EntityID uint         `gorm:"not null;index:swap_status_history_entity"`
+	// the start tx of the swap, its retry swaps and its refunds, or the register tx of the swap pair
+	StartTxHash string `gorm:"not null;index:swap_status_history_start_tx_hash"`
+	FromStatus  string `gorm:"not null"`
+	ToStatus    string `gorm:"not null"`
+	Reason      string
+	// the daemon or the admin key making the transition
+	Actor string `gorm:"not null"`
+	// the fill tx, the retry fill tx, the create pair tx or the refund tx the transition is about
+	TxHash string
+
+	CreateTime int64 `gorm:"not null"`
+}
+
+func (SwapStatusHistory) TableName() string {
+	return "swap_status_history"
+}
+
+func (h *SwapStatusHistory) BeforeCreate() (err error) {
+	h.CreateTime = time.Now().Unix()
+	return nil
+}
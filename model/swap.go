@@ -17,11 +17,13 @@ type SwapStartTxLog struct {
 	Amount      string `gorm:"not null"`
 	FeeAmount   string `gorm:"not null"`
 
-	Status       TxStatus `gorm:"not null;index:swap_start_tx_log_status"`
-	TxHash       string   `gorm:"not null;index:swap_start_tx_log_tx_hash"`
-	BlockHash    string   `gorm:"not null"`
-	Height       int64    `gorm:"not null"`
-	ConfirmedNum int64    `gorm:"not null"`
+	Status TxStatus `gorm:"not null;index:swap_start_tx_log_status"`
+	TxHash string   `gorm:"not null;index:swap_start_tx_log_tx_hash"`
+	// the index of the log in the block, it is null for the logs indexed before it was recorded
+	LogIndex     *int64
+	BlockHash    string `gorm:"not null"`
+	Height       int64  `gorm:"not null"`
+	ConfirmedNum int64  `gorm:"not null"`
 
 	Phase TxPhase `gorm:"not null;index:swap_start_tx_log_phase"`
 
@@ -56,6 +58,57 @@ func (SwapFillTx) TableName() string {
 	return "swap_fill_txs"
 }
 
+// SwapFillTxAttempt is a signed tx of a SwapFillTx. The attempts of a fill tx share the nonce and the calldata and
+// differ in the gas price, the first one is sent by the swap engine and the later ones replace it when it is stuck.
+type SwapFillTxAttempt struct {
+	gorm.Model
+
+	SwapFillTxID uint   `gorm:"not null;index:swap_fill_tx_attempt_swap_fill_tx_id"`
+	Attempt      int64  `gorm:"not null"`
+	Nonce        int64  `gorm:"not null"`
+	TxHash       string `gorm:"not null;index:swap_fill_tx_attempt_tx_hash"`
+	GasPrice     string `gorm:"not null"`
+	// the height at which the tracker first sees the attempt unmined
+	SentHeight int64
+}
+
+func (SwapFillTxAttempt) TableName() string {
+	return "swap_fill_tx_attempts"
+}
+
+// SwapFillTxLog is a SwapFilled event of the swap agents, it is linked to the swap by the start tx hash carried
+// in the event whoever sent the fill tx
+type SwapFillTxLog struct {
+	Id    int64
+	Chain string `gorm:"not null;index:swap_fill_tx_log_chain"`
+
+	TokenAddr   string `gorm:"not null"`
+	ToAddress   string `gorm:"not null"`
+	Amount      string `gorm:"not null"`
+	StartTxHash string `gorm:"not null;index:swap_fill_tx_log_start_tx_hash"`
+
+	Status       TxStatus `gorm:"not null;index:swap_fill_tx_log_status"`
+	TxHash       string   `gorm:"not null;index:swap_fill_tx_log_tx_hash"`
+	BlockHash    string   `gorm:"not null"`
+	Height       int64    `gorm:"not null"`
+	ConfirmedNum int64    `gorm:"not null"`
+
+	Phase TxPhase `gorm:"not null;index:swap_fill_tx_log_phase"`
+
+	UpdateTime int64
+	CreateTime int64
+}
+
+func (SwapFillTxLog) TableName() string {
+	return "swap_fill_events"
+}
+
+func (l *SwapFillTxLog) BeforeCreate() (err error) {
+	l.CreateTime = time.Now().Unix()
+	l.UpdateTime = time.Now().Unix()
+	return nil
+}
+
 type RetrySwap struct {
 	gorm.Model
 
@@ -90,6 +143,7 @@ type RetrySwapTx struct {
 	Status              FillRetryTxStatus `gorm:"not null"`
 	ErrorMsg            string            `gorm:"not null"`
 	GasPrice            string
+	Nonce               int64
 	ConsumedFeeAmount   string
 	Height              int64
 }
@@ -111,6 +165,8 @@ type Swap struct {
 	Amount    string               `gorm:"not null;index:swap_amount"`
 	Decimals  int                  `gorm:"not null"`
 	Direction common.SwapDirection `gorm:"not null;index:swap_direction"`
+	// the fee paid to the swap agent in the native token of the chain the swap starts on
+	FeeAmount string
 
 	// The tx hash confirmed deposit
 	StartTxHash string `gorm:"not null;index:swap_start_tx_hash"`
@@ -119,6 +175,14 @@ type Swap struct {
 
 	// used to log more message about how this swap failed or invalid
 	Log string
+	// the time the swap is claimed to be filled, the velocity limits count the swaps by it
+	ClaimedAt int64 `gorm:"not null;default:0;index:swap_claimed_at"`
+	// the class of the error the swap failed with
+	ErrorClass string
+	// the automatic retries of the failed swap so far
+	RetryAttempts int `gorm:"not null;default:0"`
+	// the time the failed swap is retried automatically, 0 if it is not retried
+	NextRetryAt int64 `gorm:"not null;default:0;index:swap_next_retry_at"`
 
 	RecordHash string `gorm:"not null"`
 }
@@ -20,6 +20,8 @@ type SwapPair struct {
 	LowBound   string `gorm:"not null"`
 	UpperBound string `gorm:"not null"`
 	IconUrl    string
+	// the swaps above the amount are filled after approved, no approval is required if it is empty
+	ApprovalThreshold string
 
 	RecordHash string `gorm:"not null"`
 }
@@ -38,11 +40,13 @@ type SwapPairRegisterTxLog struct {
 	Name      string `gorm:"not null"`
 	Decimals  int    `gorm:"not null"`
 
-	Status       TxStatus `gorm:"not null;index:swappair_register_tx_log_status"`
-	TxHash       string   `gorm:"not null;index:swappair_register_tx_log_tx_hash"`
-	BlockHash    string   `gorm:"not null"`
-	Height       int64    `gorm:"not null"`
-	ConfirmedNum int64    `gorm:"not null"`
+	Status TxStatus `gorm:"not null;index:swappair_register_tx_log_status"`
+	TxHash string   `gorm:"not null;index:swappair_register_tx_log_tx_hash"`
+	// the index of the log in the block, it is null for the logs indexed before it was recorded
+	LogIndex     *int64
+	BlockHash    string `gorm:"not null"`
+	Height       int64  `gorm:"not null"`
+	ConfirmedNum int64  `gorm:"not null"`
 
 	Phase TxPhase `gorm:"not null;index:swappair_register_tx_log_phase"`
 
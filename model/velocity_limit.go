@@ -0,0 +1,43 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+)
+
+type VelocityScope string
+
+const (
+	// the swaps of the token are counted together
+	VelocityScopeToken VelocityScope = "token"
+	// the swaps of the token are counted per sponsor
+	VelocityScopeSponsor VelocityScope = "sponsor"
+	// the swaps of all tokens are counted together, only the number of swaps is limited for the amounts of the
+	// tokens can't be added up
+	VelocityScopeDirection VelocityScope = "direction"
+)
+
+// VelocityLimit limits the total amount and the number of the swaps filled in a rolling window. The swaps beyond
+// any of the limits are held until the window allows.
+type VelocityLimit struct {
+	gorm.Model
+
+	Scope VelocityScope `gorm:"not null"`
+	// the limit applies to the swaps of the token only, it applies to all tokens if it is empty
+	ERC20Addr string `gorm:"not null;index:velocity_limit_erc20_addr"`
+	// the limit applies to the swaps of the direction only, it applies to both directions if it is empty
+	Direction common.SwapDirection `gorm:"not null"`
+
+	WindowSeconds int64 `gorm:"not null"`
+	// the total amount of the swaps in the window, it is unlimited if empty
+	MaxAmount string `gorm:"not null"`
+	// the number of the swaps in the window, it is unlimited if zero
+	MaxCount int64 `gorm:"not null"`
+
+	Enabled bool `gorm:"not null"`
+}
+
+func (VelocityLimit) TableName() string {
+	return "velocity_limits"
+}
@@ -1,6 +1,7 @@
 package observer
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -9,51 +10,104 @@ import (
 	"github.com/binance-chain/bsc-eth-swap/common"
 	"github.com/binance-chain/bsc-eth-swap/executor"
 	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/policy"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
 type Observer struct {
 	DB *gorm.DB
 
-	StartHeight int64
-	ConfirmNum  int64
+	StartHeight   int64
+	ConfirmNum    int64
+	ConfirmPolicy *policy.ConfirmPolicy
 
 	Config   *util.Config
 	Executor executor.Executor
+
+	// the latest height of the chain seen by the observer, only refreshed when the observer reaches it
+	latestHeight int64
+	// the size of the block window used by the range queries when catching up
+	fetchRangeSize int64
+
+	lifecycle util.Lifecycle
 }
 
 // NewObserver returns the observer instance
-func NewObserver(db *gorm.DB, startHeight, confirmNum int64, cfg *util.Config, executor executor.Executor) *Observer {
-	return &Observer{
+func NewObserver(db *gorm.DB, startHeight int64, confirmPolicy *policy.ConfirmPolicy, cfg *util.Config, executor executor.Executor) *Observer {
+	ob := &Observer{
 		DB: db,
 
-		StartHeight: startHeight,
-		ConfirmNum:  confirmNum,
+		StartHeight:   startHeight,
+		ConfirmNum:    confirmPolicy.ConfirmNum(),
+		ConfirmPolicy: confirmPolicy,
 
 		Config:   cfg,
 		Executor: executor,
 	}
+	ob.fetchRangeSize = ob.maxFetchRangeSize()
+
+	// the tables of the registered events are created here, so that a new event only needs to be registered
+	ob.DB.AutoMigrate(executor.GetEventRegistry().Models()...)
+	return ob
 }
 
 // Start starts the routines of observer
-func (ob *Observer) Start() {
-	go ob.Fetch(ob.StartHeight)
-	go ob.Prune()
-	go ob.Alert()
+func (ob *Observer) Start(ctx context.Context) {
+	ob.lifecycle.Start(ctx)
+	if subscriber := ob.Executor.GetSubscriber(); subscriber != nil {
+		subscriber.Start(ob.lifecycle.Context())
+	}
+	ob.lifecycle.Go(func() { ob.Fetch(ob.StartHeight) })
+	ob.lifecycle.Go(ob.Prune)
+	ob.lifecycle.Go(ob.Alert)
 }
 
+// Stop stops fetching new blocks and waits for the block being saved
+func (ob *Observer) Stop() error {
+	err := ob.lifecycle.Stop(common.ShutdownTimeout)
+	if subscriber := ob.Executor.GetSubscriber(); subscriber != nil {
+		if subErr := subscriber.Stop(); subErr != nil && err == nil {
+			err = subErr
+		}
+	}
+	return err
+}
+
+// fetchSleep waits for the next block. If the subscriptions of the executor are alive, it returns as soon as
+// a new block is pushed, otherwise it sleeps for the fetch interval.
 func (ob *Observer) fetchSleep() {
+	if subscriber := ob.Executor.GetSubscriber(); subscriber != nil && subscriber.IsActive() {
+		select {
+		case <-subscriber.NotifyCh():
+		case <-time.After(common.ObserverSubscribeWaitTimeout):
+		case <-ob.lifecycle.Context().Done():
+		}
+		return
+	}
+
 	if ob.Executor.GetChainName() == common.ChainBSC {
-		time.Sleep(time.Duration(ob.Config.ChainConfig.BSCObserverFetchInterval) * time.Second)
+		ob.lifecycle.Sleep(time.Duration(ob.Config.ChainConfig.BSCObserverFetchInterval) * time.Second)
 	} else if ob.Executor.GetChainName() == common.ChainETH {
-		time.Sleep(time.Duration(ob.Config.ChainConfig.ETHObserverFetchInterval) * time.Second)
+		ob.lifecycle.Sleep(time.Duration(ob.Config.ChainConfig.ETHObserverFetchInterval) * time.Second)
 	}
+}
 
+func (ob *Observer) maxFetchRangeSize() int64 {
+	rangeSize := int64(0)
+	if ob.Executor.GetChainName() == common.ChainBSC {
+		rangeSize = ob.Config.ChainConfig.BSCObserverFetchRangeSize
+	} else if ob.Executor.GetChainName() == common.ChainETH {
+		rangeSize = ob.Config.ChainConfig.ETHObserverFetchRangeSize
+	}
+	if rangeSize <= 0 {
+		rangeSize = common.ObserverDefaultFetchRangeSize
+	}
+	return rangeSize
 }
 
 // Fetch starts the main routine for fetching blocks of BSC
 func (ob *Observer) Fetch(startHeight int64) {
-	for {
+	for !ob.lifecycle.Stopping() {
 		curBlockLog, err := ob.GetCurrentBlockLog()
 		if err != nil {
 			util.Logger.Errorf("get current block log from db error: %s", err.Error())
@@ -66,6 +120,15 @@ func (ob *Observer) Fetch(startHeight int64) {
 			nextHeight = startHeight
 		}
 
+		if ob.isCatchingUp(nextHeight) {
+			err = ob.fetchBlockRange(nextHeight)
+			if err != nil {
+				util.Logger.Errorf("fetch %s block range error, err=%s", ob.Executor.GetChainName(), err.Error())
+				ob.fetchSleep()
+			}
+			continue
+		}
+
 		util.Logger.Debugf("fetch %s block, height=%d", ob.Executor.GetChainName(), nextHeight)
 		err = ob.fetchBlock(curBlockLog.Height, nextHeight, curBlockLog.BlockHash)
 		if err != nil {
@@ -75,8 +138,63 @@ func (ob *Observer) Fetch(startHeight int64) {
 	}
 }
 
+// isCatchingUp returns true if the next height is deeper than the confirm number, in which case the blocks
+// are fetched by range. The latest height is only refreshed once the observer has reached it.
+func (ob *Observer) isCatchingUp(nextHeight int64) bool {
+	if nextHeight > ob.latestHeight {
+		latestHeight, err := ob.Executor.GetLatestHeight()
+		if err != nil {
+			util.Logger.Debugf("get %s latest height error, err=%s", ob.Executor.GetChainName(), err.Error())
+			return false
+		}
+		ob.latestHeight = latestHeight
+	}
+	return nextHeight <= ob.latestHeight-ob.ConfirmNum
+}
+
+// fetchBlockRange fetches the blocks from the given height with range queries and saves them in one db
+// transaction. The window shrinks by half when the provider fails to serve the range and grows back after
+// successful queries.
+func (ob *Observer) fetchBlockRange(fromHeight int64) error {
+	toHeight := fromHeight + ob.fetchRangeSize - 1
+	if toHeight > ob.latestHeight-ob.ConfirmNum {
+		toHeight = ob.latestHeight - ob.ConfirmNum
+	}
+
+	util.Logger.Debugf("fetch %s blocks by range, from=%d, to=%d", ob.Executor.GetChainName(), fromHeight, toHeight)
+	blockAndEventLogsList, err := ob.Executor.GetBlockAndTxEventsByRange(fromHeight, toHeight)
+	if err != nil {
+		if ob.fetchRangeSize > common.ObserverMinFetchRangeSize {
+			ob.fetchRangeSize = ob.fetchRangeSize / 2
+			util.Logger.Infof("shrink %s fetch range size to %d", ob.Executor.GetChainName(), ob.fetchRangeSize)
+		}
+		return fmt.Errorf("get block range info error, from=%d, to=%d, err=%s", fromHeight, toHeight, err.Error())
+	}
+	if maxRangeSize := ob.maxFetchRangeSize(); ob.fetchRangeSize < maxRangeSize {
+		ob.fetchRangeSize = ob.fetchRangeSize * 2
+		if ob.fetchRangeSize > maxRangeSize {
+			ob.fetchRangeSize = maxRangeSize
+		}
+	}
+
+	err = ob.SaveBlockRangeAndTxEvents(blockAndEventLogsList)
+	if err != nil {
+		return err
+	}
+
+	err = ob.UpdateSwapStartConfirmedNum(toHeight)
+	if err != nil {
+		return err
+	}
+	err = ob.UpdateSwapPairRegisterConfirmedNum(toHeight)
+	if err != nil {
+		return err
+	}
+	return ob.UpdateSwapFillConfirmedNum(toHeight)
+}
+
 // fetchBlock fetches the next block of BSC and saves it to database. if the next block hash
-// does not match to the parent hash, the current block will be deleted for there is a fork.
+// does not match to the parent hash, the blocks after the common ancestor will be rolled back for there is a fork.
 func (ob *Observer) fetchBlock(curHeight, nextHeight int64, curBlockHash string) error {
 	blockAndEventLogs, err := ob.Executor.GetBlockAndTxEvents(nextHeight)
 	if err != nil {
@@ -85,7 +203,7 @@ func (ob *Observer) fetchBlock(curHeight, nextHeight int64, curBlockHash string)
 
 	parentHash := blockAndEventLogs.ParentBlockHash
 	if curHeight != 0 && parentHash != curBlockHash {
-		return ob.DeleteBlockAndTxEvents(curHeight)
+		return ob.handleReorg(curHeight)
 	} else {
 		nextBlockLog := model.BlockLog{
 			BlockHash:  blockAndEventLogs.BlockHash,
@@ -108,55 +226,57 @@ func (ob *Observer) fetchBlock(curHeight, nextHeight int64, curBlockHash string)
 		if err != nil {
 			return err
 		}
+		err = ob.UpdateSwapFillConfirmedNum(nextBlockLog.Height)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// DeleteBlockAndTxEvents deletes the block and txs of the given height
-func (ob *Observer) DeleteBlockAndTxEvents(height int64) error {
-	tx := ob.DB.Begin()
-	if err := tx.Error; err != nil {
+func (ob *Observer) UpdateSwapStartConfirmedNum(height int64) error {
+	err := ob.DB.Model(model.SwapStartTxLog{}).Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit).Updates(
+		map[string]interface{}{
+			"confirmed_num": gorm.Expr("? - height", height+1),
+		}).Error
+	if err != nil {
 		return err
 	}
 
-	if err := tx.Where("height = ?", height).Delete(model.BlockLog{}).Error; err != nil {
-		tx.Rollback()
+	// the logs are checked against the confirm policy one by one, for the large swaps require more confirmations
+	query := ob.DB.Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit)
+	if !ob.ConfirmPolicy.FollowsFinalityTag() {
+		query = query.Where("confirmed_num >= ?", ob.ConfirmNum)
+	}
+	txEventLogs := make([]model.SwapStartTxLog, 0)
+	err = query.Find(&txEventLogs).Error
+	if err != nil {
 		return err
 	}
 
-	txEventLogList := make([]model.SwapStartTxLog, 0)
-	ob.DB.Where("chain = ? and height = ? and status = ?", ob.Executor.GetChainName(), height, model.TxStatusInit).Find(&txEventLogList)
-	for _, txEventLog := range txEventLogList {
-		if err := tx.Where("start_tx_hash = ?", txEventLog.TxHash).Delete(model.Swap{}).Error; err != nil {
-			tx.Rollback()
+	for _, txEventLog := range txEventLogs {
+		requiredConfirmNum := ob.ConfirmPolicy.RequiredConfirmNum(txEventLog.TokenAddr, txEventLog.Amount)
+		confirmed, err := ob.ConfirmPolicy.IsConfirmed(requiredConfirmNum, txEventLog.Height, height)
+		if err != nil {
 			return err
 		}
-	}
-
-	if err := tx.Where("chain = ? and height = ? and status = ?", ob.Executor.GetChainName(), height, model.TxStatusInit).Delete(model.SwapStartTxLog{}).Error; err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	registerLogList := make([]model.SwapPairRegisterTxLog, 0)
-	ob.DB.Where("chain = ? and height = ? and status = ?", ob.Executor.GetChainName(), height, model.TxStatusInit).Find(&registerLogList)
-	for _, registerLog := range registerLogList {
-		if err := tx.Where("swap_pair_register_tx_hash = ?", registerLog.TxHash).Delete(model.SwapPairStateMachine{}).Error; err != nil {
-			tx.Rollback()
+		if !confirmed {
+			continue
+		}
+		err = ob.DB.Model(model.SwapStartTxLog{}).Where("id = ?", txEventLog.Id).Updates(
+			map[string]interface{}{
+				"status": model.TxStatusConfirmed,
+			}).Error
+		if err != nil {
 			return err
 		}
 	}
 
-	if err := tx.Where("chain = ? and height = ? and status = ?", ob.Executor.GetChainName(), height, model.TxStatusInit).Delete(model.SwapPairRegisterTxLog{}).Error; err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	return tx.Commit().Error
+	return nil
 }
 
-func (ob *Observer) UpdateSwapStartConfirmedNum(height int64) error {
-	err := ob.DB.Model(model.SwapStartTxLog{}).Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit).Updates(
+func (ob *Observer) UpdateSwapPairRegisterConfirmedNum(height int64) error {
+	err := ob.DB.Model(model.SwapPairRegisterTxLog{}).Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit).Updates(
 		map[string]interface{}{
 			"confirmed_num": gorm.Expr("? - height", height+1),
 		}).Error
@@ -164,20 +284,39 @@ func (ob *Observer) UpdateSwapStartConfirmedNum(height int64) error {
 		return err
 	}
 
-	err = ob.DB.Model(model.SwapStartTxLog{}).Where("chain = ? and status = ? and confirmed_num >= ?",
-		ob.Executor.GetChainName(), model.TxStatusInit, ob.ConfirmNum).Updates(
-		map[string]interface{}{
-			"status": model.TxStatusConfirmed,
-		}).Error
+	// the register txs carry no swap amount, they are confirmed by the confirm number or the finality tag of the chain
+	query := ob.DB.Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit)
+	if !ob.ConfirmPolicy.FollowsFinalityTag() {
+		query = query.Where("confirmed_num >= ?", ob.ConfirmNum)
+	}
+	registerTxLogs := make([]model.SwapPairRegisterTxLog, 0)
+	err = query.Find(&registerTxLogs).Error
 	if err != nil {
 		return err
 	}
 
+	for _, registerTxLog := range registerTxLogs {
+		confirmed, err := ob.ConfirmPolicy.IsConfirmed(ob.ConfirmPolicy.ConfirmNum(), registerTxLog.Height, height)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			continue
+		}
+		err = ob.DB.Model(model.SwapPairRegisterTxLog{}).Where("id = ?", registerTxLog.Id).Updates(
+			map[string]interface{}{
+				"status": model.TxStatusConfirmed,
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (ob *Observer) UpdateSwapPairRegisterConfirmedNum(height int64) error {
-	err := ob.DB.Model(model.SwapPairRegisterTxLog{}).Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit).Updates(
+func (ob *Observer) UpdateSwapFillConfirmedNum(height int64) error {
+	err := ob.DB.Model(model.SwapFillTxLog{}).Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit).Updates(
 		map[string]interface{}{
 			"confirmed_num": gorm.Expr("? - height", height+1),
 		}).Error
@@ -185,25 +324,45 @@ func (ob *Observer) UpdateSwapPairRegisterConfirmedNum(height int64) error {
 		return err
 	}
 
-	err = ob.DB.Model(model.SwapPairRegisterTxLog{}).Where("chain = ? and status = ? and confirmed_num >= ?",
-		ob.Executor.GetChainName(), model.TxStatusInit, ob.ConfirmNum).Updates(
-		map[string]interface{}{
-			"status": model.TxStatusConfirmed,
-		}).Error
+	// the fill events complete the swaps, they are confirmed like the start events of the same amounts
+	query := ob.DB.Where("chain = ? and status = ?", ob.Executor.GetChainName(), model.TxStatusInit)
+	if !ob.ConfirmPolicy.FollowsFinalityTag() {
+		query = query.Where("confirmed_num >= ?", ob.ConfirmNum)
+	}
+	fillTxLogs := make([]model.SwapFillTxLog, 0)
+	err = query.Find(&fillTxLogs).Error
 	if err != nil {
 		return err
 	}
 
+	for _, fillTxLog := range fillTxLogs {
+		requiredConfirmNum := ob.ConfirmPolicy.RequiredConfirmNum(fillTxLog.TokenAddr, fillTxLog.Amount)
+		confirmed, err := ob.ConfirmPolicy.IsConfirmed(requiredConfirmNum, fillTxLog.Height, height)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			continue
+		}
+		err = ob.DB.Model(model.SwapFillTxLog{}).Where("id = ?", fillTxLog.Id).Updates(
+			map[string]interface{}{
+				"status": model.TxStatusConfirmed,
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // Prune prunes the outdated blocks
 func (ob *Observer) Prune() {
-	for {
+	for !ob.lifecycle.Stopping() {
 		curBlockLog, err := ob.GetCurrentBlockLog()
 		if err != nil {
 			util.Logger.Errorf("get current block log error, err=%s", err.Error())
-			time.Sleep(common.ObserverPruneInterval)
+			ob.lifecycle.Sleep(common.ObserverPruneInterval)
 
 			continue
 		}
@@ -211,7 +370,7 @@ func (ob *Observer) Prune() {
 		if err != nil {
 			util.Logger.Infof("prune block logs error, err=%s", err.Error())
 		}
-		time.Sleep(common.ObserverPruneInterval)
+		ob.lifecycle.Sleep(common.ObserverPruneInterval)
 	}
 }
 
@@ -235,6 +394,36 @@ func (ob *Observer) SaveBlockAndTxEvents(blockLog *model.BlockLog, packages []in
 	return tx.Commit().Error
 }
 
+// SaveBlockRangeAndTxEvents saves the blocks and events fetched by range in one db transaction
+func (ob *Observer) SaveBlockRangeAndTxEvents(blockAndEventLogsList []*common.BlockAndEventLogs) error {
+	tx := ob.DB.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	for _, blockAndEventLogs := range blockAndEventLogsList {
+		blockLog := model.BlockLog{
+			BlockHash:  blockAndEventLogs.BlockHash,
+			ParentHash: blockAndEventLogs.ParentBlockHash,
+			Height:     blockAndEventLogs.Height,
+			BlockTime:  blockAndEventLogs.BlockTime,
+			Chain:      blockAndEventLogs.Chain,
+		}
+		if err := tx.Create(&blockLog).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		for _, pack := range blockAndEventLogs.Events {
+			if err := tx.Create(pack).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit().Error
+}
+
 // GetCurrentBlockLog returns the highest block log
 func (ob *Observer) GetCurrentBlockLog() (*model.BlockLog, error) {
 	blockLog := model.BlockLog{}
@@ -247,11 +436,11 @@ func (ob *Observer) GetCurrentBlockLog() (*model.BlockLog, error) {
 
 // Alert sends alerts to tg group if there is no new block fetched in a specific time
 func (ob *Observer) Alert() {
-	for {
+	for !ob.lifecycle.Stopping() {
 		curOtherChainBlockLog, err := ob.GetCurrentBlockLog()
 		if err != nil {
 			util.Logger.Errorf("get current block log error, err=%s", err.Error())
-			time.Sleep(common.ObserverAlertInterval)
+			ob.lifecycle.Sleep(common.ObserverAlertInterval)
 
 			continue
 		}
@@ -263,6 +452,6 @@ func (ob *Observer) Alert() {
 			}
 		}
 
-		time.Sleep(common.ObserverAlertInterval)
+		ob.lifecycle.Sleep(common.ObserverAlertInterval)
 	}
 }
@@ -0,0 +1,246 @@
+package observer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/swap"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+const (
+	ReorgSearchBatchSize = 50
+)
+
+// handleReorg walks back from the tip height to the common ancestor of the stored blocks and the canonical
+// chain, and rolls back all the blocks and events after it
+func (ob *Observer) handleReorg(tipHeight int64) error {
+	ancestor, err := ob.findCommonAncestor(tipHeight)
+	if err != nil {
+		return err
+	}
+
+	reorgEvent, err := ob.RollbackBlockAndTxEvents(ancestor, tipHeight)
+	if err != nil {
+		return err
+	}
+
+	util.Logger.Infof("%s reorg handled, ancestor height %d, tip height %d, deleted %d block logs, %d swap start logs, %d swaps, %d swap pair register logs, %d swap pair state machines, %d swap fill logs, %d other event logs",
+		reorgEvent.Chain, reorgEvent.AncestorHeight, reorgEvent.TipHeight, reorgEvent.DeletedBlockLogs, reorgEvent.DeletedSwapStartTxLogs,
+		reorgEvent.DeletedSwaps, reorgEvent.DeletedSwapPairRegisterTxLogs, reorgEvent.DeletedSwapPairSMs, reorgEvent.DeletedSwapFillTxLogs, reorgEvent.DeletedEventLogs)
+
+	if reorgEvent.AffectedSwaps != "" || reorgEvent.AffectedSwapPairs != "" {
+		msg := fmt.Sprintf("Urgent alert: %s reorg of depth %d reached handled requests, ancestor height %d, affected swaps: [%s], affected swap pairs: [%s]",
+			reorgEvent.Chain, reorgEvent.Depth, reorgEvent.AncestorHeight, reorgEvent.AffectedSwaps, reorgEvent.AffectedSwapPairs)
+		util.Logger.Critical(msg)
+		util.SendTelegramMessage(msg)
+	}
+	return nil
+}
+
+// findCommonAncestor returns the highest stored block whose hash matches the canonical chain
+func (ob *Observer) findCommonAncestor(tipHeight int64) (*model.BlockLog, error) {
+	chain := ob.Executor.GetChainName()
+	fromHeight := tipHeight
+	for {
+		blockLogs := make([]model.BlockLog, 0)
+		err := ob.DB.Where("chain = ? and height <= ?", chain, fromHeight).Order("height desc").Limit(ReorgSearchBatchSize).Find(&blockLogs).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(blockLogs) == 0 {
+			msg := fmt.Sprintf("Urgent alert: common ancestor of %s reorg is not found in stored blocks, tip height %d", chain, tipHeight)
+			util.Logger.Critical(msg)
+			util.SendTelegramMessage(msg)
+			return nil, fmt.Errorf("common ancestor is not found, chain=%s, tip height=%d", chain, tipHeight)
+		}
+
+		for idx := range blockLogs {
+			blockHash, err := ob.Executor.GetBlockHash(blockLogs[idx].Height)
+			if err != nil {
+				return nil, fmt.Errorf("get block hash error, height=%d, err=%s", blockLogs[idx].Height, err.Error())
+			}
+			if blockHash == blockLogs[idx].BlockHash {
+				return &blockLogs[idx], nil
+			}
+		}
+		fromHeight = blockLogs[len(blockLogs)-1].Height - 1
+	}
+}
+
+// RollbackBlockAndTxEvents deletes the blocks and events after the ancestor in one db transaction. The swaps
+// and swap pairs which have been sent are kept for they can't be reverted, they are reported in the reorg event.
+func (ob *Observer) RollbackBlockAndTxEvents(ancestor *model.BlockLog, tipHeight int64) (*model.ReorgEvent, error) {
+	chain := ob.Executor.GetChainName()
+	reorgEvent := &model.ReorgEvent{
+		Chain:          chain,
+		AncestorHeight: ancestor.Height,
+		AncestorHash:   ancestor.BlockHash,
+		TipHeight:      tipHeight,
+		Depth:          tipHeight - ancestor.Height,
+	}
+
+	tx := ob.DB.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	err := func() error {
+		result := tx.Where("chain = ? and height > ?", chain, ancestor.Height).Delete(model.BlockLog{})
+		if result.Error != nil {
+			return result.Error
+		}
+		reorgEvent.DeletedBlockLogs = result.RowsAffected
+
+		affectedSwaps, err := ob.rollbackSwapStartTxLogs(tx, ancestor.Height, reorgEvent)
+		if err != nil {
+			return err
+		}
+
+		affectedSwapPairs, err := ob.rollbackSwapPairRegisterTxLogs(tx, ancestor.Height, reorgEvent)
+		if err != nil {
+			return err
+		}
+		reorgEvent.AffectedSwapPairs = strings.Join(affectedSwapPairs, ",")
+
+		reconciledSwaps, err := ob.rollbackSwapFillTxLogs(tx, ancestor.Height, reorgEvent)
+		if err != nil {
+			return err
+		}
+		affectedSwaps = append(affectedSwaps, reconciledSwaps...)
+		reorgEvent.AffectedSwaps = strings.Join(affectedSwaps, ",")
+
+		err = ob.rollbackEventLogs(tx, ancestor.Height, reorgEvent)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(reorgEvent).Error
+	}()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return reorgEvent, tx.Commit().Error
+}
+
+func (ob *Observer) rollbackSwapStartTxLogs(tx *gorm.DB, ancestorHeight int64, reorgEvent *model.ReorgEvent) ([]string, error) {
+	txEventLogList := make([]model.SwapStartTxLog, 0)
+	err := tx.Where("chain = ? and height > ?", ob.Executor.GetChainName(), ancestorHeight).Find(&txEventLogList).Error
+	if err != nil {
+		return nil, err
+	}
+
+	affectedSwaps := make([]string, 0)
+	for _, txEventLog := range txEventLogList {
+		sent, err := swap.IsSwapSent(tx, txEventLog.TxHash)
+		if err != nil {
+			return nil, err
+		}
+		if sent {
+			affectedSwaps = append(affectedSwaps, txEventLog.TxHash)
+			continue
+		}
+
+		result := tx.Where("start_tx_hash = ?", txEventLog.TxHash).Delete(model.RetrySwap{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		reorgEvent.DeletedRetrySwaps += result.RowsAffected
+
+		result = tx.Where("start_tx_hash = ?", txEventLog.TxHash).Delete(model.Swap{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		reorgEvent.DeletedSwaps += result.RowsAffected
+
+		result = tx.Where("id = ?", txEventLog.Id).Delete(model.SwapStartTxLog{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		reorgEvent.DeletedSwapStartTxLogs += result.RowsAffected
+	}
+	return affectedSwaps, nil
+}
+
+// rollbackSwapFillTxLogs deletes the fill events after the ancestor, they are indexed again if the fill txs are
+// packed on the canonical chain. The swaps already marked as succeeded by the deleted events are returned.
+func (ob *Observer) rollbackSwapFillTxLogs(tx *gorm.DB, ancestorHeight int64, reorgEvent *model.ReorgEvent) ([]string, error) {
+	fillLogList := make([]model.SwapFillTxLog, 0)
+	err := tx.Where("chain = ? and height > ?", ob.Executor.GetChainName(), ancestorHeight).Find(&fillLogList).Error
+	if err != nil {
+		return nil, err
+	}
+
+	reconciledSwaps := make([]string, 0)
+	for _, fillLog := range fillLogList {
+		if fillLog.Phase == model.AckRequest {
+			reconciledSwaps = append(reconciledSwaps, fillLog.StartTxHash)
+		}
+	}
+
+	result := tx.Where("chain = ? and height > ?", ob.Executor.GetChainName(), ancestorHeight).Delete(model.SwapFillTxLog{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	reorgEvent.DeletedSwapFillTxLogs = result.RowsAffected
+	return reconciledSwaps, nil
+}
+
+// rollbackEventLogs deletes the logs of the other events registered by the executor after the ancestor, they
+// are indexed again if their txs are packed on the canonical chain
+func (ob *Observer) rollbackEventLogs(tx *gorm.DB, ancestorHeight int64, reorgEvent *model.ReorgEvent) error {
+	for _, eventModel := range ob.Executor.GetEventRegistry().Models() {
+		switch eventModel.(type) {
+		case *model.SwapStartTxLog, *model.SwapPairRegisterTxLog, *model.SwapFillTxLog:
+			// rolled back together with the swaps and the swap pairs
+			continue
+		}
+
+		result := tx.Where("chain = ? and height > ?", ob.Executor.GetChainName(), ancestorHeight).Delete(eventModel)
+		if result.Error != nil {
+			return result.Error
+		}
+		reorgEvent.DeletedEventLogs += result.RowsAffected
+	}
+	return nil
+}
+
+func (ob *Observer) rollbackSwapPairRegisterTxLogs(tx *gorm.DB, ancestorHeight int64, reorgEvent *model.ReorgEvent) ([]string, error) {
+	registerLogList := make([]model.SwapPairRegisterTxLog, 0)
+	err := tx.Where("chain = ? and height > ?", ob.Executor.GetChainName(), ancestorHeight).Find(&registerLogList).Error
+	if err != nil {
+		return nil, err
+	}
+
+	affectedSwapPairs := make([]string, 0)
+	for _, registerLog := range registerLogList {
+		var sentCount int64
+		err := tx.Model(model.SwapPairStateMachine{}).Where("pair_register_tx_hash = ? and status in (?)", registerLog.TxHash,
+			swap.SentSwapPairStatuses).Count(&sentCount).Error
+		if err != nil {
+			return nil, err
+		}
+		if sentCount > 0 {
+			affectedSwapPairs = append(affectedSwapPairs, registerLog.TxHash)
+			continue
+		}
+
+		result := tx.Where("pair_register_tx_hash = ?", registerLog.TxHash).Delete(model.SwapPairStateMachine{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		reorgEvent.DeletedSwapPairSMs += result.RowsAffected
+
+		result = tx.Where("id = ?", registerLog.Id).Delete(model.SwapPairRegisterTxLog{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		reorgEvent.DeletedSwapPairRegisterTxLogs += result.RowsAffected
+	}
+	return affectedSwapPairs, nil
+}
@@ -0,0 +1,186 @@
+package observer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// NewRescanJob saves a rescan job of the range. The range must not exceed the block cursor of the observer, for
+// the blocks above it are indexed by the live path.
+func (ob *Observer) NewRescanJob(fromHeight, toHeight int64) (*model.RescanJob, error) {
+	if fromHeight <= 0 || fromHeight > toHeight {
+		return nil, fmt.Errorf("invalid rescan range [%d, %d]", fromHeight, toHeight)
+	}
+	curBlockLog, err := ob.GetCurrentBlockLog()
+	if err != nil {
+		return nil, err
+	}
+	if toHeight > curBlockLog.Height {
+		return nil, fmt.Errorf("rescan range [%d, %d] exceeds the observed %s height %d", fromHeight, toHeight,
+			ob.Executor.GetChainName(), curBlockLog.Height)
+	}
+
+	job := &model.RescanJob{
+		Chain:         ob.Executor.GetChainName(),
+		FromHeight:    fromHeight,
+		ToHeight:      toHeight,
+		ScannedHeight: fromHeight - 1,
+		Status:        model.RescanJobRunning,
+	}
+	if err := ob.DB.Create(job).Error; err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// StartRescan runs the rescan job in background, it is interrupted when the observer stops
+func (ob *Observer) StartRescan(job *model.RescanJob) {
+	ob.lifecycle.Go(func() {
+		_ = ob.Rescan(job, nil)
+	})
+}
+
+// Rescan re-queries the swap agent events of the job range and inserts the swap start and swap pair register
+// logs which are missing. The inserted logs are confirmed by the observer and processed by the engines like the
+// live ones. progress is called after each window of blocks if it is not nil.
+func (ob *Observer) Rescan(job *model.RescanJob, progress func(job *model.RescanJob)) error {
+	err := ob.rescan(job, progress)
+	if err != nil {
+		job.Status = model.RescanJobFailed
+		job.ErrorMsg = err.Error()
+		util.Logger.Errorf("%s rescan job %d failed, scanned to %d, err=%s", job.Chain, job.Id, job.ScannedHeight, err.Error())
+	} else {
+		job.Status = model.RescanJobDone
+		util.Logger.Infof("%s rescan job %d done, range [%d, %d], found %d logs, inserted %d logs",
+			job.Chain, job.Id, job.FromHeight, job.ToHeight, job.FoundLogs, job.InsertedLogs)
+	}
+	if job.InsertedLogs > 0 {
+		util.SendTelegramMessage(fmt.Sprintf("%s rescan job %d of range [%d, %d] inserted %d missed logs",
+			job.Chain, job.Id, job.FromHeight, job.ToHeight, job.InsertedLogs))
+	}
+
+	if saveErr := ob.saveRescanJob(job); saveErr != nil {
+		util.Logger.Errorf("save %s rescan job %d error, err=%s", job.Chain, job.Id, saveErr.Error())
+	}
+	if progress != nil {
+		progress(job)
+	}
+	return err
+}
+
+func (ob *Observer) rescan(job *model.RescanJob, progress func(job *model.RescanJob)) error {
+	rangeSize := ob.maxFetchRangeSize()
+	for job.ScannedHeight < job.ToHeight {
+		if ob.lifecycle.Stopping() {
+			return fmt.Errorf("interrupted by shutdown, the range from %d is not scanned", job.ScannedHeight+1)
+		}
+
+		fromHeight := job.ScannedHeight + 1
+		toHeight := fromHeight + rangeSize - 1
+		if toHeight > job.ToHeight {
+			toHeight = job.ToHeight
+		}
+
+		blockAndEventLogsList, err := ob.Executor.GetBlockAndTxEventsByRange(fromHeight, toHeight)
+		if err != nil {
+			if rangeSize > common.ObserverMinFetchRangeSize {
+				rangeSize = rangeSize / 2
+				util.Logger.Infof("shrink %s rescan range size to %d, err=%s", job.Chain, rangeSize, err.Error())
+				continue
+			}
+			return fmt.Errorf("get block range info error, from=%d, to=%d, err=%s", fromHeight, toHeight, err.Error())
+		}
+
+		found, inserted, err := ob.saveRescannedEvents(blockAndEventLogsList)
+		if err != nil {
+			return err
+		}
+		job.ScannedHeight = toHeight
+		job.FoundLogs += found
+		job.InsertedLogs += inserted
+		if err := ob.saveRescanJob(job); err != nil {
+			return err
+		}
+
+		util.Logger.Infof("%s rescan job %d progress, scanned to %d of [%d, %d], found %d logs, inserted %d logs",
+			job.Chain, job.Id, job.ScannedHeight, job.FromHeight, job.ToHeight, job.FoundLogs, job.InsertedLogs)
+		if progress != nil {
+			progress(job)
+		}
+	}
+	return nil
+}
+
+// saveRescannedEvents inserts the swap start and swap pair register logs which are not indexed yet in one db
+// transaction, it returns the number of logs found and inserted
+func (ob *Observer) saveRescannedEvents(blockAndEventLogsList []*common.BlockAndEventLogs) (int64, int64, error) {
+	tx := ob.DB.Begin()
+	if err := tx.Error; err != nil {
+		return 0, 0, err
+	}
+
+	found, inserted := int64(0), int64(0)
+	for _, blockAndEventLogs := range blockAndEventLogsList {
+		for _, pack := range blockAndEventLogs.Events {
+			var indexed bool
+			var err error
+			switch eventLog := pack.(type) {
+			case *model.SwapStartTxLog:
+				indexed, err = isEventLogIndexed(tx, model.SwapStartTxLog{}, eventLog.Chain, eventLog.TxHash, eventLog.LogIndex)
+			case *model.SwapPairRegisterTxLog:
+				indexed, err = isEventLogIndexed(tx, model.SwapPairRegisterTxLog{}, eventLog.Chain, eventLog.TxHash, eventLog.LogIndex)
+			default:
+				continue
+			}
+			if err != nil {
+				tx.Rollback()
+				return 0, 0, err
+			}
+
+			found++
+			if indexed {
+				continue
+			}
+			if err := tx.Create(pack).Error; err != nil {
+				tx.Rollback()
+				return 0, 0, err
+			}
+			inserted++
+			util.Logger.Infof("rescan inserted missed %s log, height=%d, block hash=%s", blockAndEventLogs.Chain,
+				blockAndEventLogs.Height, blockAndEventLogs.BlockHash)
+		}
+	}
+	return found, inserted, tx.Commit().Error
+}
+
+// isEventLogIndexed returns true if the log of the tx is indexed, the logs indexed before the log index was
+// recorded match any log of their tx
+func isEventLogIndexed(tx *gorm.DB, eventModel interface{}, chain, txHash string, logIndex *int64) (bool, error) {
+	query := tx.Model(eventModel).Where("chain = ? and tx_hash = ?", chain, txHash)
+	if logIndex != nil {
+		query = query.Where("log_index = ? or log_index is null", *logIndex)
+	}
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (ob *Observer) saveRescanJob(job *model.RescanJob) error {
+	return ob.DB.Model(model.RescanJob{}).Where("id = ?", job.Id).Updates(
+		map[string]interface{}{
+			"scanned_height": job.ScannedHeight,
+			"found_logs":     job.FoundLogs,
+			"inserted_logs":  job.InsertedLogs,
+			"status":         job.Status,
+			"error_msg":      job.ErrorMsg,
+			"update_time":    time.Now().Unix(),
+		}).Error
+}
@@ -0,0 +1,194 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+const (
+	// the tagged height is cached for a while, so that a batch of txs doesn't query it one by one
+	TaggedHeightCacheTime = 5 * time.Second
+	TaggedHeightTimeout   = 5 * time.Second
+)
+
+// ConfirmPolicy decides when a tx of a chain is confirmed. A swap requires the largest confirm number among the
+// chain confirm number and the tiers it reaches. If the chain follows a finality tag, a tx is confirmed once its
+// block is at or below the tagged block instead.
+type ConfirmPolicy struct {
+	chain      string
+	db         *gorm.DB
+	confirmNum int64
+	tiers      []util.ConfirmTier
+	// key is the lower case token address
+	usdPrices map[string]*big.Float
+
+	finalityTag    string
+	finalityReader provider.FinalityReader
+
+	mutex        sync.Mutex
+	taggedHeight int64
+	taggedTime   time.Time
+}
+
+// NewConfirmPolicy returns the confirm policy of the chain, the client must be a provider.FinalityReader if the
+// chain is configured with a finality tag
+func NewConfirmPolicy(chain string, db *gorm.DB, cfg *util.Config, client provider.Client) (*ConfirmPolicy, error) {
+	policy := &ConfirmPolicy{
+		chain:     chain,
+		db:        db,
+		usdPrices: make(map[string]*big.Float),
+	}
+	switch chain {
+	case common.ChainBSC:
+		policy.confirmNum = cfg.ChainConfig.BSCConfirmNum
+		policy.tiers = cfg.ChainConfig.BSCConfirmTiers
+	case common.ChainETH:
+		policy.confirmNum = cfg.ChainConfig.ETHConfirmNum
+		policy.tiers = cfg.ChainConfig.ETHConfirmTiers
+		policy.finalityTag = cfg.ChainConfig.ETHFinalityTag
+	default:
+		return nil, fmt.Errorf("unsupported chain %s", chain)
+	}
+
+	for token, price := range cfg.ChainConfig.TokenUSDPrices {
+		usdPrice, ok := big.NewFloat(0).SetString(price)
+		if !ok {
+			return nil, fmt.Errorf("invalid usd price of %s: %s", token, price)
+		}
+		policy.usdPrices[strings.ToLower(token)] = usdPrice
+	}
+
+	if policy.finalityTag != "" {
+		finalityReader, ok := client.(provider.FinalityReader)
+		if !ok {
+			return nil, fmt.Errorf("%s client doesn't support finality tag %s", chain, policy.finalityTag)
+		}
+		policy.finalityReader = finalityReader
+	}
+	return policy, nil
+}
+
+func (p *ConfirmPolicy) GetChainName() string {
+	return p.chain
+}
+
+// ConfirmNum returns the chain confirm number, it is required by the txs without swap amount
+func (p *ConfirmPolicy) ConfirmNum() int64 {
+	return p.confirmNum
+}
+
+// FollowsFinalityTag returns true if the txs are confirmed by the finality tag instead of the confirm numbers
+func (p *ConfirmPolicy) FollowsFinalityTag() bool {
+	return p.finalityReader != nil
+}
+
+// RequiredConfirmNum returns the confirm number required by a swap of the amount in the token's smallest unit
+func (p *ConfirmPolicy) RequiredConfirmNum(tokenAddr, amount string) int64 {
+	required := p.confirmNum
+	if len(p.tiers) == 0 {
+		return required
+	}
+
+	// an invalid amount reaches all the tiers
+	rawAmount, ok := big.NewInt(0).SetString(amount, 10)
+	if !ok {
+		rawAmount = nil
+	}
+	var usdAmount *big.Float
+	usdAmountLoaded := false
+
+	for _, tier := range p.tiers {
+		if tier.ConfirmNum <= required {
+			continue
+		}
+		if tier.Token != "" && !strings.EqualFold(tier.Token, tokenAddr) {
+			continue
+		}
+		if tier.MinAmount != "" && rawAmount != nil {
+			minAmount, _ := big.NewInt(0).SetString(tier.MinAmount, 10)
+			if rawAmount.Cmp(minAmount) < 0 {
+				continue
+			}
+		}
+		if tier.MinUSDAmount != "" {
+			if !usdAmountLoaded {
+				usdAmount = p.usdAmount(tokenAddr, rawAmount)
+				usdAmountLoaded = true
+			}
+			minUSDAmount, _ := big.NewFloat(0).SetString(tier.MinUSDAmount)
+			if usdAmount != nil && usdAmount.Cmp(minUSDAmount) < 0 {
+				continue
+			}
+		}
+		required = tier.ConfirmNum
+	}
+	return required
+}
+
+// usdAmount returns the usd value of the amount, or nil if the price or the decimals of the token is unknown
+func (p *ConfirmPolicy) usdAmount(tokenAddr string, amount *big.Int) *big.Float {
+	if amount == nil {
+		return nil
+	}
+
+	var swapPair model.SwapPair
+	err := p.db.Where("erc20_addr = ? or bep20_addr = ?", tokenAddr, tokenAddr).First(&swapPair).Error
+	if err != nil {
+		util.Logger.Debugf("query swap pair of %s error, err=%s", tokenAddr, err.Error())
+		return nil
+	}
+	usdPrice, ok := p.usdPrices[strings.ToLower(swapPair.ERC20Addr)]
+	if !ok {
+		usdPrice, ok = p.usdPrices[strings.ToLower(swapPair.BEP20Addr)]
+	}
+	if !ok {
+		return nil
+	}
+
+	unit := big.NewInt(0).Exp(big.NewInt(10), big.NewInt(int64(swapPair.Decimals)), nil)
+	value := big.NewFloat(0).Quo(big.NewFloat(0).SetInt(amount), big.NewFloat(0).SetInt(unit))
+	return value.Mul(value, usdPrice)
+}
+
+// IsConfirmed returns true if a tx packed at txHeight has the required confirm number when the chain is at
+// headHeight, or if its block is finalized when the chain follows a finality tag
+func (p *ConfirmPolicy) IsConfirmed(requiredConfirmNum, txHeight, headHeight int64) (bool, error) {
+	if p.finalityReader != nil {
+		taggedHeight, err := p.getTaggedHeight()
+		if err != nil {
+			return false, err
+		}
+		return txHeight <= taggedHeight, nil
+	}
+	return headHeight-txHeight+1 >= requiredConfirmNum, nil
+}
+
+func (p *ConfirmPolicy) getTaggedHeight() (int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if time.Since(p.taggedTime) < TaggedHeightCacheTime {
+		return p.taggedHeight, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TaggedHeightTimeout)
+	defer cancel()
+	taggedHeight, err := p.finalityReader.BlockNumberByTag(ctx, p.finalityTag)
+	if err != nil {
+		return 0, fmt.Errorf("get %s %s block error, err=%s", p.chain, p.finalityTag, err.Error())
+	}
+	p.taggedHeight = taggedHeight
+	p.taggedTime = time.Now()
+	return taggedHeight, nil
+}
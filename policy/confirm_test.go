@@ -0,0 +1,109 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+const (
+	testERC20Addr = "0x0000000000000000000000000000000000000e20"
+	testBEP20Addr = "0x0000000000000000000000000000000000000b20"
+	testOtherAddr = "0x0000000000000000000000000000000000000001"
+)
+
+func newTestConfirmPolicy(t *testing.T, tiers []util.ConfirmTier) *ConfirmPolicy {
+	db, err := gorm.Open(common.DBDialectSqlite3, ":memory:")
+	if err != nil {
+		t.Fatalf("open db error: %s", err.Error())
+	}
+	db.DB().SetMaxOpenConns(1)
+	model.InitTables(db)
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Create(&model.SwapPair{ERC20Addr: testERC20Addr, BEP20Addr: testBEP20Addr, Decimals: 18}).Error; err != nil {
+		t.Fatalf("create swap pair error: %s", err.Error())
+	}
+
+	cfg := &util.Config{ChainConfig: util.ChainConfig{
+		BSCConfirmNum:   15,
+		BSCConfirmTiers: tiers,
+		TokenUSDPrices:  map[string]string{testERC20Addr: "2"},
+	}}
+	policy, err := NewConfirmPolicy(common.ChainBSC, db, cfg, nil)
+	if err != nil {
+		t.Fatalf("new confirm policy error: %s", err.Error())
+	}
+	return policy
+}
+
+func TestRequiredConfirmNum(t *testing.T) {
+	policy := newTestConfirmPolicy(t, []util.ConfirmTier{
+		{MinAmount: "1000", ConfirmNum: 20},
+		{Token: testBEP20Addr, MinAmount: "500", ConfirmNum: 30},
+		// 100 tokens of 18 decimals at 2 usd
+		{MinUSDAmount: "200", ConfirmNum: 50},
+		{MinAmount: "100", ConfirmNum: 10},
+	})
+	tests := []struct {
+		name      string
+		tokenAddr string
+		amount    string
+		want      int64
+	}{
+		{"below the tiers", testERC20Addr, "99", 15},
+		{"a tier below the chain confirm number", testERC20Addr, "100", 15},
+		{"amount tier", testERC20Addr, "1000", 20},
+		{"token tier of the other token", testERC20Addr, "500", 15},
+		{"token tier", testBEP20Addr, "500", 30},
+		{"largest of the reached tiers", testBEP20Addr, "1000", 30},
+		{"below the usd tier", testBEP20Addr, "99000000000000000000", 30},
+		{"usd tier", testBEP20Addr, "100000000000000000000", 50},
+		{"usd tier by the erc20 price", testERC20Addr, "100000000000000000000", 50},
+		// a tier can't be skipped by the amount the policy can't value
+		{"unknown usd price", testOtherAddr, "1", 50},
+		{"invalid amount", testERC20Addr, "1e30", 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if required := policy.RequiredConfirmNum(tt.tokenAddr, tt.amount); required != tt.want {
+				t.Fatalf("required confirm number is %d, want %d", required, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequiredConfirmNumWithoutTiers(t *testing.T) {
+	policy := newTestConfirmPolicy(t, nil)
+	if required := policy.RequiredConfirmNum(testERC20Addr, "100000000000000000000"); required != 15 {
+		t.Fatalf("required confirm number is %d, want 15", required)
+	}
+}
+
+func TestIsConfirmed(t *testing.T) {
+	policy := newTestConfirmPolicy(t, nil)
+	tests := []struct {
+		required   int64
+		headHeight int64
+		want       bool
+	}{
+		{15, 114, true},
+		{15, 113, false},
+		{1, 100, true},
+		{30, 128, false},
+	}
+	for _, tt := range tests {
+		confirmed, err := policy.IsConfirmed(tt.required, 100, tt.headHeight)
+		if err != nil {
+			t.Fatalf("is confirmed error: %s", err.Error())
+		}
+		if confirmed != tt.want {
+			t.Errorf("tx at 100 with head %d is confirmed %v for %d confirms, want %v", tt.headHeight, confirmed, tt.required, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package provider
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	ethcmm "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Client is the chain client used by the executors and the swap engines. Both *ethclient.Client and *Pool
+// implement it.
+type Client interface {
+	bind.ContractBackend
+	ethereum.ChainReader
+	ethereum.TransactionReader
+
+	ChainID(ctx context.Context) (*big.Int, error)
+	BalanceAt(ctx context.Context, account ethcmm.Address, blockNumber *big.Int) (*big.Int, error)
+	NonceAt(ctx context.Context, account ethcmm.Address, blockNumber *big.Int) (uint64, error)
+}
+
+// FinalityReader is implemented by the clients which can read the blocks labeled by the finality tags of
+// post-merge ethereum
+type FinalityReader interface {
+	BlockNumberByTag(ctx context.Context, tag string) (int64, error)
+}
+
+// FeeReader is implemented by the clients which can read the fee paid by the mined txs
+type FeeReader interface {
+	// EffectiveGasPrice returns the gas price paid by the mined tx, it is nil if the node doesn't report it
+	EffectiveGasPrice(ctx context.Context, txHash ethcmm.Hash) (*big.Int, error)
+}
+
+var _ Client = (*ethclient.Client)(nil)
+var _ Client = (*Pool)(nil)
+var _ FinalityReader = (*Pool)(nil)
+var _ FeeReader = (*Pool)(nil)
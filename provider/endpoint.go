@@ -0,0 +1,159 @@
+package provider
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// weight of the latest sample in the moving averages of latency and error rate
+	HealthSmoothingFactor = 0.2
+
+	// a healthy endpoint with an error rate of 100% is scored like an endpoint which is that many ms slower
+	ErrorRatePenaltyMs = 10000
+	// an endpoint lagging behind by one block is scored like an endpoint which is that many ms slower
+	HeadLagPenaltyMs = 1000
+)
+
+// Endpoint is a provider of the pool with its health statistics
+type Endpoint struct {
+	Url       string
+	client    *ethclient.Client
+	rpcClient *rpc.Client
+
+	mutex          sync.RWMutex
+	latency        float64
+	errorRate      float64
+	head           int64
+	headLag        int64
+	totalRequests  int64
+	failedRequests int64
+	lastError      string
+	lastErrorTime  int64
+}
+
+// EndpointHealth is the health statistics of an endpoint exposed to the operators
+type EndpointHealth struct {
+	Url            string  `json:"url"`
+	LatencyMs      float64 `json:"latency_ms"`
+	ErrorRate      float64 `json:"error_rate"`
+	Head           int64   `json:"head"`
+	HeadLag        int64   `json:"head_lag"`
+	TotalRequests  int64   `json:"total_requests"`
+	FailedRequests int64   `json:"failed_requests"`
+	LastError      string  `json:"last_error"`
+	LastErrorTime  int64   `json:"last_error_time"`
+	Score          float64 `json:"score"`
+}
+
+func newEndpoint(rawUrl string) (*Endpoint, error) {
+	rpcClient, err := rpc.Dial(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &Endpoint{
+		Url:       rawUrl,
+		client:    ethclient.NewClient(rpcClient),
+		rpcClient: rpcClient,
+	}, nil
+}
+
+// subscribable tells whether the endpoint supports subscriptions, the http endpoints don't
+func (e *Endpoint) subscribable() bool {
+	parsed, err := url.Parse(e.Url)
+	if err != nil {
+		return false
+	}
+	// the same schemes as rpc.Dial, an url without scheme is an ipc path
+	return parsed.Scheme != "http" && parsed.Scheme != "https"
+}
+
+// isEndpointFailure returns false if the error is returned by the node itself, e.g. a not found error or a json
+// rpc error, in which case the endpoint is healthy and the request should not be sent to the other endpoints
+func isEndpointFailure(err error) bool {
+	if err == nil || err == ethereum.NotFound {
+		return false
+	}
+	var rpcErr rpc.Error
+	return !errors.As(err, &rpcErr)
+}
+
+func (e *Endpoint) record(latency time.Duration, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	failed := isEndpointFailure(err)
+
+	e.totalRequests++
+	e.latency = e.latency*(1-HealthSmoothingFactor) + float64(latency.Milliseconds())*HealthSmoothingFactor
+	sample := 0.0
+	if failed {
+		sample = 1.0
+		e.failedRequests++
+		e.lastError = err.Error()
+		e.lastErrorTime = time.Now().Unix()
+	}
+	e.errorRate = e.errorRate*(1-HealthSmoothingFactor) + sample*HealthSmoothingFactor
+}
+
+func (e *Endpoint) setHead(head int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.head = head
+}
+
+func (e *Endpoint) setHeadLag(headLag int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.headLag = headLag
+}
+
+func (e *Endpoint) getHead() int64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.head
+}
+
+// score returns the health score of the endpoint, the lower the better
+func (e *Endpoint) score() float64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.latency + e.errorRate*ErrorRatePenaltyMs + float64(e.headLag)*HeadLagPenaltyMs
+}
+
+func (e *Endpoint) health() EndpointHealth {
+	score := e.score()
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return EndpointHealth{
+		Url:            maskUrl(e.Url),
+		LatencyMs:      e.latency,
+		ErrorRate:      e.errorRate,
+		Head:           e.head,
+		HeadLag:        e.headLag,
+		TotalRequests:  e.totalRequests,
+		FailedRequests: e.failedRequests,
+		LastError:      e.lastError,
+		LastErrorTime:  e.lastErrorTime,
+		Score:          score,
+	}
+}
+
+// maskUrl hides the path and the query of the url for they usually carry the api key of the provider
+func maskUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Host == "" {
+		return "invalid url"
+	}
+	if parsed.Path == "" && parsed.RawQuery == "" {
+		return parsed.Scheme + "://" + parsed.Host
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/***"
+}
@@ -0,0 +1,568 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	ethcmm "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+const (
+	HealthCheckInterval = 10 * time.Second
+	HealthCheckTimeout  = 5 * time.Second
+	// the timeout of a request to one endpoint, the request fails over to the next endpoint after it
+	EndpointCallTimeout = 15 * time.Second
+)
+
+// Pool routes the requests to the healthiest endpoint of a chain and fails over to the next one when an endpoint
+// is unavailable. The receipts and the head block can be required to be agreed by a quorum of endpoints.
+type Pool struct {
+	chain     string
+	endpoints []*Endpoint
+	quorum    int
+
+	lifecycle util.Lifecycle
+}
+
+// NewPool dials all the endpoints of the chain, quorum is the number of endpoints which need to agree on the
+// receipts and the head block, 0 or 1 disables it
+func NewPool(chain string, urls []string, quorum int) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no provider of %s", chain)
+	}
+	if quorum > len(urls) {
+		return nil, fmt.Errorf("quorum %d of %s is larger than the number of providers %d", quorum, chain, len(urls))
+	}
+
+	endpoints := make([]*Endpoint, 0, len(urls))
+	for _, url := range urls {
+		endpoint, err := newEndpoint(url)
+		if err != nil {
+			return nil, fmt.Errorf("dial %s provider %s error, err=%s", chain, maskUrl(url), err.Error())
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return &Pool{
+		chain:     chain,
+		endpoints: endpoints,
+		quorum:    quorum,
+	}, nil
+}
+
+// Start starts the routine refreshing the head lag of the endpoints
+func (p *Pool) Start(ctx context.Context) {
+	p.lifecycle.Start(ctx)
+	p.lifecycle.Go(p.healthCheckDaemon)
+}
+
+// Stop stops the health check and closes the connections of the endpoints
+func (p *Pool) Stop() error {
+	err := p.lifecycle.Stop(common.ShutdownTimeout)
+	for _, endpoint := range p.endpoints {
+		endpoint.client.Close()
+	}
+	return err
+}
+
+func (p *Pool) GetChainName() string {
+	return p.chain
+}
+
+// Health returns the health statistics of all the endpoints
+func (p *Pool) Health() []EndpointHealth {
+	healths := make([]EndpointHealth, 0, len(p.endpoints))
+	for _, endpoint := range p.endpoints {
+		healths = append(healths, endpoint.health())
+	}
+	return healths
+}
+
+func (p *Pool) healthCheckDaemon() {
+	for !p.lifecycle.Stopping() {
+		p.checkHeads()
+		p.lifecycle.Sleep(HealthCheckInterval)
+	}
+}
+
+func (p *Pool) checkHeads() {
+	var wg sync.WaitGroup
+	for _, endpoint := range p.endpoints {
+		wg.Add(1)
+		go func(endpoint *Endpoint) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			header, err := endpoint.client.HeaderByNumber(ctx, nil)
+			endpoint.record(time.Since(start), err)
+			if err != nil {
+				util.Logger.Debugf("%s provider %s health check error, err=%s", p.chain, maskUrl(endpoint.Url), err.Error())
+				return
+			}
+			endpoint.setHead(header.Number.Int64())
+		}(endpoint)
+	}
+	wg.Wait()
+
+	maxHead := int64(0)
+	for _, endpoint := range p.endpoints {
+		if head := endpoint.getHead(); head > maxHead {
+			maxHead = head
+		}
+	}
+	for _, endpoint := range p.endpoints {
+		endpoint.setHeadLag(maxHead - endpoint.getHead())
+	}
+}
+
+// sortedEndpoints returns the endpoints from the healthiest to the least healthy
+func (p *Pool) sortedEndpoints() []*Endpoint {
+	endpoints := make([]*Endpoint, len(p.endpoints))
+	copy(endpoints, p.endpoints)
+
+	scores := make(map[*Endpoint]float64, len(endpoints))
+	for _, endpoint := range endpoints {
+		scores[endpoint] = endpoint.score()
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return scores[endpoints[i]] < scores[endpoints[j]]
+	})
+	return endpoints
+}
+
+// call sends the request to the endpoints in the order of health until one of them serves it
+func (p *Pool) call(ctx context.Context, fn func(ctx context.Context, client *ethclient.Client) error) error {
+	return p.callEndpoint(ctx, p.sortedEndpoints(), func(ctx context.Context, endpoint *Endpoint) error {
+		return fn(ctx, endpoint.client)
+	})
+}
+
+// callRPC is the same as call, it is used by the requests which ethclient doesn't support
+func (p *Pool) callRPC(ctx context.Context, fn func(ctx context.Context, client *rpc.Client) error) error {
+	return p.callEndpoint(ctx, p.sortedEndpoints(), func(ctx context.Context, endpoint *Endpoint) error {
+		return fn(ctx, endpoint.rpcClient)
+	})
+}
+
+// subscribe is the same as call, the request is only sent to the endpoints supporting subscriptions
+func (p *Pool) subscribe(ctx context.Context, fn func(ctx context.Context, client *ethclient.Client) error) error {
+	endpoints := make([]*Endpoint, 0, len(p.endpoints))
+	for _, endpoint := range p.sortedEndpoints() {
+		if endpoint.subscribable() {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no %s provider supports subscriptions", p.chain)
+	}
+	return p.callEndpoint(ctx, endpoints, func(ctx context.Context, endpoint *Endpoint) error {
+		return fn(ctx, endpoint.client)
+	})
+}
+
+// callEndpoint sends the request to the endpoints in order, every attempt has its own timeout so that a hanging
+// endpoint doesn't use up the time of the next ones. The attempt ended by the caller canceling ctx is not recorded
+// against the health of the endpoint.
+func (p *Pool) callEndpoint(ctx context.Context, endpoints []*Endpoint, fn func(ctx context.Context, endpoint *Endpoint) error) error {
+	var err error
+	for _, endpoint := range endpoints {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				err = ctxErr
+			}
+			return err
+		}
+		start := time.Now()
+		err = p.callAttempt(ctx, endpoint, fn)
+		if ctx.Err() != nil {
+			return err
+		}
+		endpoint.record(time.Since(start), err)
+		if !isEndpointFailure(err) {
+			return err
+		}
+		util.Logger.Debugf("%s provider %s failure, try the next one, err=%s", p.chain, maskUrl(endpoint.Url), err.Error())
+	}
+	return err
+}
+
+func (p *Pool) callAttempt(ctx context.Context, endpoint *Endpoint, fn func(ctx context.Context, endpoint *Endpoint) error) error {
+	attemptCtx, cancel := context.WithTimeout(ctx, EndpointCallTimeout)
+	defer cancel()
+	return fn(attemptCtx, endpoint)
+}
+
+type quorumResponse struct {
+	endpoint *Endpoint
+	result   interface{}
+	err      error
+}
+
+// callQuorum sends the request to the endpoints in the order of health until the quorum of them serve it
+func (p *Pool) callQuorum(ctx context.Context, fn func(ctx context.Context, client *ethclient.Client) (interface{}, error)) ([]quorumResponse, error) {
+	responses := make([]quorumResponse, 0, p.quorum)
+	var err error
+	for _, endpoint := range p.sortedEndpoints() {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		start := time.Now()
+		var result interface{}
+		err = p.callAttempt(ctx, endpoint, func(ctx context.Context, endpoint *Endpoint) error {
+			var err error
+			result, err = fn(ctx, endpoint.client)
+			return err
+		})
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		endpoint.record(time.Since(start), err)
+		if isEndpointFailure(err) {
+			continue
+		}
+		responses = append(responses, quorumResponse{endpoint: endpoint, result: result, err: err})
+		if len(responses) == p.quorum {
+			return responses, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("not enough providers")
+	}
+	return nil, fmt.Errorf("%s quorum of %d providers is not reached, err=%s", p.chain, p.quorum, err.Error())
+}
+
+// TransactionReceipt returns the receipt of the tx, if the quorum is enabled the receipt must be the same on the
+// quorum of endpoints
+func (p *Pool) TransactionReceipt(ctx context.Context, txHash ethcmm.Hash) (*types.Receipt, error) {
+	if p.quorum <= 1 {
+		var receipt *types.Receipt
+		err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+			var err error
+			receipt, err = client.TransactionReceipt(ctx, txHash)
+			return err
+		})
+		return receipt, err
+	}
+
+	responses, err := p.callQuorum(ctx, func(ctx context.Context, client *ethclient.Client) (interface{}, error) {
+		return client.TransactionReceipt(ctx, txHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var agreed *types.Receipt
+	for _, response := range responses {
+		if response.err != nil {
+			return nil, response.err
+		}
+		receipt := response.result.(*types.Receipt)
+		if agreed == nil {
+			agreed = receipt
+			continue
+		}
+		if agreed.BlockHash != receipt.BlockHash || agreed.Status != receipt.Status {
+			return nil, fmt.Errorf("receipt of %s is not agreed by %d %s providers", txHash.String(), p.quorum, p.chain)
+		}
+	}
+	return agreed, nil
+}
+
+// HeaderByNumber returns the header of the given height. If the number is nil and the quorum is enabled, the
+// highest block reached by all the quorum endpoints is returned after checking its hash on them.
+func (p *Pool) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number != nil || p.quorum <= 1 {
+		var header *types.Header
+		err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+			var err error
+			header, err = client.HeaderByNumber(ctx, number)
+			return err
+		})
+		return header, err
+	}
+
+	responses, err := p.callQuorum(ctx, func(ctx context.Context, client *ethclient.Client) (interface{}, error) {
+		return client.HeaderByNumber(ctx, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var agreed *types.Header
+	for _, response := range responses {
+		if response.err != nil {
+			return nil, response.err
+		}
+		header := response.result.(*types.Header)
+		if agreed == nil || header.Number.Cmp(agreed.Number) < 0 {
+			agreed = header
+		}
+	}
+	for _, response := range responses {
+		header := response.result.(*types.Header)
+		if header.Number.Cmp(agreed.Number) != 0 {
+			start := time.Now()
+			err = p.callAttempt(ctx, response.endpoint, func(ctx context.Context, endpoint *Endpoint) error {
+				var err error
+				header, err = endpoint.client.HeaderByNumber(ctx, agreed.Number)
+				return err
+			})
+			if ctx.Err() == nil {
+				response.endpoint.record(time.Since(start), err)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if header.Hash() != agreed.Hash() {
+			return nil, fmt.Errorf("head block %s is not agreed by %d %s providers", agreed.Number.String(), p.quorum, p.chain)
+		}
+	}
+	return agreed, nil
+}
+
+// BlockNumberByTag returns the height of the block labeled by the tag, e.g. safe or finalized on post-merge
+// ethereum. Only the number is decoded for the headers carry fields unknown to the go-ethereum version in use.
+func (p *Pool) BlockNumberByTag(ctx context.Context, tag string) (int64, error) {
+	var height int64
+	err := p.callRPC(ctx, func(ctx context.Context, client *rpc.Client) error {
+		var head *struct {
+			Number *hexutil.Big `json:"number"`
+		}
+		if err := client.CallContext(ctx, &head, "eth_getBlockByNumber", tag, false); err != nil {
+			return err
+		}
+		if head == nil || head.Number == nil {
+			return ethereum.NotFound
+		}
+		height = head.Number.ToInt().Int64()
+		return nil
+	})
+	return height, err
+}
+
+// EffectiveGasPrice returns the gas price paid by the mined tx. Only the field is decoded for the receipts of the
+// go-ethereum version in use don't carry it.
+func (p *Pool) EffectiveGasPrice(ctx context.Context, txHash ethcmm.Hash) (*big.Int, error) {
+	var gasPrice *big.Int
+	err := p.callRPC(ctx, func(ctx context.Context, client *rpc.Client) error {
+		var receipt *struct {
+			EffectiveGasPrice *hexutil.Big `json:"effectiveGasPrice"`
+		}
+		if err := client.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash); err != nil {
+			return err
+		}
+		if receipt == nil {
+			return ethereum.NotFound
+		}
+		if receipt.EffectiveGasPrice != nil {
+			gasPrice = receipt.EffectiveGasPrice.ToInt()
+		}
+		return nil
+	})
+	return gasPrice, err
+}
+
+func (p *Pool) ChainID(ctx context.Context) (*big.Int, error) {
+	var chainID *big.Int
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		chainID, err = client.ChainID(ctx)
+		return err
+	})
+	return chainID, err
+}
+
+func (p *Pool) BlockByHash(ctx context.Context, hash ethcmm.Hash) (*types.Block, error) {
+	var block *types.Block
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		block, err = client.BlockByHash(ctx, hash)
+		return err
+	})
+	return block, err
+}
+
+func (p *Pool) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	var block *types.Block
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		block, err = client.BlockByNumber(ctx, number)
+		return err
+	})
+	return block, err
+}
+
+func (p *Pool) HeaderByHash(ctx context.Context, hash ethcmm.Hash) (*types.Header, error) {
+	var header *types.Header
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		header, err = client.HeaderByHash(ctx, hash)
+		return err
+	})
+	return header, err
+}
+
+func (p *Pool) TransactionCount(ctx context.Context, blockHash ethcmm.Hash) (uint, error) {
+	var count uint
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		count, err = client.TransactionCount(ctx, blockHash)
+		return err
+	})
+	return count, err
+}
+
+func (p *Pool) TransactionInBlock(ctx context.Context, blockHash ethcmm.Hash, index uint) (*types.Transaction, error) {
+	var tx *types.Transaction
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		tx, err = client.TransactionInBlock(ctx, blockHash, index)
+		return err
+	})
+	return tx, err
+}
+
+func (p *Pool) TransactionByHash(ctx context.Context, txHash ethcmm.Hash) (*types.Transaction, bool, error) {
+	var tx *types.Transaction
+	var isPending bool
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		tx, isPending, err = client.TransactionByHash(ctx, txHash)
+		return err
+	})
+	return tx, isPending, err
+}
+
+// SubscribeNewHead subscribes on the healthiest endpoint supporting subscriptions, i.e. a websocket or ipc endpoint
+func (p *Pool) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	var sub ethereum.Subscription
+	err := p.subscribe(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		sub, err = client.SubscribeNewHead(ctx, ch)
+		return err
+	})
+	return sub, err
+}
+
+// SubscribeFilterLogs subscribes on the healthiest endpoint supporting subscriptions, i.e. a websocket or ipc endpoint
+func (p *Pool) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	var sub ethereum.Subscription
+	err := p.subscribe(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		sub, err = client.SubscribeFilterLogs(ctx, query, ch)
+		return err
+	})
+	return sub, err
+}
+
+func (p *Pool) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		logs, err = client.FilterLogs(ctx, query)
+		return err
+	})
+	return logs, err
+}
+
+func (p *Pool) BalanceAt(ctx context.Context, account ethcmm.Address, blockNumber *big.Int) (*big.Int, error) {
+	var balance *big.Int
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		balance, err = client.BalanceAt(ctx, account, blockNumber)
+		return err
+	})
+	return balance, err
+}
+
+func (p *Pool) NonceAt(ctx context.Context, account ethcmm.Address, blockNumber *big.Int) (uint64, error) {
+	var nonce uint64
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		nonce, err = client.NonceAt(ctx, account, blockNumber)
+		return err
+	})
+	return nonce, err
+}
+
+func (p *Pool) CodeAt(ctx context.Context, contract ethcmm.Address, blockNumber *big.Int) ([]byte, error) {
+	var code []byte
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		code, err = client.CodeAt(ctx, contract, blockNumber)
+		return err
+	})
+	return code, err
+}
+
+func (p *Pool) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	var result []byte
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		result, err = client.CallContract(ctx, call, blockNumber)
+		return err
+	})
+	return result, err
+}
+
+func (p *Pool) PendingCodeAt(ctx context.Context, account ethcmm.Address) ([]byte, error) {
+	var code []byte
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		code, err = client.PendingCodeAt(ctx, account)
+		return err
+	})
+	return code, err
+}
+
+func (p *Pool) PendingNonceAt(ctx context.Context, account ethcmm.Address) (uint64, error) {
+	var nonce uint64
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		nonce, err = client.PendingNonceAt(ctx, account)
+		return err
+	})
+	return nonce, err
+}
+
+func (p *Pool) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	var gasPrice *big.Int
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		gasPrice, err = client.SuggestGasPrice(ctx)
+		return err
+	})
+	return gasPrice, err
+}
+
+func (p *Pool) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	var gas uint64
+	err := p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		var err error
+		gas, err = client.EstimateGas(ctx, call)
+		return err
+	})
+	return gas, err
+}
+
+// SendTransaction broadcasts the tx through the healthiest endpoint, the signed tx is sent to the next endpoint
+// only if the previous one is unavailable, a rejection from the node is returned directly
+func (p *Pool) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	return p.call(ctx, func(ctx context.Context, client *ethclient.Client) error {
+		return client.SendTransaction(ctx, tx)
+	})
+}
@@ -0,0 +1,89 @@
+package screening
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+type jsonEntry struct {
+	Address string `json:"address"`
+	List    string `json:"list"`
+	Reason  string `json:"reason"`
+}
+
+// ParseAddresses parses the entries of a csv or json file. A csv row is "address[,list[,reason]]" with an optional
+// header, and a json file is an array of {"address", "list", "reason"}. The entries without a list go to
+// defaultList.
+func ParseAddresses(content []byte, format string, defaultList model.AddressList, source string) ([]model.ScreenedAddress, error) {
+	var rows []jsonEntry
+	switch strings.ToLower(format) {
+	case FormatCSV:
+		reader := csv.NewReader(bytes.NewReader(content))
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		for line := 1; ; line++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(record) == 0 || record[0] == "" {
+				continue
+			}
+			if line == 1 && strings.EqualFold(record[0], "address") {
+				continue
+			}
+			row := jsonEntry{Address: record[0]}
+			if len(record) > 1 {
+				row.List = record[1]
+			}
+			if len(record) > 2 {
+				row.Reason = record[2]
+			}
+			rows = append(rows, row)
+		}
+	case FormatJSON:
+		if err := json.Unmarshal(content, &rows); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %s, csv or json", format)
+	}
+
+	entries := make([]model.ScreenedAddress, 0, len(rows))
+	for idx, row := range rows {
+		address := strings.TrimSpace(row.Address)
+		if !ethcom.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid address %s of entry %d", row.Address, idx+1)
+		}
+		list := model.AddressList(strings.ToLower(strings.TrimSpace(row.List)))
+		if list == "" {
+			list = defaultList
+		}
+		if list != model.AddressBlocked && list != model.AddressAllowed {
+			return nil, fmt.Errorf("invalid list %s of entry %d, block or allow", row.List, idx+1)
+		}
+		entries = append(entries, model.ScreenedAddress{
+			Address: ethcom.HexToAddress(address).String(),
+			List:    list,
+			Reason:  row.Reason,
+			Source:  source,
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,110 @@
+package screening
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+const (
+	ScreenTimeout = 10 * time.Second
+)
+
+// Result is the verdict of the screening on an address
+type Result struct {
+	Flagged bool
+	Reason  string
+}
+
+// Provider screens the addresses against the lists it maintains, e.g. an external compliance API
+type Provider interface {
+	Name() string
+	Screen(ctx context.Context, address ethcom.Address) (*Result, error)
+}
+
+// Screener screens the addresses by the allowlist and the blocklist in the db first, and asks the providers in
+// order if the address is on neither list. An address is flagged if any provider flags it.
+type Screener struct {
+	db        *gorm.DB
+	providers []Provider
+}
+
+func NewScreener(db *gorm.DB, providers ...Provider) *Screener {
+	return &Screener{
+		db:        db,
+		providers: providers,
+	}
+}
+
+// Screen returns the verdict on the address, the caller should retry later on error rather than let the address
+// pass
+func (s *Screener) Screen(address string) (*Result, error) {
+	if !ethcom.IsHexAddress(address) {
+		return &Result{Flagged: true, Reason: fmt.Sprintf("invalid address %s", address)}, nil
+	}
+	addr := ethcom.HexToAddress(address)
+
+	entry := model.ScreenedAddress{}
+	err := s.db.Where("address = ?", addr.String()).First(&entry).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	if err == nil {
+		switch entry.List {
+		case model.AddressAllowed:
+			return &Result{}, nil
+		case model.AddressBlocked:
+			return &Result{Flagged: true, Reason: fmt.Sprintf("address %s is on the blocklist: %s", addr.String(), entry.Reason)}, nil
+		}
+	}
+
+	for _, provider := range s.providers {
+		ctx, cancel := context.WithTimeout(context.Background(), ScreenTimeout)
+		result, err := provider.Screen(ctx, addr)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("screen address %s by %s error: %s", addr.String(), provider.Name(), err.Error())
+		}
+		if result.Flagged {
+			return &Result{Flagged: true, Reason: fmt.Sprintf("address %s is flagged by %s: %s", addr.String(), provider.Name(), result.Reason)}, nil
+		}
+	}
+	return &Result{}, nil
+}
+
+// SaveAddresses adds the entries to the lists, the entry of an address already listed is replaced
+func SaveAddresses(db *gorm.DB, entries []model.ScreenedAddress) error {
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		existing := model.ScreenedAddress{}
+		err := tx.Where("address = ?", entry.Address).First(&existing).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			tx.Rollback()
+			return err
+		}
+		if err == nil {
+			entry.ID = existing.ID
+			entry.CreatedAt = existing.CreatedAt
+		}
+		if err := tx.Save(&entry).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// RemoveAddress removes the address from the list it is on
+func RemoveAddress(db *gorm.DB, address string) error {
+	return db.Unscoped().Where("address = ?", ethcom.HexToAddress(address).String()).Delete(model.ScreenedAddress{}).Error
+}
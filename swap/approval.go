@@ -0,0 +1,207 @@
+package swap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// PendingApprovalSwap is a swap waiting for the approvers with the decisions made so far
+type PendingApprovalSwap struct {
+	Swap              model.Swap           `json:"swap"`
+	Approvals         []model.SwapApproval `json:"approvals"`
+	RequiredApprovals int                  `json:"required_approvals"`
+}
+
+func (engine *SwapEngine) getSwapApprovalHMAC(approval *model.SwapApproval) string {
+	material := fmt.Sprintf("%d#%s#%s#%s",
+		approval.SwapID, approval.StartTxHash, approval.Approver, approval.Decision)
+	mac := hmac.New(sha256.New, []byte(engine.hmacCKey))
+	mac.Write([]byte(material))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (engine *SwapEngine) verifySwapApproval(approval *model.SwapApproval) bool {
+	return approval.RecordHash == engine.getSwapApprovalHMAC(approval)
+}
+
+func (engine *SwapEngine) requiredApprovals() int {
+	if engine.config.AdminConfig.RequiredApprovals <= 0 {
+		return 1
+	}
+	return engine.config.AdminConfig.RequiredApprovals
+}
+
+// isApprovalRequired tells whether the swap is above the approval threshold of its pair. The threshold is read
+// from the db so that the update takes effect on the next swap to fill.
+func (engine *SwapEngine) isApprovalRequired(swap *model.Swap) (bool, error) {
+	swapPair := model.SwapPair{}
+	err := engine.db.Where("erc20_addr = ?", swap.ERC20Addr).First(&swapPair).Error
+	if err != nil {
+		return false, err
+	}
+	if swapPair.ApprovalThreshold == "" {
+		return false, nil
+	}
+	threshold, ok := big.NewInt(0).SetString(swapPair.ApprovalThreshold, 10)
+	if !ok {
+		return false, fmt.Errorf("invalid approval threshold %s of swap pair %s", swapPair.ApprovalThreshold, swapPair.ERC20Addr)
+	}
+	amount, ok := big.NewInt(0).SetString(swap.Amount, 10)
+	if !ok {
+		return false, fmt.Errorf("invalid swap amount: %s", swap.Amount)
+	}
+	return amount.Cmp(threshold) > 0, nil
+}
+
+// getApprovers returns the approvers who approve the swap, the records failing the hmac verification are ignored
+func (engine *SwapEngine) getApprovers(tx *gorm.DB, swapID uint) ([]string, error) {
+	approvals := make([]model.SwapApproval, 0)
+	err := tx.Where("swap_id = ? and decision = ?", swapID, model.ApprovalApproved).Order("id asc").Find(&approvals).Error
+	if err != nil {
+		return nil, err
+	}
+	approvers := make([]string, 0, len(approvals))
+	for _, approval := range approvals {
+		if !engine.verifySwapApproval(&approval) {
+			util.Logger.Errorf("verify hmac of approval %d of swap %d failed", approval.ID, swapID)
+			util.SendTelegramMessage(fmt.Sprintf("Urgent alert: verify hmac of approval %d of swap %d failed", approval.ID, swapID))
+			continue
+		}
+		approvers = append(approvers, approval.Approver)
+	}
+	return approvers, nil
+}
+
+// checkApproval tells whether the confirmed swap can be filled. The swap above the approval threshold of its pair
+// without enough approvals is moved to pending approval.
+func (engine *SwapEngine) checkApproval(swap *model.Swap) (bool, error) {
+	required, err := engine.isApprovalRequired(swap)
+	if err != nil || !required {
+		return !required, err
+	}
+	approvers, err := engine.getApprovers(engine.db, swap.ID)
+	if err != nil {
+		return false, err
+	}
+	if len(approvers) >= engine.requiredApprovals() {
+		return true, nil
+	}
+
+	swap.Log = "waiting for approval"
+	pending, err := engine.commitSwapTransition(swap, SwapPendingApproval, Transition{Reason: swap.Log, Actor: ActorFillDispatcher})
+	if err != nil || !pending {
+		return false, err
+	}
+
+	msg := fmt.Sprintf("swap %s is waiting for approval, id %d, direction %s, sponsor %s, token %s, amount %s",
+		swap.StartTxHash, swap.ID, swap.Direction, swap.Sponsor, swap.ERC20Addr, swap.Amount)
+	util.Logger.Infof(msg)
+	util.SendTelegramMessage(msg)
+	return false, nil
+}
+
+// ApproveSwap records the approval of the approver, the swap is sent to the fill workers once the required
+// number of distinct approvers approve it
+func (engine *SwapEngine) ApproveSwap(swapID uint, approver, comment string) (*model.Swap, error) {
+	return engine.decideSwap(swapID, approver, comment, model.ApprovalApproved)
+}
+
+// RejectSwap records the rejection of the approver, the swap is never filled once rejected
+func (engine *SwapEngine) RejectSwap(swapID uint, approver, comment string) (*model.Swap, error) {
+	return engine.decideSwap(swapID, approver, comment, model.ApprovalRejected)
+}
+
+func (engine *SwapEngine) decideSwap(swapID uint, approver, comment string, decision model.ApprovalDecision) (*model.Swap, error) {
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	swap := model.Swap{}
+	if err := tx.Where("id = ?", swapID).First(&swap).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !engine.verifySwap(&swap) {
+		tx.Rollback()
+		return nil, fmt.Errorf("verify hmac of swap failed: %s", swap.StartTxHash)
+	}
+	if swap.Status != SwapPendingApproval {
+		tx.Rollback()
+		return nil, fmt.Errorf("swap %d is not pending approval, status %s", swapID, swap.Status)
+	}
+
+	approval := &model.SwapApproval{
+		SwapID:      swap.ID,
+		StartTxHash: swap.StartTxHash,
+		Approver:    approver,
+		Decision:    decision,
+		Comment:     comment,
+	}
+	approval.RecordHash = engine.getSwapApprovalHMAC(approval)
+	if err := tx.Create(approval).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("record the decision of %s on swap %d error: %s", approver, swapID, err.Error())
+	}
+
+	if decision == model.ApprovalRejected {
+		swap.Log = fmt.Sprintf("rejected by %s", approver)
+		if _, err := engine.transitSwap(tx, &swap, SwapApprovalRejected, Transition{Reason: swap.Log, Actor: approver}); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	} else {
+		approvers, err := engine.getApprovers(tx, swap.ID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if len(approvers) >= engine.requiredApprovals() {
+			swap.Log = fmt.Sprintf("approved by %s", strings.Join(approvers, ", "))
+			if _, err := engine.transitSwap(tx, &swap, SwapConfirmed, Transition{Reason: swap.Log, Actor: approver}); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	util.Logger.Infof("swap %s is %s by %s, status %s", swap.StartTxHash, decision, approver, swap.Status)
+	return &swap, nil
+}
+
+// GetPendingApprovalSwaps returns the swaps waiting for the approvers in the order they are received
+func (engine *SwapEngine) GetPendingApprovalSwaps() ([]PendingApprovalSwap, error) {
+	swaps := make([]model.Swap, 0)
+	err := engine.db.Where("status = ?", SwapPendingApproval).Order("id asc").Find(&swaps).Error
+	if err != nil {
+		return nil, err
+	}
+
+	pendingSwaps := make([]PendingApprovalSwap, 0, len(swaps))
+	for _, swap := range swaps {
+		approvals := make([]model.SwapApproval, 0)
+		err := engine.db.Where("swap_id = ?", swap.ID).Order("id asc").Find(&approvals).Error
+		if err != nil {
+			return nil, err
+		}
+		pendingSwaps = append(pendingSwaps, PendingApprovalSwap{
+			Swap:              swap,
+			Approvals:         approvals,
+			RequiredApprovals: engine.requiredApprovals(),
+		})
+	}
+	return pendingSwaps, nil
+}
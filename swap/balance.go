@@ -0,0 +1,234 @@
+package swap
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+type BalanceLevel string
+
+const (
+	BalanceUnknown  BalanceLevel = "unknown"
+	BalanceOK       BalanceLevel = "ok"
+	BalanceWarning  BalanceLevel = "warning"
+	BalanceCritical BalanceLevel = "critical"
+	// the fills of the chain are paused until the balance is topped up
+	BalanceBelowFloor BalanceLevel = "below_floor"
+)
+
+// the severity of the levels, an alert is sent when the level changes
+var balanceLevelSeverity = map[BalanceLevel]int{
+	BalanceUnknown:    0,
+	BalanceOK:         0,
+	BalanceWarning:    1,
+	BalanceCritical:   2,
+	BalanceBelowFloor: 3,
+}
+
+// BalanceReport is the native balance of the tss account of a chain and how many fills it covers
+type BalanceReport struct {
+	Chain    string `json:"chain"`
+	Account  string `json:"account"`
+	Balance  string `json:"balance"`
+	GasPrice string `json:"gas_price"`
+	// the average gas used by the recent fill txs
+	FillGas      uint64       `json:"fill_gas"`
+	FillsCovered int64        `json:"fills_covered"`
+	Level        BalanceLevel `json:"level"`
+	CheckTime    int64        `json:"check_time"`
+	ErrMsg       string       `json:"err_msg,omitempty"`
+}
+
+// balanceMonitorDaemon checks the native balances of the tss accounts periodically, alerts when their levels
+// change and pauses the fills of the chain whose balance is below the floor
+func (engine *SwapEngine) balanceMonitorDaemon() {
+	interval := time.Duration(engine.config.ChainConfig.BalanceMonitorInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultBalanceMonitorInterval
+	}
+	for {
+		engine.checkBalance(common.ChainBSC)
+		engine.checkBalance(common.ChainETH)
+		if !engine.lifecycle.Sleep(interval) {
+			return
+		}
+	}
+}
+
+func (engine *SwapEngine) checkBalance(chain string) {
+	client, account := engine.bscClient, engine.bscTxSender
+	direction := SwapEth2BSC
+	thresholds := []struct {
+		level  BalanceLevel
+		amount string
+	}{
+		{BalanceBelowFloor, engine.config.ChainConfig.BSCBalanceFloor},
+		{BalanceCritical, engine.config.ChainConfig.BSCCriticalThreshold},
+		{BalanceWarning, engine.config.ChainConfig.BSCAlertThreshold},
+	}
+	if chain == common.ChainETH {
+		client, account = engine.ethClient, engine.ethTxSender
+		direction = SwapBSC2Eth
+		thresholds[0].amount = engine.config.ChainConfig.ETHBalanceFloor
+		thresholds[1].amount = engine.config.ChainConfig.ETHCriticalThreshold
+		thresholds[2].amount = engine.config.ChainConfig.ETHAlertThreshold
+	}
+
+	report := &BalanceReport{
+		Chain:     chain,
+		Account:   account.String(),
+		Level:     BalanceUnknown,
+		CheckTime: time.Now().Unix(),
+	}
+	err := func() error {
+		balance, err := queryBalance(client, account)
+		if err != nil {
+			return err
+		}
+		report.Balance = balance.String()
+
+		report.Level = BalanceOK
+		for _, threshold := range thresholds {
+			if threshold.amount == "" {
+				continue
+			}
+			amount, _ := big.NewInt(0).SetString(threshold.amount, 10)
+			if balance.Cmp(amount) < 0 {
+				report.Level = threshold.level
+				break
+			}
+		}
+
+		fee, err := engine.suggestTxFee(chain)
+		if err != nil {
+			return err
+		}
+		report.GasPrice = fee.GasPrice.String()
+		report.FillGas = engine.getAverageFillGas(direction)
+		fillFee := big.NewInt(0).Mul(fee.GasPrice, big.NewInt(0).SetUint64(report.FillGas))
+		if fillFee.Sign() > 0 {
+			report.FillsCovered = big.NewInt(0).Div(balance, fillFee).Int64()
+		}
+		return nil
+	}()
+	if err != nil {
+		util.Logger.Errorf("check balance of %s tss account %s error: %s", chain, account.String(), err.Error())
+		report.ErrMsg = err.Error()
+	}
+
+	engine.balanceMutex.Lock()
+	last, ok := engine.balances[chain]
+	if report.Level == BalanceUnknown && ok {
+		// the level stays until the balance is known again
+		report.Level = last.Level
+	}
+	engine.balances[chain] = report
+	engine.balanceMutex.Unlock()
+
+	lastLevel := BalanceUnknown
+	if ok {
+		lastLevel = last.Level
+	}
+	if report.Level == lastLevel || report.Level == BalanceUnknown {
+		return
+	}
+	if balanceLevelSeverity[report.Level] > balanceLevelSeverity[lastLevel] {
+		msg := fmt.Sprintf("Urgent alert: balance of %s tss account %s is %s, balance %s, about %d fills are covered at gas price %s",
+			chain, report.Account, report.Level, report.Balance, report.FillsCovered, report.GasPrice)
+		if report.Level == BalanceBelowFloor {
+			msg += ", the fills are paused"
+		}
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+	} else if lastLevel != BalanceUnknown {
+		msg := fmt.Sprintf("balance of %s tss account %s recovers to %s, balance %s, about %d fills are covered at gas price %s",
+			chain, report.Account, report.Level, report.Balance, report.FillsCovered, report.GasPrice)
+		util.Logger.Infof(msg)
+		util.SendTelegramMessage(msg)
+	}
+}
+
+func queryBalance(client provider.Client, account ethcom.Address) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BalanceQueryTimeout)
+	defer cancel()
+	return client.BalanceAt(ctx, account, nil)
+}
+
+// getAverageFillGas returns the average gas used by the recent successful fill txs of the direction
+func (engine *SwapEngine) getAverageFillGas(direction common.SwapDirection) uint64 {
+	fillTxs := make([]model.SwapFillTx, 0)
+	engine.db.Where("direction = ? and status = ?", direction, model.FillTxSuccess).Order("id desc").
+		Limit(BalanceFillGasSamples).Find(&fillTxs)
+
+	totalGas := big.NewInt(0)
+	samples := int64(0)
+	for _, fillTx := range fillTxs {
+		fee, ok := big.NewInt(0).SetString(fillTx.ConsumedFeeAmount, 10)
+		if !ok {
+			continue
+		}
+		gasPrice, ok := big.NewInt(0).SetString(fillTx.GasPrice, 10)
+		if !ok || gasPrice.Sign() <= 0 {
+			continue
+		}
+		totalGas.Add(totalGas, fee.Div(fee, gasPrice))
+		samples++
+	}
+	if samples == 0 {
+		return DefaultFillGas
+	}
+	return totalGas.Div(totalGas, big.NewInt(samples)).Uint64()
+}
+
+// isFillPaused tells whether the fills of the direction are paused for the balance of the tss account filling
+// them is below the floor
+func (engine *SwapEngine) isFillPaused(direction common.SwapDirection) bool {
+	chain := common.ChainETH
+	if direction == SwapEth2BSC {
+		chain = common.ChainBSC
+	}
+	return engine.isChainPaused(chain)
+}
+
+// isChainPaused tells whether the txs sent to the chain are paused for the balance of the tss account is below the
+// floor. The manual withdrawals and nonce replacements of the admin are not paused.
+func (engine *SwapEngine) isChainPaused(chain string) bool {
+	engine.balanceMutex.RLock()
+	defer engine.balanceMutex.RUnlock()
+	report, ok := engine.balances[chain]
+	return ok && report.Level == BalanceBelowFloor
+}
+
+// pausedFillDirections returns the directions whose fills are paused, the swaps of them are left in the db until
+// the balance is topped up
+func (engine *SwapEngine) pausedFillDirections() []common.SwapDirection {
+	directions := make([]common.SwapDirection, 0, 2)
+	for _, direction := range []common.SwapDirection{SwapEth2BSC, SwapBSC2Eth} {
+		if engine.isFillPaused(direction) {
+			directions = append(directions, direction)
+		}
+	}
+	return directions
+}
+
+// BalanceReports returns the last balance reports of the tss accounts
+func (engine *SwapEngine) BalanceReports() []BalanceReport {
+	engine.balanceMutex.RLock()
+	defer engine.balanceMutex.RUnlock()
+	reports := make([]BalanceReport, 0, len(engine.balances))
+	for _, chain := range []string{common.ChainBSC, common.ChainETH} {
+		if report, ok := engine.balances[chain]; ok {
+			reports = append(reports, *report)
+		}
+	}
+	return reports
+}
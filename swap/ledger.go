@@ -0,0 +1,263 @@
+package swap
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	ethcom "github.com/ethereum/go-ethereum/common"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/ledger"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// bookLedgerDaemon books the fees collected by the swaps and the gas spent by the txs of the tss accounts once they
+// are final, i.e. the start txs are confirmed and the receipts of the txs are seen. The rows not booked yet are
+// found by the ledger entries, so the records before the ledger are booked too.
+func (engine *SwapEngine) bookLedgerDaemon() {
+	for engine.lifecycle.Sleep(SleepTime * time.Second) {
+		for _, book := range []func() ([]*ledger.Record, error){
+			engine.swapFeeRecords,
+			engine.fillGasRecords,
+			engine.retryGasRecords,
+			engine.createPairGasRecords,
+			engine.withdrawGasRecords,
+			engine.refundGasRecords,
+		} {
+			if engine.lifecycle.Stopping() {
+				return
+			}
+			records, err := book()
+			if err != nil {
+				util.Logger.Errorf("collect ledger records error: %s", err.Error())
+				continue
+			}
+			if len(records) == 0 {
+				continue
+			}
+			if err := ledger.Book(engine.db, records...); err != nil {
+				util.Logger.Errorf("book %d ledger records error: %s", len(records), err.Error())
+				continue
+			}
+			util.Logger.Debugf("booked %d %s ledger records", len(records), records[0].Category)
+		}
+	}
+}
+
+// the chain the swap agent collects the fee on, and the chain the tss account fills on
+func swapChains(direction common.SwapDirection) (string, string) {
+	if direction == SwapEth2BSC {
+		return common.ChainETH, common.ChainBSC
+	}
+	return common.ChainBSC, common.ChainETH
+}
+
+func (engine *SwapEngine) swapFeeRecords() ([]*ledger.Record, error) {
+	swaps := make([]model.Swap, 0)
+	err := engine.db.Where("start_tx_hash in (?) and start_tx_hash not in (?)", confirmedStartTxLogs(engine.db),
+		ledger.BookedTxHashes(engine.db, model.LedgerSwapFee)).Order("id asc").Limit(BatchSize).Find(&swaps).Error
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*ledger.Record, 0, len(swaps))
+	for _, swap := range swaps {
+		feeAmount := swap.FeeAmount
+		// the swaps created before the fee is recorded on them
+		if feeAmount == "" {
+			startTxLog := model.SwapStartTxLog{}
+			if err := engine.db.Where("tx_hash = ?", swap.StartTxHash).First(&startTxLog).Error; err != nil {
+				return nil, err
+			}
+			feeAmount = startTxLog.FeeAmount
+		}
+		chain, _ := swapChains(swap.Direction)
+		records = append(records, &ledger.Record{
+			Category:  model.LedgerSwapFee,
+			SourceID:  swap.ID,
+			Chain:     chain,
+			Token:     swap.ERC20Addr,
+			Symbol:    swap.Symbol,
+			Direction: swap.Direction,
+			Amount:    feeAmount,
+			TxHash:    swap.StartTxHash,
+			BookTime:  swap.CreatedAt.Unix(),
+		})
+	}
+	return records, nil
+}
+
+func (engine *SwapEngine) fillGasRecords() ([]*ledger.Record, error) {
+	fillTxs := make([]model.SwapFillTx, 0)
+	err := engine.db.Where("status in (?) and height > 0 and id not in (?)", []model.FillTxStatus{model.FillTxSuccess, model.FillTxFailed},
+		ledger.BookedSources(engine.db, model.LedgerFillGas)).Order("id asc").Limit(BatchSize).Find(&fillTxs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*ledger.Record, 0, len(fillTxs))
+	for _, fillTx := range fillTxs {
+		swap, err := engine.getSwapByStartTxHash(engine.db, fillTx.StartSwapTxHash)
+		if err != nil {
+			return nil, err
+		}
+		_, chain := swapChains(fillTx.Direction)
+		records = append(records, &ledger.Record{
+			Category:  model.LedgerFillGas,
+			SourceID:  fillTx.ID,
+			Chain:     chain,
+			Token:     swap.ERC20Addr,
+			Symbol:    swap.Symbol,
+			Direction: fillTx.Direction,
+			Amount:    fillTx.ConsumedFeeAmount,
+			TxHash:    fillTx.FillSwapTxHash,
+			BookTime:  fillTx.CreatedAt.Unix(),
+		})
+	}
+	return records, nil
+}
+
+func (engine *SwapEngine) retryGasRecords() ([]*ledger.Record, error) {
+	retryTxs := make([]model.RetrySwapTx, 0)
+	err := engine.db.Where("status in (?) and height > 0 and id not in (?)", []model.FillRetryTxStatus{model.FillRetryTxSuccess, model.FillRetryTxFailed},
+		ledger.BookedSources(engine.db, model.LedgerRetryGas)).Order("id asc").Limit(BatchSize).Find(&retryTxs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*ledger.Record, 0, len(retryTxs))
+	for _, retryTx := range retryTxs {
+		retrySwap := model.RetrySwap{}
+		if err := engine.db.Where("id = ?", retryTx.RetrySwapID).First(&retrySwap).Error; err != nil {
+			return nil, err
+		}
+		_, chain := swapChains(retryTx.Direction)
+		records = append(records, &ledger.Record{
+			Category:  model.LedgerRetryGas,
+			SourceID:  retryTx.ID,
+			Chain:     chain,
+			Token:     retrySwap.ERC20Addr,
+			Symbol:    retrySwap.Symbol,
+			Direction: retryTx.Direction,
+			Amount:    retryTx.ConsumedFeeAmount,
+			TxHash:    retryTx.RetryFillSwapTxHash,
+			BookTime:  retryTx.CreatedAt.Unix(),
+		})
+	}
+	return records, nil
+}
+
+func (engine *SwapEngine) createPairGasRecords() ([]*ledger.Record, error) {
+	createTxs := make([]model.SwapPairCreatTx, 0)
+	err := engine.db.Where("status in (?) and height > 0 and id not in (?)", []model.FillTxStatus{model.FillTxSuccess, model.FillTxFailed},
+		ledger.BookedSources(engine.db, model.LedgerCreatePairGas)).Order("id asc").Limit(BatchSize).Find(&createTxs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*ledger.Record, 0, len(createTxs))
+	for _, createTx := range createTxs {
+		records = append(records, &ledger.Record{
+			Category: model.LedgerCreatePairGas,
+			SourceID: createTx.ID,
+			Chain:    common.ChainBSC,
+			Token:    createTx.ERC20Addr,
+			Symbol:   createTx.Symbol,
+			Amount:   createTx.ConsumedFeeAmount,
+			TxHash:   createTx.SwapPairCreatTxHash,
+			BookTime: createTx.CreatedAt.Unix(),
+		})
+	}
+	return records, nil
+}
+
+func (engine *SwapEngine) refundGasRecords() ([]*ledger.Record, error) {
+	refunds := make([]model.SwapRefund, 0)
+	err := engine.db.Where("status in (?) and height > 0 and refund_tx_hash != '' and id not in (?)", []common.RefundStatus{RefundSuccess, RefundSendFailed},
+		ledger.BookedSources(engine.db, model.LedgerRefundGas)).Order("id asc").Limit(BatchSize).Find(&refunds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*ledger.Record, 0, len(refunds))
+	for _, refund := range refunds {
+		records = append(records, &ledger.Record{
+			Category:  model.LedgerRefundGas,
+			SourceID:  refund.ID,
+			Chain:     refund.Chain,
+			Token:     refund.ERC20Addr,
+			Symbol:    refund.Symbol,
+			Direction: refund.Direction,
+			Amount:    refund.ConsumedFeeAmount,
+			TxHash:    refund.RefundTxHash,
+			BookTime:  refund.CreatedAt.Unix(),
+		})
+	}
+	return records, nil
+}
+
+// withdrawGasRecords books the withdraw txs whose nonces are consumed, the gas is read from their receipts for they
+// are not tracked otherwise. A withdraw tx without receipt is booked after a while only, it is replaced by another tx
+// of the nonce and spends no gas.
+func (engine *SwapEngine) withdrawGasRecords() ([]*ledger.Record, error) {
+	nonces := make([]model.TxNonce, 0)
+	err := engine.db.Where("purpose = ? and status = ? and id not in (?)", NoncePurposeWithdraw, model.NonceConsumed,
+		ledger.BookedSources(engine.db, model.LedgerWithdrawGas)).Order("id asc").Limit(BatchSize).Find(&nonces).Error
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*ledger.Record, 0, len(nonces))
+	for _, nonce := range nonces {
+		client := engine.bscClient
+		if nonce.Chain == common.ChainETH {
+			client = engine.ethClient
+		}
+		record := &ledger.Record{
+			Category: model.LedgerWithdrawGas,
+			SourceID: uint(nonce.Id),
+			Chain:    nonce.Chain,
+			Amount:   "0",
+			TxHash:   nonce.TxHash,
+			BookTime: nonce.UpdateTime,
+		}
+		txHash := ethcom.HexToHash(nonce.TxHash)
+		receipt, err := client.TransactionReceipt(context.Background(), txHash)
+		if err != nil && err != ethereum.NotFound {
+			return nil, err
+		}
+		// the receipt may be missing for a moment on the node lagging behind
+		if err == ethereum.NotFound && time.Since(time.Unix(nonce.UpdateTime, 0)) < LedgerReceiptTimeout {
+			continue
+		}
+		if err == nil {
+			withdrawTx, _, err := client.TransactionByHash(context.Background(), txHash)
+			if err != nil {
+				return nil, err
+			}
+			// the token is empty for the native token withdrawn
+			if len(withdrawTx.Data()) > 0 && withdrawTx.To() != nil {
+				record.Token, record.Symbol = engine.getTokenSymbol(*withdrawTx.To())
+			}
+			record.Amount = consumedFee(client, receipt, withdrawTx.GasPrice().String())
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// getTokenSymbol returns the erc20 addr and the symbol of the swap pair of the erc20 or the bep20
+func (engine *SwapEngine) getTokenSymbol(tokenAddr ethcom.Address) (string, string) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	erc20Addr := tokenAddr
+	if addr, ok := engine.bep20ToERC20[tokenAddr]; ok {
+		erc20Addr = addr
+	}
+	if pair, ok := engine.swapPairsFromERC20Addr[erc20Addr]; ok {
+		return erc20Addr.String(), pair.Symbol
+	}
+	return tokenAddr.String(), ""
+}
@@ -0,0 +1,257 @@
+package swap
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
+
+	contractabi "github.com/binance-chain/bsc-eth-swap/abi"
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// LiquidityReport compares the erc20 locked in the eth swap agent with the bep20 minted for it
+type LiquidityReport struct {
+	Symbol    string `json:"symbol"`
+	ERC20Addr string `json:"erc20_addr"`
+	BEP20Addr string `json:"bep20_addr"`
+	// the erc20 balance of the eth swap agent
+	Locked string `json:"locked"`
+	// the total supply of the bep20, which can be swapped back to erc20
+	BEP20Supply string `json:"bep20_supply"`
+	// the erc20 to be released by the unmined fills of the bsc to eth swaps and reserved for the released swaps
+	InFlight       string `json:"in_flight"`
+	AwaitingSwaps  int    `json:"awaiting_swaps"`
+	AwaitingAmount string `json:"awaiting_amount"`
+	ErrMsg         string `json:"err_msg,omitempty"`
+}
+
+// sumSwapAmounts returns the total amount and the number of the swaps found by the query
+func sumSwapAmounts(query *gorm.DB) (*big.Int, int, error) {
+	amounts := make([]string, 0)
+	if err := query.Pluck("amount", &amounts).Error; err != nil {
+		return nil, 0, err
+	}
+	total := big.NewInt(0)
+	for _, amount := range amounts {
+		swapAmount, ok := big.NewInt(0).SetString(amount, 10)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid swap amount: %s", amount)
+		}
+		total.Add(total, swapAmount)
+	}
+	return total, len(amounts), nil
+}
+
+// getAvailableLiquidity returns the erc20 balance of the eth swap agent which is not to be released by the bsc to
+// eth swaps being filled, nor reserved for the released swaps other than the excluded one
+func (engine *SwapEngine) getAvailableLiquidity(erc20Addr string, excludedSwapID uint) (*big.Int, error) {
+	token, err := contractabi.NewERC20(ethcom.HexToAddress(erc20Addr), engine.ethClient)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := token.BalanceOf(&bind.CallOpts{}, engine.ethSwapAgent)
+	if err != nil {
+		return nil, err
+	}
+	inFlight, err := engine.getInFlightAmount(erc20Addr, excludedSwapID)
+	if err != nil {
+		return nil, err
+	}
+	return balance.Sub(balance, inFlight), nil
+}
+
+// getInFlightAmount returns the erc20 to be released by the bsc to eth swaps and retry swaps being filled. A fill
+// tx releases the erc20 once it is mined, which is seen by its SwapFilled event before the swap succeeds, so only
+// the fills without the event are counted. The swaps released from waiting for liquidity are counted until they are
+// claimed, so that the liquidity covering them is not taken by a later swap, except the excluded one being claimed.
+func (engine *SwapEngine) getInFlightAmount(erc20Addr string, excludedSwapID uint) (*big.Int, error) {
+	minedFills := engine.db.Model(model.SwapFillTxLog{}).Select("start_tx_hash").Where("chain = ?", common.ChainETH).QueryExpr()
+
+	inFlight, _, err := sumSwapAmounts(engine.db.Model(model.Swap{}).Where("direction = ? and erc20_addr = ?", SwapBSC2Eth, erc20Addr).
+		Where("status = ? or (status = ? and start_tx_hash not in (?))", SwapSending, SwapSent, minedFills))
+	if err != nil {
+		return nil, err
+	}
+	retryInFlight, _, err := sumSwapAmounts(engine.db.Model(model.RetrySwap{}).Where("direction = ? and erc20_addr = ?", SwapBSC2Eth, erc20Addr).
+		Where("status = ? or (status = ? and start_tx_hash not in (?))", RetrySwapSending, RetrySwapSent, minedFills))
+	if err != nil {
+		return nil, err
+	}
+	releasedSwapIDs := engine.db.Model(model.SwapStatusHistory{}).Select("entity_id").
+		Where("entity = ? and actor = ? and to_status = ?", model.StatusEntitySwap, ActorLiquidityReleaser, SwapConfirmed).QueryExpr()
+	released, _, err := sumSwapAmounts(engine.db.Model(model.Swap{}).Where("direction = ? and erc20_addr = ?", SwapBSC2Eth, erc20Addr).
+		Where("status = ? and id <> ? and id in (?)", SwapConfirmed, excludedSwapID, releasedSwapIDs))
+	if err != nil {
+		return nil, err
+	}
+	inFlight.Add(inFlight, retryInFlight)
+	return inFlight.Add(inFlight, released), nil
+}
+
+// checkLiquidity tells whether the eth swap agent holds enough erc20 to fill the bsc to eth swap. The swap waits for
+// the liquidity if it can't be covered or an earlier swap of the token is waiting, so that they are filled in the
+// order they are received.
+func (engine *SwapEngine) checkLiquidity(swap *model.Swap) (bool, error) {
+	if swap.Direction != SwapBSC2Eth {
+		return true, nil
+	}
+
+	var earlierAwaiting int
+	err := engine.db.Model(model.Swap{}).Where("id < ? and erc20_addr = ? and status = ?", swap.ID, swap.ERC20Addr, SwapAwaitingLiquidity).
+		Count(&earlierAwaiting).Error
+	if err != nil {
+		return false, err
+	}
+	if earlierAwaiting > 0 {
+		return false, engine.awaitLiquidity(swap, fmt.Sprintf("%d earlier swaps are waiting for liquidity", earlierAwaiting))
+	}
+
+	available, err := engine.getAvailableLiquidity(swap.ERC20Addr, swap.ID)
+	if err != nil {
+		return false, err
+	}
+	amount, ok := big.NewInt(0).SetString(swap.Amount, 10)
+	if !ok {
+		return false, fmt.Errorf("invalid swap amount: %s", swap.Amount)
+	}
+	if available.Cmp(amount) >= 0 {
+		return true, nil
+	}
+
+	reason := fmt.Sprintf("the available liquidity %s is less than the swap amount", available.String())
+	if err := engine.awaitLiquidity(swap, reason); err != nil {
+		return false, err
+	}
+	// the alert is sent once when the token runs out of liquidity
+	msg := fmt.Sprintf("Urgent alert: liquidity of %s %s in the eth swap agent is insufficient, available %s, swap %s of amount %s is waiting",
+		swap.Symbol, swap.ERC20Addr, available.String(), swap.StartTxHash, swap.Amount)
+	util.Logger.Errorf(msg)
+	util.SendTelegramMessage(msg)
+	return false, nil
+}
+
+func (engine *SwapEngine) awaitLiquidity(swap *model.Swap, reason string) error {
+	swap.Log = reason
+	awaiting, err := engine.commitSwapTransition(swap, SwapAwaitingLiquidity, Transition{Reason: reason, Actor: ActorFillDispatcher})
+	if err != nil || !awaiting {
+		return err
+	}
+	util.Logger.Infof("swap %s is waiting for liquidity, %s", swap.StartTxHash, reason)
+	return nil
+}
+
+// releaseAwaitingLiquidityDaemon sends the swaps waiting for liquidity back to the fill workers in the order they
+// are received, as many as the available liquidity of their tokens covers
+func (engine *SwapEngine) releaseAwaitingLiquidityDaemon() {
+	for engine.lifecycle.Sleep(SleepTime * time.Second) {
+		swaps := make([]model.Swap, 0)
+		engine.db.Where("status = ?", SwapAwaitingLiquidity).Order("id asc").Find(&swaps)
+
+		swapsByToken := make(map[string][]model.Swap)
+		for _, swap := range swaps {
+			swapsByToken[swap.ERC20Addr] = append(swapsByToken[swap.ERC20Addr], swap)
+		}
+		for erc20Addr, tokenSwaps := range swapsByToken {
+			if engine.lifecycle.Stopping() {
+				break
+			}
+			available, err := engine.getAvailableLiquidity(erc20Addr, 0)
+			if err != nil {
+				util.Logger.Errorf("query liquidity of %s error: %s", erc20Addr, err.Error())
+				continue
+			}
+			for _, swap := range tokenSwaps {
+				if !engine.verifySwap(&swap) {
+					util.Logger.Errorf("verify hmac of swap failed: %s", swap.StartTxHash)
+					break
+				}
+				amount, ok := big.NewInt(0).SetString(swap.Amount, 10)
+				if !ok || available.Cmp(amount) < 0 {
+					break
+				}
+				if err := engine.releaseAwaitingSwap(&swap); err != nil {
+					util.Logger.Errorf("release swap %s waiting for liquidity error: %s", swap.StartTxHash, err.Error())
+					break
+				}
+				available.Sub(available, amount)
+				util.Logger.Infof("swap %s waiting for liquidity is released, amount %s", swap.StartTxHash, swap.Amount)
+			}
+		}
+	}
+}
+
+func (engine *SwapEngine) releaseAwaitingSwap(swap *model.Swap) error {
+	swap.Log = "released for the liquidity is enough"
+	_, err := engine.commitSwapTransition(swap, SwapConfirmed, Transition{Reason: swap.Log, Actor: ActorLiquidityReleaser})
+	return err
+}
+
+// LiquidityReports returns the erc20 locked in the eth swap agent and the bep20 minted for every swap pair
+func (engine *SwapEngine) LiquidityReports() []LiquidityReport {
+	engine.mutex.RLock()
+	pairs := make([]*SwapPairIns, 0, len(engine.swapPairsFromERC20Addr))
+	for _, pair := range engine.swapPairsFromERC20Addr {
+		pairs = append(pairs, pair)
+	}
+	engine.mutex.RUnlock()
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Symbol < pairs[j].Symbol
+	})
+
+	reports := make([]LiquidityReport, 0, len(pairs))
+	for _, pair := range pairs {
+		report := LiquidityReport{
+			Symbol:    pair.Symbol,
+			ERC20Addr: pair.ERC20Addr.String(),
+			BEP20Addr: pair.BEP20Addr.String(),
+		}
+		err := func() error {
+			erc20, err := contractabi.NewERC20(pair.ERC20Addr, engine.ethClient)
+			if err != nil {
+				return err
+			}
+			locked, err := erc20.BalanceOf(&bind.CallOpts{}, engine.ethSwapAgent)
+			if err != nil {
+				return err
+			}
+			report.Locked = locked.String()
+
+			bep20, err := contractabi.NewERC20(pair.BEP20Addr, engine.bscClient)
+			if err != nil {
+				return err
+			}
+			supply, err := bep20.TotalSupply(&bind.CallOpts{})
+			if err != nil {
+				return err
+			}
+			report.BEP20Supply = supply.String()
+
+			inFlight, err := engine.getInFlightAmount(report.ERC20Addr, 0)
+			if err != nil {
+				return err
+			}
+			report.InFlight = inFlight.String()
+
+			awaitingAmount, awaitingSwaps, err := sumSwapAmounts(engine.db.Model(model.Swap{}).Where("erc20_addr = ? and status = ?",
+				report.ERC20Addr, SwapAwaitingLiquidity))
+			if err != nil {
+				return err
+			}
+			report.AwaitingAmount = awaitingAmount.String()
+			report.AwaitingSwaps = awaitingSwaps
+			return nil
+		}()
+		if err != nil {
+			report.ErrMsg = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
@@ -0,0 +1,58 @@
+package swap
+
+import (
+	"testing"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+func TestInFlightAmountCountsReleasedSwaps(t *testing.T) {
+	engine := &SwapEngine{db: newTestDB(t), hmacCKey: "test", config: &util.Config{}}
+	createSwap := func(startTxHash string, status common.SwapStatus, amount string) *model.Swap {
+		swap := &model.Swap{Status: status, Direction: SwapBSC2Eth, StartTxHash: startTxHash, ERC20Addr: testERC20Addr, Amount: amount}
+		swap.RecordHash = engine.getSwapHMAC(swap)
+		if err := engine.db.Create(swap).Error; err != nil {
+			t.Fatalf("create swap error: %s", err.Error())
+		}
+		return swap
+	}
+	released := createSwap("0x01", SwapAwaitingLiquidity, "100")
+	if err := engine.releaseAwaitingSwap(released); err != nil {
+		t.Fatalf("release swap error: %s", err.Error())
+	}
+	later := createSwap("0x02", SwapConfirmed, "50")
+
+	tests := []struct {
+		name           string
+		excludedSwapID uint
+		want           string
+	}{
+		// the liquidity covering the released swap is not available to the later swap
+		{"later swap", later.ID, "100"},
+		{"released swap", released.ID, "0"},
+	}
+	for _, tt := range tests {
+		inFlight, err := engine.getInFlightAmount(testERC20Addr, tt.excludedSwapID)
+		if err != nil {
+			t.Fatalf("get in-flight amount error: %s", err.Error())
+		}
+		if inFlight.String() != tt.want {
+			t.Errorf("in-flight amount for the %s is %s, want %s", tt.name, inFlight.String(), tt.want)
+		}
+	}
+
+	// the claimed swap is counted once as being filled
+	claimed, err := engine.claimSwap(released)
+	if err != nil || !claimed {
+		t.Fatalf("released swap is claimed %v, err=%v, want claimed", claimed, err)
+	}
+	inFlight, err := engine.getInFlightAmount(testERC20Addr, later.ID)
+	if err != nil {
+		t.Fatalf("get in-flight amount error: %s", err.Error())
+	}
+	if inFlight.String() != "100" {
+		t.Fatalf("in-flight amount after the claim is %s, want 100", inFlight.String())
+	}
+}
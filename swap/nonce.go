@@ -0,0 +1,491 @@
+package swap
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+var errNonceTaken = errors.New("nonce is taken by another reservation")
+
+// the errors of the nodes rejecting a tx, they are matched in lower case. Nonce too low is not one of them, the
+// endpoint failed over to returns it for the tx relayed by the endpoint which timed out.
+var txRejectedErrorPatterns = []string{
+	"underpriced",
+	"insufficient funds",
+	"intrinsic gas too low",
+	"exceeds block gas limit",
+	"invalid sender",
+	"oversized data",
+}
+
+// NonceManager reserves the nonces of a sender account in the db, so that the txs sent by the engines, the
+// retries and the withdrawals never share a nonce, even if they are sent by different processes
+type NonceManager struct {
+	chain  string
+	sender ethcom.Address
+	db     *gorm.DB
+	client provider.Client
+
+	mutex    sync.Mutex
+	gapNonce int64
+	gapCount int
+}
+
+// NonceReport is the state of the nonces of a sender account exposed to the operators
+type NonceReport struct {
+	Chain        string `json:"chain"`
+	Sender       string `json:"sender"`
+	LatestNonce  int64  `json:"latest_nonce"`
+	PendingNonce int64  `json:"pending_nonce"`
+	// the missing nonce which blocks the sent txs, -1 if there is none
+	GapNonce     int64           `json:"gap_nonce"`
+	Reservations []model.TxNonce `json:"reservations"`
+}
+
+func NewNonceManager(chain string, sender ethcom.Address, db *gorm.DB, client provider.Client) *NonceManager {
+	return &NonceManager{
+		chain:    chain,
+		sender:   sender,
+		db:       db,
+		client:   client,
+		gapNonce: -1,
+	}
+}
+
+// Use reserves a nonce and passes it to send, which builds, records and broadcasts the tx. send returns the signed tx
+// even if its broadcast fails, see Finish.
+func (m *NonceManager) Use(purpose string, send func(nonce uint64) (*types.Transaction, error)) error {
+	reservation, err := m.Reserve(purpose)
+	if err != nil {
+		return err
+	}
+	signedTx, err := send(uint64(reservation.Nonce))
+	m.Finish(reservation, signedTx, err)
+	return err
+}
+
+// Reserve reserves a nonce for a tx which is broadcast later, the reservation is finished by Finish. The nonces
+// are reserved in order, so the txs reserved one after another are broadcast in the order of their nonces.
+func (m *NonceManager) Reserve(purpose string) (*model.TxNonce, error) {
+	reservation, err := m.reserve(purpose)
+	if err != nil {
+		return nil, fmt.Errorf("reserve %s nonce error, err=%s", m.chain, err.Error())
+	}
+	return reservation, nil
+}
+
+// Replace reserves a nonce which is not mined yet for a replacement tx, e.g. a tx with a higher gas price, without
+// blocking the reservations of the other nonces. The hash of the replaced tx is passed to send, it is empty if the
+// nonce was never sent, e.g. a gap left by another tool.
+func (m *NonceManager) Replace(nonce int64, purpose string, send func(nonce uint64, replacedTxHash string) (*types.Transaction, error)) error {
+	reservation, err := m.reserveReplacement(nonce, purpose)
+	if err != nil {
+		return fmt.Errorf("reserve %s nonce %d for replacement error, err=%s", m.chain, nonce, err.Error())
+	}
+	signedTx, err := send(uint64(reservation.Nonce), reservation.TxHash)
+	m.Finish(reservation, signedTx, err)
+	return err
+}
+
+// Finish marks the reserved nonce as sent with the hash of the broadcast tx, or releases it for the next tx if no tx
+// is signed or the node rejects the tx. A tx whose broadcast fails otherwise, e.g. by a timeout, may be in the
+// mempool already, its nonce is kept as sent and left to the reconciliation.
+func (m *NonceManager) Finish(reservation *model.TxNonce, signedTx *types.Transaction, sendErr error) {
+	if signedTx == nil || (sendErr != nil && isTxRejected(sendErr)) {
+		if err := m.release(reservation); err != nil {
+			util.Logger.Errorf("release %s nonce %d of %s error, err=%s", m.chain, reservation.Nonce, m.sender.String(), err.Error())
+		}
+		return
+	}
+
+	err := m.db.Model(model.TxNonce{}).Where("id = ?", reservation.Id).Updates(
+		map[string]interface{}{
+			"status":      model.NonceSent,
+			"tx_hash":     signedTx.Hash().String(),
+			"update_time": time.Now().Unix(),
+		}).Error
+	if err != nil {
+		// the tx is broadcast, the reservation is consumed by the reconciliation once the tx is mined
+		util.Logger.Errorf("mark %s nonce %d of %s as sent error, err=%s", m.chain, reservation.Nonce, m.sender.String(), err.Error())
+	}
+}
+
+// isTxRejected tells whether the error is the node rejecting the tx, so that the tx is surely not broadcast
+func isTxRejected(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range txRejectedErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// release gives the nonce back for the next reservation, a failed replacement restores the replaced tx instead
+func (m *NonceManager) release(reservation *model.TxNonce) error {
+	status := model.NonceReleased
+	if reservation.TxHash != "" {
+		status = model.NonceSent
+	}
+	return m.db.Model(model.TxNonce{}).Where("id = ?", reservation.Id).Updates(
+		map[string]interface{}{
+			"status":      status,
+			"update_time": time.Now().Unix(),
+		}).Error
+}
+
+func (m *NonceManager) chainNonces() (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), NonceQueryTimeout)
+	defer cancel()
+
+	latestNonce, err := m.client.NonceAt(ctx, m.sender, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	pendingNonce, err := m.client.PendingNonceAt(ctx, m.sender)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(latestNonce), int64(pendingNonce), nil
+}
+
+func (m *NonceManager) reserve(purpose string) (*model.TxNonce, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	latestNonce, pendingNonce, err := m.chainNonces()
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < NonceReserveMaxAttempts; attempt++ {
+		reservation, err := m.tryReserve(purpose, latestNonce, pendingNonce)
+		if err != errNonceTaken {
+			return reservation, err
+		}
+	}
+	return nil, fmt.Errorf("nonce is taken by other processes for %d times", NonceReserveMaxAttempts)
+}
+
+// tryReserve reserves the lowest released nonce, or the next one of both the chain and the db
+func (m *NonceManager) tryReserve(purpose string, latestNonce, pendingNonce int64) (*model.TxNonce, error) {
+	released := model.TxNonce{}
+	err := m.db.Where("chain = ? and sender = ? and status = ? and nonce >= ?", m.chain, m.sender.String(), model.NonceReleased, latestNonce).
+		Order("nonce asc").First(&released).Error
+	if err == nil {
+		result := m.db.Model(model.TxNonce{}).Where("id = ? and status = ?", released.Id, model.NonceReleased).Updates(
+			map[string]interface{}{
+				"status":      model.NonceReserved,
+				"purpose":     purpose,
+				"tx_hash":     "",
+				"update_time": time.Now().Unix(),
+			})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, errNonceTaken
+		}
+		released.Status = model.NonceReserved
+		released.Purpose = purpose
+		released.TxHash = ""
+		return &released, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	var maxNonce sql.NullInt64
+	err = m.db.Model(model.TxNonce{}).Where("chain = ? and sender = ?", m.chain, m.sender.String()).
+		Select("max(nonce)").Row().Scan(&maxNonce)
+	if err != nil {
+		return nil, err
+	}
+	nonce := pendingNonce
+	if maxNonce.Valid && maxNonce.Int64 >= nonce {
+		nonce = maxNonce.Int64 + 1
+	}
+
+	reservation := &model.TxNonce{
+		Chain:   m.chain,
+		Sender:  m.sender.String(),
+		Nonce:   nonce,
+		Status:  model.NonceReserved,
+		Purpose: purpose,
+	}
+	if err := m.db.Create(reservation).Error; err != nil {
+		// the unique index rejects the nonce reserved by another process in the meantime
+		var count int64
+		countErr := m.db.Model(model.TxNonce{}).Where("chain = ? and sender = ? and nonce = ?", m.chain, m.sender.String(), nonce).Count(&count).Error
+		if countErr == nil && count > 0 {
+			return nil, errNonceTaken
+		}
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func (m *NonceManager) reserveReplacement(nonce int64, purpose string) (*model.TxNonce, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	latestNonce, _, err := m.chainNonces()
+	if err != nil {
+		return nil, err
+	}
+	if nonce < latestNonce {
+		return nil, fmt.Errorf("nonce %d is already mined, the latest nonce is %d", nonce, latestNonce)
+	}
+
+	reservation := model.TxNonce{}
+	err = m.db.Where("chain = ? and sender = ? and nonce = ?", m.chain, m.sender.String(), nonce).First(&reservation).Error
+	if err == gorm.ErrRecordNotFound {
+		reservation = model.TxNonce{
+			Chain:   m.chain,
+			Sender:  m.sender.String(),
+			Nonce:   nonce,
+			Status:  model.NonceReserved,
+			Purpose: purpose,
+		}
+		if err := m.db.Create(&reservation).Error; err != nil {
+			return nil, err
+		}
+		return &reservation, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reservation.Status == model.NonceReserved {
+		return nil, fmt.Errorf("nonce %d is being used by a %s tx", nonce, reservation.Purpose)
+	}
+
+	result := m.db.Model(model.TxNonce{}).Where("id = ? and status = ?", reservation.Id, reservation.Status).Updates(
+		map[string]interface{}{
+			"status":      model.NonceReserved,
+			"purpose":     purpose,
+			"update_time": time.Now().Unix(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errNonceTaken
+	}
+	reservation.Status = model.NonceReserved
+	reservation.Purpose = purpose
+	return &reservation, nil
+}
+
+// Reconcile checks the reservations against the nonces of the chain. The nonces below the latest nonce are
+// consumed, the reservations abandoned by crashed processes are released, and a missing nonce which blocks the
+// sent txs is reported.
+func (m *NonceManager) Reconcile() error {
+	latestNonce, pendingNonce, err := m.chainNonces()
+	if err != nil {
+		return err
+	}
+	abandonedTime := time.Now().Add(-NonceReservationTimeout).Unix()
+
+	err = m.db.Model(model.TxNonce{}).Where("chain = ? and sender = ? and nonce < ? and (status in (?) or (status = ? and update_time < ?))",
+		m.chain, m.sender.String(), latestNonce, []model.NonceStatus{model.NonceSent, model.NonceReleased}, model.NonceReserved, abandonedTime).Updates(
+		map[string]interface{}{
+			"status":      model.NonceConsumed,
+			"update_time": time.Now().Unix(),
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	// the reservations below the pending nonce are kept for their txs may be in the mempool
+	abandoned := make([]model.TxNonce, 0)
+	err = m.db.Where("chain = ? and sender = ? and status = ? and update_time < ? and nonce >= ?",
+		m.chain, m.sender.String(), model.NonceReserved, abandonedTime, pendingNonce).Find(&abandoned).Error
+	if err != nil {
+		return err
+	}
+	for idx := range abandoned {
+		util.Logger.Infof("release abandoned %s nonce %d of %s reserved for %s", m.chain, abandoned[idx].Nonce, m.sender.String(), abandoned[idx].Purpose)
+		if err := m.release(&abandoned[idx]); err != nil {
+			return err
+		}
+	}
+
+	var maxSentNonce sql.NullInt64
+	err = m.db.Model(model.TxNonce{}).Where("chain = ? and sender = ? and status = ?", m.chain, m.sender.String(), model.NonceSent).
+		Select("max(nonce)").Row().Scan(&maxSentNonce)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// the pending nonce stops at the first nonce missing in the mempool, the sent txs after it are queued
+	if !maxSentNonce.Valid || maxSentNonce.Int64 < pendingNonce {
+		m.gapNonce, m.gapCount = -1, 0
+		return nil
+	}
+	if m.gapNonce == pendingNonce {
+		m.gapCount++
+	} else {
+		m.gapNonce, m.gapCount = pendingNonce, 1
+	}
+	if m.gapCount == NonceGapAlertThreshold {
+		msg := fmt.Sprintf("%s nonce %d of %s is missing, %d sent txs are queued behind it, replace the nonce to unblock them",
+			m.chain, pendingNonce, m.sender.String(), maxSentNonce.Int64-pendingNonce+1)
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+	}
+	return nil
+}
+
+// Report returns the nonces of the chain and the reservations which are not consumed yet
+func (m *NonceManager) Report() (*NonceReport, error) {
+	latestNonce, pendingNonce, err := m.chainNonces()
+	if err != nil {
+		return nil, err
+	}
+	reservations := make([]model.TxNonce, 0)
+	err = m.db.Where("chain = ? and sender = ? and status <> ?", m.chain, m.sender.String(), model.NonceConsumed).
+		Order("nonce asc").Find(&reservations).Error
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	gapNonce := m.gapNonce
+	m.mutex.Unlock()
+	return &NonceReport{
+		Chain:        m.chain,
+		Sender:       m.sender.String(),
+		LatestNonce:  latestNonce,
+		PendingNonce: pendingNonce,
+		GapNonce:     gapNonce,
+		Reservations: reservations,
+	}, nil
+}
+
+func (engine *SwapEngine) reconcileNonceDaemon() {
+	for engine.lifecycle.Sleep(NonceReconcileInterval) {
+		for _, nonceManager := range []*NonceManager{engine.bscNonceManager, engine.ethNonceManager} {
+			if err := nonceManager.Reconcile(); err != nil {
+				util.Logger.Errorf("reconcile %s nonces error, err=%s", nonceManager.chain, err.Error())
+			}
+		}
+	}
+}
+
+// NonceReports returns the nonce reports of the bsc and eth tx senders
+func (engine *SwapEngine) NonceReports() ([]*NonceReport, error) {
+	reports := make([]*NonceReport, 0, 2)
+	for _, nonceManager := range []*NonceManager{engine.bscNonceManager, engine.ethNonceManager} {
+		report, err := nonceManager.Report()
+		if err != nil {
+			return nil, fmt.Errorf("get %s nonce report error, err=%s", nonceManager.chain, err.Error())
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// ReplaceNonce sends a zero value transfer to the tx sender itself with the nonce, so that a gap is filled or a
+// stuck tx is replaced
+func (engine *SwapEngine) ReplaceNonce(chain string, nonce int64) (string, error) {
+	nonceManager := engine.bscNonceManager
+	if chain == common.ChainETH {
+		nonceManager = engine.ethNonceManager
+	} else if chain != common.ChainBSC {
+		return "", fmt.Errorf("unsupported chain %s", chain)
+	}
+
+	var txHash string
+	err := nonceManager.Replace(nonce, NoncePurposeReplace, func(nonce uint64, replacedTxHash string) (*types.Transaction, error) {
+		signedTx, err := engine.sendSelfTransfer(chain, nonce, replacedTxHash)
+		if err != nil {
+			return signedTx, err
+		}
+		txHash = signedTx.Hash().String()
+		return signedTx, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return txHash, nil
+}
+
+// fillNonceGap takes the reserved nonce of a tx which is not broadcast by a zero value transfer to the tx sender
+// itself. The nonce is not released for the txs of the later nonces may be broadcast already, they would be blocked
+// behind it until another tx happened to reuse it. The transfer is tried until it may be broadcast.
+func (engine *SwapEngine) fillNonceGap(chain string, nonceManager *NonceManager, reservation *model.TxNonce) {
+	for attempt := 1; ; attempt++ {
+		signedTx, err := engine.sendSelfTransfer(chain, uint64(reservation.Nonce), "")
+		if err == nil || (signedTx != nil && !isTxRejected(err)) {
+			nonceManager.Finish(reservation, signedTx, err)
+			return
+		}
+		if attempt == 1 {
+			msg := fmt.Sprintf("Urgent alert: fill %s nonce %d of %s error: %s, the later txs are blocked until it is filled",
+				chain, reservation.Nonce, nonceManager.sender.String(), err.Error())
+			util.Logger.Errorf(msg)
+			util.SendTelegramMessage(msg)
+		}
+		if !engine.lifecycle.Sleep(NonceGapFillRetryInterval) {
+			// the released nonce is the first one reserved by the next run
+			nonceManager.Finish(reservation, nil, err)
+			return
+		}
+	}
+}
+
+// sendSelfTransfer sends a zero value transfer to the tx sender itself with the nonce. The gas price of the replaced
+// tx is bumped to get the replacement accepted by the mempool. The signed tx is returned even if its broadcast fails.
+func (engine *SwapEngine) sendSelfTransfer(chain string, nonce uint64, replacedTxHash string) (*types.Transaction, error) {
+	txSender, client, explorerUrl := engine.bscTxSender, engine.bscClient, engine.config.ChainConfig.BSCExplorerUrl
+	if chain == common.ChainETH {
+		txSender, client, explorerUrl = engine.ethTxSender, engine.ethClient, engine.config.ChainConfig.ETHExplorerUrl
+	}
+
+	fee, err := engine.suggestTxFee(chain)
+	if err != nil {
+		return nil, err
+	}
+	gasPrice := fee.GasPrice
+	if replacedTxHash != "" {
+		replacedTx, _, err := client.TransactionByHash(context.Background(), ethcom.HexToHash(replacedTxHash))
+		if err != nil && err != ethereum.NotFound {
+			return nil, err
+		}
+		if replacedTx != nil {
+			minGasPrice := bumpGasPrice(replacedTx.GasPrice(), ReplaceGasPriceBumpPercent)
+			if gasPrice.Cmp(minGasPrice) < 0 {
+				gasPrice = minGasPrice
+			}
+		}
+	}
+
+	signedTx, err := buildNativeCoinTransferTx(engine.getSigner(chain), txSender, big.NewInt(0), client, nonce, gasPrice)
+	if err != nil {
+		return nil, err
+	}
+	err = client.SendTransaction(context.Background(), signedTx)
+	if err != nil {
+		util.Logger.Errorf("broadcast tx to %s error: %s", chain, err.Error())
+		return signedTx, err
+	}
+	util.Logger.Infof("Replace %s nonce %d of tx %s, %s/%s", chain, nonce, replacedTxHash, explorerUrl, signedTx.Hash().String())
+	return signedTx, nil
+}
@@ -0,0 +1,292 @@
+package swap
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+)
+
+var testSender = ethcom.HexToAddress("0x000000000000000000000000000000000000dEaD")
+
+// nonceClient returns the latest and pending nonces of the sender, the other calls are not expected
+type nonceClient struct {
+	provider.Client
+
+	latestNonce  uint64
+	pendingNonce uint64
+}
+
+func (c *nonceClient) NonceAt(ctx context.Context, account ethcom.Address, blockNumber *big.Int) (uint64, error) {
+	return c.latestNonce, nil
+}
+
+func (c *nonceClient) PendingNonceAt(ctx context.Context, account ethcom.Address) (uint64, error) {
+	return c.pendingNonce, nil
+}
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(common.DBDialectSqlite3, ":memory:")
+	if err != nil {
+		t.Fatalf("open db error: %s", err.Error())
+	}
+	// every connection opens its own in-memory db
+	db.DB().SetMaxOpenConns(1)
+	model.InitTables(db)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestTx(nonce uint64) *types.Transaction {
+	return types.NewTransaction(nonce, testSender, big.NewInt(0), 21000, big.NewInt(1), nil)
+}
+
+func getTxNonce(t *testing.T, db *gorm.DB, nonce int64) model.TxNonce {
+	txNonce := model.TxNonce{}
+	if err := db.Where("chain = ? and sender = ? and nonce = ?", common.ChainBSC, testSender.String(), nonce).First(&txNonce).Error; err != nil {
+		t.Fatalf("get nonce %d error: %s", nonce, err.Error())
+	}
+	return txNonce
+}
+
+func saveTxNonce(t *testing.T, db *gorm.DB, nonce int64, status model.NonceStatus, txHash string, updateTime int64) {
+	txNonce := &model.TxNonce{
+		Chain:   common.ChainBSC,
+		Sender:  testSender.String(),
+		Nonce:   nonce,
+		Status:  status,
+		Purpose: NoncePurposeFillSwap,
+		TxHash:  txHash,
+	}
+	if err := db.Create(txNonce).Error; err != nil {
+		t.Fatalf("create nonce %d error: %s", nonce, err.Error())
+	}
+	if err := db.Model(txNonce).Update("update_time", updateTime).Error; err != nil {
+		t.Fatalf("update nonce %d error: %s", nonce, err.Error())
+	}
+}
+
+func TestNonceManagerReserve(t *testing.T) {
+	db := newTestDB(t)
+	m := NewNonceManager(common.ChainBSC, testSender, db, &nonceClient{latestNonce: 5, pendingNonce: 5})
+
+	first, err := m.Reserve(NoncePurposeFillSwap)
+	if err != nil {
+		t.Fatalf("reserve error: %s", err.Error())
+	}
+	second, err := m.Reserve(NoncePurposeWithdraw)
+	if err != nil {
+		t.Fatalf("reserve error: %s", err.Error())
+	}
+	if first.Nonce != 5 || second.Nonce != 6 {
+		t.Fatalf("reserved nonces %d and %d, want 5 and 6", first.Nonce, second.Nonce)
+	}
+
+	m.Finish(first, newTestTx(5), nil)
+	m.Finish(second, nil, errors.New("sign tx error"))
+	if txNonce := getTxNonce(t, db, 5); txNonce.Status != model.NonceSent || txNonce.TxHash != newTestTx(5).Hash().String() {
+		t.Fatalf("nonce 5 is %s with tx %s, want sent", txNonce.Status, txNonce.TxHash)
+	}
+	if txNonce := getTxNonce(t, db, 6); txNonce.Status != model.NonceReleased {
+		t.Fatalf("nonce 6 is %s, want released", txNonce.Status)
+	}
+
+	// the released nonce is reused before a new one
+	third, err := m.Reserve(NoncePurposeRefund)
+	if err != nil {
+		t.Fatalf("reserve error: %s", err.Error())
+	}
+	if third.Nonce != 6 || third.Purpose != NoncePurposeRefund {
+		t.Fatalf("reserved nonce %d for %s, want 6 for %s", third.Nonce, third.Purpose, NoncePurposeRefund)
+	}
+	fourth, err := m.Reserve(NoncePurposeFillSwap)
+	if err != nil {
+		t.Fatalf("reserve error: %s", err.Error())
+	}
+	if fourth.Nonce != 7 {
+		t.Fatalf("reserved nonce %d, want 7", fourth.Nonce)
+	}
+}
+
+func TestNonceManagerReserveAbovePending(t *testing.T) {
+	db := newTestDB(t)
+	// the pending nonce is ahead of the db for txs sent by another tool
+	m := NewNonceManager(common.ChainBSC, testSender, db, &nonceClient{latestNonce: 8, pendingNonce: 10})
+	saveTxNonce(t, db, 3, model.NonceReleased, "", time.Now().Unix())
+
+	reservation, err := m.Reserve(NoncePurposeFillSwap)
+	if err != nil {
+		t.Fatalf("reserve error: %s", err.Error())
+	}
+	if reservation.Nonce != 10 {
+		t.Fatalf("reserved nonce %d, want 10", reservation.Nonce)
+	}
+}
+
+func TestNonceManagerFinish(t *testing.T) {
+	tests := []struct {
+		name       string
+		signedTx   *types.Transaction
+		sendErr    error
+		wantStatus model.NonceStatus
+	}{
+		{"sent", newTestTx(0), nil, model.NonceSent},
+		{"not signed", nil, errors.New("sign tx error"), model.NonceReleased},
+		// the tx may be relayed by the endpoint failed over from
+		{"nonce too low", newTestTx(0), errors.New("nonce too low"), model.NonceSent},
+		{"underpriced", newTestTx(0), errors.New("replacement transaction underpriced"), model.NonceReleased},
+		{"insufficient funds", newTestTx(0), errors.New("Insufficient funds for gas * price + value"), model.NonceReleased},
+		{"timeout", newTestTx(0), context.DeadlineExceeded, model.NonceSent},
+		{"connection reset", newTestTx(0), errors.New("read tcp: connection reset by peer"), model.NonceSent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			m := NewNonceManager(common.ChainBSC, testSender, db, &nonceClient{})
+			reservation, err := m.Reserve(NoncePurposeFillSwap)
+			if err != nil {
+				t.Fatalf("reserve error: %s", err.Error())
+			}
+
+			m.Finish(reservation, tt.signedTx, tt.sendErr)
+			txNonce := getTxNonce(t, db, reservation.Nonce)
+			if txNonce.Status != tt.wantStatus {
+				t.Fatalf("nonce is %s, want %s", txNonce.Status, tt.wantStatus)
+			}
+			if tt.wantStatus == model.NonceSent && txNonce.TxHash != tt.signedTx.Hash().String() {
+				t.Fatalf("nonce is sent with tx %s, want %s", txNonce.TxHash, tt.signedTx.Hash().String())
+			}
+		})
+	}
+}
+
+func TestNonceManagerReplace(t *testing.T) {
+	db := newTestDB(t)
+	m := NewNonceManager(common.ChainBSC, testSender, db, &nonceClient{latestNonce: 5, pendingNonce: 7})
+	replacedTxHash := newTestTx(5).Hash().String()
+	saveTxNonce(t, db, 5, model.NonceSent, replacedTxHash, time.Now().Unix())
+	saveTxNonce(t, db, 6, model.NonceReserved, "", time.Now().Unix())
+
+	// a rejected replacement restores the replaced tx
+	err := m.Replace(5, NoncePurposeReplace, func(nonce uint64, txHash string) (*types.Transaction, error) {
+		if nonce != 5 || txHash != replacedTxHash {
+			t.Fatalf("replace nonce %d of tx %s, want nonce 5 of tx %s", nonce, txHash, replacedTxHash)
+		}
+		return newTestTx(nonce), errors.New("replacement transaction underpriced")
+	})
+	if err == nil {
+		t.Fatalf("replace error is expected")
+	}
+	if txNonce := getTxNonce(t, db, 5); txNonce.Status != model.NonceSent || txNonce.TxHash != replacedTxHash {
+		t.Fatalf("nonce 5 is %s with tx %s, want sent with tx %s", txNonce.Status, txNonce.TxHash, replacedTxHash)
+	}
+
+	replacement := types.NewTransaction(5, testSender, big.NewInt(0), 21000, big.NewInt(2), nil)
+	err = m.Replace(5, NoncePurposeReplace, func(nonce uint64, txHash string) (*types.Transaction, error) {
+		return replacement, nil
+	})
+	if err != nil {
+		t.Fatalf("replace error: %s", err.Error())
+	}
+	if txNonce := getTxNonce(t, db, 5); txNonce.Status != model.NonceSent || txNonce.TxHash != replacement.Hash().String() {
+		t.Fatalf("nonce 5 is %s with tx %s, want sent with tx %s", txNonce.Status, txNonce.TxHash, replacement.Hash().String())
+	}
+
+	// the mined nonces and the nonces being used can't be replaced
+	for _, nonce := range []int64{4, 6} {
+		err := m.Replace(nonce, NoncePurposeReplace, func(nonce uint64, txHash string) (*types.Transaction, error) {
+			t.Fatalf("nonce %d is replaced", nonce)
+			return nil, nil
+		})
+		if err == nil {
+			t.Fatalf("replace nonce %d error is expected", nonce)
+		}
+	}
+
+	// a gap is filled by a new reservation
+	err = m.Replace(8, NoncePurposeReplace, func(nonce uint64, txHash string) (*types.Transaction, error) {
+		if txHash != "" {
+			t.Fatalf("replace gap with tx %s", txHash)
+		}
+		return newTestTx(nonce), nil
+	})
+	if err != nil {
+		t.Fatalf("replace error: %s", err.Error())
+	}
+	if txNonce := getTxNonce(t, db, 8); txNonce.Status != model.NonceSent {
+		t.Fatalf("nonce 8 is %s, want sent", txNonce.Status)
+	}
+}
+
+func TestNonceManagerReconcile(t *testing.T) {
+	db := newTestDB(t)
+	client := &nonceClient{latestNonce: 3, pendingNonce: 5}
+	m := NewNonceManager(common.ChainBSC, testSender, db, client)
+	now := time.Now().Unix()
+	abandonedTime := time.Now().Add(-2 * NonceReservationTimeout).Unix()
+	saveTxNonce(t, db, 1, model.NonceReleased, "", now)
+	saveTxNonce(t, db, 2, model.NonceSent, newTestTx(2).Hash().String(), now)
+	saveTxNonce(t, db, 3, model.NonceReserved, "", now)
+	saveTxNonce(t, db, 4, model.NonceReserved, "", abandonedTime)
+	saveTxNonce(t, db, 5, model.NonceReserved, "", abandonedTime)
+	saveTxNonce(t, db, 6, model.NonceReserved, "", now)
+	saveTxNonce(t, db, 7, model.NonceSent, newTestTx(7).Hash().String(), now)
+
+	if err := m.Reconcile(); err != nil {
+		t.Fatalf("reconcile error: %s", err.Error())
+	}
+	wantStatuses := map[int64]model.NonceStatus{
+		1: model.NonceConsumed,
+		2: model.NonceConsumed,
+		3: model.NonceReserved,
+		// the tx of an abandoned reservation below the pending nonce may be in the mempool
+		4: model.NonceReserved,
+		5: model.NonceReleased,
+		6: model.NonceReserved,
+		7: model.NonceSent,
+	}
+	for nonce, wantStatus := range wantStatuses {
+		if txNonce := getTxNonce(t, db, nonce); txNonce.Status != wantStatus {
+			t.Errorf("nonce %d is %s, want %s", nonce, txNonce.Status, wantStatus)
+		}
+	}
+
+	// the sent nonce 7 is queued behind the missing nonce 5
+	report, err := m.Report()
+	if err != nil {
+		t.Fatalf("report error: %s", err.Error())
+	}
+	if report.GapNonce != 5 {
+		t.Fatalf("gap nonce is %d, want 5", report.GapNonce)
+	}
+	for i := 1; i < NonceGapAlertThreshold; i++ {
+		if err := m.Reconcile(); err != nil {
+			t.Fatalf("reconcile error: %s", err.Error())
+		}
+	}
+	if m.gapNonce != 5 || m.gapCount != NonceGapAlertThreshold {
+		t.Fatalf("gap nonce %d is seen %d times, want 5 for %d times", m.gapNonce, m.gapCount, NonceGapAlertThreshold)
+	}
+
+	// the gap is cleared once the queued txs are mined
+	client.latestNonce, client.pendingNonce = 8, 8
+	if err := m.Reconcile(); err != nil {
+		t.Fatalf("reconcile error: %s", err.Error())
+	}
+	if m.gapNonce != -1 {
+		t.Fatalf("gap nonce is %d, want none", m.gapNonce)
+	}
+	if txNonce := getTxNonce(t, db, 7); txNonce.Status != model.NonceConsumed {
+		t.Fatalf("nonce 7 is %s, want consumed", txNonce.Status)
+	}
+}
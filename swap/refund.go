@@ -0,0 +1,506 @@
+package swap
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+func (engine *SwapEngine) getRefundHMAC(refund *model.SwapRefund) string {
+	material := fmt.Sprintf("%d#%s#%s#%s#%s#%s#%s#%s#%s#%s#%s",
+		refund.SwapID, refund.Direction, refund.StartTxHash, refund.Chain, refund.Sponsor, refund.TokenAddr,
+		refund.ERC20Addr, refund.Amount, refund.Approver, refund.RefundTxHash, refund.Status)
+	mac := hmac.New(sha256.New, []byte(engine.hmacCKey))
+	mac.Write([]byte(material))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (engine *SwapEngine) verifyRefund(refund *model.SwapRefund) bool {
+	return refund.RecordHash == engine.getRefundHMAC(refund)
+}
+
+func (engine *SwapEngine) insertRefund(tx *gorm.DB, refund *model.SwapRefund, transition Transition) error {
+	refund.RecordHash = engine.getRefundHMAC(refund)
+	if err := tx.Create(refund).Error; err != nil {
+		return err
+	}
+	_, err := transit(tx, RefundStateMachine, model.SwapRefund{}, nil, &model.SwapStatusHistory{
+		EntityID:    refund.ID,
+		StartTxHash: refund.StartTxHash,
+		ToStatus:    string(refund.Status),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	return err
+}
+
+func (engine *SwapEngine) updateRefund(tx *gorm.DB, refund *model.SwapRefund) error {
+	refund.RecordHash = engine.getRefundHMAC(refund)
+	return tx.Save(refund).Error
+}
+
+// refundDirection returns the direction of the fill the refund makes, a refund fills the start tx on the swap agent
+// of the chain the swap starts on
+func refundDirection(direction common.SwapDirection) common.SwapDirection {
+	if direction == SwapEth2BSC {
+		return SwapBSC2Eth
+	}
+	return SwapEth2BSC
+}
+
+// confirmedStartTxLogs is the sub-query of the start txs confirmed by the confirm policy of their chains
+func confirmedStartTxLogs(tx *gorm.DB) interface{} {
+	return tx.Model(model.SwapStartTxLog{}).Select("tx_hash").
+		Where("status = ? and phase = ?", model.TxStatusConfirmed, model.AckRequest).QueryExpr()
+}
+
+// getConfirmedStartTxLog returns the log of the confirmed start tx, a swap is refunded only if its start tx can't be
+// reorged out. The refund is paid as the log says, the swap record is only checked against it.
+func getConfirmedStartTxLog(tx *gorm.DB, startTxHash string) (*model.SwapStartTxLog, error) {
+	startTxLog := model.SwapStartTxLog{}
+	err := tx.Where("tx_hash = ? and status = ? and phase = ?", startTxHash, model.TxStatusConfirmed, model.AckRequest).
+		First(&startTxLog).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, permanentError(fmt.Errorf("start tx %s is not confirmed", startTxHash))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &startTxLog, nil
+}
+
+// checkStartTxLog returns an error if the sponsor, the token or the amount differs from the start tx log
+func checkStartTxLog(startTxLog *model.SwapStartTxLog, sponsor, tokenAddr, amount string) error {
+	if ethcom.HexToAddress(sponsor) != ethcom.HexToAddress(startTxLog.FromAddress) {
+		return fmt.Errorf("sponsor %s differs from %s of start tx %s", sponsor, startTxLog.FromAddress, startTxLog.TxHash)
+	}
+	if ethcom.HexToAddress(tokenAddr) != ethcom.HexToAddress(startTxLog.TokenAddr) {
+		return fmt.Errorf("token %s differs from %s of start tx %s", tokenAddr, startTxLog.TokenAddr, startTxLog.TxHash)
+	}
+	if amount != startTxLog.Amount {
+		return fmt.Errorf("amount %s differs from %s of start tx %s", amount, startTxLog.Amount, startTxLog.TxHash)
+	}
+	return nil
+}
+
+// GetRefundCandidates returns the rejected swaps of the confirmed start txs, their token is held by the swap agent of
+// the chain they start on
+func (engine *SwapEngine) GetRefundCandidates() ([]model.Swap, error) {
+	swaps := make([]model.Swap, 0)
+	err := engine.db.Where("status = ? and start_tx_hash in (?)", SwapQuoteRejected, confirmedStartTxLogs(engine.db)).
+		Order("id asc").Find(&swaps).Error
+	return swaps, err
+}
+
+// ApproveRefund queues the refund of the rejected swap on behalf of the approver
+func (engine *SwapEngine) ApproveRefund(swapID uint, approver, reason string) (*model.SwapRefund, error) {
+	swap := model.Swap{}
+	if err := engine.db.Where("id = ?", swapID).First(&swap).Error; err != nil {
+		return nil, err
+	}
+	if !engine.verifySwap(&swap) {
+		return nil, fmt.Errorf("verify hmac of swap failed: %s", swap.StartTxHash)
+	}
+	if swap.Status != SwapQuoteRejected {
+		return nil, fmt.Errorf("swap %d is not rejected, status %s", swapID, swap.Status)
+	}
+	startTxLog, err := getConfirmedStartTxLog(engine.db, swap.StartTxHash)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, _ := swapChains(swap.Direction)
+	tokenAddr, erc20Addr := swap.ERC20Addr, ethcom.HexToAddress(swap.ERC20Addr)
+	if swap.Direction == SwapBSC2Eth {
+		tokenAddr = swap.BEP20Addr
+	}
+	// the swap record may be tampered, the refund pays what the start tx locked
+	if err := checkStartTxLog(startTxLog, swap.Sponsor, tokenAddr, swap.Amount); err != nil {
+		msg := fmt.Sprintf("Urgent alert: refund of swap %d is refused, %s", swapID, err.Error())
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+		return nil, err
+	}
+	if swap.Direction == SwapBSC2Eth {
+		// the erc20 is unknown if the swap is rejected for its bep20 is not of a swap pair of the engine
+		if erc20Addr == (ethcom.Address{}) {
+			erc20Addr, err = queryERC20Addr(engine.bscClient, engine.bscSwapAgent, ethcom.HexToAddress(swap.BEP20Addr), engine.bscSwapAgentABI)
+			if err != nil {
+				return nil, fmt.Errorf("query erc20 of bep20 %s error: %s", swap.BEP20Addr, err.Error())
+			}
+			if erc20Addr == (ethcom.Address{}) {
+				return nil, fmt.Errorf("bep20 %s is not of a swap pair of the bsc swap agent", swap.BEP20Addr)
+			}
+		}
+	}
+
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+	refund := &model.SwapRefund{
+		Status:      RefundApproved,
+		SwapID:      swap.ID,
+		Direction:   swap.Direction,
+		StartTxHash: swap.StartTxHash,
+		Chain:       chain,
+		Sponsor:     startTxLog.FromAddress,
+		TokenAddr:   startTxLog.TokenAddr,
+		ERC20Addr:   erc20Addr.String(),
+		Symbol:      swap.Symbol,
+		Amount:      startTxLog.Amount,
+		Approver:    approver,
+		Reason:      reason,
+	}
+	if err := engine.insertRefund(tx, refund, Transition{Reason: reason, Actor: approver}); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	swap.Log = fmt.Sprintf("refund %d approved by %s", refund.ID, approver)
+	transited, err := engine.transitSwap(tx, &swap, SwapRefunding, Transition{Reason: reason, Actor: approver})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !transited {
+		tx.Rollback()
+		return nil, fmt.Errorf("swap %d is moved by others", swapID)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	util.Logger.Infof("refund %d of swap %s is approved by %s, chain %s, sponsor %s, amount %s",
+		refund.ID, refund.StartTxHash, approver, refund.Chain, refund.Sponsor, refund.Amount)
+	return refund, nil
+}
+
+// failRefund marks the refund failed and rejects its swap again, so that another refund can be approved. The swap
+// agent refunds a start tx once at most, a refund tx mined after all makes the next refund find it refunded.
+func (engine *SwapEngine) failRefund(tx *gorm.DB, refund *model.SwapRefund, refundErr error, actor string) error {
+	refund.ErrorMsg = refundErr.Error()
+	_, err := engine.transitRefund(tx, refund, RefundSendFailed, Transition{Reason: refundErr.Error(), Actor: actor, TxHash: refund.RefundTxHash})
+	if err != nil {
+		return err
+	}
+
+	swap, err := engine.getSwapByStartTxHash(tx, refund.StartTxHash)
+	if err != nil {
+		return err
+	}
+	if swap.Status == SwapRefunding {
+		swap.Log = fmt.Sprintf("refund %d failure: %s", refund.ID, refundErr.Error())
+		if _, err := engine.transitSwap(tx, swap, SwapQuoteRejected, Transition{Reason: swap.Log, Actor: actor, TxHash: refund.RefundTxHash}); err != nil {
+			return err
+		}
+	}
+
+	msg := fmt.Sprintf("Urgent alert: refund %d of swap %s failed: %s, chain %s, sponsor %s, amount %s",
+		refund.ID, refund.StartTxHash, refundErr.Error(), refund.Chain, refund.Sponsor, refund.Amount)
+	util.Logger.Errorf(msg)
+	util.SendTelegramMessage(msg)
+	return nil
+}
+
+// completeRefund marks the refund succeeded and its swap refunded
+func (engine *SwapEngine) completeRefund(tx *gorm.DB, refund *model.SwapRefund, reason, actor string) error {
+	_, err := engine.transitRefund(tx, refund, RefundSuccess, Transition{Reason: reason, Actor: actor, TxHash: refund.RefundTxHash})
+	if err != nil {
+		return err
+	}
+
+	swap, err := engine.getSwapByStartTxHash(tx, refund.StartTxHash)
+	if err != nil {
+		return err
+	}
+	// the swap may have been filled on the chain it swaps to in between, which pays the sponsor twice
+	if swap.Status != SwapRefunding {
+		msg := fmt.Sprintf("Urgent alert: swap %s is refunded by tx %s while its status is %s, direction %s, sponsor %s, amount %s",
+			swap.StartTxHash, refund.RefundTxHash, swap.Status, swap.Direction, swap.Sponsor, swap.Amount)
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+		return nil
+	}
+	swap.Log = fmt.Sprintf("refunded by refund %d, refund tx %s", refund.ID, refund.RefundTxHash)
+	if _, err := engine.transitSwap(tx, swap, SwapRefunded, Transition{Reason: reason, Actor: actor, TxHash: refund.RefundTxHash}); err != nil {
+		return err
+	}
+	util.Logger.Infof("swap %s is refunded by tx %s on %s", swap.StartTxHash, refund.RefundTxHash, refund.Chain)
+	return nil
+}
+
+// doRefund sends the refund tx, the swap agent of the chain the swap starts on fills the start tx to the sponsor
+func (engine *SwapEngine) doRefund(refund *model.SwapRefund) (string, error) {
+	amount := big.NewInt(0)
+	_, ok := amount.SetString(refund.Amount, 10)
+	if !ok {
+		return "", permanentError(fmt.Errorf("invalid swap amount: %s", refund.Amount))
+	}
+
+	startTxLog, err := getConfirmedStartTxLog(engine.db, refund.StartTxHash)
+	if err != nil {
+		return "", err
+	}
+	if err := checkStartTxLog(startTxLog, refund.Sponsor, refund.TokenAddr, refund.Amount); err != nil {
+		return "", permanentError(err)
+	}
+
+	// the sponsor is paid twice if the swap is filled on the chain it swaps to as well
+	client, swapAgent, swapAgentABI, method := engine.bscClient, engine.bscSwapAgent, engine.bscSwapAgentABI, "filledETHTx"
+	if refund.Direction == SwapBSC2Eth {
+		client, swapAgent, swapAgentABI, method = engine.ethClient, engine.ethSwapAgent, engine.ethSwapAgentABI, "filledBSCTx"
+	}
+	filled, err := queryFilled(client, swapAgent, method, ethcom.HexToHash(refund.StartTxHash), swapAgentABI)
+	if err != nil {
+		return "", fmt.Errorf("query %s of start tx %s error: %s", method, refund.StartTxHash, err.Error())
+	}
+	if filled {
+		return "", permanentError(fmt.Errorf("swap %s is filled, it can't be refunded", refund.StartTxHash))
+	}
+
+	var data []byte
+	var nonceManager *NonceManager
+	var explorerUrl string
+	if refund.Chain == common.ChainETH {
+		data, err = abiEncodeFillBSC2ETHSwap(ethcom.HexToHash(refund.StartTxHash), ethcom.HexToAddress(refund.ERC20Addr), ethcom.HexToAddress(refund.Sponsor), amount, engine.ethSwapAgentABI)
+		client, swapAgent, nonceManager, explorerUrl = engine.ethClient, engine.ethSwapAgent, engine.ethNonceManager, engine.config.ChainConfig.ETHExplorerUrl
+	} else {
+		data, err = abiEncodeFillETH2BSCSwap(ethcom.HexToHash(refund.StartTxHash), ethcom.HexToAddress(refund.ERC20Addr), ethcom.HexToAddress(refund.Sponsor), amount, engine.bscSwapAgentABI)
+		client, swapAgent, nonceManager, explorerUrl = engine.bscClient, engine.bscSwapAgent, engine.bscNonceManager, engine.config.ChainConfig.BSCExplorerUrl
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := engine.checkFill(refundDirection(refund.Direction), refund.StartTxHash, data); err != nil {
+		return "", err
+	}
+
+	var refundTxHash string
+	err = nonceManager.Use(NoncePurposeRefund, func(nonce uint64) (*types.Transaction, error) {
+		fee, err := engine.suggestTxFee(refund.Chain)
+		if err != nil {
+			return nil, err
+		}
+		signedTx, err := buildSignedTransaction(engine.getSigner(refund.Chain), swapAgent, client, data, nonce, fee.GasPrice)
+		if err != nil {
+			return nil, err
+		}
+		refund.RefundTxHash = signedTx.Hash().String()
+		refund.GasPrice = signedTx.GasPrice().String()
+		if err := engine.updateRefund(engine.db, refund); err != nil {
+			return nil, err
+		}
+		err = client.SendTransaction(context.Background(), signedTx)
+		if err != nil {
+			util.Logger.Errorf("broadcast tx to %s error: %s", refund.Chain, err.Error())
+			return signedTx, err
+		}
+		util.Logger.Infof("Send transaction to %s, %s/%s", refund.Chain, explorerUrl, signedTx.Hash().String())
+		refundTxHash = signedTx.Hash().String()
+		return signedTx, nil
+	})
+	return refundTxHash, err
+}
+
+// refundSwapsDaemon sends the approved refunds
+func (engine *SwapEngine) refundSwapsDaemon() {
+	for engine.lifecycle.Sleep(SwapSleepSecond * time.Second) {
+		query := engine.db.Where("status in (?)", []common.RefundStatus{RefundApproved, RefundSending})
+		pausedChains := make([]string, 0, 2)
+		for _, chain := range []string{common.ChainBSC, common.ChainETH} {
+			if engine.isChainPaused(chain) {
+				pausedChains = append(pausedChains, chain)
+			}
+		}
+		// the refunds being sent are still settled, they send no tx
+		if len(pausedChains) > 0 {
+			query = query.Where("status = ? or chain not in (?)", RefundSending, pausedChains)
+		}
+		refunds := make([]model.SwapRefund, 0)
+		query.Order("id asc").Limit(BatchSize).Find(&refunds)
+
+		for _, refund := range refunds {
+			if engine.lifecycle.Stopping() {
+				break
+			}
+			writeDBErr := engine.handleRefund(&refund)
+			if writeDBErr != nil {
+				util.Logger.Errorf("write db error: %s", writeDBErr.Error())
+				util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
+			}
+		}
+	}
+}
+
+func (engine *SwapEngine) handleRefund(refund *model.SwapRefund) error {
+	if !engine.verifyRefund(refund) {
+		util.Logger.Errorf("verify hmac of refund %d failed: %s, skip it", refund.ID, refund.StartTxHash)
+		return nil
+	}
+
+	skip, err := func() (bool, error) {
+		tx := engine.db.Begin()
+		if err := tx.Error; err != nil {
+			return false, err
+		}
+		var transited bool
+		var err error
+		switch {
+		case refund.Status == RefundSending && refund.RefundTxHash == "":
+			_, err = engine.transitRefund(tx, refund, RefundApproved, Transition{Reason: "no refund tx is built", Actor: ActorRefundWorker})
+		case refund.Status == RefundSending:
+			util.Logger.Infof("refund tx is built, but its status is uncertain, just mark the refund as sent, refund ID %d", refund.ID)
+			_, err = engine.transitRefund(tx, refund, RefundSent, Transition{
+				Reason: "refund tx is built, its status is uncertain",
+				Actor:  ActorRefundWorker,
+				TxHash: refund.RefundTxHash,
+			})
+		default:
+			transited, err = engine.transitRefund(tx, refund, RefundSending, Transition{Reason: "refund tx is being sent", Actor: ActorRefundWorker})
+		}
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		// the refund is moved by others, or it is recovered and picked up again later
+		return !transited, tx.Commit().Error
+	}()
+	if err != nil || skip {
+		return err
+	}
+
+	util.Logger.Infof("Refund swap, refund id: %d, start tx hash %s, chain %s, token %s, amount %s, sponsor %s",
+		refund.ID, refund.StartTxHash, refund.Chain, refund.TokenAddr, refund.Amount, refund.Sponsor)
+
+	refundTxHash, refundErr := engine.doRefund(refund)
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if refundErr == errSwapAlreadyFilled {
+		// the refund tx of a failed refund is mined after all
+		refund.RefundTxHash = engine.getOnChainFillTxHash(tx, refundDirection(refund.Direction), refund.StartTxHash)
+		err = engine.completeRefund(tx, refund, "the start tx is already refunded on chain", ActorRefundWorker)
+	} else if refundErr != nil {
+		util.Logger.Errorf("refund failed: %s, start hash %s", refundErr.Error(), refund.StartTxHash)
+		err = engine.failRefund(tx, refund, refundErr, ActorRefundWorker)
+	} else {
+		_, err = engine.transitRefund(tx, refund, RefundSent, Transition{Reason: "refund tx is sent", Actor: ActorRefundWorker, TxHash: refundTxHash})
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// trackRefundTxDaemon completes the refunds by the receipts of their txs once they are confirmed, the refunds whose
+// txs are still uncertain after the max track retries of their chains are failed
+func (engine *SwapEngine) trackRefundTxDaemon() {
+	for engine.lifecycle.Sleep(SleepTime * time.Second) {
+		refunds := make([]model.SwapRefund, 0)
+		engine.db.Where("status = ?", RefundSent).Order("id asc").Limit(TrackSentTxBatchSize).Find(&refunds)
+
+		if len(refunds) > 0 {
+			util.Logger.Debugf("Track %d non-finalized refund txs", len(refunds))
+		}
+
+		for _, refund := range refunds {
+			if engine.lifecycle.Stopping() {
+				break
+			}
+			writeDBErr := engine.trackRefund(&refund)
+			if writeDBErr != nil {
+				util.Logger.Errorf("update db failure: %s", writeDBErr.Error())
+				util.SendTelegramMessage(fmt.Sprintf("Urgent alert: update db failure: %s", writeDBErr.Error()))
+			}
+		}
+	}
+}
+
+func (engine *SwapEngine) trackRefund(refund *model.SwapRefund) error {
+	if !engine.verifyRefund(refund) {
+		util.Logger.Errorf("verify hmac of refund %d failed: %s, skip it", refund.ID, refund.StartTxHash)
+		return nil
+	}
+
+	var client provider.Client = engine.bscClient
+	maxRetry := engine.config.ChainConfig.BSCMaxTrackRetry
+	if refund.Chain == common.ChainETH {
+		client = engine.ethClient
+		maxRetry = engine.config.ChainConfig.ETHMaxTrackRetry
+	}
+
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if refund.TrackRetryCounter >= maxRetry {
+		util.Logger.Errorf("The refund tx is sent, however, after %d seconds its status is still uncertain. Mark refund as failed, chain %s, refund hash %s",
+			SleepTime*maxRetry, refund.Chain, refund.RefundTxHash)
+		trackErr := fmt.Errorf("track refund tx for more than %d times, the refund tx status is still uncertain", maxRetry)
+		if err := engine.failRefund(tx, refund, trackErr, ActorRefundTracker); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit().Error
+	}
+
+	var receipt *types.Receipt
+	queryTxStatusErr := func() error {
+		header, err := client.HeaderByNumber(context.Background(), nil)
+		if err != nil {
+			util.Logger.Debugf("%s, query block failed: %s", refund.Chain, err.Error())
+			return err
+		}
+		receipt, err = client.TransactionReceipt(context.Background(), ethcom.HexToHash(refund.RefundTxHash))
+		if err != nil {
+			util.Logger.Debugf("%s, query tx failed: %s", refund.Chain, err.Error())
+			return err
+		}
+		confirmed, err := engine.isFillTxConfirmed(refundDirection(refund.Direction), refund.StartTxHash, receipt, header)
+		if err != nil {
+			util.Logger.Debugf("%s, check tx confirmation failed: %s", refund.Chain, err.Error())
+			return err
+		}
+		if !confirmed {
+			return fmt.Errorf("%s, refund tx is still not finalized", refund.Chain)
+		}
+		return nil
+	}()
+	if queryTxStatusErr != nil {
+		tx.Model(model.SwapRefund{}).Where("id = ?", refund.ID).Update("track_retry_counter", gorm.Expr("track_retry_counter + 1"))
+		return tx.Commit().Error
+	}
+
+	refund.Height = receipt.BlockNumber.Int64()
+	refund.ConsumedFeeAmount = consumedFee(client, receipt, refund.GasPrice)
+	var err error
+	if receipt.Status == TxFailedStatus {
+		util.Logger.Infof("refund tx is failed, chain %s, txHash: %s", refund.Chain, refund.RefundTxHash)
+		err = engine.failRefund(tx, refund, permanentError(fmt.Errorf("refund tx %s is reverted on %s", refund.RefundTxHash, refund.Chain)), ActorRefundTracker)
+	} else {
+		util.Logger.Infof("refund tx is success, chain %s, txHash: %s", refund.Chain, refund.RefundTxHash)
+		err = engine.completeRefund(tx, refund, "refund tx is success", ActorRefundTracker)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,123 @@
+package swap
+
+import (
+	"testing"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+const (
+	testSponsor   = "0x0000000000000000000000000000000000005000"
+	testERC20Addr = "0x0000000000000000000000000000000000000E20"
+)
+
+// createTestRejectedSwap creates the rejected eth to bsc swap of a confirmed start tx
+func createTestRejectedSwap(t *testing.T, engine *SwapEngine, startTxHash string) *model.Swap {
+	startTxLog := &model.SwapStartTxLog{
+		Chain:       common.ChainETH,
+		TokenAddr:   testERC20Addr,
+		FromAddress: testSponsor,
+		Amount:      "100",
+		FeeAmount:   "0",
+		Status:      model.TxStatusConfirmed,
+		TxHash:      startTxHash,
+		Phase:       model.AckRequest,
+	}
+	if err := engine.db.Create(startTxLog).Error; err != nil {
+		t.Fatalf("create start tx log error: %s", err.Error())
+	}
+	swap := &model.Swap{
+		Status:      SwapQuoteRejected,
+		Direction:   SwapEth2BSC,
+		StartTxHash: startTxHash,
+		Sponsor:     testSponsor,
+		ERC20Addr:   testERC20Addr,
+		Amount:      "100",
+	}
+	swap.RecordHash = engine.getSwapHMAC(swap)
+	if err := engine.db.Create(swap).Error; err != nil {
+		t.Fatalf("create swap error: %s", err.Error())
+	}
+	return swap
+}
+
+func TestApproveRefund(t *testing.T) {
+	engine := &SwapEngine{db: newTestDB(t), hmacCKey: "test"}
+	swap := createTestRejectedSwap(t, engine, "0x01")
+
+	refund, err := engine.ApproveRefund(swap.ID, "admin", "test")
+	if err != nil {
+		t.Fatalf("approve refund error: %s", err.Error())
+	}
+	if refund.Sponsor != testSponsor || refund.TokenAddr != testERC20Addr || refund.Amount != "100" {
+		t.Fatalf("refund of %s %s to %s, want %s %s to %s", refund.Amount, refund.TokenAddr, refund.Sponsor, "100", testERC20Addr, testSponsor)
+	}
+	saved := model.Swap{}
+	engine.db.First(&saved, swap.ID)
+	if saved.Status != SwapRefunding {
+		t.Fatalf("swap is %s, want %s", saved.Status, SwapRefunding)
+	}
+}
+
+func TestApproveRefundOfResignedSwap(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(swap *model.Swap)
+	}{
+		{"sponsor", func(swap *model.Swap) { swap.Sponsor = testSender.String() }},
+		{"amount", func(swap *model.Swap) { swap.Amount = "1000" }},
+		{"token", func(swap *model.Swap) { swap.ERC20Addr = testContract.String() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &SwapEngine{db: newTestDB(t), hmacCKey: "test"}
+			swap := createTestRejectedSwap(t, engine, "0x01")
+			// the swap is tampered and signed again, e.g. by a transition made before the hmac was checked
+			tt.tamper(swap)
+			engine.updateSwap(engine.db, swap)
+
+			if _, err := engine.ApproveRefund(swap.ID, "admin", "test"); err == nil {
+				t.Fatalf("refund of the swap not matching its start tx is approved")
+			}
+			var count int
+			engine.db.Model(model.SwapRefund{}).Count(&count)
+			if count != 0 {
+				t.Fatalf("%d refunds are created, want 0", count)
+			}
+		})
+	}
+}
+
+func TestClaimFillQuarantinesTamperedSwap(t *testing.T) {
+	engine := &SwapEngine{db: newTestDB(t), hmacCKey: "test"}
+	swap := &model.Swap{Status: SwapConfirmed, Direction: SwapEth2BSC, StartTxHash: "0x01", Sponsor: testSponsor, Amount: "100"}
+	swap.RecordHash = engine.getSwapHMAC(swap)
+	if err := engine.db.Create(swap).Error; err != nil {
+		t.Fatalf("create swap error: %s", err.Error())
+	}
+	recordHash := swap.RecordHash
+	engine.db.Model(model.Swap{}).Where("id = ?", swap.ID).Update("amount", "1000")
+
+	tampered := model.Swap{}
+	engine.db.First(&tampered, swap.ID)
+	if job := engine.claimFill(tampered); job != nil {
+		t.Fatalf("tampered swap is claimed")
+	}
+
+	saved := model.Swap{}
+	engine.db.First(&saved, swap.ID)
+	if saved.Status != SwapQuarantined {
+		t.Fatalf("swap is %s, want %s", saved.Status, SwapQuarantined)
+	}
+	if saved.RecordHash != recordHash || engine.verifySwap(&saved) {
+		t.Fatalf("hmac of the tampered swap is recomputed")
+	}
+	candidates, err := engine.GetRefundCandidates()
+	if err != nil {
+		t.Fatalf("get refund candidates error: %s", err.Error())
+	}
+	if len(candidates) != 0 {
+		t.Fatalf("%d refund candidates, want 0", len(candidates))
+	}
+}
@@ -0,0 +1,323 @@
+package swap
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// ErrorClass tells whether a failed swap is worth retrying
+type ErrorClass string
+
+const (
+	// the error goes away by itself, e.g. an rpc timeout, an underpriced tx or the signer being unavailable
+	ErrorClassTransient ErrorClass = "transient"
+	// retrying can't make the fill succeed, e.g. a reverted fill or the swap agent lacking liquidity
+	ErrorClassPermanent ErrorClass = "permanent"
+	ErrorClassUnknown   ErrorClass = "unknown"
+)
+
+// the errors are mostly seen as the messages of the nodes and the signers, they are matched in lower case
+var (
+	permanentErrorPatterns = []string{
+		"revert",
+		"insufficient liquidity",
+		"transfer amount exceeds balance",
+		"hmac verification failure",
+		"invalid swap amount",
+	}
+	transientErrorPatterns = []string{
+		"timeout",
+		"deadline exceeded",
+		"connection refused",
+		"connection reset",
+		"eof",
+		"too many requests",
+		"header not found",
+		"nonce too low",
+		"transaction underpriced",
+		"tss server failure",
+		"remote signer failure",
+	}
+)
+
+// classifiedError is an error whose class is known where it happens
+type classifiedError struct {
+	class ErrorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func permanentError(err error) error {
+	return &classifiedError{class: ErrorClassPermanent, err: err}
+}
+
+// ClassifyError returns the class of the error a swap failed with
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassUnknown
+	}
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range permanentErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return ErrorClassPermanent
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTransient
+	}
+	for _, pattern := range transientErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return ErrorClassTransient
+		}
+	}
+	return ErrorClassUnknown
+}
+
+// RetryPolicy is how many times and how soon the failed swaps are retried automatically
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+// Backoff returns the wait before the retry following the given attempts, it doubles with every attempt
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 0; i < attempts && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// the permanent failures are never retried
+var retryPolicies = map[ErrorClass]RetryPolicy{
+	ErrorClassTransient: {
+		MaxAttempts: TransientRetryMaxAttempts,
+		BaseBackoff: TransientRetryBaseBackoff,
+		MaxBackoff:  TransientRetryMaxBackoff,
+	},
+	ErrorClassUnknown: {
+		MaxAttempts: UnknownRetryMaxAttempts,
+		BaseBackoff: UnknownRetryBaseBackoff,
+		MaxBackoff:  UnknownRetryMaxBackoff,
+	},
+}
+
+// failSwap marks the swap failed and schedules its automatic retry by the policy of the class of the error, a human is
+// paged only if the swap is not going to be retried
+func (engine *SwapEngine) failSwap(tx *gorm.DB, swap *model.Swap, swapErr error, actor string) error {
+	class := ClassifyError(swapErr)
+	retryPolicy := retryPolicies[class]
+
+	swap.ErrorClass = string(class)
+	swap.NextRetryAt = 0
+	var retryAt time.Time
+	if swap.RetryAttempts < retryPolicy.MaxAttempts {
+		retryAt = time.Now().Add(retryPolicy.Backoff(swap.RetryAttempts))
+		swap.NextRetryAt = retryAt.Unix()
+	}
+	transited, err := engine.transitSwap(tx, swap, SwapSendFailed, Transition{
+		Reason: fmt.Sprintf("%s error: %s", class, swapErr.Error()),
+		Actor:  actor,
+		TxHash: swap.FillTxHash,
+	})
+	if err != nil || !transited {
+		return err
+	}
+
+	if swap.NextRetryAt > 0 {
+		util.Logger.Infof("swap failed with %s error: %s, start hash %s, retry %d of %d at %s", class, swapErr.Error(),
+			swap.StartTxHash, swap.RetryAttempts+1, retryPolicy.MaxAttempts, retryAt.UTC().Format(time.RFC3339))
+	} else {
+		msg := fmt.Sprintf("Urgent alert: swap failed with %s error after %d automatic retries: %s, start hash %s, direction %s, sponsor %s, amount %s",
+			class, swap.RetryAttempts, swapErr.Error(), swap.StartTxHash, swap.Direction, swap.Sponsor, swap.Amount)
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+	}
+	return nil
+}
+
+// failRetrySwap marks the retry swap failed and fails its swap again, which schedules the next retry
+func (engine *SwapEngine) failRetrySwap(tx *gorm.DB, retrySwap *model.RetrySwap, retryErr error, actor string) error {
+	retrySwap.ErrorMsg = retryErr.Error()
+	_, err := engine.transitRetrySwap(tx, retrySwap, RetrySwapSendFailed, Transition{Reason: retryErr.Error(), Actor: actor, TxHash: retrySwap.FillTxHash})
+	if err != nil {
+		return err
+	}
+
+	swap, err := engine.getSwapByStartTxHash(tx, retrySwap.StartTxHash)
+	if err != nil {
+		return err
+	}
+	// the swap may have been filled by another tx which is seen by the SwapFilled event
+	if swap.Status == SwapSendFailed {
+		swap.Log = fmt.Sprintf("retry swap %d failure: %s", retrySwap.ID, retryErr.Error())
+		return engine.failSwap(tx, swap, retryErr, actor)
+	}
+	return nil
+}
+
+func newRetrySwap(swap *model.Swap) *model.RetrySwap {
+	return &model.RetrySwap{
+		Status:      RetrySwapConfirmed,
+		SwapID:      swap.ID,
+		Direction:   swap.Direction,
+		StartTxHash: swap.StartTxHash,
+		FillTxHash:  swap.FillTxHash,
+		Sponsor:     swap.Sponsor,
+		BEP20Addr:   swap.BEP20Addr,
+		ERC20Addr:   swap.ERC20Addr,
+		Symbol:      swap.Symbol,
+		Amount:      swap.Amount,
+		Decimals:    swap.Decimals,
+	}
+}
+
+// retryingSwapIDs is the sub-query of the ids of the swaps whose retry swaps are not finished
+func retryingSwapIDs(tx *gorm.DB) interface{} {
+	return tx.Model(model.RetrySwap{}).Select("swap_id").
+		Where("status in (?)", []common.RetrySwapStatus{RetrySwapConfirmed, RetrySwapSending, RetrySwapSent}).QueryExpr()
+}
+
+// autoRetryFailedSwapsDaemon queues the failed swaps whose retries are due as retry swaps, the swaps being retried
+// already are left alone
+func (engine *SwapEngine) autoRetryFailedSwapsDaemon() {
+	for engine.lifecycle.Sleep(SleepTime * time.Second) {
+		engine.queueDueRetries()
+	}
+}
+
+func (engine *SwapEngine) queueDueRetries() {
+	query := engine.db.Where("status = ? and next_retry_at > 0 and next_retry_at <= ? and id not in (?)", SwapSendFailed, time.Now().Unix(),
+		retryingSwapIDs(engine.db))
+	// the retries of the paused directions are kept due, so that they are queued once the fills resume
+	if paused := engine.pausedFillDirections(); len(paused) > 0 {
+		query = query.Where("direction not in (?)", paused)
+	}
+	swaps := make([]model.Swap, 0)
+	query.Order("next_retry_at asc").Limit(BatchSize).Find(&swaps)
+
+	for _, swap := range swaps {
+		if engine.lifecycle.Stopping() {
+			break
+		}
+		if !engine.verifySwap(&swap) {
+			util.Logger.Errorf("verify hmac of swap failed: %s, skip its automatic retry", swap.StartTxHash)
+			continue
+		}
+		consumed, err := engine.fillNonceConsumed(&swap)
+		if err != nil {
+			util.Logger.Errorf("check fill nonce of swap %s error: %s, skip its automatic retry", swap.StartTxHash, err.Error())
+			continue
+		}
+		if !consumed {
+			// the swap is moved behind the other due retries until its fill nonce is mined
+			util.Logger.Infof("fill tx of swap %s is not mined yet, postpone its automatic retry", swap.StartTxHash)
+			engine.db.Model(model.Swap{}).Where("id = ? and status = ?", swap.ID, SwapSendFailed).
+				Update("next_retry_at", time.Now().Add(NonceReconcileInterval).Unix())
+			continue
+		}
+		writeDBErr := func() error {
+			tx := engine.db.Begin()
+			if err := tx.Error; err != nil {
+				return err
+			}
+			retrySwap := newRetrySwap(&swap)
+			reason := fmt.Sprintf("automatic retry %d of the %s error", swap.RetryAttempts+1, swap.ErrorClass)
+			if err := engine.insertRetrySwap(tx, retrySwap, Transition{Reason: reason, Actor: ActorRetryScheduler}); err != nil {
+				tx.Rollback()
+				return err
+			}
+			swap.RetryAttempts++
+			swap.NextRetryAt = 0
+			engine.updateSwap(tx, &swap)
+			return tx.Commit().Error
+		}()
+		if writeDBErr != nil {
+			util.Logger.Errorf("queue retry of swap %s error: %s", swap.StartTxHash, writeDBErr.Error())
+			util.SendTelegramMessage(fmt.Sprintf("queue retry of swap %s error: %s", swap.StartTxHash, writeDBErr.Error()))
+			continue
+		}
+		util.Logger.Infof("retry failed swap automatically, attempt %d, start hash %s, error class %s",
+			swap.RetryAttempts, swap.StartTxHash, swap.ErrorClass)
+	}
+}
+
+// fillNonceConsumed tells whether the nonces of the fill txs sent for the swap are mined, so that none of them can
+// be mined after the fill tx of the retry and revert it. The last nonce which is not mined is replaced by a zero
+// value transfer to the tx sender itself, once.
+func (engine *SwapEngine) fillNonceConsumed(swap *model.Swap) (bool, error) {
+	chain, nonceManager := common.ChainETH, engine.ethNonceManager
+	if swap.Direction == SwapEth2BSC {
+		chain, nonceManager = common.ChainBSC, engine.bscNonceManager
+	}
+
+	var fillNonce, retryFillNonce sql.NullInt64
+	err := engine.db.Model(model.SwapFillTxAttempt{}).Where("swap_fill_tx_id in (?)",
+		engine.db.Model(model.SwapFillTx{}).Select("id").Where("start_swap_tx_hash = ?", swap.StartTxHash).QueryExpr()).
+		Select("max(nonce)").Row().Scan(&fillNonce)
+	if err != nil {
+		return false, err
+	}
+	err = engine.db.Model(model.RetrySwapTx{}).Where("start_tx_hash = ?", swap.StartTxHash).
+		Select("max(nonce)").Row().Scan(&retryFillNonce)
+	if err != nil {
+		return false, err
+	}
+	if retryFillNonce.Valid && (!fillNonce.Valid || retryFillNonce.Int64 > fillNonce.Int64) {
+		fillNonce = retryFillNonce
+	}
+	// the fill tx is never signed
+	if !fillNonce.Valid {
+		return true, nil
+	}
+
+	latestNonce, _, err := nonceManager.chainNonces()
+	if err != nil {
+		return false, err
+	}
+	if fillNonce.Int64 < latestNonce {
+		return true, nil
+	}
+
+	txNonce := model.TxNonce{}
+	err = engine.db.Where("chain = ? and sender = ? and nonce = ?", chain, nonceManager.sender.String(), fillNonce.Int64).First(&txNonce).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return false, err
+	}
+	if txNonce.Purpose == NoncePurposeReplace {
+		return false, nil
+	}
+	txHash, err := engine.ReplaceNonce(chain, fillNonce.Int64)
+	if err != nil {
+		return false, err
+	}
+	util.Logger.Infof("replace %s nonce %d of the fill tx of swap %s by %s before its automatic retry", chain, fillNonce.Int64, swap.StartTxHash, txHash)
+	return false, nil
+}
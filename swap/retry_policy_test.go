@@ -0,0 +1,145 @@
+package swap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// timeoutError is a net.Error whose message matches no pattern
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestClassifyErrorPatterns(t *testing.T) {
+	for _, pattern := range permanentErrorPatterns {
+		err := fmt.Errorf("fill swap error: %s", strings.ToUpper(pattern))
+		if class := ClassifyError(err); class != ErrorClassPermanent {
+			t.Errorf("pattern %q is classified %s, want %s", pattern, class, ErrorClassPermanent)
+		}
+	}
+	for _, pattern := range transientErrorPatterns {
+		err := fmt.Errorf("fill swap error: %s", strings.ToUpper(pattern))
+		if class := ClassifyError(err); class != ErrorClassTransient {
+			t.Errorf("pattern %q is classified %s, want %s", pattern, class, ErrorClassTransient)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ErrorClassUnknown},
+		{"unknown message", errors.New("something went wrong"), ErrorClassUnknown},
+		{"classified", permanentError(errors.New("request timeout")), ErrorClassPermanent},
+		{"wrapped classified", fmt.Errorf("refund error: %w", permanentError(errors.New("not confirmed"))), ErrorClassPermanent},
+		{"deadline exceeded", fmt.Errorf("call error: %w", context.DeadlineExceeded), ErrorClassTransient},
+		{"net timeout", &net.OpError{Op: "read", Err: timeoutError{}}, ErrorClassTransient},
+		// a permanent pattern wins over a transient one
+		{"reverted after timeout", errors.New("timeout waiting for receipt, execution reverted"), ErrorClassPermanent},
+		{"reverted deadline", fmt.Errorf("execution reverted: %w", context.DeadlineExceeded), ErrorClassPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if class := ClassifyError(tt.err); class != tt.want {
+				t.Fatalf("classified %s, want %s", class, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseBackoff: time.Minute, MaxBackoff: 5 * time.Minute}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{3, 5 * time.Minute},
+		{10, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if backoff := policy.Backoff(tt.attempts); backoff != tt.want {
+			t.Errorf("backoff after %d attempts is %s, want %s", tt.attempts, backoff, tt.want)
+		}
+	}
+}
+
+func TestAutoRetryWaitsForFillNonce(t *testing.T) {
+	db := newTestDB(t)
+	signer := NewMemorySigner(newTestKey(t))
+	client := &sendClient{nonceClient: nonceClient{latestNonce: 3, pendingNonce: 4}}
+	engine := &SwapEngine{
+		db:              db,
+		hmacCKey:        "test",
+		config:          &util.Config{},
+		bscClient:       client,
+		bscSigner:       signer,
+		bscTxSender:     signer.Address(),
+		bscSwapAgent:    testContract,
+		bscNonceManager: NewNonceManager(common.ChainBSC, signer.Address(), db, client),
+	}
+	swap := &model.Swap{Status: SwapSendFailed, Direction: SwapEth2BSC, StartTxHash: "0x01", Amount: "1", ErrorClass: string(ErrorClassTransient)}
+	swap.RecordHash = engine.getSwapHMAC(swap)
+	if err := db.Create(swap).Error; err != nil {
+		t.Fatalf("create swap error: %s", err.Error())
+	}
+	// the fill tx timed out with nonce 3, which is still pending
+	fillTx := newTestTx(3)
+	err := engine.insertSwapTxToDB(&model.SwapFillTx{Direction: SwapEth2BSC, StartSwapTxHash: swap.StartTxHash,
+		FillSwapTxHash: fillTx.Hash().String(), GasPrice: "1", Status: model.FillTxFailed}, 3)
+	if err != nil {
+		t.Fatalf("insert fill tx error: %s", err.Error())
+	}
+	err = db.Create(&model.TxNonce{Chain: common.ChainBSC, Sender: signer.Address().String(), Nonce: 3, Status: model.NonceSent,
+		Purpose: NoncePurposeFillSwap, TxHash: fillTx.Hash().String()}).Error
+	if err != nil {
+		t.Fatalf("create nonce error: %s", err.Error())
+	}
+	queueDue := func() int {
+		db.Model(model.Swap{}).Where("id = ?", swap.ID).Update("next_retry_at", time.Now().Unix())
+		engine.queueDueRetries()
+		var retrySwaps int
+		db.Model(model.RetrySwap{}).Where("swap_id = ?", swap.ID).Count(&retrySwaps)
+		return retrySwaps
+	}
+
+	if retrySwaps := queueDue(); retrySwaps != 0 {
+		t.Fatalf("%d retry swaps are queued while the fill nonce is pending, want 0", retrySwaps)
+	}
+	if len(client.sent) != 1 || client.sent[0].Nonce() != 3 || *client.sent[0].To() != signer.Address() {
+		t.Fatalf("%d txs are sent, want the fill nonce replaced by a transfer to the sender", len(client.sent))
+	}
+	saved := model.Swap{}
+	db.First(&saved, swap.ID)
+	if saved.NextRetryAt <= time.Now().Unix() {
+		t.Fatalf("retry of the swap is due at %d, want postponed", saved.NextRetryAt)
+	}
+
+	// the nonce is replaced once
+	if retrySwaps := queueDue(); retrySwaps != 0 || len(client.sent) != 1 {
+		t.Fatalf("%d retry swaps are queued and %d txs are sent, want 0 and 1", retrySwaps, len(client.sent))
+	}
+
+	client.latestNonce = 4
+	if retrySwaps := queueDue(); retrySwaps != 1 {
+		t.Fatalf("%d retry swaps are queued once the fill nonce is mined, want 1", retrySwaps)
+	}
+}
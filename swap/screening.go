@@ -0,0 +1,129 @@
+package swap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+func (engine *SwapEngine) getScreeningReleaseHMAC(release *model.ScreeningRelease) string {
+	material := fmt.Sprintf("%d#%s#%s",
+		release.SwapID, release.StartTxHash, release.Releaser)
+	mac := hmac.New(sha256.New, []byte(engine.hmacCKey))
+	mac.Write([]byte(material))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isScreeningReleased tells whether an admin has released the swap from the screening block
+func (engine *SwapEngine) isScreeningReleased(swap *model.Swap) (bool, error) {
+	release := model.ScreeningRelease{}
+	err := engine.db.Where("swap_id = ?", swap.ID).First(&release).Error
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if release.RecordHash != engine.getScreeningReleaseHMAC(&release) || release.StartTxHash != swap.StartTxHash {
+		util.Logger.Errorf("verify hmac of screening release of swap %d failed", swap.ID)
+		util.SendTelegramMessage(fmt.Sprintf("Urgent alert: verify hmac of screening release of swap %d failed", swap.ID))
+		return false, nil
+	}
+	return true, nil
+}
+
+// screenSwap tells whether the confirmed swap passes the address screening, the swap whose sponsor is flagged is
+// blocked. The screening is done right before filling for the lists may change after the swap is received.
+func (engine *SwapEngine) screenSwap(swap *model.Swap) (bool, error) {
+	released, err := engine.isScreeningReleased(swap)
+	if err != nil || released {
+		return released, err
+	}
+	result, err := engine.screener.Screen(swap.Sponsor)
+	if err != nil {
+		return false, err
+	}
+	if !result.Flagged {
+		return true, nil
+	}
+
+	swap.Log = result.Reason
+	blocked, err := engine.commitSwapTransition(swap, SwapBlocked, Transition{Reason: result.Reason, Actor: ActorFillDispatcher})
+	if err != nil || !blocked {
+		return false, err
+	}
+
+	msg := fmt.Sprintf("Urgent alert: swap %s is blocked, %s, direction %s, amount %s", swap.StartTxHash, result.Reason,
+		swap.Direction, swap.Amount)
+	util.Logger.Errorf(msg)
+	util.SendTelegramMessage(msg)
+	return false, nil
+}
+
+// ReleaseBlockedSwap lets the blocked swap be filled without screening it again. The swap waits for the
+// confirmation of its start tx if it is blocked before confirmed.
+func (engine *SwapEngine) ReleaseBlockedSwap(swapID uint, releaser, reason string) (*model.Swap, error) {
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	swap := model.Swap{}
+	if err := tx.Where("id = ?", swapID).First(&swap).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !engine.verifySwap(&swap) {
+		tx.Rollback()
+		return nil, fmt.Errorf("verify hmac of swap failed: %s", swap.StartTxHash)
+	}
+	if swap.Status != SwapBlocked {
+		tx.Rollback()
+		return nil, fmt.Errorf("swap %d is not blocked, status %s", swapID, swap.Status)
+	}
+	startTxLog := model.SwapStartTxLog{}
+	if err := tx.Where("tx_hash = ?", swap.StartTxHash).First(&startTxLog).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	release := &model.ScreeningRelease{
+		SwapID:      swap.ID,
+		StartTxHash: swap.StartTxHash,
+		Releaser:    releaser,
+		Reason:      reason,
+	}
+	release.RecordHash = engine.getScreeningReleaseHMAC(release)
+	if err := tx.Create(release).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	status := SwapConfirmed
+	if startTxLog.Phase != model.AckRequest {
+		status = SwapTokenReceived
+	}
+	swap.Log = fmt.Sprintf("released from the screening block by %s: %s", releaser, reason)
+	transited, err := engine.transitSwap(tx, &swap, status, Transition{Reason: swap.Log, Actor: releaser})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !transited {
+		tx.Rollback()
+		return nil, fmt.Errorf("swap %d is moved by others", swapID)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	util.Logger.Infof("blocked swap %s is released by %s, status %s", swap.StartTxHash, releaser, swap.Status)
+	return &swap, nil
+}
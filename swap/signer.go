@@ -0,0 +1,196 @@
+package swap
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	tsssdksecure "github.com/binance-chain/tss-zerotrust-sdk/secure"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// Signer signs the txs sent by the tx sender of a chain
+type Signer interface {
+	// Address returns the tx sender whose txs are signed
+	Address() ethcom.Address
+	// SignTx signs the unsigned tx for the chain
+	SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// NewSigner returns the signer of the chain chosen by the key type of the chain. The signer of a local key must hold
+// the key of the configured tx sender.
+func NewSigner(chain string, cfg *util.Config, keyConfig *util.KeyConfig) (Signer, error) {
+	sender := ethcom.HexToAddress(cfg.KeyManagerConfig.BSCAccountAddr)
+	keystorePath, keystorePassword := cfg.KeyManagerConfig.BSCKeystorePath, cfg.KeyManagerConfig.BSCKeystorePassword
+	memoryKey, remoteSignerUrl := cfg.KeyManagerConfig.BSCMemoryKey, cfg.KeyManagerConfig.BSCRemoteSignerUrl
+	if chain == common.ChainETH {
+		sender = ethcom.HexToAddress(cfg.KeyManagerConfig.ETHAccountAddr)
+		keystorePath, keystorePassword = cfg.KeyManagerConfig.ETHKeystorePath, cfg.KeyManagerConfig.ETHKeystorePassword
+		memoryKey, remoteSignerUrl = cfg.KeyManagerConfig.ETHMemoryKey, cfg.KeyManagerConfig.ETHRemoteSignerUrl
+	}
+
+	var signer Signer
+	switch keyType := cfg.KeyManagerConfig.ChainKeyType(chain); keyType {
+	case common.LocalPrivateKey, common.AWSPrivateKey:
+		return NewTSSSigner(chain, sender, cfg.KeyManagerConfig.Endpoint, NewClientSecureConfig(keyConfig)), nil
+	case common.RemoteKey:
+		tlsConfig, err := NewRemoteSignerTLSConfig(cfg.KeyManagerConfig.RemoteSignerCAPath, cfg.KeyManagerConfig.RemoteSignerCertPath,
+			cfg.KeyManagerConfig.RemoteSignerKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		timeout := time.Duration(cfg.KeyManagerConfig.RemoteSignerTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = DefaultRemoteSignerTimeout
+		}
+		// the remote signer is trusted to hold the key of the tx sender, every tx it signs is checked for that
+		remoteSigner, err := NewRemoteSigner(remoteSignerUrl, sender, tlsConfig, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return remoteSigner, nil
+	case common.KeystoreKey:
+		keystoreSigner, err := NewKeystoreSigner(keystorePath, keystorePassword)
+		if err != nil {
+			return nil, err
+		}
+		signer = keystoreSigner
+	case common.MemoryKey:
+		key, err := crypto.HexToECDSA(memoryKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s memory key: %s", chain, err.Error())
+		}
+		signer = NewMemorySigner(key)
+	default:
+		return nil, fmt.Errorf("unsupported %s key type %s", chain, keyType)
+	}
+	if signer.Address() != sender {
+		return nil, fmt.Errorf("%s signer holds the key of %s rather than the tx sender %s", chain, signer.Address().String(), sender.String())
+	}
+	return signer, nil
+}
+
+// TSSSigner asks the TSS server to sign the txs, the tx sender is the account of the TSS key
+type TSSSigner struct {
+	chain        string
+	sender       ethcom.Address
+	endpoint     string
+	secureConfig *tsssdksecure.ClientSecureConfig
+}
+
+func NewTSSSigner(chain string, sender ethcom.Address, endpoint string, secureConfig *tsssdksecure.ClientSecureConfig) *TSSSigner {
+	return &TSSSigner{
+		chain:        chain,
+		sender:       sender,
+		endpoint:     endpoint,
+		secureConfig: secureConfig,
+	}
+}
+
+func (s *TSSSigner) Address() ethcom.Address {
+	return s.sender
+}
+
+// SignTx signs the tx by the TSS server, the tx without data is signed as a native coin transfer
+func (s *TSSSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	sign := signBSC
+	nativeSymbol := "BNB"
+	if s.chain == common.ChainETH {
+		sign = signETH
+		nativeSymbol = "ETH"
+	}
+	amount, contract, data := "0", "", tx.Data()
+	if len(data) == 0 {
+		amount, contract, data = tx.Value().String(), nativeSymbol, nil
+	}
+
+	signedRawTx, err := sign(s.secureConfig, s.endpoint, s.sender.String(), tx.To().String(), amount, contract, "",
+		chainID.Int64(), int64(tx.Nonce()), "0x"+strconv.FormatInt(tx.GasPrice().Int64(), 16), "0x"+strconv.FormatInt(int64(tx.Gas()), 16), data, true)
+	if err != nil {
+		return nil, fmt.Errorf("TSS server failure: %v", err)
+	}
+
+	var signedTx types.Transaction
+	err = rlp.DecodeBytes(ethcom.FromHex(signedRawTx.RawTransaction), &signedTx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode TSS signed result: %v", err)
+	}
+	return &signedTx, nil
+}
+
+// KeystoreSigner signs the txs by the key decrypted from a keystore file, it is meant for the testnets and the
+// deployments without a TSS server
+type KeystoreSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func NewKeystoreSigner(path, password string) (*KeystoreSigner, error) {
+	keyJson, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keystore error: %s", err.Error())
+	}
+	key, err := keystore.DecryptKey(keyJson, password)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt keystore error: %s", err.Error())
+	}
+	return &KeystoreSigner{key: key.PrivateKey}, nil
+}
+
+func (s *KeystoreSigner) Address() ethcom.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+func (s *KeystoreSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.NewEIP155Signer(chainID), s.key)
+}
+
+// MemorySigner signs the txs by a key in memory and keeps the signed txs, it is meant for the tests
+type MemorySigner struct {
+	mutex    sync.Mutex
+	key      *ecdsa.PrivateKey
+	signedTx []*types.Transaction
+}
+
+func NewMemorySigner(key *ecdsa.PrivateKey) *MemorySigner {
+	return &MemorySigner{key: key}
+}
+
+func (s *MemorySigner) Address() ethcom.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+func (s *MemorySigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), s.key)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.signedTx = append(s.signedTx, signedTx)
+	s.mutex.Unlock()
+	return signedTx, nil
+}
+
+// SignedTxs returns the txs signed so far
+func (s *MemorySigner) SignedTxs() []*types.Transaction {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*types.Transaction(nil), s.signedTx...)
+}
+
+var (
+	_ Signer = (*TSSSigner)(nil)
+	_ Signer = (*KeystoreSigner)(nil)
+	_ Signer = (*MemorySigner)(nil)
+)
@@ -0,0 +1,167 @@
+package swap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// RemoteSignTxArgs is the tx of eth_signTransaction, which web3signer and Clef take
+type RemoteSignTxArgs struct {
+	From     ethcom.Address  `json:"from"`
+	To       *ethcom.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Data     hexutil.Bytes   `json:"data"`
+	ChainID  *hexutil.Big    `json:"chainId"`
+}
+
+// remoteSignTxResult is the result of eth_signTransaction of Clef, web3signer returns the raw tx only
+type remoteSignTxResult struct {
+	Raw hexutil.Bytes `json:"raw"`
+}
+
+// RemoteSigner asks a remote signer to sign the txs by eth_signTransaction, e.g. web3signer or Clef fronting an HSM.
+// The signed tx is checked against the requested one, so that a compromised or misbehaving signer can't get
+// another tx broadcast.
+type RemoteSigner struct {
+	url     string
+	sender  ethcom.Address
+	timeout time.Duration
+	client  *rpc.Client
+}
+
+// NewRemoteSigner dials the remote signer, the client certificate is sent if tlsConfig has one
+func NewRemoteSigner(url string, sender ethcom.Address, tlsConfig *tls.Config, timeout time.Duration) (*RemoteSigner, error) {
+	httpClient := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	client, err := rpc.DialHTTPWithClient(url, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteSigner{
+		url:     url,
+		sender:  sender,
+		timeout: timeout,
+		client:  client,
+	}, nil
+}
+
+// NewRemoteSignerTLSConfig returns the tls config trusting the ca of the remote signer and presenting the client
+// certificate, the system roots are trusted if caPath is empty. The client certificate is required for anyone
+// reaching the remote signer could sign txs of the tss account otherwise.
+func NewRemoteSignerTLSConfig(caPath, certPath, keyPath string) (*tls.Config, error) {
+	if certPath == "" || keyPath == "" {
+		return nil, fmt.Errorf("missing remote signer client certificate")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caPath != "" {
+		caPem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("read remote signer ca error: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate is found in the remote signer ca %s", caPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load remote signer client certificate error: %s", err.Error())
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil
+}
+
+func (s *RemoteSigner) Address() ethcom.Address {
+	return s.sender
+}
+
+func (s *RemoteSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	args := RemoteSignTxArgs{
+		From:     s.sender,
+		To:       tx.To(),
+		Gas:      hexutil.Uint64(tx.Gas()),
+		GasPrice: (*hexutil.Big)(tx.GasPrice()),
+		Value:    (*hexutil.Big)(tx.Value()),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Data:     tx.Data(),
+		ChainID:  (*hexutil.Big)(chainID),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	var result json.RawMessage
+	if err := s.client.CallContext(ctx, &result, "eth_signTransaction", args); err != nil {
+		return nil, fmt.Errorf("remote signer failure: %v", err)
+	}
+
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(result, &raw); err != nil {
+		var clefResult remoteSignTxResult
+		if err := json.Unmarshal(result, &clefResult); err != nil {
+			return nil, fmt.Errorf("unrecognized remote signer result: %s", string(result))
+		}
+		raw = clefResult.Raw
+	}
+	var signedTx types.Transaction
+	if err := rlp.DecodeBytes(raw, &signedTx); err != nil {
+		return nil, fmt.Errorf("failed to decode remote signed result: %v", err)
+	}
+	if err := checkSignedTx(tx, &signedTx, s.sender, chainID); err != nil {
+		return nil, fmt.Errorf("remote signer returns a mismatched tx: %v", err)
+	}
+	return &signedTx, nil
+}
+
+// checkSignedTx tells whether the signed tx is the unsigned tx signed by the sender for the chain
+func checkSignedTx(tx, signedTx *types.Transaction, sender ethcom.Address, chainID *big.Int) error {
+	if signedTx.Nonce() != tx.Nonce() {
+		return fmt.Errorf("nonce %d, expected %d", signedTx.Nonce(), tx.Nonce())
+	}
+	if signedTx.To() == nil || *signedTx.To() != *tx.To() {
+		return fmt.Errorf("to %v, expected %s", signedTx.To(), tx.To().String())
+	}
+	if !bytes.Equal(signedTx.Data(), tx.Data()) {
+		return fmt.Errorf("data %s, expected %s", hexutil.Encode(signedTx.Data()), hexutil.Encode(tx.Data()))
+	}
+	if signedTx.Value().Cmp(tx.Value()) != 0 {
+		return fmt.Errorf("value %s, expected %s", signedTx.Value().String(), tx.Value().String())
+	}
+	if signedTx.Gas() != tx.Gas() || signedTx.GasPrice().Cmp(tx.GasPrice()) != 0 {
+		return fmt.Errorf("gas %d at %s, expected %d at %s", signedTx.Gas(), signedTx.GasPrice().String(), tx.Gas(), tx.GasPrice().String())
+	}
+	if !signedTx.Protected() || signedTx.ChainId().Cmp(chainID) != 0 {
+		return fmt.Errorf("chain id %s, expected %s", signedTx.ChainId().String(), chainID.String())
+	}
+	from, err := types.Sender(types.NewEIP155Signer(chainID), signedTx)
+	if err != nil {
+		return err
+	}
+	if from != sender {
+		return fmt.Errorf("sender %s, expected %s", from.String(), sender.String())
+	}
+	return nil
+}
+
+var _ Signer = (*RemoteSigner)(nil)
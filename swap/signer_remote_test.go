@@ -0,0 +1,169 @@
+package swap
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	testChainID  = big.NewInt(56)
+	testContract = ethcom.HexToAddress("0x0000000000000000000000000000000000001000")
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key error: %s", err.Error())
+	}
+	return key
+}
+
+func newTestFillTx(nonce uint64, to ethcom.Address, value, gasPrice int64, gas uint64, data []byte) *types.Transaction {
+	return types.NewTransaction(nonce, to, big.NewInt(value), gas, big.NewInt(gasPrice), data)
+}
+
+func TestCheckSignedTx(t *testing.T) {
+	key := newTestKey(t)
+	signer := NewMemorySigner(key)
+	tx := newTestFillTx(1, testContract, 0, 5, 100000, []byte{0x01, 0x02})
+
+	tests := []struct {
+		name     string
+		signedTx func() (*types.Transaction, error)
+		wantErr  bool
+	}{
+		{"same tx", func() (*types.Transaction, error) {
+			return signer.SignTx(tx, testChainID)
+		}, false},
+		{"other nonce", func() (*types.Transaction, error) {
+			return signer.SignTx(newTestFillTx(2, testContract, 0, 5, 100000, []byte{0x01, 0x02}), testChainID)
+		}, true},
+		{"other recipient", func() (*types.Transaction, error) {
+			return signer.SignTx(newTestFillTx(1, testSender, 0, 5, 100000, []byte{0x01, 0x02}), testChainID)
+		}, true},
+		{"other value", func() (*types.Transaction, error) {
+			return signer.SignTx(newTestFillTx(1, testContract, 1, 5, 100000, []byte{0x01, 0x02}), testChainID)
+		}, true},
+		{"other gas price", func() (*types.Transaction, error) {
+			return signer.SignTx(newTestFillTx(1, testContract, 0, 6, 100000, []byte{0x01, 0x02}), testChainID)
+		}, true},
+		{"other gas", func() (*types.Transaction, error) {
+			return signer.SignTx(newTestFillTx(1, testContract, 0, 5, 100001, []byte{0x01, 0x02}), testChainID)
+		}, true},
+		{"other data", func() (*types.Transaction, error) {
+			return signer.SignTx(newTestFillTx(1, testContract, 0, 5, 100000, []byte{0x01, 0x03}), testChainID)
+		}, true},
+		{"other chain", func() (*types.Transaction, error) {
+			return signer.SignTx(tx, big.NewInt(1))
+		}, true},
+		{"other key", func() (*types.Transaction, error) {
+			return NewMemorySigner(newTestKey(t)).SignTx(tx, testChainID)
+		}, true},
+		{"replayable", func() (*types.Transaction, error) {
+			return types.SignTx(tx, types.HomesteadSigner{}, key)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signedTx, err := tt.signedTx()
+			if err != nil {
+				t.Fatalf("sign tx error: %s", err.Error())
+			}
+			err = checkSignedTx(tx, signedTx, signer.Address(), testChainID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check signed tx error: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// standInSignerService signs the txs like cmd/signer, tamper changes the tx before it is signed
+type standInSignerService struct {
+	key    *ecdsa.PrivateKey
+	tamper func(args *RemoteSignTxArgs)
+}
+
+func (s *standInSignerService) SignTransaction(args RemoteSignTxArgs) (hexutil.Bytes, error) {
+	if args.From != crypto.PubkeyToAddress(s.key.PublicKey) {
+		return nil, fmt.Errorf("unknown account %s", args.From.String())
+	}
+	if s.tamper != nil {
+		s.tamper(&args)
+	}
+	tx := types.NewTransaction(uint64(args.Nonce), *args.To, args.Value.ToInt(), uint64(args.Gas), args.GasPrice.ToInt(), args.Data)
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(args.ChainID.ToInt()), s.key)
+	if err != nil {
+		return nil, err
+	}
+	return rlp.EncodeToBytes(signedTx)
+}
+
+func newTestRemoteSigner(t *testing.T, service *standInSignerService) *RemoteSigner {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", service); err != nil {
+		t.Fatalf("register service error: %s", err.Error())
+	}
+	httpServer := httptest.NewTLSServer(server)
+	t.Cleanup(httpServer.Close)
+
+	tlsConfig := httpServer.Client().Transport.(*http.Transport).TLSClientConfig
+	remoteSigner, err := NewRemoteSigner(httpServer.URL, crypto.PubkeyToAddress(service.key.PublicKey), tlsConfig, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial remote signer error: %s", err.Error())
+	}
+	return remoteSigner
+}
+
+func TestRemoteSignerSignTx(t *testing.T) {
+	tx := newTestFillTx(1, testContract, 0, 5, 100000, []byte{0x01, 0x02})
+	tests := []struct {
+		name    string
+		tamper  func(args *RemoteSignTxArgs)
+		wantErr bool
+	}{
+		{"honest", nil, false},
+		{"redirected", func(args *RemoteSignTxArgs) { args.To = &testSender }, true},
+		{"drained", func(args *RemoteSignTxArgs) { args.Value = (*hexutil.Big)(big.NewInt(1)) }, true},
+		{"other chain", func(args *RemoteSignTxArgs) { args.ChainID = (*hexutil.Big)(big.NewInt(1)) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newTestKey(t)
+			remoteSigner := newTestRemoteSigner(t, &standInSignerService{key: key, tamper: tt.tamper})
+
+			signedTx, err := remoteSigner.SignTx(tx, testChainID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sign tx error: %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// the remote signer signs the same tx as the memory signer of the same key
+			expectedTx, err := NewMemorySigner(key).SignTx(tx, testChainID)
+			if err != nil {
+				t.Fatalf("sign tx error: %s", err.Error())
+			}
+			if signedTx.Hash() != expectedTx.Hash() {
+				t.Fatalf("signed tx %s, want %s", signedTx.Hash().String(), expectedTx.Hash().String())
+			}
+		})
+	}
+}
+
+func TestNewRemoteSignerTLSConfig(t *testing.T) {
+	if _, err := NewRemoteSignerTLSConfig("", "", ""); err == nil {
+		t.Fatalf("tls config without client certificate error is expected")
+	}
+}
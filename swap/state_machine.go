@@ -0,0 +1,324 @@
+package swap
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+// StateMachine is the declared transitions between the statuses of an entity, the empty status is the one before the
+// entity is created
+type StateMachine struct {
+	entity      model.StatusEntity
+	transitions map[string]map[string]bool
+}
+
+func newStateMachine(entity model.StatusEntity, transitions map[string][]string) *StateMachine {
+	machine := &StateMachine{
+		entity:      entity,
+		transitions: make(map[string]map[string]bool, len(transitions)),
+	}
+	for from, tos := range transitions {
+		machine.transitions[from] = make(map[string]bool, len(tos))
+		for _, to := range tos {
+			machine.transitions[from][to] = true
+		}
+	}
+	return machine
+}
+
+func (m *StateMachine) Allows(from, to string) bool {
+	return m.transitions[from][to]
+}
+
+// a swap is moved to success from any status once it is seen filled on chain, which is the truth of the swap
+var SwapStateMachine = newStateMachine(model.StatusEntitySwap, map[string][]string{
+	"":                            {string(SwapTokenReceived), string(SwapQuoteRejected), string(SwapBlocked)},
+	string(SwapTokenReceived):     {string(SwapConfirmed), string(SwapSuccess)},
+	string(SwapQuoteRejected):     {string(SwapRefunding), string(SwapSuccess)},
+	string(SwapConfirmed):         {string(SwapSending), string(SwapHeld), string(SwapPendingApproval), string(SwapBlocked), string(SwapAwaitingLiquidity), string(SwapQuoteRejected), string(SwapQuarantined), string(SwapSuccess)},
+	string(SwapSending):           {string(SwapConfirmed), string(SwapSent), string(SwapSendFailed), string(SwapSuccess)},
+	string(SwapSent):              {string(SwapSendFailed), string(SwapSuccess)},
+	string(SwapSendFailed):        {string(SwapSendFailed), string(SwapSuccess)},
+	string(SwapHeld):              {string(SwapConfirmed), string(SwapPendingApproval), string(SwapSuccess)},
+	string(SwapPendingApproval):   {string(SwapConfirmed), string(SwapApprovalRejected), string(SwapSuccess)},
+	string(SwapApprovalRejected):  {string(SwapSuccess)},
+	string(SwapBlocked):           {string(SwapTokenReceived), string(SwapConfirmed), string(SwapSuccess)},
+	string(SwapAwaitingLiquidity): {string(SwapConfirmed), string(SwapSuccess)},
+	// the swap is rejected again if its refund fails, so that another refund can be approved
+	string(SwapRefunding): {string(SwapQuoteRejected), string(SwapRefunded), string(SwapSuccess)},
+	string(SwapRefunded):  {},
+	// the tampered swap is left to the admins
+	string(SwapQuarantined): {},
+})
+
+var RetrySwapStateMachine = newStateMachine(model.StatusEntityRetrySwap, map[string][]string{
+	"":                          {string(RetrySwapConfirmed)},
+	string(RetrySwapConfirmed):  {string(RetrySwapSending), string(RetrySwapSendFailed)},
+	string(RetrySwapSending):    {string(RetrySwapConfirmed), string(RetrySwapSent), string(RetrySwapSendFailed), string(RetrySwapSuccess)},
+	string(RetrySwapSent):       {string(RetrySwapSendFailed), string(RetrySwapSuccess)},
+	string(RetrySwapSendFailed): {},
+	string(RetrySwapSuccess):    {},
+})
+
+var SwapPairStateMachine = newStateMachine(model.StatusEntitySwapPair, map[string][]string{
+	"":                         {string(SwapPairReceived)},
+	string(SwapPairReceived):   {string(SwapPairConfirmed)},
+	string(SwapPairConfirmed):  {string(SwapPairSending)},
+	string(SwapPairSending):    {string(SwapPairConfirmed), string(SwapPairSent), string(SwapPairSendFailed)},
+	string(SwapPairSent):       {string(SwapPairSendFailed), string(SwapPairSuccess)},
+	string(SwapPairSendFailed): {},
+	string(SwapPairSuccess):    {string(SwapPairFinalized)},
+	string(SwapPairFinalized):  {},
+})
+
+var RefundStateMachine = newStateMachine(model.StatusEntityRefund, map[string][]string{
+	"":                       {string(RefundApproved)},
+	string(RefundApproved):   {string(RefundSending), string(RefundSendFailed)},
+	string(RefundSending):    {string(RefundApproved), string(RefundSent), string(RefundSendFailed), string(RefundSuccess)},
+	string(RefundSent):       {string(RefundSendFailed), string(RefundSuccess)},
+	string(RefundSendFailed): {},
+	string(RefundSuccess):    {},
+})
+
+// the statuses after which the tx of the entity may have been broadcast, such an entity is kept when the event it
+// is created by is rolled back by a reorg. They are declared next to the state machines for the new statuses to be
+// considered here.
+var (
+	SentSwapStatuses      = []common.SwapStatus{SwapSending, SwapSent, SwapSuccess, SwapRefunding, SwapRefunded}
+	SentRetrySwapStatuses = []common.RetrySwapStatus{RetrySwapSending, RetrySwapSent, RetrySwapSuccess}
+	SentSwapPairStatuses  = []common.SwapPairStatus{SwapPairSending, SwapPairSent, SwapPairSuccess, SwapPairFinalized}
+)
+
+// IsSwapSent returns true if the fill tx of the swap, one of its retries or its refund may have been broadcast. The
+// failed swaps and refunds are counted too if their txs are not known failed, e.g. a missing tx may still be mined.
+func IsSwapSent(tx *gorm.DB, startTxHash string) (bool, error) {
+	var count int64
+	err := tx.Model(model.Swap{}).Where("start_tx_hash = ? and status in (?)", startTxHash, SentSwapStatuses).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = tx.Model(model.RetrySwap{}).Where("start_tx_hash = ? and status in (?)", startTxHash, SentRetrySwapStatuses).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = tx.Model(model.SwapFillTx{}).Where("start_swap_tx_hash = ? and status != ?", startTxHash, model.FillTxFailed).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = tx.Model(model.RetrySwapTx{}).Where("start_tx_hash = ? and status != ?", startTxHash, model.FillRetryTxFailed).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	// a failed refund without a receipt may have been broadcast
+	err = tx.Model(model.SwapRefund{}).Where("start_tx_hash = ? and (status != ? or (refund_tx_hash != '' and height = 0))",
+		startTxHash, RefundSendFailed).Count(&count).Error
+	return count > 0, err
+}
+
+// Transition is why and by whom the status of an entity is changed
+type Transition struct {
+	Reason string
+	// the daemon or the admin key making the transition
+	Actor string
+	// the tx the transition is about, e.g. the fill tx
+	TxHash string
+}
+
+// transit saves the entity of the table with the fields if it is still in the from status of the history and records
+// the history, the transition must be declared by the state machine. All the status changes go through it. False is
+// returned if the entity is moved by others in between.
+func transit(tx *gorm.DB, machine *StateMachine, table interface{}, fields map[string]interface{}, history *model.SwapStatusHistory) (bool, error) {
+	if !machine.Allows(history.FromStatus, history.ToStatus) {
+		return false, fmt.Errorf("%s %d can't transit from %s to %s", machine.entity, history.EntityID, history.FromStatus, history.ToStatus)
+	}
+	history.Entity = machine.entity
+
+	if history.FromStatus != "" {
+		result := tx.Model(table).Where("id = ? and status = ?", history.EntityID, history.FromStatus).Updates(fields)
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return false, nil
+		}
+	}
+	if err := tx.Create(history).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// transitSwap moves the swap to the status and saves it, see transit
+func (engine *SwapEngine) transitSwap(tx *gorm.DB, swap *model.Swap, to common.SwapStatus, transition Transition) (bool, error) {
+	from := swap.Status
+	swap.Status = to
+	swap.RecordHash = engine.getSwapHMAC(swap)
+	transited, err := transit(tx, SwapStateMachine, model.Swap{}, map[string]interface{}{
+		"status":         swap.Status,
+		"fill_tx_hash":   swap.FillTxHash,
+		"log":            swap.Log,
+		"claimed_at":     swap.ClaimedAt,
+		"error_class":    swap.ErrorClass,
+		"retry_attempts": swap.RetryAttempts,
+		"next_retry_at":  swap.NextRetryAt,
+		"record_hash":    swap.RecordHash,
+	}, &model.SwapStatusHistory{
+		EntityID:    swap.ID,
+		StartTxHash: swap.StartTxHash,
+		FromStatus:  string(from),
+		ToStatus:    string(to),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	if !transited {
+		swap.Status = from
+		swap.RecordHash = engine.getSwapHMAC(swap)
+	}
+	return transited, err
+}
+
+// commitSwapTransition moves the swap to the status in a db tx of its own
+func (engine *SwapEngine) commitSwapTransition(swap *model.Swap, to common.SwapStatus, transition Transition) (bool, error) {
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return false, err
+	}
+	transited, err := engine.transitSwap(tx, swap, to, transition)
+	if err != nil || !transited {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit().Error
+}
+
+// quarantineSwap moves the swap failing the hmac check to quarantined in a db tx of its own. Only the status and the
+// log are saved, the record hash is not recomputed for it would sign the tampered fields.
+func (engine *SwapEngine) quarantineSwap(swap *model.Swap, transition Transition) (bool, error) {
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return false, err
+	}
+	transited, err := transit(tx, SwapStateMachine, model.Swap{}, map[string]interface{}{
+		"status": SwapQuarantined,
+		"log":    transition.Reason,
+	}, &model.SwapStatusHistory{
+		EntityID:    swap.ID,
+		StartTxHash: swap.StartTxHash,
+		FromStatus:  string(swap.Status),
+		ToStatus:    string(SwapQuarantined),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	if err != nil || !transited {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+	swap.Status = SwapQuarantined
+	swap.Log = transition.Reason
+	return true, nil
+}
+
+// transitRetrySwap moves the retry swap to the status and saves it, see transit
+func (engine *SwapEngine) transitRetrySwap(tx *gorm.DB, retrySwap *model.RetrySwap, to common.RetrySwapStatus, transition Transition) (bool, error) {
+	from := retrySwap.Status
+	retrySwap.Status = to
+	retrySwap.RecordHash = engine.getRetrySwapHMAC(retrySwap)
+	transited, err := transit(tx, RetrySwapStateMachine, model.RetrySwap{}, map[string]interface{}{
+		"status":       retrySwap.Status,
+		"fill_tx_hash": retrySwap.FillTxHash,
+		"error_msg":    retrySwap.ErrorMsg,
+		"record_hash":  retrySwap.RecordHash,
+	}, &model.SwapStatusHistory{
+		EntityID:    retrySwap.ID,
+		StartTxHash: retrySwap.StartTxHash,
+		FromStatus:  string(from),
+		ToStatus:    string(to),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	if !transited {
+		retrySwap.Status = from
+		retrySwap.RecordHash = engine.getRetrySwapHMAC(retrySwap)
+	}
+	return transited, err
+}
+
+// transitSwapPair moves the swap pair to the status and saves it, see transit
+func (engine *SwapPairEngine) transitSwapPair(tx *gorm.DB, swapPairSM *model.SwapPairStateMachine, to common.SwapPairStatus, transition Transition) (bool, error) {
+	from := swapPairSM.Status
+	swapPairSM.Status = to
+	swapPairSM.RecordHash = engine.getSwapPairSMHMAC(swapPairSM)
+	transited, err := transit(tx, SwapPairStateMachine, model.SwapPairStateMachine{}, map[string]interface{}{
+		"status":             swapPairSM.Status,
+		"bep20_addr":         swapPairSM.BEP20Addr,
+		"pair_creat_tx_hash": swapPairSM.PairCreatTxHash,
+		"log":                swapPairSM.Log,
+		"record_hash":        swapPairSM.RecordHash,
+	}, &model.SwapStatusHistory{
+		EntityID:    swapPairSM.ID,
+		StartTxHash: swapPairSM.PairRegisterTxHash,
+		FromStatus:  string(from),
+		ToStatus:    string(to),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	if !transited {
+		swapPairSM.Status = from
+		swapPairSM.RecordHash = engine.getSwapPairSMHMAC(swapPairSM)
+	}
+	return transited, err
+}
+
+// transitRefund moves the refund to the status and saves it, see transit
+func (engine *SwapEngine) transitRefund(tx *gorm.DB, refund *model.SwapRefund, to common.RefundStatus, transition Transition) (bool, error) {
+	from := refund.Status
+	refund.Status = to
+	refund.RecordHash = engine.getRefundHMAC(refund)
+	transited, err := transit(tx, RefundStateMachine, model.SwapRefund{}, map[string]interface{}{
+		"status":              refund.Status,
+		"refund_tx_hash":      refund.RefundTxHash,
+		"height":              refund.Height,
+		"consumed_fee_amount": refund.ConsumedFeeAmount,
+		"error_msg":           refund.ErrorMsg,
+		"record_hash":         refund.RecordHash,
+	}, &model.SwapStatusHistory{
+		EntityID:    refund.ID,
+		StartTxHash: refund.StartTxHash,
+		FromStatus:  string(from),
+		ToStatus:    string(to),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	if !transited {
+		refund.Status = from
+		refund.RecordHash = engine.getRefundHMAC(refund)
+	}
+	return transited, err
+}
+
+// GetSwapTimeline returns the transitions of the swap, its retry swaps and its refunds in the order they are made
+func (engine *SwapEngine) GetSwapTimeline(swapID uint) (*model.Swap, []model.SwapStatusHistory, error) {
+	swap := model.Swap{}
+	if err := engine.db.Where("id = ?", swapID).First(&swap).Error; err != nil {
+		return nil, nil, err
+	}
+	histories := make([]model.SwapStatusHistory, 0)
+	err := engine.db.Where("start_tx_hash = ? and entity in (?)", swap.StartTxHash,
+		[]model.StatusEntity{model.StatusEntitySwap, model.StatusEntityRetrySwap, model.StatusEntityRefund}).Order("id asc").Find(&histories).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return &swap, histories, nil
+}
@@ -0,0 +1,105 @@
+package swap
+
+import (
+	"testing"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+func TestSwapStateMachineAllows(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want bool
+	}{
+		{"", string(SwapTokenReceived), true},
+		{"", string(SwapQuoteRejected), true},
+		{"", string(SwapSending), false},
+		{string(SwapTokenReceived), string(SwapConfirmed), true},
+		{string(SwapConfirmed), string(SwapSending), true},
+		{string(SwapConfirmed), string(SwapSent), false},
+		{string(SwapSending), string(SwapConfirmed), true},
+		{string(SwapSending), string(SwapSent), true},
+		{string(SwapSent), string(SwapSending), false},
+		{string(SwapSent), string(SwapConfirmed), false},
+		{string(SwapSendFailed), string(SwapSendFailed), true},
+		{string(SwapSendFailed), string(SwapSending), false},
+		// a rejected swap is only refunded, it is never filled by the workers
+		{string(SwapQuoteRejected), string(SwapSending), false},
+		{string(SwapQuoteRejected), string(SwapConfirmed), false},
+		{string(SwapQuoteRejected), string(SwapRefunding), true},
+		{string(SwapApprovalRejected), string(SwapSending), false},
+		{string(SwapApprovalRejected), string(SwapRefunding), false},
+		{string(SwapRefunding), string(SwapQuoteRejected), true},
+		{string(SwapRefunding), string(SwapRefunded), true},
+		{string(SwapRefunding), string(SwapSending), false},
+		// the truth on chain wins
+		{string(SwapRefunding), string(SwapSuccess), true},
+		{string(SwapHeld), string(SwapSuccess), true},
+		{string(SwapSuccess), string(SwapSendFailed), false},
+	}
+	for _, tt := range tests {
+		if allowed := SwapStateMachine.Allows(tt.from, tt.to); allowed != tt.want {
+			t.Errorf("transition from %q to %q is allowed %v, want %v", tt.from, tt.to, allowed, tt.want)
+		}
+	}
+}
+
+func TestStateMachinesTerminal(t *testing.T) {
+	tests := []struct {
+		machine  *StateMachine
+		terminal []string
+	}{
+		{SwapStateMachine, []string{string(SwapRefunded), string(SwapQuarantined)}},
+		{RetrySwapStateMachine, []string{string(RetrySwapSendFailed), string(RetrySwapSuccess)}},
+		{SwapPairStateMachine, []string{string(SwapPairSendFailed), string(SwapPairFinalized)}},
+		{RefundStateMachine, []string{string(RefundSendFailed), string(RefundSuccess)}},
+	}
+	for _, tt := range tests {
+		for _, from := range tt.terminal {
+			for to := range tt.machine.transitions {
+				if tt.machine.Allows(from, to) {
+					t.Errorf("%s can transit from the terminal %s to %q", tt.machine.entity, from, to)
+				}
+			}
+		}
+	}
+}
+
+func TestTransitLosesRace(t *testing.T) {
+	db := newTestDB(t)
+	engine := &SwapEngine{db: db, hmacCKey: "test"}
+	swap := &model.Swap{Status: SwapConfirmed, StartTxHash: "0x01", Amount: "1"}
+	swap.RecordHash = engine.getSwapHMAC(swap)
+	if err := db.Create(swap).Error; err != nil {
+		t.Fatalf("create swap error: %s", err.Error())
+	}
+	// two workers load the same swap
+	first, second := *swap, *swap
+
+	transited, err := engine.commitSwapTransition(&first, SwapSending, Transition{Reason: "claimed", Actor: ActorFillDispatcher})
+	if err != nil || !transited {
+		t.Fatalf("first transition is %v, err=%v, want done", transited, err)
+	}
+	transited, err = engine.commitSwapTransition(&second, SwapHeld, Transition{Reason: "held", Actor: ActorFillDispatcher})
+	if err != nil {
+		t.Fatalf("second transition error: %s", err.Error())
+	}
+	if transited {
+		t.Fatalf("second transition is done, want lost")
+	}
+	if second.Status != SwapConfirmed || !engine.verifySwap(&second) {
+		t.Fatalf("loser is %s, want restored to %s with a valid hmac", second.Status, SwapConfirmed)
+	}
+
+	saved := model.Swap{}
+	db.First(&saved, swap.ID)
+	if saved.Status != SwapSending || !engine.verifySwap(&saved) {
+		t.Fatalf("saved swap is %s, want %s with a valid hmac", saved.Status, SwapSending)
+	}
+	var histories int
+	db.Model(model.SwapStatusHistory{}).Where("entity = ? and entity_id = ?", model.StatusEntitySwap, swap.ID).Count(&histories)
+	if histories != 1 {
+		t.Fatalf("%d status histories are recorded, want 1", histories)
+	}
+}
@@ -12,19 +12,20 @@ import (
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	ethcom "github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/jinzhu/gorm"
 
 	sabi "github.com/binance-chain/bsc-eth-swap/abi"
 	"github.com/binance-chain/bsc-eth-swap/common"
 	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/policy"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/screening"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
 // NewSwapEngine returns the swapEngine instance
-func NewSwapEngine(db *gorm.DB, cfg *util.Config, bscClient, ethClient *ethclient.Client) (*SwapEngine, error) {
+func NewSwapEngine(db *gorm.DB, cfg *util.Config, bscClient, ethClient provider.Client, bscConfirmPolicy, ethConfirmPolicy *policy.ConfirmPolicy) (*SwapEngine, error) {
 	pairs := make([]model.SwapPair, 0)
 	db.Find(&pairs)
 
@@ -64,17 +65,40 @@ func NewSwapEngine(db *gorm.DB, cfg *util.Config, bscClient, ethClient *ethclien
 		return nil, err
 	}
 
+	bscSigner, err := NewSigner(common.ChainBSC, cfg, keyConfig)
+	if err != nil {
+		return nil, err
+	}
+	ethSigner, err := NewSigner(common.ChainETH, cfg, keyConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// the eth to bsc swaps are filled on bsc and the bsc to eth ones on eth
+	fillPipelines := map[common.SwapDirection]*fillPipeline{
+		SwapEth2BSC: newFillPipeline(SwapEth2BSC, cfg.ChainConfig.BSCFillWorkers, cfg.ChainConfig.BSCMaxInFlightFills),
+		SwapBSC2Eth: newFillPipeline(SwapBSC2Eth, cfg.ChainConfig.ETHFillWorkers, cfg.ChainConfig.ETHMaxInFlightFills),
+	}
+
 	swapEngine := &SwapEngine{
 		db:                     db,
 		config:                 cfg,
 		hmacCKey:               keyConfig.HMACKey,
-		tssClientSecureConfig:  NewClientSecureConfig(keyConfig),
+		bscSigner:              bscSigner,
+		ethSigner:              ethSigner,
 		bscClient:              bscClient,
 		ethClient:              ethClient,
+		bscConfirmPolicy:       bscConfirmPolicy,
+		ethConfirmPolicy:       ethConfirmPolicy,
 		bscChainID:             bscChainID.Int64(),
 		ethChainID:             ethChainID.Int64(),
 		bscTxSender:            ethcom.HexToAddress(cfg.KeyManagerConfig.BSCAccountAddr),
 		ethTxSender:            ethcom.HexToAddress(cfg.KeyManagerConfig.ETHAccountAddr),
+		bscNonceManager:        NewNonceManager(common.ChainBSC, ethcom.HexToAddress(cfg.KeyManagerConfig.BSCAccountAddr), db, bscClient),
+		ethNonceManager:        NewNonceManager(common.ChainETH, ethcom.HexToAddress(cfg.KeyManagerConfig.ETHAccountAddr), db, ethClient),
+		screener:               screening.NewScreener(db),
+		fillPipelines:          fillPipelines,
+		balances:               make(map[string]*BalanceReport),
 		swapPairsFromERC20Addr: swapPairInstances,
 		bep20ToERC20:           bscContractAddrToEthContractAddr,
 		erc20ToBEP20:           ethContractAddrToBscContractAddr,
@@ -87,34 +111,64 @@ func NewSwapEngine(db *gorm.DB, cfg *util.Config, bscClient, ethClient *ethclien
 	return swapEngine, nil
 }
 
-func (engine *SwapEngine) Start() {
-	go engine.monitorSwapRequestDaemon()
-	go engine.confirmSwapRequestDaemon()
-	go engine.swapInstanceDaemon(SwapEth2BSC)
-	go engine.swapInstanceDaemon(SwapBSC2Eth)
-	go engine.trackSwapTxDaemon()
-	go engine.retryFailedSwapsDaemon()
-	go engine.trackRetrySwapTxDaemon()
+func (engine *SwapEngine) Start(ctx context.Context) {
+	engine.lifecycle.Start(ctx)
+	engine.lifecycle.Go(engine.monitorSwapRequestDaemon)
+	engine.lifecycle.Go(engine.confirmSwapRequestDaemon)
+	engine.lifecycle.Go(func() { engine.swapInstanceDaemon(SwapEth2BSC) })
+	engine.lifecycle.Go(func() { engine.swapInstanceDaemon(SwapBSC2Eth) })
+	engine.lifecycle.Go(engine.releaseHeldSwapsDaemon)
+	engine.lifecycle.Go(engine.releaseAwaitingLiquidityDaemon)
+	engine.lifecycle.Go(engine.balanceMonitorDaemon)
+	engine.lifecycle.Go(engine.bookLedgerDaemon)
+	engine.trackSwapTxDaemon()
+	engine.lifecycle.Go(engine.retryFailedSwapsDaemon)
+	engine.lifecycle.Go(engine.autoRetryFailedSwapsDaemon)
+	engine.trackRetrySwapTxDaemon()
+	engine.lifecycle.Go(engine.refundSwapsDaemon)
+	engine.lifecycle.Go(engine.trackRefundTxDaemon)
+	engine.lifecycle.Go(engine.reconcileSwapFillDaemon)
+	engine.lifecycle.Go(engine.reconcileNonceDaemon)
+}
+
+// Stop stops picking up new swaps and waits for the swaps being signed and broadcast
+func (engine *SwapEngine) Stop() error {
+	return engine.lifecycle.Stop(common.ShutdownTimeout)
 }
 
 func (engine *SwapEngine) monitorSwapRequestDaemon() {
-	for {
+	for !engine.lifecycle.Stopping() {
 		swapStartTxLogs := make([]model.SwapStartTxLog, 0)
 		engine.db.Where("phase = ?", model.SeenRequest).Order("height asc").Limit(BatchSize).Find(&swapStartTxLogs)
 
 		if len(swapStartTxLogs) == 0 {
-			time.Sleep(SleepTime * time.Second)
+			engine.lifecycle.Sleep(SleepTime * time.Second)
 			continue
 		}
 
 		for _, swapEventLog := range swapStartTxLogs {
+			if engine.isSwapExist(swapEventLog.TxHash) {
+				// the swap was kept when its start tx was reorged out, the start tx is seen again on the canonical chain
+				util.Logger.Infof("swap of start tx %s already exists, skip it", swapEventLog.TxHash)
+				engine.db.Model(model.SwapStartTxLog{}).Where("id = ?", swapEventLog.Id).Updates(
+					map[string]interface{}{
+						"phase":       model.AckRequest,
+						"update_time": time.Now().Unix(),
+					})
+				continue
+			}
+
 			swap := engine.createSwap(&swapEventLog)
 			writeDBErr := func() error {
 				tx := engine.db.Begin()
 				if err := tx.Error; err != nil {
 					return err
 				}
-				if err := engine.insertSwap(tx, swap); err != nil {
+				reason := swap.Log
+				if reason == "" {
+					reason = "start tx is seen"
+				}
+				if err := engine.insertSwap(tx, swap, Transition{Reason: reason, Actor: ActorSwapMonitor, TxHash: swap.StartTxHash}); err != nil {
 					tx.Rollback()
 					return err
 				}
@@ -134,6 +188,12 @@ func (engine *SwapEngine) monitorSwapRequestDaemon() {
 	}
 }
 
+func (engine *SwapEngine) isSwapExist(startTxHash string) bool {
+	var count int64
+	engine.db.Model(model.Swap{}).Where("start_tx_hash = ?", startTxHash).Count(&count)
+	return count > 0
+}
+
 func (engine *SwapEngine) getSwapHMAC(swap *model.Swap) string {
 	material := fmt.Sprintf("%s#%s#%s#%s#%s#%s#%d#%s#%s#%s",
 		swap.Status, swap.Sponsor, swap.BEP20Addr, swap.ERC20Addr, swap.Symbol, swap.Amount, swap.Decimals, swap.Direction, swap.StartTxHash, swap.FillTxHash)
@@ -147,9 +207,20 @@ func (engine *SwapEngine) verifySwap(swap *model.Swap) bool {
 	return swap.RecordHash == engine.getSwapHMAC(swap)
 }
 
-func (engine *SwapEngine) insertSwap(tx *gorm.DB, swap *model.Swap) error {
+func (engine *SwapEngine) insertSwap(tx *gorm.DB, swap *model.Swap, transition Transition) error {
 	swap.RecordHash = engine.getSwapHMAC(swap)
-	return tx.Create(swap).Error
+	if err := tx.Create(swap).Error; err != nil {
+		return err
+	}
+	_, err := transit(tx, SwapStateMachine, model.Swap{}, nil, &model.SwapStatusHistory{
+		EntityID:    swap.ID,
+		StartTxHash: swap.StartTxHash,
+		ToStatus:    string(swap.Status),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	return err
 }
 
 func (engine *SwapEngine) updateSwap(tx *gorm.DB, swap *model.Swap) {
@@ -208,6 +279,21 @@ func (engine *SwapEngine) createSwap(txEventLog *model.SwapStartTxLog) *model.Sw
 		log = err.Error()
 	}
 
+	// the sponsor is both the sender of the start tx and the recipient of the fill tx, it is screened again before
+	// filling if the screening fails here
+	if swapStatus == SwapTokenReceived {
+		result, err := engine.screener.Screen(sponsor)
+		if err != nil {
+			util.Logger.Errorf("screen sponsor of swap %s error: %s", swapStartTxHash, err.Error())
+		} else if result.Flagged {
+			swapStatus = SwapBlocked
+			log = result.Reason
+			msg := fmt.Sprintf("Urgent alert: swap %s is blocked, %s, direction %s, amount %s", swapStartTxHash, result.Reason, swapDirection, amount)
+			util.Logger.Errorf(msg)
+			util.SendTelegramMessage(msg)
+		}
+	}
+
 	swap := &model.Swap{
 		Status:      swapStatus,
 		Sponsor:     sponsor,
@@ -215,6 +301,7 @@ func (engine *SwapEngine) createSwap(txEventLog *model.SwapStartTxLog) *model.Sw
 		ERC20Addr:   erc20Addr.String(),
 		Symbol:      symbol,
 		Amount:      amount,
+		FeeAmount:   txEventLog.FeeAmount,
 		Decimals:    decimals,
 		Direction:   swapDirection,
 		StartTxHash: swapStartTxHash,
@@ -226,13 +313,13 @@ func (engine *SwapEngine) createSwap(txEventLog *model.SwapStartTxLog) *model.Sw
 }
 
 func (engine *SwapEngine) confirmSwapRequestDaemon() {
-	for {
+	for !engine.lifecycle.Stopping() {
 		txEventLogs := make([]model.SwapStartTxLog, 0)
 		engine.db.Where("status = ? and phase = ?", model.TxStatusConfirmed, model.ConfirmRequest).
 			Order("height asc").Limit(BatchSize).Find(&txEventLogs)
 
 		if len(txEventLogs) == 0 {
-			time.Sleep(SleepTime * time.Second)
+			engine.lifecycle.Sleep(SleepTime * time.Second)
 			continue
 		}
 
@@ -252,8 +339,11 @@ func (engine *SwapEngine) confirmSwapRequestDaemon() {
 				}
 
 				if swap.Status == SwapTokenReceived {
-					swap.Status = SwapConfirmed
-					engine.updateSwap(tx, swap)
+					_, err := engine.transitSwap(tx, swap, SwapConfirmed, Transition{Reason: "start tx is confirmed", Actor: ActorSwapConfirmer, TxHash: swap.StartTxHash})
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
 				}
 
 				tx.Model(model.SwapStartTxLog{}).Where("id = ?", txEventLog.Id).Updates(
@@ -272,229 +362,9 @@ func (engine *SwapEngine) confirmSwapRequestDaemon() {
 	}
 }
 
-func (engine *SwapEngine) swapInstanceDaemon(direction common.SwapDirection) {
-	util.Logger.Infof("start swap daemon, direction %s", direction)
-	for {
-
-		swaps := make([]model.Swap, 0)
-		engine.db.Where("status in (?) and direction = ?", []common.SwapStatus{SwapConfirmed, SwapSending}, direction).Order("id asc").Limit(BatchSize).Find(&swaps)
-
-		if len(swaps) == 0 {
-			time.Sleep(SwapSleepSecond * time.Second)
-			continue
-		}
-
-		util.Logger.Debugf("found %d confirmed swap requests", len(swaps))
-
-		for _, swap := range swaps {
-			var swapPairInstance *SwapPairIns
-			var err error
-			retryCheckErr := func() error {
-				if !engine.verifySwap(&swap) {
-					return fmt.Errorf("verify hmac of swap failed: %s", swap.StartTxHash)
-				}
-				swapPairInstance, err = engine.GetSwapPairInstance(ethcom.HexToAddress(swap.ERC20Addr))
-				if err != nil {
-					return fmt.Errorf("swap instance for bep20 %s doesn't exist, skip this swap", swap.BEP20Addr)
-				}
-				return nil
-			}()
-			if retryCheckErr != nil {
-				writeDBErr := func() error {
-					tx := engine.db.Begin()
-					if err := tx.Error; err != nil {
-						return err
-					}
-					swap.Status = SwapQuoteRejected
-					swap.Log = retryCheckErr.Error()
-					engine.updateSwap(tx, &swap)
-					return tx.Commit().Error
-				}()
-				if writeDBErr != nil {
-					util.Logger.Errorf("write db error: %s", writeDBErr.Error())
-					util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
-				}
-				continue
-			}
-
-			skip, writeDBErr := func() (bool, error) {
-				isSkip := false
-				tx := engine.db.Begin()
-				if err := tx.Error; err != nil {
-					return false, err
-				}
-				if swap.Status == SwapSending {
-					var swapTx model.SwapFillTx
-					engine.db.Where("start_swap_tx_hash = ?", swap.StartTxHash).First(&swapTx)
-					if swapTx.FillSwapTxHash == "" {
-						util.Logger.Infof("retry swap, start tx hash %s, symbol %s, amount %s, direction %s",
-							swap.StartTxHash, swap.Symbol, swap.Amount, swap.Direction)
-						swap.Status = SwapConfirmed
-						engine.updateSwap(tx, &swap)
-					} else {
-						util.Logger.Infof("swap tx is built successfully, but the swap tx status is uncertain, just mark the swap and swap tx status as sent, swap ID %d", swap.ID)
-						tx.Model(model.SwapFillTx{}).Where("fill_swap_tx_hash = ?", swapTx.FillSwapTxHash).Updates(
-							map[string]interface{}{
-								"status":     model.FillTxSent,
-								"updated_at": time.Now().Unix(),
-							})
-						swap.Status = SwapSent
-						swap.FillTxHash = swapTx.FillSwapTxHash
-						engine.updateSwap(tx, &swap)
-
-						isSkip = true
-					}
-				} else {
-					swap.Status = SwapSending
-					engine.updateSwap(tx, &swap)
-				}
-				return isSkip, tx.Commit().Error
-			}()
-			if writeDBErr != nil {
-				util.Logger.Errorf("write db error: %s", writeDBErr.Error())
-				util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
-				continue
-			}
-			if skip {
-				util.Logger.Debugf("skip this swap, start tx hash %s", swap.StartTxHash)
-				continue
-			}
-
-			util.Logger.Infof("Swap token %s, direction %s, sponsor: %s, amount %s, decimals %d", swap.BEP20Addr, direction, swap.Sponsor, swap.Amount, swap.Decimals)
-			swapTx, swapErr := engine.doSwap(&swap, swapPairInstance)
-
-			writeDBErr = func() error {
-				tx := engine.db.Begin()
-				if err := tx.Error; err != nil {
-					return err
-				}
-				if swapErr != nil {
-					util.Logger.Errorf("do swap failed: %s, start hash %s", swapErr.Error(), swap.StartTxHash)
-					util.SendTelegramMessage(fmt.Sprintf("do swap failed: %s, start hash %s", swapErr.Error(), swap.StartTxHash))
-					if swapErr.Error() == core.ErrReplaceUnderpriced.Error() || strings.Contains(swapErr.Error(), "TSS server failure") {
-						//delete the fill swap tx
-						tx.Where("fill_swap_tx_hash = ?", swapTx.FillSwapTxHash).Delete(model.SwapFillTx{})
-						// retry this swap
-						swap.Status = SwapConfirmed
-						swap.Log = fmt.Sprintf("do swap failure: %s", swapErr.Error())
-
-						engine.updateSwap(tx, &swap)
-					} else {
-						fillTxHash := ""
-						if swapTx != nil {
-							tx.Model(model.SwapFillTx{}).Where("fill_swap_tx_hash = ?", swapTx.FillSwapTxHash).Updates(
-								map[string]interface{}{
-									"status":     model.FillTxFailed,
-									"updated_at": time.Now().Unix(),
-								})
-							fillTxHash = swapTx.FillSwapTxHash
-						}
-
-						swap.Status = SwapSendFailed
-						swap.FillTxHash = fillTxHash
-						swap.Log = fmt.Sprintf("do swap failure: %s", swapErr.Error())
-						engine.updateSwap(tx, &swap)
-					}
-				} else {
-					tx.Model(model.SwapFillTx{}).Where("fill_swap_tx_hash = ?", swapTx.FillSwapTxHash).Updates(
-						map[string]interface{}{
-							"status":     model.FillTxSent,
-							"updated_at": time.Now().Unix(),
-						})
-
-					swap.Status = SwapSent
-					swap.FillTxHash = swapTx.FillSwapTxHash
-					engine.updateSwap(tx, &swap)
-				}
-
-				return tx.Commit().Error
-			}()
-
-			if writeDBErr != nil {
-				util.Logger.Errorf("write db error: %s", writeDBErr.Error())
-				util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
-			}
-
-			if swap.Direction == SwapEth2BSC {
-				time.Sleep(time.Duration(engine.config.ChainConfig.BSCWaitMilliSecBetweenSwaps) * time.Millisecond)
-			} else {
-				time.Sleep(time.Duration(engine.config.ChainConfig.ETHWaitMilliSecBetweenSwaps) * time.Millisecond)
-			}
-		}
-	}
-}
-
-func (engine *SwapEngine) doSwap(swap *model.Swap, swapPairInstance *SwapPairIns) (*model.SwapFillTx, error) {
-	amount := big.NewInt(0)
-	_, ok := amount.SetString(swap.Amount, 10)
-	if !ok {
-		return nil, fmt.Errorf("invalid swap amount: %s", swap.Amount)
-	}
-
-	if swap.Direction == SwapEth2BSC {
-		bscClientMutex.Lock()
-		defer bscClientMutex.Unlock()
-		data, err := abiEncodeFillETH2BSCSwap(ethcom.HexToHash(swap.StartTxHash), swapPairInstance.ERC20Addr, ethcom.HexToAddress(swap.Sponsor), amount, engine.bscSwapAgentABI)
-		if err != nil {
-			return nil, err
-		}
-		signedTx, err := buildSignedTransaction(common.ChainBSC, engine.bscTxSender, engine.bscSwapAgent, engine.bscClient, data, engine.tssClientSecureConfig, engine.config.KeyManagerConfig.Endpoint)
-		if err != nil {
-			return nil, err
-		}
-		swapTx := &model.SwapFillTx{
-			Direction:       SwapEth2BSC,
-			StartSwapTxHash: swap.StartTxHash,
-			FillSwapTxHash:  signedTx.Hash().String(),
-			GasPrice:        signedTx.GasPrice().String(),
-			Status:          model.FillTxCreated,
-		}
-		err = engine.insertSwapTxToDB(swapTx)
-		if err != nil {
-			return nil, err
-		}
-		err = engine.bscClient.SendTransaction(context.Background(), signedTx)
-		if err != nil {
-			util.Logger.Errorf("broadcast tx to BSC error: %s", err.Error())
-			return nil, err
-		}
-		util.Logger.Infof("Send transaction to BSC, %s/%s", engine.config.ChainConfig.BSCExplorerUrl, signedTx.Hash().String())
-		return swapTx, nil
-	} else {
-		ethClientMutex.Lock()
-		defer ethClientMutex.Unlock()
-		data, err := abiEncodeFillBSC2ETHSwap(ethcom.HexToHash(swap.StartTxHash), swapPairInstance.ERC20Addr, ethcom.HexToAddress(swap.Sponsor), amount, engine.ethSwapAgentABI)
-		signedTx, err := buildSignedTransaction(common.ChainETH, engine.ethTxSender, engine.ethSwapAgent, engine.ethClient, data, engine.tssClientSecureConfig, engine.config.KeyManagerConfig.Endpoint)
-		if err != nil {
-			return nil, err
-		}
-		swapTx := &model.SwapFillTx{
-			Direction:       SwapBSC2Eth,
-			StartSwapTxHash: swap.StartTxHash,
-			GasPrice:        signedTx.GasPrice().String(),
-			FillSwapTxHash:  signedTx.Hash().String(),
-			Status:          model.FillTxCreated,
-		}
-		err = engine.insertSwapTxToDB(swapTx)
-		if err != nil {
-			return nil, err
-		}
-		err = engine.ethClient.SendTransaction(context.Background(), signedTx)
-		if err != nil {
-			util.Logger.Errorf("broadcast tx to ETH error: %s", err.Error())
-			return nil, err
-		} else {
-			util.Logger.Infof("Send transaction to ETH, %s/%s", engine.config.ChainConfig.ETHExplorerUrl, signedTx.Hash().String())
-		}
-		return swapTx, nil
-	}
-}
-
 func (engine *SwapEngine) trackSwapTxDaemon() {
-	go func() {
-		for {
-			time.Sleep(SleepTime * time.Second)
-
+	engine.lifecycle.Go(func() {
+		for engine.lifecycle.Sleep(SleepTime * time.Second) {
 			swapTxs := make([]model.SwapFillTx, 0)
 			engine.db.Where("status = ? and track_retry_counter >= ?", model.FillTxSent, engine.config.ChainConfig.ETHMaxTrackRetry).
 				Order("id asc").Limit(TrackSentTxBatchSize).Find(&swapTxs)
@@ -511,7 +381,6 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 					maxRetry = engine.config.ChainConfig.BSCMaxTrackRetry
 				}
 				util.Logger.Errorf("The fill tx is sent, however, after %d seconds its status is still uncertain. Mark tx as missing and mark swap as failed, chain %s, fill hash %s", SleepTime*maxRetry, chainName, swapTx.StartSwapTxHash)
-				util.SendTelegramMessage(fmt.Sprintf("The fill tx is sent, however, after %d seconds its status is still uncertain. Mark tx as missing and mark swap as failed, chain %s, start hash %s", SleepTime*maxRetry, chainName, swapTx.StartSwapTxHash))
 
 				writeDBErr := func() error {
 					tx := engine.db.Begin()
@@ -529,9 +398,15 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 						tx.Rollback()
 						return err
 					}
-					swap.Status = SwapSendFailed
-					swap.Log = fmt.Sprintf("track fill tx for more than %d times, the fill tx status is still uncertain", maxRetry)
-					engine.updateSwap(tx, swap)
+					// the swap may have been filled by another tx which is seen by the SwapFilled event
+					if swap.Status != SwapSuccess {
+						trackErr := fmt.Errorf("track fill tx for more than %d times, the fill tx status is still uncertain", maxRetry)
+						swap.Log = trackErr.Error()
+						if err := engine.failSwap(tx, swap, trackErr, ActorFillTracker); err != nil {
+							tx.Rollback()
+							return err
+						}
+					}
 
 					return tx.Commit().Error
 				}()
@@ -541,12 +416,10 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 				}
 			}
 		}
-	}()
-
-	go func() {
-		for {
-			time.Sleep(SleepTime * time.Second)
+	})
 
+	engine.lifecycle.Go(func() {
+		for engine.lifecycle.Sleep(SleepTime * time.Second) {
 			ethSwapTxs := make([]model.SwapFillTx, 0)
 			engine.db.Where("status = ? and direction = ? and track_retry_counter < ?", model.FillTxSent, SwapBSC2Eth, engine.config.ChainConfig.ETHMaxTrackRetry).
 				Order("id asc").Limit(TrackSentTxBatchSize).Find(&ethSwapTxs)
@@ -562,10 +435,7 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 			}
 
 			for _, swapTx := range swapTxs {
-				gasPrice := big.NewInt(0)
-				gasPrice.SetString(swapTx.GasPrice, 10)
-
-				var client *ethclient.Client
+				var client provider.Client
 				var chainName string
 				if swapTx.Direction == SwapBSC2Eth {
 					client = engine.ethClient
@@ -575,20 +445,38 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 					chainName = "BSC"
 				}
 				var txRecipient *types.Receipt
+				var minedAttempt *model.SwapFillTxAttempt
+				var txFee string
 				queryTxStatusErr := func() error {
-					block, err := client.BlockByNumber(context.Background(), nil)
+					header, err := client.HeaderByNumber(context.Background(), nil)
 					if err != nil {
 						util.Logger.Debugf("%s, query block failed: %s", chainName, err.Error())
 						return err
 					}
-					txRecipient, err = client.TransactionReceipt(context.Background(), ethcom.HexToHash(swapTx.FillSwapTxHash))
+					attempts, err := engine.getSwapFillTxAttempts(&swapTx)
+					if err != nil {
+						return err
+					}
+					txRecipient, minedAttempt, err = getFillTxReceipt(client, attempts)
 					if err != nil {
 						util.Logger.Debugf("%s, query tx failed: %s", chainName, err.Error())
 						return err
 					}
-					if block.Number().Int64() < txRecipient.BlockNumber.Int64()+engine.config.ChainConfig.ETHConfirmNum {
+					if txRecipient == nil {
+						if err := engine.speedUpFillTx(&swapTx, attempts, header); err != nil {
+							util.Logger.Errorf("%s, speed up fill tx of swap %s failed: %s", chainName, swapTx.StartSwapTxHash, err.Error())
+						}
+						return fmt.Errorf("%s, swap tx is not mined yet", chainName)
+					}
+					confirmed, err := engine.isFillTxConfirmed(swapTx.Direction, swapTx.StartSwapTxHash, txRecipient, header)
+					if err != nil {
+						util.Logger.Debugf("%s, check tx confirmation failed: %s", chainName, err.Error())
+						return err
+					}
+					if !confirmed {
 						return fmt.Errorf("%s, swap tx is still not finalized", chainName)
 					}
+					txFee = consumedFee(client, txRecipient, minedAttempt.GasPrice)
 					return nil
 				}()
 
@@ -604,10 +492,9 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 								"updated_at":          time.Now().Unix(),
 							})
 					} else {
-						txFee := big.NewInt(1).Mul(gasPrice, big.NewInt(int64(txRecipient.GasUsed))).String()
+						settleSwapFillTx(tx, &swapTx, minedAttempt)
 						if txRecipient.Status == TxFailedStatus {
 							util.Logger.Infof(fmt.Sprintf("fill swap tx is failed, chain %s, txHash: %s", chainName, txRecipient.TxHash.String()))
-							util.SendTelegramMessage(fmt.Sprintf("fill swap tx is failed, chain %s, txHash: %s", chainName, txRecipient.TxHash.String()))
 							tx.Model(model.SwapFillTx{}).Where("id = ?", swapTx.ID).Updates(
 								map[string]interface{}{
 									"status":              model.FillTxFailed,
@@ -621,9 +508,16 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 								tx.Rollback()
 								return err
 							}
-							swap.Status = SwapSendFailed
-							swap.Log = "fill tx is failed"
-							engine.updateSwap(tx, swap)
+							// the swap may have been filled by another tx which is seen by the SwapFilled event
+							if swap.Status != SwapSuccess {
+								swap.FillTxHash = minedAttempt.TxHash
+								swap.Log = "fill tx is failed"
+								revertErr := permanentError(fmt.Errorf("fill tx %s is reverted on %s", minedAttempt.TxHash, chainName))
+								if err := engine.failSwap(tx, swap, revertErr, ActorFillTracker); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
 						} else {
 							util.Logger.Infof(fmt.Sprintf("fill swap tx is success, chain %s, txHash: %s", chainName, txRecipient.TxHash.String()))
 							tx.Model(model.SwapFillTx{}).Where("id = ?", swapTx.ID).Updates(
@@ -639,8 +533,15 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 								tx.Rollback()
 								return err
 							}
-							swap.Status = SwapSuccess
-							engine.updateSwap(tx, swap)
+							// the swap may have been completed by the fill reconciler
+							if swap.Status != SwapSuccess {
+								swap.FillTxHash = minedAttempt.TxHash
+								_, err := engine.transitSwap(tx, swap, SwapSuccess, Transition{Reason: "fill tx is success", Actor: ActorFillTracker, TxHash: minedAttempt.TxHash})
+								if err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
 						}
 					}
 					return tx.Commit().Error
@@ -652,7 +553,37 @@ func (engine *SwapEngine) trackSwapTxDaemon() {
 
 			}
 		}
-	}()
+	})
+}
+
+// isFillTxConfirmed checks the receipt of the fill tx against the confirm policy of the chain the swap is filled on
+func (engine *SwapEngine) isFillTxConfirmed(direction common.SwapDirection, startTxHash string, receipt *types.Receipt, header *types.Header) (bool, error) {
+	swap, err := engine.getSwapByStartTxHash(engine.db, startTxHash)
+	if err != nil {
+		return false, err
+	}
+	confirmPolicy, tokenAddr := engine.bscConfirmPolicy, swap.BEP20Addr
+	if direction == SwapBSC2Eth {
+		confirmPolicy, tokenAddr = engine.ethConfirmPolicy, swap.ERC20Addr
+	}
+	requiredConfirmNum := confirmPolicy.RequiredConfirmNum(tokenAddr, swap.Amount)
+	return confirmPolicy.IsConfirmed(requiredConfirmNum, receipt.BlockNumber.Int64(), header.Number.Int64())
+}
+
+// getSigner returns the signer of the tx sender of the chain
+func (engine *SwapEngine) getSigner(chain string) Signer {
+	if chain == common.ChainETH {
+		return engine.ethSigner
+	}
+	return engine.bscSigner
+}
+
+// suggestTxFee returns the fee of a tx sent to the chain
+func (engine *SwapEngine) suggestTxFee(chain string) (*txFee, error) {
+	if chain == common.ChainETH {
+		return suggestTxFee(engine.ethClient)
+	}
+	return suggestTxFee(engine.bscClient)
 }
 
 func (engine *SwapEngine) getSwapByStartTxHash(tx *gorm.DB, txHash string) (*model.Swap, error) {
@@ -667,7 +598,8 @@ func (engine *SwapEngine) getSwapByStartTxHash(tx *gorm.DB, txHash string) (*mod
 	return &swap, nil
 }
 
-func (engine *SwapEngine) insertSwapTxToDB(data *model.SwapFillTx) error {
+// insertSwapTxToDB saves the fill tx together with its first attempt
+func (engine *SwapEngine) insertSwapTxToDB(data *model.SwapFillTx, nonce uint64) error {
 	tx := engine.db.Begin()
 	if err := tx.Error; err != nil {
 		return err
@@ -677,6 +609,17 @@ func (engine *SwapEngine) insertSwapTxToDB(data *model.SwapFillTx) error {
 		tx.Rollback()
 		return err
 	}
+	attempt := &model.SwapFillTxAttempt{
+		SwapFillTxID: data.ID,
+		Attempt:      1,
+		Nonce:        int64(nonce),
+		TxHash:       data.FillSwapTxHash,
+		GasPrice:     data.GasPrice,
+	}
+	if err := tx.Create(attempt).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
 
 	return tx.Commit().Error
 }
@@ -0,0 +1,112 @@
+package swap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// reconcileSwapFillDaemon marks the swaps as succeeded by the confirmed SwapFilled events of the swap agents, so
+// that the fills made by a replacement tx, another instance or an operator are recognized as well
+func (engine *SwapEngine) reconcileSwapFillDaemon() {
+	for !engine.lifecycle.Stopping() {
+		fillTxLogs := make([]model.SwapFillTxLog, 0)
+		engine.db.Where("status = ? and phase = ?", model.TxStatusConfirmed, model.SeenRequest).
+			Order("height asc").Limit(BatchSize).Find(&fillTxLogs)
+
+		if len(fillTxLogs) > 0 {
+			util.Logger.Debugf("found %d confirmed swap fill event logs", len(fillTxLogs))
+		}
+
+		for _, fillTxLog := range fillTxLogs {
+			writeDBErr := engine.reconcileSwapFill(&fillTxLog)
+			if writeDBErr != nil {
+				util.Logger.Errorf("write db error: %s", writeDBErr.Error())
+				util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
+			}
+		}
+
+		engine.lifecycle.Sleep(SleepTime * time.Second)
+	}
+}
+
+func (engine *SwapEngine) reconcileSwapFill(fillTxLog *model.SwapFillTxLog) error {
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	swap := model.Swap{}
+	err := tx.Where("start_tx_hash = ?", fillTxLog.StartTxHash).First(&swap).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return err
+	}
+
+	// a fill on BSC completes an ETH to BSC swap and vice versa
+	direction := SwapBSC2Eth
+	if fillTxLog.Chain == common.ChainBSC {
+		direction = SwapEth2BSC
+	}
+
+	if err == nil && swap.Direction != direction && (swap.Status == SwapRefunding || swap.Status == SwapRefunded) {
+		// a refund fills the start tx on the chain the swap starts on, it is completed by the refund tracker
+		util.Logger.Infof("swap %s is refunded by tx %s on %s, status %s", swap.StartTxHash, fillTxLog.TxHash, fillTxLog.Chain, swap.Status)
+	} else if err == gorm.ErrRecordNotFound || swap.Direction != direction {
+		msg := fmt.Sprintf("Urgent alert: swap of the %s fill tx %s is not found, start tx hash %s, recipient %s, amount %s",
+			fillTxLog.Chain, fillTxLog.TxHash, fillTxLog.StartTxHash, fillTxLog.ToAddress, fillTxLog.Amount)
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+	} else if !engine.verifySwap(&swap) {
+		// the tampered swap is left as it is, the fill event is acked so that it is alerted once
+		msg := fmt.Sprintf("Urgent alert: verify hmac of swap %s failed, it is filled by tx %s on %s, recipient %s, amount %s",
+			swap.StartTxHash, fillTxLog.TxHash, fillTxLog.Chain, fillTxLog.ToAddress, fillTxLog.Amount)
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+	} else {
+		switch swap.Status {
+		case SwapSending:
+			// the fill tx of this instance is being built, wait for its result to avoid overwriting it
+			tx.Rollback()
+			return nil
+		case SwapRefunded:
+			msg := fmt.Sprintf("Urgent alert: swap %s is filled by tx %s on %s after it is refunded, sponsor %s, amount %s",
+				swap.StartTxHash, fillTxLog.TxHash, fillTxLog.Chain, swap.Sponsor, swap.Amount)
+			util.Logger.Errorf(msg)
+			util.SendTelegramMessage(msg)
+		case SwapSuccess:
+			if swap.FillTxHash == "" {
+				// the swap is found filled on chain before the fill event is indexed
+				swap.FillTxHash = fillTxLog.TxHash
+				engine.updateSwap(tx, &swap)
+			} else if swap.FillTxHash != fillTxLog.TxHash {
+				util.Logger.Infof("swap %s is already succeeded with fill tx %s, the fill event is seen in tx %s",
+					swap.StartTxHash, swap.FillTxHash, fillTxLog.TxHash)
+			}
+		default:
+			if swap.FillTxHash != fillTxLog.TxHash {
+				util.Logger.Infof("swap %s is filled by tx %s on %s, the recorded fill tx is %s, status %s",
+					swap.StartTxHash, fillTxLog.TxHash, fillTxLog.Chain, swap.FillTxHash, swap.Status)
+			}
+			swap.FillTxHash = fillTxLog.TxHash
+			swap.Log = fmt.Sprintf("filled by tx %s seen in the SwapFilled event", fillTxLog.TxHash)
+			_, err := engine.transitSwap(tx, &swap, SwapSuccess, Transition{Reason: swap.Log, Actor: ActorFillReconciler, TxHash: fillTxLog.TxHash})
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	tx.Model(model.SwapFillTxLog{}).Where("id = ?", fillTxLog.Id).Updates(
+		map[string]interface{}{
+			"phase":       model.AckRequest,
+			"update_time": time.Now().Unix(),
+		})
+	return tx.Commit().Error
+}
@@ -0,0 +1,72 @@
+package swap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// errSwapAlreadyFilled is returned instead of building a fill tx for the swap which is filled on chain already
+var errSwapAlreadyFilled = errors.New("swap is already filled on chain")
+
+// checkFill makes sure the fill tx of the start tx would neither pay the user twice nor revert. The swap agent is
+// asked whether the start tx is filled, and the fill is simulated with eth_call from the tx sender. The local
+// status is not trusted here for the db may be restored from a backup or the swap may be re-driven by a retry.
+func (engine *SwapEngine) checkFill(direction common.SwapDirection, startTxHash string, data []byte) error {
+	client, txSender, swapAgent, swapAgentABI, method := engine.ethClient, engine.ethTxSender, engine.ethSwapAgent, engine.ethSwapAgentABI, "filledBSCTx"
+	if direction == SwapEth2BSC {
+		client, txSender, swapAgent, swapAgentABI, method = engine.bscClient, engine.bscTxSender, engine.bscSwapAgent, engine.bscSwapAgentABI, "filledETHTx"
+	}
+
+	filled, err := queryFilled(client, swapAgent, method, ethcom.HexToHash(startTxHash), swapAgentABI)
+	if err != nil {
+		return fmt.Errorf("query %s of start tx %s error: %s", method, startTxHash, err.Error())
+	}
+	if filled {
+		return errSwapAlreadyFilled
+	}
+
+	_, err = client.CallContract(context.Background(), ethereum.CallMsg{From: txSender, To: &swapAgent, Data: data}, nil)
+	if err != nil {
+		return fmt.Errorf("simulate fill of start tx %s error: %s", startTxHash, err.Error())
+	}
+	return nil
+}
+
+// getOnChainFillTxHash returns the hash of the fill tx of the start tx found by the SwapFilled event index, it is
+// empty if the event is not indexed yet
+func (engine *SwapEngine) getOnChainFillTxHash(tx *gorm.DB, direction common.SwapDirection, startTxHash string) string {
+	chain := common.ChainETH
+	if direction == SwapEth2BSC {
+		chain = common.ChainBSC
+	}
+	fillTxLog := model.SwapFillTxLog{}
+	err := tx.Where("chain = ? and start_tx_hash = ?", chain, startTxHash).Order("height asc").First(&fillTxLog).Error
+	if err != nil {
+		return ""
+	}
+	return fillTxLog.TxHash
+}
+
+// markSwapFilled completes the swap which is found filled on chain, the fill tx hash is left to the fill reconciler
+// if its event is not indexed yet
+func (engine *SwapEngine) markSwapFilled(tx *gorm.DB, swap *model.Swap, actor string) error {
+	fillTxHash := engine.getOnChainFillTxHash(tx, swap.Direction, swap.StartTxHash)
+	msg := fmt.Sprintf("Urgent alert: swap %s is already filled on chain by tx %s, direction %s, sponsor %s, amount %s, skip the fill",
+		swap.StartTxHash, fillTxHash, swap.Direction, swap.Sponsor, swap.Amount)
+	util.Logger.Errorf(msg)
+	util.SendTelegramMessage(msg)
+
+	swap.FillTxHash = fillTxHash
+	swap.Log = errSwapAlreadyFilled.Error()
+	_, err := engine.transitSwap(tx, swap, SwapSuccess, Transition{Reason: swap.Log, Actor: actor, TxHash: fillTxHash})
+	return err
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"math/big"
 	"strings"
 	"time"
 
@@ -16,15 +15,16 @@ import (
 	ethcom "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 
 	sabi "github.com/binance-chain/bsc-eth-swap/abi"
 	"github.com/binance-chain/bsc-eth-swap/common"
 	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/policy"
+	"github.com/binance-chain/bsc-eth-swap/provider"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
-func NewSwapPairEngine(db *gorm.DB, cfg *util.Config, bscClient *ethclient.Client, swapEngine *SwapEngine) (*SwapPairEngine, error) {
+func NewSwapPairEngine(db *gorm.DB, cfg *util.Config, bscClient provider.Client, bscConfirmPolicy *policy.ConfirmPolicy, swapEngine *SwapEngine) (*SwapPairEngine, error) {
 	keyConfig, err := GetKeyConfig(cfg)
 	if err != nil {
 		return nil, err
@@ -38,45 +38,63 @@ func NewSwapPairEngine(db *gorm.DB, cfg *util.Config, bscClient *ethclient.Clien
 		return nil, err
 	}
 	swapPairEngine := &SwapPairEngine{
-		db:                    db,
-		config:                cfg,
-		hmacKey:               keyConfig.HMACKey,
-		tssClientSecureConfig: NewClientSecureConfig(keyConfig),
-		bscClient:             bscClient,
-		bscChainID:            bscChainID.Int64(),
-		bscTxSender:           ethcom.HexToAddress(cfg.KeyManagerConfig.BSCAccountAddr),
-		bscSwapAgentABi:       &bscSwapAgentAbi,
-		bscSwapAgent:          ethcom.HexToAddress(cfg.ChainConfig.BSCSwapAgentAddr),
-		swapEngine:            swapEngine,
+		db:               db,
+		config:           cfg,
+		hmacKey:          keyConfig.HMACKey,
+		bscClient:        bscClient,
+		bscConfirmPolicy: bscConfirmPolicy,
+		bscChainID:       bscChainID.Int64(),
+		bscTxSender:      ethcom.HexToAddress(cfg.KeyManagerConfig.BSCAccountAddr),
+		bscSwapAgentABi:  &bscSwapAgentAbi,
+		bscSwapAgent:     ethcom.HexToAddress(cfg.ChainConfig.BSCSwapAgentAddr),
+		swapEngine:       swapEngine,
 	}
 	return swapPairEngine, nil
 }
 
-func (engine *SwapPairEngine) Start() {
-	go engine.monitorSwapRequestDaemon()
-	go engine.confirmSwapRequestDaemon()
-	go engine.swapPairInstanceDaemon()
-	go engine.trackSwapPairTxDaemon()
+func (engine *SwapPairEngine) Start(ctx context.Context) {
+	engine.lifecycle.Start(ctx)
+	engine.lifecycle.Go(engine.monitorSwapRequestDaemon)
+	engine.lifecycle.Go(engine.confirmSwapRequestDaemon)
+	engine.lifecycle.Go(engine.swapPairInstanceDaemon)
+	engine.trackSwapPairTxDaemon()
+}
+
+// Stop stops picking up new swap pair registrations and waits for the ones being created
+func (engine *SwapPairEngine) Stop() error {
+	return engine.lifecycle.Stop(common.ShutdownTimeout)
 }
 
 func (engine *SwapPairEngine) monitorSwapRequestDaemon() {
-	for {
+	for !engine.lifecycle.Stopping() {
 		swapPairRegisterTxLogs := make([]model.SwapPairRegisterTxLog, 0)
 		engine.db.Where("phase = ?", model.SeenRequest).Order("height asc").Limit(BatchSize).Find(&swapPairRegisterTxLogs)
 
 		if len(swapPairRegisterTxLogs) == 0 {
-			time.Sleep(SleepTime * time.Second)
+			engine.lifecycle.Sleep(SleepTime * time.Second)
 			continue
 		}
 
 		for _, swapPairEventLog := range swapPairRegisterTxLogs {
+			if engine.isSwapPairSMExist(swapPairEventLog.TxHash) {
+				// the swap pair was kept when its register tx was reorged out, the register tx is seen again on the canonical chain
+				util.Logger.Infof("swapPairSM of register tx %s already exists, skip it", swapPairEventLog.TxHash)
+				engine.db.Model(model.SwapPairRegisterTxLog{}).Where("id = ?", swapPairEventLog.Id).Updates(
+					map[string]interface{}{
+						"phase":       model.AckRequest,
+						"update_time": time.Now().Unix(),
+					})
+				continue
+			}
+
 			swapSM := engine.createSwapPairSM(&swapPairEventLog)
 			writeDBErr := func() error {
 				tx := engine.db.Begin()
 				if err := tx.Error; err != nil {
 					return err
 				}
-				if err := engine.insertSwapPairSM(tx, swapSM); err != nil {
+				transition := Transition{Reason: "register tx is seen", Actor: ActorSwapPairMonitor, TxHash: swapSM.PairRegisterTxHash}
+				if err := engine.insertSwapPairSM(tx, swapSM, transition); err != nil {
 					tx.Rollback()
 					return err
 				}
@@ -122,9 +140,26 @@ func (engine *SwapPairEngine) createSwapPairSM(txEventLog *model.SwapPairRegiste
 	return swapSM
 }
 
-func (engine *SwapPairEngine) insertSwapPairSM(tx *gorm.DB, swapSM *model.SwapPairStateMachine) error {
+func (engine *SwapPairEngine) isSwapPairSMExist(registerTxHash string) bool {
+	var count int64
+	engine.db.Model(model.SwapPairStateMachine{}).Where("pair_register_tx_hash = ?", registerTxHash).Count(&count)
+	return count > 0
+}
+
+func (engine *SwapPairEngine) insertSwapPairSM(tx *gorm.DB, swapSM *model.SwapPairStateMachine, transition Transition) error {
 	swapSM.RecordHash = engine.getSwapPairSMHMAC(swapSM)
-	return tx.Create(swapSM).Error
+	if err := tx.Create(swapSM).Error; err != nil {
+		return err
+	}
+	_, err := transit(tx, SwapPairStateMachine, model.SwapPairStateMachine{}, nil, &model.SwapStatusHistory{
+		EntityID:    swapSM.ID,
+		StartTxHash: swapSM.PairRegisterTxHash,
+		ToStatus:    string(swapSM.Status),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	return err
 }
 
 func (engine *SwapPairEngine) insertSwapPair(tx *gorm.DB, swapPair *model.SwapPair) error {
@@ -132,12 +167,6 @@ func (engine *SwapPairEngine) insertSwapPair(tx *gorm.DB, swapPair *model.SwapPa
 	return tx.Create(swapPair).Error
 }
 
-func (engine *SwapPairEngine) updateSwapPairSM(tx *gorm.DB, swapPairSM *model.SwapPairStateMachine) {
-	swapPairSM.RecordHash = engine.getSwapPairSMHMAC(swapPairSM)
-
-	tx.Save(swapPairSM)
-}
-
 func (engine *SwapPairEngine) verifySwapPairSM(swapPairSM *model.SwapPairStateMachine) bool {
 	return swapPairSM.RecordHash == engine.getSwapPairSMHMAC(swapPairSM)
 }
@@ -159,13 +188,13 @@ func (engine *SwapPairEngine) getSwapPairHMAC(swapSM *model.SwapPair) string {
 }
 
 func (engine *SwapPairEngine) confirmSwapRequestDaemon() {
-	for {
+	for !engine.lifecycle.Stopping() {
 		swapPairRegisterEventLogs := make([]model.SwapPairRegisterTxLog, 0)
 		engine.db.Where("status = ? and phase = ?", model.TxStatusConfirmed, model.ConfirmRequest).
 			Order("height asc").Limit(BatchSize).Find(&swapPairRegisterEventLogs)
 
 		if len(swapPairRegisterEventLogs) == 0 {
-			time.Sleep(SleepTime * time.Second)
+			engine.lifecycle.Sleep(SleepTime * time.Second)
 			continue
 		}
 
@@ -192,8 +221,11 @@ func (engine *SwapPairEngine) confirmSwapRequestDaemon() {
 					return err
 				}
 				if swapPairSM.Status == SwapPairReceived {
-					swapPairSM.Status = SwapPairConfirmed
-					engine.updateSwapPairSM(tx, &swapPairSM)
+					transition := Transition{Reason: "register tx is confirmed", Actor: ActorSwapPairConfirmer, TxHash: swapPairSM.PairRegisterTxHash}
+					if _, err := engine.transitSwapPair(tx, &swapPairSM, SwapPairConfirmed, transition); err != nil {
+						tx.Rollback()
+						return err
+					}
 				}
 
 				tx.Model(model.SwapPairRegisterTxLog{}).Where("id = ?", pairRegisterEventLog.Id).Updates(
@@ -213,19 +245,22 @@ func (engine *SwapPairEngine) confirmSwapRequestDaemon() {
 }
 
 func (engine *SwapPairEngine) swapPairInstanceDaemon() {
-	for {
+	for !engine.lifecycle.Stopping() {
 
 		swapPairSMs := make([]model.SwapPairStateMachine, 0)
 		engine.db.Where("status in (?)", []common.SwapPairStatus{SwapPairConfirmed, SwapPairSending}).Order("id asc").Limit(BatchSize).Find(&swapPairSMs)
 
 		if len(swapPairSMs) == 0 {
-			time.Sleep(SwapSleepSecond * time.Second)
+			engine.lifecycle.Sleep(SwapSleepSecond * time.Second)
 			continue
 		}
 
 		util.Logger.Infof("found %d confirmed swapPairSM pair register requests", len(swapPairSMs))
 
 		for _, swapPairSM := range swapPairSMs {
+			if engine.lifecycle.Stopping() {
+				break
+			}
 			if !engine.verifySwapPairSM(&swapPairSM) {
 				util.Logger.Errorf("verify hmac of swapPairSM failed: %s", swapPairSM.PairRegisterTxHash)
 				util.SendTelegramMessage(fmt.Sprintf("Urgent alert: verify hmac of swapPairSM failed: %s", swapPairSM.PairRegisterTxHash))
@@ -256,14 +291,26 @@ func (engine *SwapPairEngine) swapPairInstanceDaemon() {
 							})
 
 						// update swapPairSM
-						swapPairSM.Status = SwapPairSent
 						swapPairSM.PairCreatTxHash = swapPairTx.SwapPairCreatTxHash
-						engine.updateSwapPairSM(tx, &swapPairSM)
+						_, err := engine.transitSwapPair(tx, &swapPairSM, SwapPairSent, Transition{
+							Reason: "create pair tx is built by the last run, its status is uncertain",
+							Actor:  ActorSwapPairWorker,
+							TxHash: swapPairTx.SwapPairCreatTxHash,
+						})
+						if err != nil {
+							tx.Rollback()
+							return false, err
+						}
 						isSkip = true
 					}
 				} else {
-					swapPairSM.Status = SwapPairSending
-					engine.updateSwapPairSM(tx, &swapPairSM)
+					transited, err := engine.transitSwapPair(tx, &swapPairSM, SwapPairSending, Transition{Reason: "create pair tx is being sent", Actor: ActorSwapPairWorker})
+					if err != nil {
+						tx.Rollback()
+						return false, err
+					}
+					// the swap pair is moved by others
+					isSkip = !transited
 				}
 				return isSkip, tx.Commit().Error
 			}()
@@ -291,10 +338,11 @@ func (engine *SwapPairEngine) swapPairInstanceDaemon() {
 						// delete this create swap tx
 						tx.Where("swap_pair_creat_tx_hash = ?", swapPairCreateTx.SwapPairCreatTxHash).Delete(model.SwapPairCreatTx{})
 						// retry this swapPairSM
-						swapPairSM.Status = SwapPairConfirmed
 						swapPairSM.Log = fmt.Sprintf("do swapPairSM failure: %s", swapErr.Error())
-
-						engine.updateSwapPairSM(tx, &swapPairSM)
+						if _, err := engine.transitSwapPair(tx, &swapPairSM, SwapPairConfirmed, Transition{Reason: swapPairSM.Log, Actor: ActorSwapPairWorker}); err != nil {
+							tx.Rollback()
+							return err
+						}
 					} else {
 						util.SendTelegramMessage(fmt.Sprintf("do swapPairSM failed: %s, start hash %s", swapErr.Error(), swapPairSM.PairRegisterTxHash))
 						createPairTxHash := ""
@@ -302,10 +350,13 @@ func (engine *SwapPairEngine) swapPairInstanceDaemon() {
 							createPairTxHash = swapPairCreateTx.SwapPairCreatTxHash
 						}
 
-						swapPairSM.Status = SwapPairSendFailed
 						swapPairSM.PairCreatTxHash = createPairTxHash
 						swapPairSM.Log = fmt.Sprintf("do swapPairSM failure: %s", swapErr.Error())
-						engine.updateSwapPairSM(tx, &swapPairSM)
+						_, err := engine.transitSwapPair(tx, &swapPairSM, SwapPairSendFailed, Transition{Reason: swapPairSM.Log, Actor: ActorSwapPairWorker, TxHash: createPairTxHash})
+						if err != nil {
+							tx.Rollback()
+							return err
+						}
 					}
 				} else {
 					tx.Model(model.SwapPairCreatTx{}).Where("id = ?", swapPairCreateTx.ID).Updates(
@@ -314,9 +365,16 @@ func (engine *SwapPairEngine) swapPairInstanceDaemon() {
 							"updated_at": time.Now().Unix(),
 						})
 
-					swapPairSM.Status = SwapPairSent
 					swapPairSM.PairCreatTxHash = swapPairCreateTx.SwapPairCreatTxHash
-					engine.updateSwapPairSM(tx, &swapPairSM)
+					_, err := engine.transitSwapPair(tx, &swapPairSM, SwapPairSent, Transition{
+						Reason: "create pair tx is sent",
+						Actor:  ActorSwapPairWorker,
+						TxHash: swapPairCreateTx.SwapPairCreatTxHash,
+					})
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
 				}
 
 				return tx.Commit().Error
@@ -326,43 +384,51 @@ func (engine *SwapPairEngine) swapPairInstanceDaemon() {
 				util.Logger.Errorf("write db error: %s", writeDBErr.Error())
 				util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
 			}
-			time.Sleep(time.Duration(engine.config.ChainConfig.BSCWaitMilliSecBetweenSwaps) * time.Millisecond)
+			engine.lifecycle.Sleep(time.Duration(engine.config.ChainConfig.BSCWaitMilliSecBetweenSwaps) * time.Millisecond)
 		}
 	}
 }
 
 func (engine *SwapPairEngine) doCreateSwapPair(swapPairSM *model.SwapPairStateMachine) (*model.SwapPairCreatTx, error) {
-
-	bscClientMutex.Lock()
-	defer bscClientMutex.Unlock()
 	data, err := abiEncodeCreateSwapPair(ethcom.HexToHash(swapPairSM.PairRegisterTxHash), ethcom.HexToAddress(swapPairSM.ERC20Addr), swapPairSM.Name, swapPairSM.Symbol, uint8(swapPairSM.Decimals), engine.bscSwapAgentABi)
 	if err != nil {
 		return nil, err
 	}
-	signedTx, err := buildSignedTransaction(common.ChainBSC, engine.bscTxSender, engine.bscSwapAgent, engine.bscClient, data, engine.tssClientSecureConfig, engine.config.KeyManagerConfig.Endpoint)
-	if err != nil {
-		return nil, err
-	}
-	swapTx := &model.SwapPairCreatTx{
-		SwapPairRegisterTxHash: swapPairSM.PairRegisterTxHash,
-		SwapPairCreatTxHash:    signedTx.Hash().String(),
-		ERC20Addr:              swapPairSM.ERC20Addr,
-		Symbol:                 swapPairSM.Symbol,
-		Name:                   swapPairSM.Name,
-		Decimals:               swapPairSM.Decimals,
-		GasPrice:               signedTx.GasPrice().String(),
-		Status:                 model.FillTxCreated,
-	}
-	err = engine.insertSwapPairTxToDB(swapTx)
-	if err != nil {
-		return nil, err
-	}
-	err = engine.bscClient.SendTransaction(context.Background(), signedTx)
+	var swapTx *model.SwapPairCreatTx
+	err = engine.swapEngine.bscNonceManager.Use(NoncePurposeCreateSwapPair, func(nonce uint64) (*types.Transaction, error) {
+		fee, err := engine.swapEngine.suggestTxFee(common.ChainBSC)
+		if err != nil {
+			return nil, err
+		}
+		signedTx, err := buildSignedTransaction(engine.swapEngine.bscSigner, engine.bscSwapAgent, engine.bscClient, data, nonce, fee.GasPrice)
+		if err != nil {
+			return nil, err
+		}
+		swapTx = &model.SwapPairCreatTx{
+			SwapPairRegisterTxHash: swapPairSM.PairRegisterTxHash,
+			SwapPairCreatTxHash:    signedTx.Hash().String(),
+			ERC20Addr:              swapPairSM.ERC20Addr,
+			Symbol:                 swapPairSM.Symbol,
+			Name:                   swapPairSM.Name,
+			Decimals:               swapPairSM.Decimals,
+			GasPrice:               signedTx.GasPrice().String(),
+			Status:                 model.FillTxCreated,
+		}
+		err = engine.insertSwapPairTxToDB(swapTx)
+		if err != nil {
+			return nil, err
+		}
+		err = engine.bscClient.SendTransaction(context.Background(), signedTx)
+		if err != nil {
+			util.Logger.Errorf("broadcast tx to BSC error: %s", err.Error())
+			return signedTx, err
+		}
+		util.Logger.Infof("Send transaction to BSC, %s/%s", engine.config.ChainConfig.BSCExplorerUrl, signedTx.Hash().String())
+		return signedTx, nil
+	})
 	if err != nil {
-		util.Logger.Errorf("broadcast tx to BSC error: %s", err.Error())
 		return nil, err
 	}
-	util.Logger.Infof("Send transaction to BSC, %s/%s", engine.config.ChainConfig.BSCExplorerUrl, signedTx.Hash().String())
 	return swapTx, nil
 }
 
@@ -381,10 +447,8 @@ func (engine *SwapPairEngine) insertSwapPairTxToDB(data *model.SwapPairCreatTx)
 }
 
 func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
-	go func() {
-		for {
-			time.Sleep(SleepTime * time.Second)
-
+	engine.lifecycle.Go(func() {
+		for engine.lifecycle.Sleep(SleepTime * time.Second) {
 			swapPairCreateTxs := make([]model.SwapPairCreatTx, 0)
 			engine.db.Where("status = ? and track_retry_counter >= ?", model.FillTxSent, engine.config.ChainConfig.BSCMaxTrackRetry).
 				Order("id asc").Limit(TrackSentTxBatchSize).Find(&swapPairCreateTxs)
@@ -416,9 +480,16 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 						tx.Rollback()
 						return err
 					}
-					swapPairSM.Status = SwapPairSendFailed
 					swapPairSM.Log = fmt.Sprintf("track create swap tx for more than %d times, the fill tx status is still uncertain", maxRetry)
-					engine.updateSwapPairSM(tx, swapPairSM)
+					_, err = engine.transitSwapPair(tx, swapPairSM, SwapPairSendFailed, Transition{
+						Reason: swapPairSM.Log,
+						Actor:  ActorSwapPairTracker,
+						TxHash: swapPairTx.SwapPairCreatTxHash,
+					})
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
 
 					return tx.Commit().Error
 				}()
@@ -428,12 +499,10 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 				}
 			}
 		}
-	}()
-
-	go func() {
-		for {
-			time.Sleep(SleepTime * time.Second)
+	})
 
+	engine.lifecycle.Go(func() {
+		for engine.lifecycle.Sleep(SleepTime * time.Second) {
 			swapPairTxs := make([]model.SwapPairCreatTx, 0)
 			engine.db.Where("status = ? and track_retry_counter < ?", model.FillTxSent, engine.config.ChainConfig.ETHMaxTrackRetry).
 				Order("id asc").Limit(TrackSentTxBatchSize).Find(&swapPairTxs)
@@ -443,14 +512,12 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 			}
 
 			for _, swapPairTx := range swapPairTxs {
-				gasPrice := big.NewInt(0)
-				gasPrice.SetString(swapPairTx.GasPrice, 10)
-
 				client := engine.bscClient
 
 				var txRecipient *types.Receipt
+				var txFee string
 				queryTxStatusErr := func() error {
-					block, err := client.BlockByNumber(context.Background(), nil)
+					header, err := client.HeaderByNumber(context.Background(), nil)
 					if err != nil {
 						util.Logger.Debugf("query block failed: %s", err.Error())
 						return err
@@ -460,9 +527,15 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 						util.Logger.Debugf("query tx failed: %s", err.Error())
 						return err
 					}
-					if block.Number().Int64() < txRecipient.BlockNumber.Int64()+engine.config.ChainConfig.ETHConfirmNum {
+					confirmed, err := engine.bscConfirmPolicy.IsConfirmed(engine.bscConfirmPolicy.ConfirmNum(), txRecipient.BlockNumber.Int64(), header.Number.Int64())
+					if err != nil {
+						util.Logger.Debugf("check tx confirmation failed: %s", err.Error())
+						return err
+					}
+					if !confirmed {
 						return fmt.Errorf("swap tx is still not finalized")
 					}
+					txFee = consumedFee(client, txRecipient, swapPairTx.GasPrice)
 					return nil
 				}()
 
@@ -478,10 +551,9 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 								"updated_at":          time.Now().Unix(),
 							})
 					} else {
-						txFee := big.NewInt(1).Mul(gasPrice, big.NewInt(int64(txRecipient.GasUsed))).String()
 						if txRecipient.Status == TxFailedStatus {
 							util.Logger.Infof(fmt.Sprintf("create swapPairSM pair tx is failed, txHash: %s", txRecipient.TxHash))
-							util.SendTelegramMessage(fmt.Sprintf("create swapPairSM pair tx is failed, chain %s, txHash: %s", txRecipient.TxHash))
+							util.SendTelegramMessage(fmt.Sprintf("create swapPairSM pair tx is failed, txHash: %s", txRecipient.TxHash.String()))
 							tx.Model(model.SwapPairCreatTx{}).Where("id = ?", swapPairTx.ID).Updates(
 								map[string]interface{}{
 									"status":              model.FillTxFailed,
@@ -495,9 +567,16 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 								tx.Rollback()
 								return err
 							}
-							swapPairSM.Status = SwapPairSendFailed
 							swapPairSM.Log = "create swapPairSM pair tx is failed"
-							engine.updateSwapPairSM(tx, swapPairSM)
+							_, err = engine.transitSwapPair(tx, swapPairSM, SwapPairSendFailed, Transition{
+								Reason: swapPairSM.Log,
+								Actor:  ActorSwapPairTracker,
+								TxHash: swapPairTx.SwapPairCreatTxHash,
+							})
+							if err != nil {
+								tx.Rollback()
+								return err
+							}
 						} else {
 							bep20ContractAddr, err := queryDeployedBEP20ContractAddr(
 								ethcom.HexToAddress(swapPairTx.ERC20Addr),
@@ -521,9 +600,16 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 								tx.Rollback()
 								return err
 							}
-							swapPairSM.Status = SwapPairSuccess
 							swapPairSM.BEP20Addr = bep20ContractAddr.String()
-							engine.updateSwapPairSM(tx, swapPairSM)
+							_, err = engine.transitSwapPair(tx, swapPairSM, SwapPairSuccess, Transition{
+								Reason: "create pair tx is success",
+								Actor:  ActorSwapPairTracker,
+								TxHash: swapPairTx.SwapPairCreatTxHash,
+							})
+							if err != nil {
+								tx.Rollback()
+								return err
+							}
 						}
 					}
 					return tx.Commit().Error
@@ -535,12 +621,10 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 
 			}
 		}
-	}()
-
-	go func() {
-		for {
-			time.Sleep(SleepTime * time.Second)
+	})
 
+	engine.lifecycle.Go(func() {
+		for engine.lifecycle.Sleep(SleepTime * time.Second) {
 			swapPairSMs := make([]model.SwapPairStateMachine, 0)
 			engine.db.Where("status = ? ", SwapPairSuccess).
 				Order("id asc").Limit(TrackSwapPairSMBatchSize).Find(&swapPairSMs)
@@ -575,8 +659,11 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 						tx.Rollback()
 						return err
 					}
-					swapPairSM.Status = SwapPairFinalized
-					engine.updateSwapPairSM(tx, &swapPairSM)
+					_, err := engine.transitSwapPair(tx, &swapPairSM, SwapPairFinalized, Transition{Reason: "swap pair is added", Actor: ActorSwapPairTracker})
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
 					return tx.Commit().Error
 				}()
 
@@ -588,7 +675,7 @@ func (engine *SwapPairEngine) trackSwapPairTxDaemon() {
 			}
 
 		}
-	}()
+	})
 
 }
 
@@ -0,0 +1,199 @@
+package swap
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// getSwapFillTxAttempts returns the attempts of the fill tx in the order they are sent. The fill txs sent before
+// the attempts were recorded have a single attempt of their own hash, which can't be replaced for its nonce is
+// unknown.
+func (engine *SwapEngine) getSwapFillTxAttempts(swapFillTx *model.SwapFillTx) ([]model.SwapFillTxAttempt, error) {
+	attempts := make([]model.SwapFillTxAttempt, 0)
+	err := engine.db.Where("swap_fill_tx_id = ?", swapFillTx.ID).Order("attempt asc").Find(&attempts).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(attempts) == 0 {
+		attempts = append(attempts, model.SwapFillTxAttempt{
+			SwapFillTxID: swapFillTx.ID,
+			TxHash:       swapFillTx.FillSwapTxHash,
+			GasPrice:     swapFillTx.GasPrice,
+		})
+	}
+	return attempts, nil
+}
+
+// getFillTxReceipt returns the receipt of the attempt which is mined, the receipt is nil if none of them is mined
+func getFillTxReceipt(client provider.Client, attempts []model.SwapFillTxAttempt) (*types.Receipt, *model.SwapFillTxAttempt, error) {
+	// the later attempts pay more and are more likely to be mined
+	for idx := len(attempts) - 1; idx >= 0; idx-- {
+		receipt, err := client.TransactionReceipt(context.Background(), ethcom.HexToHash(attempts[idx].TxHash))
+		if err == ethereum.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return receipt, &attempts[idx], nil
+	}
+	return nil, nil, nil
+}
+
+// speedUpFillTx replaces the last attempt of the fill tx with the same nonce and calldata and a higher gas price if
+// it is unmined for the configured number of blocks. The gas price is bumped over the replaced one and never
+// exceeds the ceiling of the chain, the fill tx is left to be tracked once the ceiling is reached.
+func (engine *SwapEngine) speedUpFillTx(swapFillTx *model.SwapFillTx, attempts []model.SwapFillTxAttempt, header *types.Header) error {
+	chain := common.ChainBSC
+	client := engine.bscClient
+	nonceManager := engine.bscNonceManager
+	swapAgent := engine.bscSwapAgent
+	explorerUrl := engine.config.ChainConfig.BSCExplorerUrl
+	replaceBlocks := engine.config.ChainConfig.BSCFillTxReplaceBlocks
+	maxGasPriceStr := engine.config.ChainConfig.BSCMaxGasPrice
+	if swapFillTx.Direction == SwapBSC2Eth {
+		chain = common.ChainETH
+		client = engine.ethClient
+		nonceManager = engine.ethNonceManager
+		swapAgent = engine.ethSwapAgent
+		explorerUrl = engine.config.ChainConfig.ETHExplorerUrl
+		replaceBlocks = engine.config.ChainConfig.ETHFillTxReplaceBlocks
+		maxGasPriceStr = engine.config.ChainConfig.ETHMaxGasPrice
+	}
+
+	lastAttempt := attempts[len(attempts)-1]
+	// a replacement spends more gas, it waits for the balance to be topped up like the new fills
+	if replaceBlocks == 0 || lastAttempt.ID == 0 || engine.isChainPaused(chain) {
+		return nil
+	}
+	headHeight := header.Number.Int64()
+	if lastAttempt.SentHeight == 0 {
+		return engine.db.Model(model.SwapFillTxAttempt{}).Where("id = ?", lastAttempt.ID).Update("sent_height", headHeight).Error
+	}
+	if headHeight-lastAttempt.SentHeight < replaceBlocks {
+		return nil
+	}
+
+	lastGasPrice, ok := big.NewInt(0).SetString(lastAttempt.GasPrice, 10)
+	if !ok {
+		return fmt.Errorf("invalid gas price %s of fill tx %s", lastAttempt.GasPrice, lastAttempt.TxHash)
+	}
+	gasPrice := bumpGasPrice(lastGasPrice, ReplaceGasPriceBumpPercent)
+	fee, err := engine.suggestTxFee(chain)
+	if err != nil {
+		return err
+	}
+	if fee.GasPrice.Cmp(gasPrice) > 0 {
+		gasPrice = fee.GasPrice
+	}
+	if maxGasPriceStr != "" {
+		maxGasPrice, _ := big.NewInt(0).SetString(maxGasPriceStr, 10)
+		if gasPrice.Cmp(maxGasPrice) > 0 {
+			gasPrice = maxGasPrice
+		}
+		if gasPrice.Cmp(bumpGasPrice(lastGasPrice, MinReplaceGasPriceBumpPercent)) < 0 {
+			util.Logger.Debugf("fill tx %s of swap %s reaches the %s gas price ceiling %s", lastAttempt.TxHash,
+				swapFillTx.StartSwapTxHash, chain, maxGasPriceStr)
+			return nil
+		}
+	}
+
+	swap, err := engine.getSwapByStartTxHash(engine.db, swapFillTx.StartSwapTxHash)
+	if err != nil {
+		return err
+	}
+	amount := big.NewInt(0)
+	if _, ok := amount.SetString(swap.Amount, 10); !ok {
+		return fmt.Errorf("invalid swap amount: %s", swap.Amount)
+	}
+	var data []byte
+	if swapFillTx.Direction == SwapEth2BSC {
+		data, err = abiEncodeFillETH2BSCSwap(ethcom.HexToHash(swap.StartTxHash), ethcom.HexToAddress(swap.ERC20Addr), ethcom.HexToAddress(swap.Sponsor), amount, engine.bscSwapAgentABI)
+	} else {
+		data, err = abiEncodeFillBSC2ETHSwap(ethcom.HexToHash(swap.StartTxHash), ethcom.HexToAddress(swap.ERC20Addr), ethcom.HexToAddress(swap.Sponsor), amount, engine.ethSwapAgentABI)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nonceManager.Replace(lastAttempt.Nonce, NoncePurposeSpeedUpFillSwap, func(nonce uint64, replacedTxHash string) (*types.Transaction, error) {
+		signedTx, err := buildSignedTransaction(engine.getSigner(chain), swapAgent, client, data, nonce, gasPrice)
+		if err != nil {
+			return nil, err
+		}
+		attempt := &model.SwapFillTxAttempt{
+			SwapFillTxID: swapFillTx.ID,
+			Attempt:      lastAttempt.Attempt + 1,
+			Nonce:        lastAttempt.Nonce,
+			TxHash:       signedTx.Hash().String(),
+			GasPrice:     signedTx.GasPrice().String(),
+			SentHeight:   headHeight,
+		}
+		err = engine.insertSwapFillTxAttempt(attempt)
+		if err != nil {
+			return nil, err
+		}
+		err = client.SendTransaction(context.Background(), signedTx)
+		if err != nil {
+			util.Logger.Errorf("broadcast replacement of fill tx %s to %s error: %s", lastAttempt.TxHash, chain, err.Error())
+			// the attempt is kept if the replacement may be broadcast, so that its receipt is tracked as well
+			if isTxRejected(err) {
+				if deleteErr := engine.db.Unscoped().Delete(attempt).Error; deleteErr != nil {
+					util.Logger.Errorf("delete unsent attempt %s of fill tx error: %s", attempt.TxHash, deleteErr.Error())
+				}
+			}
+			return signedTx, err
+		}
+		util.Logger.Infof("Replace fill tx %s of swap %s with gas price %s, attempt %d, %s/%s", lastAttempt.TxHash,
+			swapFillTx.StartSwapTxHash, attempt.GasPrice, attempt.Attempt, explorerUrl, signedTx.Hash().String())
+		return signedTx, nil
+	})
+}
+
+// insertSwapFillTxAttempt saves the replacement attempt, the tracking of the fill tx starts over for it
+func (engine *SwapEngine) insertSwapFillTxAttempt(attempt *model.SwapFillTxAttempt) error {
+	tx := engine.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	if err := tx.Create(attempt).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Model(model.SwapFillTx{}).Where("id = ?", attempt.SwapFillTxID).Updates(
+		map[string]interface{}{
+			"track_retry_counter": 0,
+			"updated_at":          time.Now().Unix(),
+		}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// settleSwapFillTx records the mined attempt as the fill tx
+func settleSwapFillTx(tx *gorm.DB, swapFillTx *model.SwapFillTx, minedAttempt *model.SwapFillTxAttempt) {
+	if minedAttempt.TxHash == swapFillTx.FillSwapTxHash {
+		return
+	}
+	tx.Model(model.SwapFillTx{}).Where("id = ?", swapFillTx.ID).Updates(
+		map[string]interface{}{
+			"fill_swap_tx_hash": minedAttempt.TxHash,
+			"gas_price":         minedAttempt.GasPrice,
+		})
+}
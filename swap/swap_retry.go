@@ -13,15 +13,14 @@ import (
 
 	sabi "github.com/binance-chain/bsc-eth-swap/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi"
-	"github.com/ethereum/go-ethereum/core"
 
 	ethcom "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/jinzhu/gorm"
 
 	"github.com/binance-chain/bsc-eth-swap/common"
 	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
@@ -39,14 +38,20 @@ func (engine *SwapEngine) verifyRetrySwap(retrySwap *model.RetrySwap) bool {
 	return retrySwap.RecordHash == engine.getRetrySwapHMAC(retrySwap)
 }
 
-func (engine *SwapEngine) insertRetrySwap(tx *gorm.DB, swap *model.RetrySwap) error {
+func (engine *SwapEngine) insertRetrySwap(tx *gorm.DB, swap *model.RetrySwap, transition Transition) error {
 	swap.RecordHash = engine.getRetrySwapHMAC(swap)
-	return tx.Create(swap).Error
-}
-
-func (engine *SwapEngine) updateRetrySwap(tx *gorm.DB, retrySwap *model.RetrySwap) {
-	retrySwap.RecordHash = engine.getRetrySwapHMAC(retrySwap)
-	tx.Save(retrySwap)
+	if err := tx.Create(swap).Error; err != nil {
+		return err
+	}
+	_, err := transit(tx, RetrySwapStateMachine, model.RetrySwap{}, nil, &model.SwapStatusHistory{
+		EntityID:    swap.ID,
+		StartTxHash: swap.StartTxHash,
+		ToStatus:    string(swap.Status),
+		Reason:      transition.Reason,
+		Actor:       transition.Actor,
+		TxHash:      transition.TxHash,
+	})
+	return err
 }
 
 func (engine *SwapEngine) getRetrySwapByID(tx *gorm.DB, id uint) (*model.RetrySwap, error) {
@@ -82,83 +87,130 @@ func (engine *SwapEngine) doRetrySwap(retrySwap *model.RetrySwap, swapPairInstan
 		return nil, fmt.Errorf("invalid swap amount: %s", retrySwap.Amount)
 	}
 
+	var retrySwapTx *model.RetrySwapTx
 	if retrySwap.Direction == SwapEth2BSC {
-		bscClientMutex.Lock()
-		defer bscClientMutex.Unlock()
 		data, err := abiEncodeFillETH2BSCSwap(ethcom.HexToHash(retrySwap.StartTxHash), swapPairInstance.ERC20Addr, ethcom.HexToAddress(retrySwap.Sponsor), amount, engine.bscSwapAgentABI)
 		if err != nil {
 			return nil, err
 		}
-		signedTx, err := buildSignedTransaction(common.ChainBSC, engine.bscTxSender, engine.bscSwapAgent, engine.bscClient, data, engine.tssClientSecureConfig, engine.config.KeyManagerConfig.Endpoint)
-		if err != nil {
+		if err := engine.checkFill(retrySwap.Direction, retrySwap.StartTxHash, data); err != nil {
 			return nil, err
 		}
-		retrySwapTx := &model.RetrySwapTx{
-			RetrySwapID:         retrySwap.ID,
-			StartTxHash:         retrySwap.StartTxHash,
-			Direction:           retrySwap.Direction,
-			RetryFillSwapTxHash: signedTx.Hash().String(),
-			Status:              model.FillRetryTxCreated,
-			GasPrice:            signedTx.GasPrice().String(),
-		}
-		err = engine.insertRetrySwapTxsToDB(retrySwapTx)
-		if err != nil {
-			return nil, err
-		}
-		err = engine.bscClient.SendTransaction(context.Background(), signedTx)
+		err = engine.bscNonceManager.Use(NoncePurposeRetryFillSwap, func(nonce uint64) (*types.Transaction, error) {
+			fee, err := engine.suggestTxFee(common.ChainBSC)
+			if err != nil {
+				return nil, err
+			}
+			signedTx, err := buildSignedTransaction(engine.bscSigner, engine.bscSwapAgent, engine.bscClient, data, nonce, fee.GasPrice)
+			if err != nil {
+				return nil, err
+			}
+			retrySwapTx = &model.RetrySwapTx{
+				RetrySwapID:         retrySwap.ID,
+				StartTxHash:         retrySwap.StartTxHash,
+				Direction:           retrySwap.Direction,
+				RetryFillSwapTxHash: signedTx.Hash().String(),
+				Nonce:               int64(nonce),
+				Status:              model.FillRetryTxCreated,
+				GasPrice:            signedTx.GasPrice().String(),
+			}
+			err = engine.insertRetrySwapTxsToDB(retrySwapTx)
+			if err != nil {
+				return nil, err
+			}
+			err = engine.bscClient.SendTransaction(context.Background(), signedTx)
+			if err != nil {
+				util.Logger.Errorf("broadcast tx to BSC error: %s", err.Error())
+				return signedTx, err
+			}
+			util.Logger.Infof("Send transaction to BSC, %s/%s", engine.config.ChainConfig.BSCExplorerUrl, signedTx.Hash().String())
+			return signedTx, nil
+		})
 		if err != nil {
-			util.Logger.Errorf("broadcast tx to BSC error: %s", err.Error())
 			return nil, err
 		}
-		util.Logger.Infof("Send transaction to BSC, %s/%s", engine.config.ChainConfig.BSCExplorerUrl, signedTx.Hash().String())
 		return retrySwapTx, nil
 	} else {
-		ethClientMutex.Lock()
-		defer ethClientMutex.Unlock()
 		data, err := abiEncodeFillBSC2ETHSwap(ethcom.HexToHash(retrySwap.StartTxHash), swapPairInstance.ERC20Addr, ethcom.HexToAddress(retrySwap.Sponsor), amount, engine.ethSwapAgentABI)
-		signedTx, err := buildSignedTransaction(common.ChainETH, engine.ethTxSender, engine.ethSwapAgent, engine.ethClient, data, engine.tssClientSecureConfig, engine.config.KeyManagerConfig.Endpoint)
 		if err != nil {
 			return nil, err
 		}
-		retrySwapTx := &model.RetrySwapTx{
-			RetrySwapID:         retrySwap.ID,
-			StartTxHash:         retrySwap.StartTxHash,
-			Direction:           retrySwap.Direction,
-			RetryFillSwapTxHash: signedTx.Hash().String(),
-			GasPrice:            signedTx.GasPrice().String(),
-		}
-		err = engine.insertRetrySwapTxsToDB(retrySwapTx)
-		if err != nil {
+		if err := engine.checkFill(retrySwap.Direction, retrySwap.StartTxHash, data); err != nil {
 			return nil, err
 		}
-		err = engine.ethClient.SendTransaction(context.Background(), signedTx)
+		err = engine.ethNonceManager.Use(NoncePurposeRetryFillSwap, func(nonce uint64) (*types.Transaction, error) {
+			fee, err := engine.suggestTxFee(common.ChainETH)
+			if err != nil {
+				return nil, err
+			}
+			signedTx, err := buildSignedTransaction(engine.ethSigner, engine.ethSwapAgent, engine.ethClient, data, nonce, fee.GasPrice)
+			if err != nil {
+				return nil, err
+			}
+			retrySwapTx = &model.RetrySwapTx{
+				RetrySwapID:         retrySwap.ID,
+				StartTxHash:         retrySwap.StartTxHash,
+				Direction:           retrySwap.Direction,
+				RetryFillSwapTxHash: signedTx.Hash().String(),
+				Nonce:               int64(nonce),
+				GasPrice:            signedTx.GasPrice().String(),
+			}
+			err = engine.insertRetrySwapTxsToDB(retrySwapTx)
+			if err != nil {
+				return nil, err
+			}
+			err = engine.ethClient.SendTransaction(context.Background(), signedTx)
+			if err != nil {
+				util.Logger.Errorf("broadcast tx to ETH error: %s", err.Error())
+				return signedTx, err
+			}
+			util.Logger.Infof("Send transaction to ETH, %s/%s", engine.config.ChainConfig.ETHExplorerUrl, signedTx.Hash().String())
+			return signedTx, nil
+		})
 		if err != nil {
-			util.Logger.Errorf("broadcast tx to ETH error: %s", err.Error())
 			return nil, err
-		} else {
-			util.Logger.Infof("Send transaction to ETH, %s/%s", engine.config.ChainConfig.ETHExplorerUrl, signedTx.Hash().String())
 		}
 		return retrySwapTx, nil
 	}
 }
 
 func (engine *SwapEngine) retryFailedSwapsDaemon() {
-	for {
+	for !engine.lifecycle.Stopping() {
+		query := engine.db.Where("status in (?)", []common.RetrySwapStatus{RetrySwapConfirmed, RetrySwapSending})
+		// the retry swaps being sent are still settled, they send no tx
+		if paused := engine.pausedFillDirections(); len(paused) > 0 {
+			query = query.Where("status = ? or direction not in (?)", RetrySwapSending, paused)
+		}
 		retrySwaps := make([]model.RetrySwap, 0)
-		engine.db.Where("status in (?)", []common.RetrySwapStatus{RetrySwapConfirmed, RetrySwapSending}).Order("id asc").Limit(BatchSize).Find(&retrySwaps)
+		query.Order("id asc").Limit(BatchSize).Find(&retrySwaps)
+
+		if len(retrySwaps) == 0 {
+			engine.lifecycle.Sleep(SleepTime * time.Second)
+			continue
+		}
 
 		for _, retrySwap := range retrySwaps {
+			if engine.lifecycle.Stopping() {
+				break
+			}
 			var swapPairInstance *SwapPairIns
 			var err error
 			retryCheckErr := func() error {
 				valid := engine.verifyRetrySwap(&retrySwap)
 				if !valid {
-					return fmt.Errorf("verify hmac of retry swap failed: %s", retrySwap.StartTxHash)
+					return permanentError(fmt.Errorf("verify hmac of retry swap failed: %s", retrySwap.StartTxHash))
 				}
 				swapPairInstance, err = engine.GetSwapPairInstance(ethcom.HexToAddress(retrySwap.ERC20Addr))
 				if err != nil {
 					return fmt.Errorf("failed to get swap instance for erc20 %s, err: %s, skip this swap", retrySwap.ERC20Addr, err.Error())
 				}
+				result, err := engine.screener.Screen(retrySwap.Sponsor)
+				if err != nil {
+					return fmt.Errorf("failed to screen sponsor %s, err: %s", retrySwap.Sponsor, err.Error())
+				}
+				if result.Flagged {
+					return permanentError(fmt.Errorf("sponsor is flagged by the screening, %s", result.Reason))
+				}
 				return nil
 			}()
 			if retryCheckErr != nil {
@@ -167,9 +219,10 @@ func (engine *SwapEngine) retryFailedSwapsDaemon() {
 					if err := tx.Error; err != nil {
 						return err
 					}
-					retrySwap.Status = RetrySwapSendFailed
-					retrySwap.ErrorMsg = retryCheckErr.Error()
-					engine.updateRetrySwap(tx, &retrySwap)
+					if err := engine.failRetrySwap(tx, &retrySwap, retryCheckErr, ActorRetryWorker); err != nil {
+						tx.Rollback()
+						return err
+					}
 					return tx.Commit().Error
 				}()
 				if writeDBErr != nil {
@@ -187,12 +240,15 @@ func (engine *SwapEngine) retryFailedSwapsDaemon() {
 				}
 				if retrySwap.Status == RetrySwapSending {
 					var retrySwapTx model.RetrySwapTx
-					engine.db.Where("start_swap_tx_hash = ?", retrySwap.StartTxHash).First(&retrySwapTx)
+					tx.Where("retry_swap_id = ?", retrySwap.ID).Order("id desc").First(&retrySwapTx)
 					if retrySwapTx.RetryFillSwapTxHash == "" {
 						util.Logger.Infof("retry the retrySwap, start tx hash %s, symbol %s, amount %s, direction",
 							retrySwap.StartTxHash, retrySwap.Symbol, retrySwap.Amount, retrySwap.Direction)
-						retrySwap.Status = RetrySwapConfirmed
-						engine.updateRetrySwap(tx, &retrySwap)
+						_, err := engine.transitRetrySwap(tx, &retrySwap, RetrySwapConfirmed, Transition{Reason: "no retry fill tx is built", Actor: ActorRetryWorker})
+						if err != nil {
+							tx.Rollback()
+							return false, err
+						}
 					} else {
 						util.Logger.Infof("retry swap tx is built successfully, but the retry swap tx status is uncertain, just mark the swap and swap tx status as sent, retry swap ID %d", retrySwap.ID)
 						tx.Model(model.RetrySwapTx{}).Where("id = ?", retrySwapTx.ID).Updates(
@@ -200,15 +256,27 @@ func (engine *SwapEngine) retryFailedSwapsDaemon() {
 								"status":     model.FillRetryTxSent,
 								"updated_at": time.Now().Unix(),
 							})
-						retrySwap.Status = RetrySwapSent
 						retrySwap.FillTxHash = retrySwapTx.RetryFillSwapTxHash
-						engine.updateRetrySwap(tx, &retrySwap)
+						_, err := engine.transitRetrySwap(tx, &retrySwap, RetrySwapSent, Transition{
+							Reason: "retry fill tx is built, its status is uncertain",
+							Actor:  ActorRetryWorker,
+							TxHash: retrySwapTx.RetryFillSwapTxHash,
+						})
+						if err != nil {
+							tx.Rollback()
+							return false, err
+						}
 
 						isSkip = true
 					}
 				} else {
-					retrySwap.Status = RetrySwapSending
-					engine.updateRetrySwap(tx, &retrySwap)
+					transited, err := engine.transitRetrySwap(tx, &retrySwap, RetrySwapSending, Transition{Reason: "retry fill tx is being sent", Actor: ActorRetryWorker})
+					if err != nil {
+						tx.Rollback()
+						return false, err
+					}
+					// the retry swap is moved by others
+					isSkip = !transited
 				}
 				return isSkip, tx.Commit().Error
 			}()
@@ -231,22 +299,28 @@ func (engine *SwapEngine) retryFailedSwapsDaemon() {
 				if err := tx.Error; err != nil {
 					return err
 				}
-				if doRetrySwapErr != nil {
-					if doRetrySwapErr.Error() == core.ErrReplaceUnderpriced.Error() {
-						// delete the fill retry swap tx
-						tx.Where("retry_fill_swap_tx_hash = ?", retrySwapTx.RetryFillSwapTxHash).Delete(model.RetrySwapTx{})
-						// retry this swap
-						retrySwap.ErrorMsg = doRetrySwapErr.Error()
-						engine.updateRetrySwap(tx, &retrySwap)
-						util.Logger.Infof("Just try again for the retrySwap, start TxHash %s", retrySwap.StartTxHash)
-					} else {
-						util.Logger.Errorf("do retry swap failed: %s, start hash %s", doRetrySwapErr.Error(), retrySwap.StartTxHash)
-						util.SendTelegramMessage(fmt.Sprintf("do retry swap failed: %s, start hash %s", doRetrySwapErr.Error(), retrySwap.StartTxHash))
-
-						retrySwap.Status = RetrySwapSendFailed
-						retrySwap.ErrorMsg = doRetrySwapErr.Error()
-						engine.updateRetrySwap(tx, &retrySwap)
+				if doRetrySwapErr == errSwapAlreadyFilled {
+					swap, err := engine.getSwapByStartTxHash(tx, retrySwap.StartTxHash)
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
+					if err := engine.markSwapFilled(tx, swap, ActorRetryWorker); err != nil {
+						tx.Rollback()
+						return err
+					}
 
+					retrySwap.FillTxHash = swap.FillTxHash
+					retrySwap.ErrorMsg = doRetrySwapErr.Error()
+					_, err = engine.transitRetrySwap(tx, &retrySwap, RetrySwapSuccess, Transition{Reason: doRetrySwapErr.Error(), Actor: ActorRetryWorker, TxHash: swap.FillTxHash})
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
+				} else if doRetrySwapErr != nil {
+					util.Logger.Errorf("do retry swap failed: %s, start hash %s", doRetrySwapErr.Error(), retrySwap.StartTxHash)
+					// the retry swap tx is missing if the retry fails before its tx is built
+					if retrySwapTx != nil {
 						tx.Model(model.RetrySwapTx{}).Where("retry_fill_swap_tx_hash = ?", retrySwapTx.RetryFillSwapTxHash).Updates(
 							map[string]interface{}{
 								"status":     model.FillRetryTxFailed,
@@ -254,14 +328,25 @@ func (engine *SwapEngine) retryFailedSwapsDaemon() {
 								"updated_at": time.Now().Unix(),
 							})
 					}
+					if err := engine.failRetrySwap(tx, &retrySwap, doRetrySwapErr, ActorRetryWorker); err != nil {
+						tx.Rollback()
+						return err
+					}
 				} else {
 					tx.Model(model.RetrySwapTx{}).Where("retry_fill_swap_tx_hash = ?", retrySwapTx.RetryFillSwapTxHash).Updates(
 						map[string]interface{}{
 							"status":     model.FillRetryTxSent,
 							"updated_at": time.Now().Unix(),
 						})
-					retrySwap.Status = RetrySwapSent
-					engine.updateRetrySwap(tx, &retrySwap)
+					_, err := engine.transitRetrySwap(tx, &retrySwap, RetrySwapSent, Transition{
+						Reason: "retry fill tx is sent",
+						Actor:  ActorRetryWorker,
+						TxHash: retrySwapTx.RetryFillSwapTxHash,
+					})
+					if err != nil {
+						tx.Rollback()
+						return err
+					}
 				}
 				return tx.Commit().Error
 			}()
@@ -274,10 +359,8 @@ func (engine *SwapEngine) retryFailedSwapsDaemon() {
 }
 
 func (engine *SwapEngine) trackRetrySwapTxDaemon() {
-	go func() {
-		for {
-			time.Sleep(SleepTime * time.Second)
-
+	engine.lifecycle.Go(func() {
+		for engine.lifecycle.Sleep(SleepTime * time.Second) {
 			retrySwapTxs := make([]model.RetrySwapTx, 0)
 			engine.db.Where("status = ? and track_retry_counter >= ?", model.FillRetryTxSent, engine.config.ChainConfig.ETHMaxTrackRetry).
 				Order("id asc").Limit(TrackSentTxBatchSize).Find(&retrySwapTxs)
@@ -294,7 +377,6 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 					maxRetry = engine.config.ChainConfig.BSCMaxTrackRetry
 				}
 				util.Logger.Errorf("The retry fill tx is sent, however, after %d seconds its status is still uncertain. Mark tx as missing and mark swap as failed, chain %s, fill hash %s", SleepTime*maxRetry, chainName, retrySwapTx.RetryFillSwapTxHash)
-				util.SendTelegramMessage(fmt.Sprintf("The retry fill tx is sent, however, after %d seconds its status is still uncertain. Mark tx as missing and mark swap as failed, chain %s, start hash %s", SleepTime*maxRetry, chainName, retrySwapTx.RetryFillSwapTxHash))
 
 				writeDBErr := func() error {
 					tx := engine.db.Begin()
@@ -312,9 +394,11 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 						tx.Rollback()
 						return err
 					}
-					retrySwap.Status = RetrySwapSendFailed
-					retrySwap.ErrorMsg = fmt.Sprintf("track fill retry swap tx for more than %d times, the fill retry swap tx status is still uncertain", maxRetry)
-					engine.updateRetrySwap(tx, retrySwap)
+					trackErr := fmt.Errorf("track fill retry swap tx for more than %d times, the fill retry swap tx status is still uncertain", maxRetry)
+					if err := engine.failRetrySwap(tx, retrySwap, trackErr, ActorRetryTracker); err != nil {
+						tx.Rollback()
+						return err
+					}
 
 					return tx.Commit().Error
 				}()
@@ -324,12 +408,10 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 				}
 			}
 		}
-	}()
-
-	go func() {
-		for {
-			time.Sleep(SleepTime * time.Second)
+	})
 
+	engine.lifecycle.Go(func() {
+		for engine.lifecycle.Sleep(SleepTime * time.Second) {
 			retrySwapTxs := make([]model.RetrySwapTx, 0)
 			engine.db.Where("status = ? and track_retry_counter < ?", model.FillRetryTxSent, engine.config.ChainConfig.ETHMaxTrackRetry).
 				Order("id asc").Limit(TrackSentTxBatchSize).Find(&retrySwapTxs)
@@ -339,10 +421,7 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 			}
 
 			for _, retrySwapTx := range retrySwapTxs {
-				gasPrice := big.NewInt(0)
-				gasPrice.SetString(retrySwapTx.GasPrice, 10)
-
-				var client *ethclient.Client
+				var client provider.Client
 				var chainName string
 				if retrySwapTx.Direction == SwapBSC2Eth {
 					client = engine.ethClient
@@ -352,8 +431,9 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 					chainName = "BSC"
 				}
 				var txRecipient *types.Receipt
+				var txFee string
 				queryTxStatusErr := func() error {
-					block, err := client.BlockByNumber(context.Background(), nil)
+					header, err := client.HeaderByNumber(context.Background(), nil)
 					if err != nil {
 						util.Logger.Debugf("%s, query block failed: %s", chainName, err.Error())
 						return err
@@ -363,9 +443,15 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 						util.Logger.Debugf("%s, query tx failed: %s", chainName, err.Error())
 						return err
 					}
-					if block.Number().Int64() < txRecipient.BlockNumber.Int64()+engine.config.ChainConfig.ETHConfirmNum {
+					confirmed, err := engine.isFillTxConfirmed(retrySwapTx.Direction, retrySwapTx.StartTxHash, txRecipient, header)
+					if err != nil {
+						util.Logger.Debugf("%s, check tx confirmation failed: %s", chainName, err.Error())
+						return err
+					}
+					if !confirmed {
 						return fmt.Errorf("%s, swap tx is still not finalized", chainName)
 					}
+					txFee = consumedFee(client, txRecipient, retrySwapTx.GasPrice)
 					return nil
 				}()
 
@@ -381,10 +467,8 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 								"updated_at":          time.Now().Unix(),
 							})
 					} else {
-						txFee := big.NewInt(1).Mul(gasPrice, big.NewInt(int64(txRecipient.GasUsed))).String()
 						if txRecipient.Status == TxFailedStatus {
 							util.Logger.Infof(fmt.Sprintf("fill retry swap tx is failed, chain %s, txHash: %s", chainName, txRecipient.TxHash.String()))
-							util.SendTelegramMessage(fmt.Sprintf("fill retry swap tx is failed, chain %s, txHash: %s", chainName, txRecipient.TxHash.String()))
 							err := tx.Model(model.RetrySwapTx{}).Where("id = ?", retrySwapTx.ID).Updates(
 								map[string]interface{}{
 									"status":              model.FillRetryTxFailed,
@@ -401,9 +485,11 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 								tx.Rollback()
 								return err
 							}
-							retrySwap.Status = RetrySwapSendFailed
-							retrySwap.ErrorMsg = "fill retry swap tx is failed"
-							engine.updateRetrySwap(tx, retrySwap)
+							revertErr := permanentError(fmt.Errorf("fill retry swap tx %s is reverted on %s", retrySwapTx.RetryFillSwapTxHash, chainName))
+							if err := engine.failRetrySwap(tx, retrySwap, revertErr, ActorRetryTracker); err != nil {
+								tx.Rollback()
+								return err
+							}
 						} else {
 							util.Logger.Infof(fmt.Sprintf("fill retry swap tx is success, chain %s, txHash: %s", chainName, txRecipient.TxHash.String()))
 							err := tx.Model(model.RetrySwapTx{}).Where("id = ?", retrySwapTx.ID).Updates(
@@ -423,18 +509,26 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 								tx.Rollback()
 								return err
 							}
-							retrySwap.Status = RetrySwapSuccess
-							retrySwap.ErrorMsg = "fill retry swap tx is failed"
-							engine.updateRetrySwap(tx, retrySwap)
+							success := Transition{Reason: "retry fill tx is success", Actor: ActorRetryTracker, TxHash: retrySwapTx.RetryFillSwapTxHash}
+							if _, err := engine.transitRetrySwap(tx, retrySwap, RetrySwapSuccess, success); err != nil {
+								tx.Rollback()
+								return err
+							}
 
 							swap, err := engine.getSwapByStartTxHash(tx, retrySwapTx.StartTxHash)
 							if err != nil {
 								tx.Rollback()
 								return err
 							}
-							swap.Status = SwapSuccess
-							swap.Log = fmt.Sprintf("retry success, retry txHash %s", retrySwapTx.RetryFillSwapTxHash)
-							engine.updateSwap(tx, swap)
+							// the swap may have been completed by the fill reconciler
+							if swap.Status != SwapSuccess {
+								swap.FillTxHash = retrySwapTx.RetryFillSwapTxHash
+								swap.Log = fmt.Sprintf("retry success, retry txHash %s", retrySwapTx.RetryFillSwapTxHash)
+								if _, err := engine.transitSwap(tx, swap, SwapSuccess, success); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
 						}
 					}
 					return tx.Commit().Error
@@ -445,10 +539,11 @@ func (engine *SwapEngine) trackRetrySwapTxDaemon() {
 				}
 			}
 		}
-	}()
+	})
 }
 
-func (engine *SwapEngine) InsertRetryFailedSwaps(swapIDList []uint) ([]uint, []uint, error) {
+// InsertRetryFailedSwaps queues the failed swaps as retry swaps on behalf of the admin key
+func (engine *SwapEngine) InsertRetryFailedSwaps(swapIDList []uint, actor string) ([]uint, []uint, error) {
 	swaps := make([]model.Swap, 0)
 	engine.db.Where("id  in (?)", swapIDList).Find(&swaps)
 
@@ -463,33 +558,35 @@ func (engine *SwapEngine) InsertRetryFailedSwaps(swapIDList []uint) ([]uint, []u
 		if err := tx.Error; err != nil {
 			return err
 		}
+		// a swap being retried already is not retried twice, or it may be filled twice
+		retryingSwaps := make([]model.Swap, 0)
+		if err := tx.Select("id").Where("id in (?) and id in (?)", swapIDList, retryingSwapIDs(tx)).Find(&retryingSwaps).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		retrying := make(map[uint]bool, len(retryingSwaps))
+		for _, swap := range retryingSwaps {
+			retrying[swap.ID] = true
+		}
+
 		for _, swap := range swaps {
 			if !engine.verifySwap(&swap) {
 				rejectedRetrySwapList = append(rejectedRetrySwapList, swap.ID)
 				continue
 			}
-			if swap.Status != SwapSendFailed {
+			if swap.Status != SwapSendFailed || retrying[swap.ID] {
 				rejectedRetrySwapList = append(rejectedRetrySwapList, swap.ID)
 				continue
 			}
 			retrySwapList = append(retrySwapList, swap.ID)
-			retrySwap := &model.RetrySwap{
-				Status:      RetrySwapConfirmed,
-				SwapID:      swap.ID,
-				Direction:   swap.Direction,
-				StartTxHash: swap.StartTxHash,
-				FillTxHash:  swap.FillTxHash,
-				Sponsor:     swap.Sponsor,
-				BEP20Addr:   swap.BEP20Addr,
-				ERC20Addr:   swap.ERC20Addr,
-				Symbol:      swap.Symbol,
-				Amount:      swap.Amount,
-				Decimals:    swap.Decimals,
-			}
-			if err := engine.insertRetrySwap(tx, retrySwap); err != nil {
+			retrySwap := newRetrySwap(&swap)
+			if err := engine.insertRetrySwap(tx, retrySwap, Transition{Reason: "retry requested by the admin", Actor: actor}); err != nil {
 				tx.Rollback()
 				return err
 			}
+			// the automatic retry is dropped for the swap is retried now
+			swap.NextRetryAt = 0
+			engine.updateSwap(tx, &swap)
 		}
 		return tx.Commit().Error
 	}()
@@ -502,48 +599,51 @@ func (engine *SwapEngine) WithdrawToken(chain string, tokenAddr, recipient ethco
 		return "", err
 	}
 	emptyAddr := ethcom.Address{}
-	txSender := engine.bscTxSender
 	client := engine.bscClient
+	nonceManager := engine.bscNonceManager
 	explorerUrl := engine.config.ChainConfig.BSCExplorerUrl
 	if chain == common.ChainETH {
-		txSender = engine.ethTxSender
 		client = engine.ethClient
+		nonceManager = engine.ethNonceManager
 		explorerUrl = engine.config.ChainConfig.ETHExplorerUrl
-		ethClientMutex.Lock()
-		defer ethClientMutex.Unlock()
-	} else {
-		bscClientMutex.Lock()
-		defer bscClientMutex.Unlock()
 	}
-	// withdraw native token
-	if bytes.Equal(tokenAddr[:], emptyAddr[:]) {
-		signedTx, err := buildNativeCoinTransferTx(chain, txSender, recipient, amount, client, engine.tssClientSecureConfig, engine.config.KeyManagerConfig.Endpoint)
+
+	var txHash string
+	err = nonceManager.Use(NoncePurposeWithdraw, func(nonce uint64) (*types.Transaction, error) {
+		fee, err := engine.suggestTxFee(chain)
 		if err != nil {
-			util.Logger.Errorf("build native coin transfer error: %s", err.Error())
-			return "", err
+			return nil, err
+		}
+		var signedTx *types.Transaction
+		// withdraw native token
+		if bytes.Equal(tokenAddr[:], emptyAddr[:]) {
+			signedTx, err = buildNativeCoinTransferTx(engine.getSigner(chain), recipient, amount, client, nonce, fee.GasPrice)
+			if err != nil {
+				util.Logger.Errorf("build native coin transfer error: %s", err.Error())
+				return nil, err
+			}
+		} else {
+			// withdraw BEP20 or ERC20 token
+			data, err := abiEncodeERC20Transfer(recipient, amount, &tokenABI)
+			if err != nil {
+				return nil, err
+			}
+			signedTx, err = buildSignedTransaction(engine.getSigner(chain), tokenAddr, client, data, nonce, fee.GasPrice)
+			if err != nil {
+				return nil, err
+			}
 		}
 		err = client.SendTransaction(context.Background(), signedTx)
 		if err != nil {
 			util.Logger.Errorf("broadcast tx to %s error: %s", chain, err.Error())
-			return "", err
+			return signedTx, err
 		}
 		util.Logger.Infof("Send transaction to %s, %s/%s", chain, explorerUrl, signedTx.Hash().String())
-		return signedTx.Hash().String(), nil
-	}
-	// withdraw BEP20 or ERC20 token
-	data, err := abiEncodeERC20Transfer(recipient, amount, &tokenABI)
-	if err != nil {
-		return "", err
-	}
-	signedTx, err := buildSignedTransaction(chain, txSender, tokenAddr, client, data, engine.tssClientSecureConfig, engine.config.KeyManagerConfig.Endpoint)
-	if err != nil {
-		return "", err
-	}
-	err = client.SendTransaction(context.Background(), signedTx)
+		txHash = signedTx.Hash().String()
+		return signedTx, nil
+	})
 	if err != nil {
-		util.Logger.Errorf("broadcast tx to %s error: %s", chain, err.Error())
 		return "", err
 	}
-	util.Logger.Infof("Send transaction to %s, %s/%s", chain, explorerUrl, signedTx.Hash().String())
-	return signedTx.Hash().String(), nil
+	return txHash, nil
 }
@@ -0,0 +1,55 @@
+package swap
+
+import (
+	"testing"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+)
+
+func TestInsertRetryFailedSwaps(t *testing.T) {
+	db := newTestDB(t)
+	engine := &SwapEngine{db: db, hmacCKey: "test"}
+	for _, swap := range []*model.Swap{
+		{Status: SwapSendFailed, StartTxHash: "0x01", NextRetryAt: 100},
+		{Status: SwapSendFailed, StartTxHash: "0x02", NextRetryAt: 100},
+		{Status: SwapSent, StartTxHash: "0x03"},
+	} {
+		swap.RecordHash = engine.getSwapHMAC(swap)
+		if err := db.Create(swap).Error; err != nil {
+			t.Fatalf("insert swap error: %s", err.Error())
+		}
+	}
+
+	retried, rejected, err := engine.InsertRetryFailedSwaps([]uint{1}, "test")
+	if err != nil {
+		t.Fatalf("insert retry swaps error: %s", err.Error())
+	}
+	if len(retried) != 1 || len(rejected) != 0 {
+		t.Fatalf("retried %v and rejected %v, want [1] and []", retried, rejected)
+	}
+
+	// the swap being retried and the swap which is not failed are rejected
+	retried, rejected, err = engine.InsertRetryFailedSwaps([]uint{1, 2, 3}, "test")
+	if err != nil {
+		t.Fatalf("insert retry swaps error: %s", err.Error())
+	}
+	if len(retried) != 1 || retried[0] != 2 || len(rejected) != 2 {
+		t.Fatalf("retried %v and rejected %v, want [2] and [1 3]", retried, rejected)
+	}
+
+	var count int
+	db.Model(model.RetrySwap{}).Where("swap_id = ?", 1).Count(&count)
+	if count != 1 {
+		t.Fatalf("swap 1 has %d retry swaps, want 1", count)
+	}
+	for _, id := range retried {
+		swap := model.Swap{}
+		db.First(&swap, id)
+		if swap.NextRetryAt != 0 {
+			t.Fatalf("automatic retry of swap %d is at %d, want none", id, swap.NextRetryAt)
+		}
+		if !engine.verifySwap(&swap) {
+			t.Fatalf("verify hmac of swap %d failed", id)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package swap
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// fillJob is a swap claimed by the dispatcher of a direction together with a reserved nonce. The jobs are signed
+// concurrently by the workers and broadcast one by one in the order they are claimed, i.e. the order of nonces.
+type fillJob struct {
+	swap             model.Swap
+	swapPairInstance *SwapPairIns
+	reservation      *model.TxNonce
+	// the calldata of the fill tx, it is simulated before the nonce is reserved
+	data []byte
+	// receives the fill tx built by the signing worker
+	signed chan *signedFill
+}
+
+type signedFill struct {
+	swapTx   *model.SwapFillTx
+	signedTx *types.Transaction
+	err      error
+}
+
+// FillMetrics is the throughput statistics of the fill workers of a direction exposed to the operators
+type FillMetrics struct {
+	Direction   common.SwapDirection `json:"direction"`
+	Workers     int                  `json:"workers"`
+	MaxInFlight int64                `json:"max_in_flight"`
+	// the fills which are broadcast and not confirmed yet
+	InFlight int64 `json:"in_flight"`
+	// the swaps which are claimed and not broadcast yet
+	Pending        int64   `json:"pending"`
+	Throttled      bool    `json:"throttled"`
+	Claimed        int64   `json:"claimed"`
+	Sent           int64   `json:"sent"`
+	Failed         int64   `json:"failed"`
+	SentLastMinute int64   `json:"sent_last_minute"`
+	SignLatencyMs  float64 `json:"sign_latency_ms"`
+}
+
+// fillPipeline holds the settings and the statistics of the fill workers of a direction
+type fillPipeline struct {
+	direction   common.SwapDirection
+	workers     int
+	maxInFlight int64
+
+	mutex         sync.Mutex
+	inFlight      int64
+	pending       int64
+	throttled     bool
+	claimed       int64
+	sent          int64
+	failed        int64
+	sendTimes     []time.Time
+	signLatencyMs float64
+}
+
+func newFillPipeline(direction common.SwapDirection, workers int, maxInFlight int64) *fillPipeline {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &fillPipeline{
+		direction:   direction,
+		workers:     workers,
+		maxInFlight: maxInFlight,
+	}
+}
+
+func (p *fillPipeline) setInFlight(inFlight int64, throttled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight = inFlight
+	p.throttled = throttled
+}
+
+func (p *fillPipeline) getPending() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pending
+}
+
+func (p *fillPipeline) recordClaimed() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.claimed++
+	p.pending++
+}
+
+func (p *fillPipeline) recordSigned(latency time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.signLatencyMs = p.signLatencyMs*(1-FillMetricsSmoothingFactor) + float64(latency.Milliseconds())*FillMetricsSmoothingFactor
+}
+
+func (p *fillPipeline) recordBroadcast(sent bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pending--
+	if !sent {
+		p.failed++
+		return
+	}
+	p.sent++
+	p.sendTimes = append(p.sendTimes, time.Now())
+	p.trimSendTimes()
+}
+
+// trimSendTimes drops the send times out of the metrics window, the mutex must be held
+func (p *fillPipeline) trimSendTimes() {
+	windowStart := time.Now().Add(-FillMetricsWindow)
+	idx := 0
+	for idx < len(p.sendTimes) && p.sendTimes[idx].Before(windowStart) {
+		idx++
+	}
+	p.sendTimes = p.sendTimes[idx:]
+}
+
+func (p *fillPipeline) metrics() FillMetrics {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.trimSendTimes()
+	return FillMetrics{
+		Direction:      p.direction,
+		Workers:        p.workers,
+		MaxInFlight:    p.maxInFlight,
+		InFlight:       p.inFlight,
+		Pending:        p.pending,
+		Throttled:      p.throttled,
+		Claimed:        p.claimed,
+		Sent:           p.sent,
+		Failed:         p.failed,
+		SentLastMinute: int64(len(p.sendTimes)),
+		SignLatencyMs:  p.signLatencyMs,
+	}
+}
+
+// FillMetrics returns the throughput statistics of the fill workers of both directions
+func (engine *SwapEngine) FillMetrics() []FillMetrics {
+	return []FillMetrics{
+		engine.fillPipelines[SwapEth2BSC].metrics(),
+		engine.fillPipelines[SwapBSC2Eth].metrics(),
+	}
+}
+
+// swapInstanceDaemon claims the confirmed swaps of the direction and reserves their nonces in order, the claimed
+// swaps are signed by the workers concurrently and broadcast in the order of nonces. No more swaps are claimed
+// while the unconfirmed fills reach the in-flight limit.
+func (engine *SwapEngine) swapInstanceDaemon(direction common.SwapDirection) {
+	util.Logger.Infof("start swap daemon, direction %s", direction)
+	pipeline := engine.fillPipelines[direction]
+	engine.recoverSendingSwaps(direction)
+
+	signJobs := make(chan *fillJob, pipeline.workers)
+	broadcastJobs := make(chan *fillJob, pipeline.workers*FillJobQueueFactor)
+	for idx := 0; idx < pipeline.workers; idx++ {
+		engine.lifecycle.Go(func() {
+			for job := range signJobs {
+				start := time.Now()
+				result := engine.signFill(job)
+				pipeline.recordSigned(time.Since(start))
+				job.signed <- result
+			}
+		})
+	}
+	engine.lifecycle.Go(func() {
+		// the claimed jobs are broadcast even if the engine is stopping, their nonces are reserved already
+		for job := range broadcastJobs {
+			pipeline.recordBroadcast(engine.broadcastFill(job, <-job.signed))
+
+			waitMilliSec := engine.config.ChainConfig.ETHWaitMilliSecBetweenSwaps
+			if direction == SwapEth2BSC {
+				waitMilliSec = engine.config.ChainConfig.BSCWaitMilliSecBetweenSwaps
+			}
+			engine.lifecycle.Sleep(time.Duration(waitMilliSec) * time.Millisecond)
+		}
+	})
+	defer close(broadcastJobs)
+	defer close(signJobs)
+
+	for !engine.lifecycle.Stopping() {
+		if engine.isFillPaused(direction) {
+			util.Logger.Debugf("balance of the tss account is below the floor, stop claiming swaps, direction %s", direction)
+			engine.lifecycle.Sleep(SwapSleepSecond * time.Second)
+			continue
+		}
+		inFlight, err := engine.countInFlightFills(direction)
+		if err != nil {
+			util.Logger.Errorf("count in-flight fills error, direction %s, err=%s", direction, err.Error())
+			engine.lifecycle.Sleep(SwapSleepSecond * time.Second)
+			continue
+		}
+		inFlight += pipeline.getPending()
+		limit := BatchSize
+		throttled := false
+		if pipeline.maxInFlight > 0 {
+			if inFlight >= pipeline.maxInFlight {
+				throttled = true
+			} else if pipeline.maxInFlight-inFlight < int64(limit) {
+				limit = int(pipeline.maxInFlight - inFlight)
+			}
+		}
+		pipeline.setInFlight(inFlight, throttled)
+		if throttled {
+			util.Logger.Debugf("%d fills are in flight, stop claiming swaps, direction %s", inFlight, direction)
+			engine.lifecycle.Sleep(SwapSleepSecond * time.Second)
+			continue
+		}
+
+		swaps := make([]model.Swap, 0)
+		engine.db.Where("status = ? and direction = ?", SwapConfirmed, direction).Order("id asc").Limit(limit).Find(&swaps)
+
+		if len(swaps) == 0 {
+			engine.lifecycle.Sleep(SwapSleepSecond * time.Second)
+			continue
+		}
+
+		util.Logger.Debugf("found %d confirmed swap requests", len(swaps))
+
+		for _, swap := range swaps {
+			if engine.lifecycle.Stopping() {
+				break
+			}
+			job := engine.claimFill(swap)
+			if job == nil {
+				continue
+			}
+			pipeline.recordClaimed()
+			broadcastJobs <- job
+			signJobs <- job
+		}
+	}
+}
+
+// recoverSendingSwaps settles the swaps left in sending by the last run. The swaps without fill tx are sent
+// again, and the others are marked as sent and left to the tracker for their fill txs may have been broadcast.
+func (engine *SwapEngine) recoverSendingSwaps(direction common.SwapDirection) {
+	swaps := make([]model.Swap, 0)
+	engine.db.Where("status = ? and direction = ?", SwapSending, direction).Order("id asc").Find(&swaps)
+
+	for _, swap := range swaps {
+		if !engine.verifySwap(&swap) {
+			util.Logger.Errorf("verify hmac of swap failed: %s", swap.StartTxHash)
+			continue
+		}
+		writeDBErr := func() error {
+			tx := engine.db.Begin()
+			if err := tx.Error; err != nil {
+				return err
+			}
+			var swapTx model.SwapFillTx
+			tx.Where("start_swap_tx_hash = ?", swap.StartTxHash).First(&swapTx)
+			if swapTx.FillSwapTxHash == "" {
+				util.Logger.Infof("retry swap, start tx hash %s, symbol %s, amount %s, direction %s",
+					swap.StartTxHash, swap.Symbol, swap.Amount, swap.Direction)
+				_, err := engine.transitSwap(tx, &swap, SwapConfirmed, Transition{Reason: "no fill tx is built by the last run", Actor: ActorFillDispatcher})
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			} else {
+				util.Logger.Infof("swap tx is built successfully, but the swap tx status is uncertain, just mark the swap and swap tx status as sent, swap ID %d", swap.ID)
+				tx.Model(model.SwapFillTx{}).Where("fill_swap_tx_hash = ?", swapTx.FillSwapTxHash).Updates(
+					map[string]interface{}{
+						"status":     model.FillTxSent,
+						"updated_at": time.Now().Unix(),
+					})
+				swap.FillTxHash = swapTx.FillSwapTxHash
+				_, err := engine.transitSwap(tx, &swap, SwapSent, Transition{
+					Reason: "fill tx is built by the last run, its status is uncertain",
+					Actor:  ActorFillDispatcher,
+					TxHash: swapTx.FillSwapTxHash,
+				})
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			return tx.Commit().Error
+		}()
+		if writeDBErr != nil {
+			util.Logger.Errorf("write db error: %s", writeDBErr.Error())
+			util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
+		}
+	}
+}
+
+func (engine *SwapEngine) countInFlightFills(direction common.SwapDirection) (int64, error) {
+	var count int64
+	err := engine.db.Model(model.SwapFillTx{}).Where("direction = ? and status in (?)", direction,
+		[]model.FillTxStatus{model.FillTxCreated, model.FillTxSent}).Count(&count).Error
+	return count, err
+}
+
+// claimFill marks the swap as sending if it passes the screening, it is approved when required, its liquidity is
+// enough, no one else has claimed it and the velocity limits allow it, and reserves the nonce of its fill tx once
+// the fill is simulated. A nonce released after the later nonces are broadcast would leave a gap blocking them.
+func (engine *SwapEngine) claimFill(swap model.Swap) *fillJob {
+	if !engine.verifySwap(&swap) {
+		msg := fmt.Sprintf("Urgent alert: verify hmac of swap failed: %s, it is quarantined, direction %s, sponsor %s, amount %s",
+			swap.StartTxHash, swap.Direction, swap.Sponsor, swap.Amount)
+		util.Logger.Errorf(msg)
+		util.SendTelegramMessage(msg)
+		_, writeDBErr := engine.quarantineSwap(&swap, Transition{Reason: "verify hmac of swap failed", Actor: ActorFillDispatcher})
+		if writeDBErr != nil {
+			util.Logger.Errorf("write db error: %s", writeDBErr.Error())
+			util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
+		}
+		return nil
+	}
+
+	var swapPairInstance *SwapPairIns
+	var err error
+	retryCheckErr := func() error {
+		swapPairInstance, err = engine.GetSwapPairInstance(ethcom.HexToAddress(swap.ERC20Addr))
+		if err != nil {
+			return fmt.Errorf("swap instance for bep20 %s doesn't exist, skip this swap", swap.BEP20Addr)
+		}
+		return nil
+	}()
+	if retryCheckErr != nil {
+		swap.Log = retryCheckErr.Error()
+		_, writeDBErr := engine.commitSwapTransition(&swap, SwapQuoteRejected, Transition{Reason: swap.Log, Actor: ActorFillDispatcher})
+		if writeDBErr != nil {
+			util.Logger.Errorf("write db error: %s", writeDBErr.Error())
+			util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
+		}
+		return nil
+	}
+
+	passed, err := engine.screenSwap(&swap)
+	if err != nil {
+		util.Logger.Errorf("screen swap %s error: %s", swap.StartTxHash, err.Error())
+		return nil
+	}
+	if !passed {
+		return nil
+	}
+
+	approved, err := engine.checkApproval(&swap)
+	if err != nil {
+		util.Logger.Errorf("check approval of swap %s error: %s", swap.StartTxHash, err.Error())
+		return nil
+	}
+	if !approved {
+		return nil
+	}
+
+	covered, err := engine.checkLiquidity(&swap)
+	if err != nil {
+		util.Logger.Errorf("check liquidity of swap %s error: %s", swap.StartTxHash, err.Error())
+		return nil
+	}
+	if !covered {
+		return nil
+	}
+
+	claimed, err := engine.claimSwap(&swap)
+	if err != nil {
+		util.Logger.Errorf("claim swap %s error: %s", swap.StartTxHash, err.Error())
+		return nil
+	}
+	if !claimed {
+		return nil
+	}
+
+	data, err := engine.buildFillData(&swap, swapPairInstance)
+	if err == nil {
+		err = engine.checkFill(swap.Direction, swap.StartTxHash, data)
+	}
+	if err != nil {
+		engine.saveFillResult(&swap, nil, err)
+		return nil
+	}
+
+	nonceManager := engine.ethNonceManager
+	if swap.Direction == SwapEth2BSC {
+		nonceManager = engine.bscNonceManager
+	}
+	reservation, err := nonceManager.Reserve(NoncePurposeFillSwap)
+	if err != nil {
+		util.Logger.Errorf("%s, start hash %s", err.Error(), swap.StartTxHash)
+		_, writeDBErr := engine.commitSwapTransition(&swap, SwapConfirmed, Transition{Reason: err.Error(), Actor: ActorFillDispatcher})
+		if writeDBErr != nil {
+			util.Logger.Errorf("write db error: %s", writeDBErr.Error())
+			util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
+		}
+		return nil
+	}
+
+	util.Logger.Infof("Swap token %s, direction %s, sponsor: %s, amount %s, decimals %d, nonce %d", swap.BEP20Addr,
+		swap.Direction, swap.Sponsor, swap.Amount, swap.Decimals, reservation.Nonce)
+	return &fillJob{
+		swap:             swap,
+		swapPairInstance: swapPairInstance,
+		reservation:      reservation,
+		data:             data,
+		signed:           make(chan *signedFill, 1),
+	}
+}
+
+// claimSwap marks the confirmed swap as sending unless it exceeds a velocity limit or is claimed by others
+func (engine *SwapEngine) claimSwap(swap *model.Swap) (bool, error) {
+	engine.velocityMutex.Lock()
+	defer engine.velocityMutex.Unlock()
+
+	limit, err := engine.checkVelocity(engine.db, swap)
+	if err != nil {
+		return false, err
+	}
+	if limit != nil {
+		return false, engine.limitVelocity(swap, limit, ActorFillDispatcher)
+	}
+
+	swap.ClaimedAt = time.Now().Unix()
+	claimed, err := engine.commitSwapTransition(swap, SwapSending, Transition{Reason: "claimed to be filled", Actor: ActorFillDispatcher})
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		util.Logger.Debugf("swap %s is claimed by others", swap.StartTxHash)
+	}
+	return claimed, nil
+}
+
+// buildFillData encodes the call of the swap agent filling the swap
+func (engine *SwapEngine) buildFillData(swap *model.Swap, swapPairInstance *SwapPairIns) ([]byte, error) {
+	amount, ok := big.NewInt(0).SetString(swap.Amount, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid swap amount: %s", swap.Amount)
+	}
+	if swap.Direction == SwapEth2BSC {
+		return abiEncodeFillETH2BSCSwap(ethcom.HexToHash(swap.StartTxHash), swapPairInstance.ERC20Addr, ethcom.HexToAddress(swap.Sponsor), amount, engine.bscSwapAgentABI)
+	}
+	return abiEncodeFillBSC2ETHSwap(ethcom.HexToHash(swap.StartTxHash), swapPairInstance.ERC20Addr, ethcom.HexToAddress(swap.Sponsor), amount, engine.ethSwapAgentABI)
+}
+
+// signFill builds the fill tx of the job with its reserved nonce, gets it signed by the signer of the chain and records it
+func (engine *SwapEngine) signFill(job *fillJob) *signedFill {
+	swap := &job.swap
+	chain, swapAgent, client := common.ChainETH, engine.ethSwapAgent, engine.ethClient
+	if swap.Direction == SwapEth2BSC {
+		chain, swapAgent, client = common.ChainBSC, engine.bscSwapAgent, engine.bscClient
+	}
+
+	fee, err := engine.suggestTxFee(chain)
+	if err != nil {
+		return &signedFill{err: err}
+	}
+	nonce := uint64(job.reservation.Nonce)
+	signedTx, err := buildSignedTransaction(engine.getSigner(chain), swapAgent, client, job.data, nonce, fee.GasPrice)
+	if err != nil {
+		return &signedFill{err: err}
+	}
+	swapTx := &model.SwapFillTx{
+		Direction:       swap.Direction,
+		StartSwapTxHash: swap.StartTxHash,
+		FillSwapTxHash:  signedTx.Hash().String(),
+		GasPrice:        signedTx.GasPrice().String(),
+		Status:          model.FillTxCreated,
+	}
+	err = engine.insertSwapTxToDB(swapTx, nonce)
+	if err != nil {
+		return &signedFill{err: err}
+	}
+	return &signedFill{swapTx: swapTx, signedTx: signedTx}
+}
+
+// broadcastFill sends the signed fill tx of the job, finishes its nonce reservation and saves the result
+func (engine *SwapEngine) broadcastFill(job *fillJob, result *signedFill) bool {
+	chain, chainName, client, nonceManager, explorerUrl := common.ChainETH, "ETH", engine.ethClient, engine.ethNonceManager, engine.config.ChainConfig.ETHExplorerUrl
+	if job.swap.Direction == SwapEth2BSC {
+		chain, chainName, client, nonceManager, explorerUrl = common.ChainBSC, "BSC", engine.bscClient, engine.bscNonceManager, engine.config.ChainConfig.BSCExplorerUrl
+	}
+
+	swapErr := result.err
+	if swapErr == nil {
+		swapErr = client.SendTransaction(context.Background(), result.signedTx)
+		if swapErr != nil {
+			util.Logger.Errorf("broadcast tx to %s error: %s", chainName, swapErr.Error())
+		} else {
+			util.Logger.Infof("Send transaction to %s, %s/%s", chainName, explorerUrl, result.signedTx.Hash().String())
+		}
+	}
+	if swapErr != nil && result.signedTx != nil && !isTxRejected(swapErr) {
+		// the fill tx may be broadcast all the same, e.g. it is relayed by the endpoint which timed out, it is left to
+		// the tracker which fails the swap if the fill tx is missing
+		nonceManager.Finish(job.reservation, result.signedTx, swapErr)
+		engine.saveFillResult(&job.swap, result.swapTx, nil)
+		return false
+	}
+	// the jobs of the later nonces are broadcast next, the nonce of the fill tx which is not broadcast is filled first
+	if result.signedTx == nil || (swapErr != nil && isTxRejected(swapErr)) {
+		engine.fillNonceGap(chain, nonceManager, job.reservation)
+	} else {
+		nonceManager.Finish(job.reservation, result.signedTx, swapErr)
+	}
+	engine.saveFillResult(&job.swap, result.swapTx, swapErr)
+	return swapErr == nil
+}
+
+func (engine *SwapEngine) saveFillResult(swap *model.Swap, swapTx *model.SwapFillTx, swapErr error) {
+	writeDBErr := func() error {
+		tx := engine.db.Begin()
+		if err := tx.Error; err != nil {
+			return err
+		}
+		// the start tx may be filled by the fill tx of another run whose result is unknown
+		if swapErr != nil && swapErr != errSwapAlreadyFilled && engine.getOnChainFillTxHash(tx, swap.Direction, swap.StartTxHash) != "" {
+			swapErr = errSwapAlreadyFilled
+		}
+		if swapErr == errSwapAlreadyFilled {
+			if err := engine.markSwapFilled(tx, swap, ActorFillWorker); err != nil {
+				tx.Rollback()
+				return err
+			}
+		} else if swapErr != nil {
+			util.Logger.Errorf("do swap failed: %s, start hash %s", swapErr.Error(), swap.StartTxHash)
+			fillTxHash := ""
+			if swapTx != nil {
+				tx.Model(model.SwapFillTx{}).Where("fill_swap_tx_hash = ?", swapTx.FillSwapTxHash).Updates(
+					map[string]interface{}{
+						"status":     model.FillTxFailed,
+						"updated_at": time.Now().Unix(),
+					})
+				fillTxHash = swapTx.FillSwapTxHash
+			}
+
+			swap.FillTxHash = fillTxHash
+			swap.Log = fmt.Sprintf("do swap failure: %s", swapErr.Error())
+			if err := engine.failSwap(tx, swap, swapErr, ActorFillWorker); err != nil {
+				tx.Rollback()
+				return err
+			}
+		} else {
+			tx.Model(model.SwapFillTx{}).Where("fill_swap_tx_hash = ?", swapTx.FillSwapTxHash).Updates(
+				map[string]interface{}{
+					"status":     model.FillTxSent,
+					"updated_at": time.Now().Unix(),
+				})
+
+			swap.FillTxHash = swapTx.FillSwapTxHash
+			_, err := engine.transitSwap(tx, swap, SwapSent, Transition{Reason: "fill tx is sent", Actor: ActorFillWorker, TxHash: swapTx.FillSwapTxHash})
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		return tx.Commit().Error
+	}()
+
+	if writeDBErr != nil {
+		util.Logger.Errorf("write db error: %s", writeDBErr.Error())
+		util.SendTelegramMessage(fmt.Sprintf("write db error: %s", writeDBErr.Error()))
+	}
+}
@@ -0,0 +1,178 @@
+package swap
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// sendClient builds and records the broadcast txs of the sender
+type sendClient struct {
+	nonceClient
+
+	sent    []*types.Transaction
+	sendErr error
+}
+
+func (c *sendClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1), nil
+}
+
+func (c *sendClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	return 21000, nil
+}
+
+func (c *sendClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return testChainID, nil
+}
+
+func (c *sendClient) TransactionByHash(ctx context.Context, hash ethcom.Hash) (*types.Transaction, bool, error) {
+	for _, tx := range c.sent {
+		if tx.Hash() == hash {
+			return tx, true, nil
+		}
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func (c *sendClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.sent = append(c.sent, tx)
+	return c.sendErr
+}
+
+// failingSigner fails to sign the calls of the contract with the nonce
+type failingSigner struct {
+	Signer
+
+	contract ethcom.Address
+	nonce    uint64
+}
+
+func (s *failingSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	if tx.To() != nil && *tx.To() == s.contract && tx.Nonce() == s.nonce {
+		return nil, errors.New("tss server failure")
+	}
+	return s.Signer.SignTx(tx, chainID)
+}
+
+func TestFailedSignOfMiddleFillLeavesNoNonceGap(t *testing.T) {
+	db := newTestDB(t)
+	signer := &failingSigner{Signer: NewMemorySigner(newTestKey(t)), contract: testContract, nonce: 1}
+	client := &sendClient{}
+	engine := &SwapEngine{
+		db:              db,
+		hmacCKey:        "test",
+		config:          &util.Config{},
+		bscClient:       client,
+		bscSigner:       signer,
+		bscTxSender:     signer.Address(),
+		bscSwapAgent:    testContract,
+		bscNonceManager: NewNonceManager(common.ChainBSC, signer.Address(), db, client),
+	}
+
+	jobs := make([]*fillJob, 0, 3)
+	for _, startTxHash := range []string{"0x01", "0x02", "0x03"} {
+		swap := &model.Swap{Status: SwapSending, Direction: SwapEth2BSC, StartTxHash: startTxHash, Amount: "1"}
+		swap.RecordHash = engine.getSwapHMAC(swap)
+		if err := db.Create(swap).Error; err != nil {
+			t.Fatalf("create swap error: %s", err.Error())
+		}
+		reservation, err := engine.bscNonceManager.Reserve(NoncePurposeFillSwap)
+		if err != nil {
+			t.Fatalf("reserve nonce error: %s", err.Error())
+		}
+		jobs = append(jobs, &fillJob{swap: *swap, reservation: reservation, data: []byte{0x01}})
+	}
+	// the jobs are broadcast in the order of nonces as the broadcaster does
+	for _, job := range jobs {
+		engine.broadcastFill(job, engine.signFill(job))
+	}
+
+	if len(client.sent) != 3 {
+		t.Fatalf("%d txs are sent, want 3", len(client.sent))
+	}
+	for idx, tx := range client.sent {
+		if tx.Nonce() != uint64(idx) {
+			t.Fatalf("tx %d is sent with nonce %d, want %d", idx, tx.Nonce(), idx)
+		}
+		to := testContract
+		if idx == 1 {
+			// the nonce of the failed fill is taken by a transfer to the sender before the next fill
+			to = signer.Address()
+		}
+		if *tx.To() != to || tx.Value().Sign() != 0 {
+			t.Fatalf("tx %d is sent to %s with value %s, want %s with zero value", idx, tx.To().String(), tx.Value().String(), to.String())
+		}
+	}
+	for nonce := int64(0); nonce < 3; nonce++ {
+		txNonce := model.TxNonce{}
+		db.Where("chain = ? and nonce = ?", common.ChainBSC, nonce).First(&txNonce)
+		if txNonce.Status != model.NonceSent || txNonce.TxHash != client.sent[nonce].Hash().String() {
+			t.Fatalf("nonce %d is %s with tx %s, want %s with tx %s", nonce, txNonce.Status, txNonce.TxHash,
+				model.NonceSent, client.sent[nonce].Hash().String())
+		}
+	}
+	for idx, want := range []common.SwapStatus{SwapSent, SwapSendFailed, SwapSent} {
+		swap := model.Swap{}
+		db.First(&swap, jobs[idx].swap.ID)
+		if swap.Status != want {
+			t.Fatalf("swap %s is %s, want %s", swap.StartTxHash, swap.Status, want)
+		}
+	}
+}
+
+func TestFillNonceTooLowIsTracked(t *testing.T) {
+	db := newTestDB(t)
+	signer := NewMemorySigner(newTestKey(t))
+	// the endpoint failed over to has the fill tx relayed by the endpoint which timed out
+	client := &sendClient{sendErr: errors.New("nonce too low")}
+	engine := &SwapEngine{
+		db:              db,
+		hmacCKey:        "test",
+		config:          &util.Config{},
+		bscClient:       client,
+		bscSigner:       signer,
+		bscTxSender:     signer.Address(),
+		bscSwapAgent:    testContract,
+		bscNonceManager: NewNonceManager(common.ChainBSC, signer.Address(), db, client),
+	}
+	swap := &model.Swap{Status: SwapSending, Direction: SwapEth2BSC, StartTxHash: "0x01", Amount: "1"}
+	swap.RecordHash = engine.getSwapHMAC(swap)
+	if err := db.Create(swap).Error; err != nil {
+		t.Fatalf("create swap error: %s", err.Error())
+	}
+	reservation, err := engine.bscNonceManager.Reserve(NoncePurposeFillSwap)
+	if err != nil {
+		t.Fatalf("reserve nonce error: %s", err.Error())
+	}
+	job := &fillJob{swap: *swap, reservation: reservation, data: []byte{0x01}}
+	engine.broadcastFill(job, engine.signFill(job))
+
+	if len(client.sent) != 1 {
+		t.Fatalf("%d txs are sent, want 1", len(client.sent))
+	}
+	txNonce := model.TxNonce{}
+	db.Where("chain = ? and nonce = ?", common.ChainBSC, reservation.Nonce).First(&txNonce)
+	if txNonce.Status != model.NonceSent || txNonce.TxHash != client.sent[0].Hash().String() {
+		t.Fatalf("nonce is %s with tx %s, want %s with tx %s", txNonce.Status, txNonce.TxHash, model.NonceSent, client.sent[0].Hash().String())
+	}
+	saved := model.Swap{}
+	db.First(&saved, swap.ID)
+	if saved.Status != SwapSent {
+		t.Fatalf("swap is %s, want %s", saved.Status, SwapSent)
+	}
+	fillTx := model.SwapFillTx{}
+	db.Where("start_swap_tx_hash = ?", swap.StartTxHash).First(&fillTx)
+	if fillTx.Status != model.FillTxSent {
+		t.Fatalf("fill tx is %d, want %d", fillTx.Status, model.FillTxSent)
+	}
+}
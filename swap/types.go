@@ -4,13 +4,15 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"math/big"
 	"sync"
+	"time"
 
-	tsssdksecure "github.com/binance-chain/tss-zerotrust-sdk/secure"
 	ethcom "github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/jinzhu/gorm"
 
 	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/policy"
+	"github.com/binance-chain/bsc-eth-swap/provider"
+	"github.com/binance-chain/bsc-eth-swap/screening"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
@@ -22,6 +24,20 @@ const (
 	SwapSent          common.SwapStatus = "sent"
 	SwapSendFailed    common.SwapStatus = "sent_fail"
 	SwapSuccess       common.SwapStatus = "sent_success"
+	// the swap exceeds a velocity limit and waits for the window to allow it
+	SwapHeld common.SwapStatus = "held"
+	// the swap is above the approval threshold of its pair and waits for the approvers
+	SwapPendingApproval  common.SwapStatus = "pending_approval"
+	SwapApprovalRejected common.SwapStatus = "approval_rejected"
+	// the sponsor is flagged by the address screening, the swap is filled only if an admin releases it
+	SwapBlocked common.SwapStatus = "blocked"
+	// the eth swap agent doesn't hold enough erc20 to fill the bsc to eth swap
+	SwapAwaitingLiquidity common.SwapStatus = "awaiting_liquidity"
+	// the rejected swap is approved to be refunded, the token is sent back to the sponsor on the chain it starts on
+	SwapRefunding common.SwapStatus = "refunding"
+	SwapRefunded  common.SwapStatus = "refunded"
+	// the swap fails the hmac check, it keeps its record hash so that it is neither filled nor refunded
+	SwapQuarantined common.SwapStatus = "quarantined"
 
 	SwapPairReceived   common.SwapPairStatus = "received"
 	SwapPairConfirmed  common.SwapPairStatus = "confirmed"
@@ -37,6 +53,12 @@ const (
 	RetrySwapSendFailed common.RetrySwapStatus = "sent_fail"
 	RetrySwapSuccess    common.RetrySwapStatus = "sent_success"
 
+	RefundApproved   common.RefundStatus = "approved"
+	RefundSending    common.RefundStatus = "sending"
+	RefundSent       common.RefundStatus = "sent"
+	RefundSendFailed common.RefundStatus = "sent_fail"
+	RefundSuccess    common.RefundStatus = "sent_success"
+
 	SwapEth2BSC common.SwapDirection = "eth_bsc"
 	SwapBSC2Eth common.SwapDirection = "bsc_eth"
 
@@ -49,10 +71,73 @@ const (
 	TxFailedStatus = 0x00
 
 	MaxUpperBound = "999999999999999999999999999999999999"
-)
 
-var ethClientMutex sync.RWMutex
-var bscClientMutex sync.RWMutex
+	NonceReconcileInterval = 30 * time.Second
+	NonceQueryTimeout      = 5 * time.Second
+	// a nonce reserved for longer is considered abandoned by a crashed process
+	NonceReservationTimeout = 10 * time.Minute
+	NonceReserveMaxAttempts = 5
+	// a gap seen by that many reconciliations in a row is reported
+	NonceGapAlertThreshold = 3
+	// the wait before the nonce of a tx which is not broadcast is tried to be filled again
+	NonceGapFillRetryInterval = 10 * time.Second
+	// a consumed nonce whose tx has no receipt for longer is booked as replaced by another tx
+	LedgerReceiptTimeout = 10 * time.Minute
+	// the gas price of a replacement tx is raised by the percentage over the replaced one, the nodes require
+	// MinReplaceGasPriceBumpPercent
+	ReplaceGasPriceBumpPercent    = 15
+	MinReplaceGasPriceBumpPercent = 10
+
+	NoncePurposeFillSwap        = "fill_swap"
+	NoncePurposeSpeedUpFillSwap = "speed_up_fill_swap"
+	NoncePurposeRetryFillSwap   = "retry_fill_swap"
+	NoncePurposeCreateSwapPair  = "create_swap_pair"
+	NoncePurposeWithdraw        = "withdraw"
+	NoncePurposeReplace         = "replace"
+	NoncePurposeRefund          = "refund"
+
+	// the claimed swaps waiting for broadcast are buffered up to the factor times the workers
+	FillJobQueueFactor         = 2
+	FillMetricsSmoothingFactor = 0.2
+	FillMetricsWindow          = time.Minute
+
+	DefaultBalanceMonitorInterval = time.Minute
+	BalanceQueryTimeout           = 10 * time.Second
+	// the gas used by the fill txs is averaged over the recent samples, DefaultFillGas is used before any fill
+	BalanceFillGasSamples = 20
+	DefaultFillGas        = 200000
+
+	DefaultRemoteSignerTimeout = 10 * time.Second
+
+	// the failed swaps are retried automatically after the backoff of the class of their error, which doubles with
+	// every attempt up to the max backoff
+	TransientRetryMaxAttempts = 5
+	TransientRetryBaseBackoff = time.Minute
+	TransientRetryMaxBackoff  = time.Hour
+	UnknownRetryMaxAttempts   = 1
+	UnknownRetryBaseBackoff   = 10 * time.Minute
+	UnknownRetryMaxBackoff    = 10 * time.Minute
+
+	// the daemons recorded as the actors of the status transitions, the admin transitions are recorded with the name
+	// of the admin key
+	ActorSwapMonitor       = "swap_monitor"
+	ActorSwapConfirmer     = "swap_confirmer"
+	ActorFillDispatcher    = "fill_dispatcher"
+	ActorFillWorker        = "fill_worker"
+	ActorFillTracker       = "fill_tracker"
+	ActorFillReconciler    = "fill_reconciler"
+	ActorHeldSwapReleaser  = "held_swap_releaser"
+	ActorLiquidityReleaser = "liquidity_releaser"
+	ActorRetryScheduler    = "retry_scheduler"
+	ActorRetryWorker       = "retry_worker"
+	ActorRetryTracker      = "retry_tracker"
+	ActorSwapPairMonitor   = "swap_pair_monitor"
+	ActorSwapPairConfirmer = "swap_pair_confirmer"
+	ActorSwapPairWorker    = "swap_pair_worker"
+	ActorSwapPairTracker   = "swap_pair_tracker"
+	ActorRefundWorker      = "refund_worker"
+	ActorRefundTracker     = "refund_tracker"
+)
 
 type SwapEngine struct {
 	mutex    sync.RWMutex
@@ -61,13 +146,20 @@ type SwapEngine struct {
 	config   *util.Config
 	// key is the bsc contract addr
 	swapPairsFromERC20Addr map[ethcom.Address]*SwapPairIns
-	tssClientSecureConfig  *tsssdksecure.ClientSecureConfig
-	ethClient              *ethclient.Client
-	bscClient              *ethclient.Client
+	bscSigner              Signer
+	ethSigner              Signer
+	ethClient              provider.Client
+	bscClient              provider.Client
+	ethConfirmPolicy       *policy.ConfirmPolicy
+	bscConfirmPolicy       *policy.ConfirmPolicy
 	ethChainID             int64
 	bscChainID             int64
 	ethTxSender            ethcom.Address
 	bscTxSender            ethcom.Address
+	ethNonceManager        *NonceManager
+	bscNonceManager        *NonceManager
+	screener               *screening.Screener
+	fillPipelines          map[common.SwapDirection]*fillPipeline
 	bep20ToERC20           map[ethcom.Address]ethcom.Address
 	erc20ToBEP20           map[ethcom.Address]ethcom.Address
 
@@ -76,6 +168,15 @@ type SwapEngine struct {
 
 	ethSwapAgent ethcom.Address
 	bscSwapAgent ethcom.Address
+
+	// serializes the velocity checks and the claims of both directions
+	velocityMutex sync.Mutex
+
+	balanceMutex sync.RWMutex
+	// the last balance reports of the tss accounts keyed by the chain
+	balances map[string]*BalanceReport
+
+	lifecycle util.Lifecycle
 }
 
 type SwapPairEngine struct {
@@ -86,12 +187,14 @@ type SwapPairEngine struct {
 
 	swapEngine *SwapEngine
 
-	tssClientSecureConfig *tsssdksecure.ClientSecureConfig
-	bscClient             *ethclient.Client
-	bscChainID            int64
-	bscTxSender           ethcom.Address
-	bscSwapAgent          ethcom.Address
-	bscSwapAgentABi       *abi.ABI
+	bscClient        provider.Client
+	bscConfirmPolicy *policy.ConfirmPolicy
+	bscChainID       int64
+	bscTxSender      ethcom.Address
+	bscSwapAgent     ethcom.Address
+	bscSwapAgentABi  *abi.ABI
+
+	lifecycle util.Lifecycle
 }
 
 type SwapPairIns struct {
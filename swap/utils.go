@@ -10,10 +10,7 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	ethcom "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/ethereum/go-ethereum/rlp"
 	"math/big"
-	"strconv"
 
 	"github.com/binance-chain/tss-crypto-toolkit/ec"
 	rsaTool "github.com/binance-chain/tss-crypto-toolkit/rsa"
@@ -24,6 +21,7 @@ import (
 	contractabi "github.com/binance-chain/bsc-eth-swap/abi"
 	"github.com/binance-chain/bsc-eth-swap/common"
 	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/provider"
 	"github.com/binance-chain/bsc-eth-swap/util"
 )
 
@@ -117,6 +115,41 @@ func abiEncodeCreateSwapPair(registerTxHash ethcom.Hash, erc20Addr ethcom.Addres
 	return data, nil
 }
 
+// queryFilled calls the view of the swap agent which tells whether the start tx is filled, i.e. filledETHTx of the
+// bsc swap agent or filledBSCTx of the eth swap agent
+func queryFilled(client provider.Client, swapAgent ethcom.Address, method string, startTxHash ethcom.Hash, abi *abi.ABI) (bool, error) {
+	data, err := abi.Pack(method, startTxHash)
+	if err != nil {
+		return false, err
+	}
+	output, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &swapAgent, Data: data}, nil)
+	if err != nil {
+		return false, err
+	}
+	var filled bool
+	if err := abi.Unpack(&filled, method, output); err != nil {
+		return false, err
+	}
+	return filled, nil
+}
+
+// queryERC20Addr calls swapMappingBSC2ETH of the bsc swap agent, the erc20 is zero if the bep20 is not of a swap pair
+func queryERC20Addr(client provider.Client, swapAgent ethcom.Address, bep20Addr ethcom.Address, abi *abi.ABI) (ethcom.Address, error) {
+	data, err := abi.Pack("swapMappingBSC2ETH", bep20Addr)
+	if err != nil {
+		return ethcom.Address{}, err
+	}
+	output, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &swapAgent, Data: data}, nil)
+	if err != nil {
+		return ethcom.Address{}, err
+	}
+	var erc20Addr ethcom.Address
+	if err := abi.Unpack(&erc20Addr, "swapMappingBSC2ETH", output); err != nil {
+		return ethcom.Address{}, err
+	}
+	return erc20Addr, nil
+}
+
 func NewClientSecureConfig(keyCfg *util.KeyConfig) *tsssdksecure.ClientSecureConfig {
 	rsaPrvBz, err := base64.StdEncoding.DecodeString(keyCfg.RSAPrvB64)
 	if err != nil {
@@ -211,18 +244,44 @@ func signETH(secureConfig *tsssdksecure.ClientSecureConfig, endPoint string, fro
 	return nt.Ethereum.Sign(request)
 }
 
-func buildSignedTransaction(network string, txSender, contract ethcom.Address, ethClient *ethclient.Client, txInput []byte, tssConfig *tsssdksecure.ClientSecureConfig, endpoint string) (*types.Transaction, error) {
+// txFee is the fee of a tx to build. The TSS signer and the go-ethereum version in use only build legacy txs, which
+// pay their full gas price, so the txs are priced at the suggested gas price on every chain.
+type txFee struct {
+	GasPrice *big.Int
+}
 
-	nonce, err := ethClient.PendingNonceAt(context.Background(), txSender)
+// suggestTxFee returns the fee of a tx
+func suggestTxFee(client provider.Client) (*txFee, error) {
+	gasPrice, err := client.SuggestGasPrice(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	gasPrice, err := ethClient.SuggestGasPrice(context.Background())
-	if err != nil {
-		return nil, err
+	return &txFee{GasPrice: gasPrice}, nil
+}
+
+// consumedFee returns the fee paid by the mined tx. The effective gas price of the receipt is used if the node
+// reports it, otherwise the submitted gas price.
+func consumedFee(client provider.Client, receipt *types.Receipt, submittedGasPrice string) string {
+	gasPrice, ok := big.NewInt(0).SetString(submittedGasPrice, 10)
+	if !ok {
+		gasPrice = big.NewInt(0)
+	}
+	if feeReader, ok := client.(provider.FeeReader); ok {
+		effectiveGasPrice, err := feeReader.EffectiveGasPrice(context.Background(), receipt.TxHash)
+		if err != nil {
+			util.Logger.Debugf("query effective gas price of %s failed: %s", receipt.TxHash.String(), err.Error())
+		} else if effectiveGasPrice != nil {
+			gasPrice = effectiveGasPrice
+		}
 	}
+	return big.NewInt(0).Mul(gasPrice, big.NewInt(int64(receipt.GasUsed))).String()
+}
+
+// buildSignedTransaction builds a contract call signed by the signer of the tx sender, the nonce is reserved by the
+// NonceManager of the sender
+func buildSignedTransaction(signer Signer, contract ethcom.Address, ethClient provider.Client, txInput []byte, nonce uint64, gasPrice *big.Int) (*types.Transaction, error) {
 	value := big.NewInt(0)
-	msg := ethereum.CallMsg{From: txSender, To: &contract, GasPrice: gasPrice, Value: value, Data: txInput}
+	msg := ethereum.CallMsg{From: signer.Address(), To: &contract, GasPrice: gasPrice, Value: value, Data: txInput}
 	gasLimit, err := ethClient.EstimateGas(context.Background(), msg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to estimate gas needed: %v", err)
@@ -234,40 +293,13 @@ func buildSignedTransaction(network string, txSender, contract ethcom.Address, e
 		return nil, fmt.Errorf("failed to get chainid: %v", err)
 	}
 
-	var signedRawTx *tsssdktypes.SignResponse
-	if network == common.ChainBSC {
-		signedRawTx, err = signBSC(tssConfig, endpoint, txSender.String(),
-			contract.String(), "0", "", "", chainId.Int64(), int64(nonce), "0x"+strconv.FormatInt(gasPrice.Int64(), 16), "0x"+strconv.FormatInt(int64(gasLimit), 16), txInput, true)
-		if err != nil {
-			return nil, fmt.Errorf("TSS server failure: %v", err)
-		}
-	} else {
-		signedRawTx, err = signETH(tssConfig, endpoint, txSender.String(),
-			contract.String(), "0", "", "", chainId.Int64(), int64(nonce), "0x"+strconv.FormatInt(gasPrice.Int64(), 16), "0x"+strconv.FormatInt(int64(gasLimit), 16), txInput, true)
-		if err != nil {
-			return nil, fmt.Errorf("TSS server failure: %v", err)
-		}
-	}
-
-	var signedTx types.Transaction
-	err = rlp.DecodeBytes(ethcom.FromHex(signedRawTx.RawTransaction), &signedTx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode TSS signed result: %v", err)
-	}
-
-	return &signedTx, nil
+	return signer.SignTx(types.NewTransaction(nonce, contract, value, gasLimit, gasPrice, txInput), chainId)
 }
 
-func buildNativeCoinTransferTx(network string, txSender, recipient ethcom.Address, amount *big.Int, ethClient *ethclient.Client, tssConfig *tsssdksecure.ClientSecureConfig, endpoint string) (*types.Transaction, error) {
-	nonce, err := ethClient.PendingNonceAt(context.Background(), txSender)
-	if err != nil {
-		return nil, err
-	}
-	gasPrice, err := ethClient.SuggestGasPrice(context.Background())
-	if err != nil {
-		return nil, err
-	}
-	msg := ethereum.CallMsg{From: txSender, To: &recipient, GasPrice: gasPrice, Value: amount}
+// buildNativeCoinTransferTx builds a native coin transfer signed by the signer of the tx sender, the nonce is
+// reserved by the NonceManager of the sender
+func buildNativeCoinTransferTx(signer Signer, recipient ethcom.Address, amount *big.Int, ethClient provider.Client, nonce uint64, gasPrice *big.Int) (*types.Transaction, error) {
+	msg := ethereum.CallMsg{From: signer.Address(), To: &recipient, GasPrice: gasPrice, Value: amount}
 	gasLimit, err := ethClient.EstimateGas(context.Background(), msg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to estimate gas needed: %v", err)
@@ -279,31 +311,10 @@ func buildNativeCoinTransferTx(network string, txSender, recipient ethcom.Addres
 		return nil, fmt.Errorf("failed to get chainid: %v", err)
 	}
 
-	var signedRawTx *tsssdktypes.SignResponse
-	if network == common.ChainBSC {
-		signedRawTx, err = signBSC(tssConfig, endpoint, txSender.String(),
-			recipient.String(), amount.String(), "BNB", "", chainId.Int64(), int64(nonce), "0x"+strconv.FormatInt(gasPrice.Int64(), 16), "0x"+strconv.FormatInt(int64(gasLimit), 16), nil, true)
-		if err != nil {
-			return nil, fmt.Errorf("TSS server failure: %v", err)
-		}
-	} else {
-		signedRawTx, err = signETH(tssConfig, endpoint, txSender.String(),
-			recipient.String(), amount.String(), "ETH", "", chainId.Int64(), int64(nonce), "0x"+strconv.FormatInt(gasPrice.Int64(), 16), "0x"+strconv.FormatInt(int64(gasLimit), 16), nil, true)
-		if err != nil {
-			return nil, fmt.Errorf("TSS server failure: %v", err)
-		}
-	}
-
-	var signedTx types.Transaction
-	err = rlp.DecodeBytes(ethcom.FromHex(signedRawTx.RawTransaction), &signedTx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode TSS signed result: %v", err)
-	}
-
-	return &signedTx, nil
+	return signer.SignTx(types.NewTransaction(nonce, recipient, amount, gasLimit, gasPrice, nil), chainId)
 }
 
-func queryDeployedBEP20ContractAddr(erc20Addr ethcom.Address, bscSwapAgentAddr ethcom.Address, txRecipient *types.Receipt, bscClient *ethclient.Client) (ethcom.Address, error) {
+func queryDeployedBEP20ContractAddr(erc20Addr ethcom.Address, bscSwapAgentAddr ethcom.Address, txRecipient *types.Receipt, bscClient provider.Client) (ethcom.Address, error) {
 	swapAgentInstance, err := contractabi.NewBSCSwapAgent(bscSwapAgentAddr, bscClient)
 	if err != nil {
 		return ethcom.Address{}, err
@@ -319,3 +330,9 @@ func queryDeployedBEP20ContractAddr(erc20Addr ethcom.Address, bscSwapAgentAddr e
 	util.Logger.Debugf("Deployed bep20 contact %s for register erc20 %s", createSwapEvent.Bep20Addr.String(), erc20Addr.String())
 	return createSwapEvent.Bep20Addr, nil
 }
+
+// bumpGasPrice returns the gas price raised by the percentage
+func bumpGasPrice(gasPrice *big.Int, percent int64) *big.Int {
+	bumped := big.NewInt(0).Mul(gasPrice, big.NewInt(100+percent))
+	return bumped.Div(bumped, big.NewInt(100))
+}
@@ -0,0 +1,224 @@
+package swap
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+// checkVelocity returns the enabled velocity limit which the swap would exceed if it is filled now, it is nil if
+// none is exceeded. A limit exceeded by the swap on its own is skipped once the swap is approved, see
+// requireVelocityApproval. The velocityMutex must be held until the swap is claimed or held.
+func (engine *SwapEngine) checkVelocity(tx *gorm.DB, swap *model.Swap) (*model.VelocityLimit, error) {
+	limits := make([]model.VelocityLimit, 0)
+	err := tx.Where("enabled = ?", true).Order("id asc").Find(&limits).Error
+	if err != nil {
+		return nil, err
+	}
+
+	swapAmount, ok := big.NewInt(0).SetString(swap.Amount, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid swap amount: %s", swap.Amount)
+	}
+	var approved *bool
+	now := time.Now().Unix()
+	for idx := range limits {
+		limit := &limits[idx]
+		if limit.ERC20Addr != "" && !strings.EqualFold(limit.ERC20Addr, swap.ERC20Addr) {
+			continue
+		}
+		if limit.Direction != "" && limit.Direction != swap.Direction {
+			continue
+		}
+
+		exceeded, err := exceedsVelocityLimit(limit, swapAmount, nil)
+		if err != nil {
+			return nil, err
+		}
+		if exceeded {
+			if approved == nil {
+				isApproved, err := engine.isSwapApproved(tx, swap)
+				if err != nil {
+					return nil, err
+				}
+				approved = &isApproved
+			}
+			if *approved {
+				continue
+			}
+			return limit, nil
+		}
+
+		query := tx.Model(model.Swap{}).Where("claimed_at >= ? and id <> ?", now-limit.WindowSeconds, swap.ID)
+		if limit.Direction != "" {
+			query = query.Where("direction = ?", limit.Direction)
+		}
+		switch limit.Scope {
+		case model.VelocityScopeToken:
+			query = query.Where("erc20_addr = ?", swap.ERC20Addr)
+		case model.VelocityScopeSponsor:
+			query = query.Where("erc20_addr = ? and sponsor = ?", swap.ERC20Addr, swap.Sponsor)
+		case model.VelocityScopeDirection:
+			// the limit of a token counts the swaps of the token only
+			if limit.ERC20Addr != "" {
+				query = query.Where("erc20_addr = ?", swap.ERC20Addr)
+			}
+		}
+
+		amounts := make([]string, 0)
+		if err := query.Pluck("amount", &amounts).Error; err != nil {
+			return nil, err
+		}
+		exceeded, err = exceedsVelocityLimit(limit, swapAmount, amounts)
+		if err != nil {
+			return nil, err
+		}
+		if exceeded {
+			return limit, nil
+		}
+	}
+	return nil, nil
+}
+
+// exceedsVelocityLimit tells whether the swap of the amount exceeds the limit together with the swaps of the amounts
+// claimed in the window
+func exceedsVelocityLimit(limit *model.VelocityLimit, swapAmount *big.Int, amounts []string) (bool, error) {
+	if limit.MaxCount > 0 && int64(len(amounts))+1 > limit.MaxCount {
+		return true, nil
+	}
+	if limit.MaxAmount == "" {
+		return false, nil
+	}
+	maxAmount, ok := big.NewInt(0).SetString(limit.MaxAmount, 10)
+	if !ok {
+		return false, fmt.Errorf("invalid max amount %s of velocity limit %d", limit.MaxAmount, limit.ID)
+	}
+	total := big.NewInt(0).Set(swapAmount)
+	for _, amount := range amounts {
+		swappedAmount, ok := big.NewInt(0).SetString(amount, 10)
+		if !ok {
+			return false, fmt.Errorf("invalid swap amount: %s", amount)
+		}
+		total.Add(total, swappedAmount)
+	}
+	return total.Cmp(maxAmount) > 0, nil
+}
+
+// isSwapApproved tells whether the swap has the approvals required to be filled
+func (engine *SwapEngine) isSwapApproved(tx *gorm.DB, swap *model.Swap) (bool, error) {
+	approvers, err := engine.getApprovers(tx, swap.ID)
+	if err != nil {
+		return false, err
+	}
+	return len(approvers) >= engine.requiredApprovals(), nil
+}
+
+// limitVelocity holds the swap exceeding the limit, or sends it to the approvers if it exceeds the limit on its own,
+// for no window would ever allow it
+func (engine *SwapEngine) limitVelocity(swap *model.Swap, limit *model.VelocityLimit, actor string) error {
+	swapAmount, ok := big.NewInt(0).SetString(swap.Amount, 10)
+	if !ok {
+		return fmt.Errorf("invalid swap amount: %s", swap.Amount)
+	}
+	exceeded, err := exceedsVelocityLimit(limit, swapAmount, nil)
+	if err != nil {
+		return err
+	}
+	if exceeded {
+		return engine.requireVelocityApproval(swap, limit, actor)
+	}
+	if swap.Status == SwapHeld {
+		return nil
+	}
+	return engine.holdSwap(swap, limit)
+}
+
+// requireVelocityApproval moves the swap exceeding the limit on its own to pending approval, the approved swap is
+// filled regardless of the limits it exceeds on its own
+func (engine *SwapEngine) requireVelocityApproval(swap *model.Swap, limit *model.VelocityLimit, actor string) error {
+	swap.Log = fmt.Sprintf("exceeds the %s velocity limit %d on its own, waiting for approval", limit.Scope, limit.ID)
+	pending, err := engine.commitSwapTransition(swap, SwapPendingApproval, Transition{Reason: swap.Log, Actor: actor})
+	if err != nil || !pending {
+		return err
+	}
+
+	msg := fmt.Sprintf("swap %s is waiting for approval, it %s, id %d, direction %s, sponsor %s, token %s, amount %s",
+		swap.StartTxHash, swap.Log, swap.ID, swap.Direction, swap.Sponsor, swap.ERC20Addr, swap.Amount)
+	util.Logger.Infof(msg)
+	util.SendTelegramMessage(msg)
+	return nil
+}
+
+// holdSwap sets the confirmed swap aside for it exceeds the velocity limit
+func (engine *SwapEngine) holdSwap(swap *model.Swap, limit *model.VelocityLimit) error {
+	swap.Log = fmt.Sprintf("exceeds the %s velocity limit %d in %d seconds", limit.Scope, limit.ID, limit.WindowSeconds)
+	held, err := engine.commitSwapTransition(swap, SwapHeld, Transition{Reason: swap.Log, Actor: ActorFillDispatcher})
+	if err != nil || !held {
+		return err
+	}
+
+	msg := fmt.Sprintf("swap %s is held, it %s, direction %s, sponsor %s, token %s, amount %s", swap.StartTxHash,
+		swap.Log, swap.Direction, swap.Sponsor, swap.ERC20Addr, swap.Amount)
+	util.Logger.Infof(msg)
+	util.SendTelegramMessage(msg)
+	return nil
+}
+
+// releaseHeldSwapsDaemon sends the held swaps back to the fill workers once the velocity limits allow them, in
+// the order they are received
+func (engine *SwapEngine) releaseHeldSwapsDaemon() {
+	for engine.lifecycle.Sleep(SleepTime * time.Second) {
+		engine.releaseHeldSwaps()
+	}
+}
+
+// releaseHeldSwaps goes through all the held swaps page by page, so that the swaps which stay held don't keep the
+// later ones from being released
+func (engine *SwapEngine) releaseHeldSwaps() {
+	var lastID uint
+	for !engine.lifecycle.Stopping() {
+		swaps := make([]model.Swap, 0)
+		engine.db.Where("status = ? and id > ?", SwapHeld, lastID).Order("id asc").Limit(BatchSize).Find(&swaps)
+
+		for _, swap := range swaps {
+			lastID = swap.ID
+			if !engine.verifySwap(&swap) {
+				util.Logger.Errorf("verify hmac of swap failed: %s", swap.StartTxHash)
+				continue
+			}
+			released, err := engine.releaseHeldSwap(&swap)
+			if err != nil {
+				util.Logger.Errorf("release held swap %s error: %s", swap.StartTxHash, err.Error())
+				continue
+			}
+			if released {
+				util.Logger.Infof("held swap %s is released, direction %s, amount %s", swap.StartTxHash, swap.Direction, swap.Amount)
+			}
+		}
+		if len(swaps) < BatchSize {
+			return
+		}
+	}
+}
+
+func (engine *SwapEngine) releaseHeldSwap(swap *model.Swap) (bool, error) {
+	engine.velocityMutex.Lock()
+	defer engine.velocityMutex.Unlock()
+
+	limit, err := engine.checkVelocity(engine.db, swap)
+	if err != nil {
+		return false, err
+	}
+	if limit != nil {
+		return false, engine.limitVelocity(swap, limit, ActorHeldSwapReleaser)
+	}
+
+	swap.Log = "released from the velocity hold"
+	return engine.commitSwapTransition(swap, SwapConfirmed, Transition{Reason: swap.Log, Actor: ActorHeldSwapReleaser})
+}
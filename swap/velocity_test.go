@@ -0,0 +1,75 @@
+package swap
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/binance-chain/bsc-eth-swap/common"
+	"github.com/binance-chain/bsc-eth-swap/model"
+	"github.com/binance-chain/bsc-eth-swap/util"
+)
+
+func createTestHeldSwap(t *testing.T, engine *SwapEngine, startTxHash, amount string) *model.Swap {
+	swap := &model.Swap{Status: SwapHeld, Direction: SwapEth2BSC, StartTxHash: startTxHash, ERC20Addr: testERC20Addr, Amount: amount}
+	swap.RecordHash = engine.getSwapHMAC(swap)
+	if err := engine.db.Create(swap).Error; err != nil {
+		t.Fatalf("create swap error: %s", err.Error())
+	}
+	return swap
+}
+
+func getTestSwapStatus(t *testing.T, engine *SwapEngine, id uint) common.SwapStatus {
+	swap := model.Swap{}
+	if err := engine.db.First(&swap, id).Error; err != nil {
+		t.Fatalf("get swap %d error: %s", id, err.Error())
+	}
+	return swap.Status
+}
+
+func TestReleaseHeldSwapsOverLimitOnItsOwn(t *testing.T) {
+	engine := &SwapEngine{db: newTestDB(t), hmacCKey: "test", config: &util.Config{}}
+	limit := &model.VelocityLimit{Scope: model.VelocityScopeToken, WindowSeconds: 3600, MaxAmount: "100", Enabled: true}
+	if err := engine.db.Create(limit).Error; err != nil {
+		t.Fatalf("create velocity limit error: %s", err.Error())
+	}
+	// the swaps above the limit fill more than a page, they must not starve the swap after them
+	large := make([]*model.Swap, 0, BatchSize+1)
+	for idx := 0; idx < BatchSize+1; idx++ {
+		large = append(large, createTestHeldSwap(t, engine, fmt.Sprintf("0x1%03d", idx), "200"))
+	}
+	small := createTestHeldSwap(t, engine, "0x02", "50")
+
+	engine.releaseHeldSwaps()
+
+	for _, swap := range large {
+		if status := getTestSwapStatus(t, engine, swap.ID); status != SwapPendingApproval {
+			t.Fatalf("swap above the limit on its own is %s, want %s", status, SwapPendingApproval)
+		}
+	}
+	if status := getTestSwapStatus(t, engine, small.ID); status != SwapConfirmed {
+		t.Fatalf("swap within the limit is %s, want %s", status, SwapConfirmed)
+	}
+
+	// the approved swap is claimed regardless of the limit it exceeds on its own
+	swap, err := engine.ApproveSwap(large[0].ID, "admin", "test")
+	if err != nil {
+		t.Fatalf("approve swap error: %s", err.Error())
+	}
+	if swap.Status != SwapConfirmed {
+		t.Fatalf("approved swap is %s, want %s", swap.Status, SwapConfirmed)
+	}
+	claimed, err := engine.claimSwap(swap)
+	if err != nil || !claimed {
+		t.Fatalf("approved swap is claimed %v, err=%v, want claimed", claimed, err)
+	}
+
+	// the limit still holds the swap within it once the window is used up by the approved swap
+	small.Status = SwapConfirmed
+	claimed, err = engine.claimSwap(small)
+	if err != nil || claimed {
+		t.Fatalf("swap within the limit is claimed %v, err=%v, want held", claimed, err)
+	}
+	if status := getTestSwapStatus(t, engine, small.ID); status != SwapHeld {
+		t.Fatalf("swap within the limit is %s, want %s", status, SwapHeld)
+	}
+}
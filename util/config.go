@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net/url"
 
 	ethcom "github.com/ethereum/go-ethereum/common"
 
@@ -24,6 +26,7 @@ func (cfg *Config) Validate() {
 	cfg.ChainConfig.Validate()
 	cfg.LogConfig.Validate()
 	cfg.AlertConfig.Validate()
+	cfg.AdminConfig.Validate()
 }
 
 type AlertConfig struct {
@@ -48,6 +51,26 @@ type KeyManagerConfig struct {
 	AWSRegion     string `json:"aws_region"`
 	AWSSecretName string `json:"aws_secret_name"`
 
+	// the key types of the signers of the chains, the key_type is used if they are empty
+	BSCKeyType string `json:"bsc_key_type"`
+	ETHKeyType string `json:"eth_key_type"`
+	// the keystore files of the keystore signers
+	BSCKeystorePath     string `json:"bsc_keystore_path"`
+	BSCKeystorePassword string `json:"bsc_keystore_password"`
+	ETHKeystorePath     string `json:"eth_keystore_path"`
+	ETHKeystorePassword string `json:"eth_keystore_password"`
+	// the hex private keys of the memory signers
+	BSCMemoryKey string `json:"bsc_memory_key"`
+	ETHMemoryKey string `json:"eth_memory_key"`
+	// the https urls of the remote signers and the tls files of their mutual authentication, the client certificate
+	// is required and the system roots are trusted if the ca is empty
+	BSCRemoteSignerUrl   string `json:"bsc_remote_signer_url"`
+	ETHRemoteSignerUrl   string `json:"eth_remote_signer_url"`
+	RemoteSignerCAPath   string `json:"remote_signer_ca_path"`
+	RemoteSignerCertPath string `json:"remote_signer_cert_path"`
+	RemoteSignerKeyPath  string `json:"remote_signer_key_path"`
+	RemoteSignerTimeout  int64  `json:"remote_signer_timeout"`
+
 	// local keys
 	LocalHMACKey               string `json:"local_hmac_key"`
 	LocalAdminApiKey           string `json:"local_admin_api_key"`
@@ -68,34 +91,94 @@ type KeyConfig struct {
 	RSAPrvB64ForServerPub string `json:"rsa_prv_b64_for_server_pub"`
 }
 
+// ChainKeyType returns the key type of the signer of the chain
+func (cfg KeyManagerConfig) ChainKeyType(chain string) string {
+	keyType := cfg.BSCKeyType
+	if chain == common.ChainETH {
+		keyType = cfg.ETHKeyType
+	}
+	if keyType == "" {
+		return cfg.KeyType
+	}
+	return keyType
+}
+
 func (cfg KeyManagerConfig) Validate() {
-	if cfg.Endpoint == "" {
+	if cfg.KeyType != common.LocalPrivateKey && cfg.KeyType != common.AWSPrivateKey && cfg.KeyType != common.KeystoreKey &&
+		cfg.KeyType != common.MemoryKey && cfg.KeyType != common.RemoteKey {
+		panic(fmt.Sprintf("unsupported key type %s", cfg.KeyType))
+	}
+
+	tssSigner, remoteSigner := false, false
+	for _, chain := range []string{common.ChainBSC, common.ChainETH} {
+		keystorePath, memoryKey, remoteSignerUrl := cfg.BSCKeystorePath, cfg.BSCMemoryKey, cfg.BSCRemoteSignerUrl
+		if chain == common.ChainETH {
+			keystorePath, memoryKey, remoteSignerUrl = cfg.ETHKeystorePath, cfg.ETHMemoryKey, cfg.ETHRemoteSignerUrl
+		}
+		switch keyType := cfg.ChainKeyType(chain); keyType {
+		case common.LocalPrivateKey, common.AWSPrivateKey:
+			tssSigner = true
+		case common.KeystoreKey:
+			if keystorePath == "" {
+				panic(fmt.Sprintf("missing keystore path of %s", chain))
+			}
+		case common.MemoryKey:
+			if memoryKey == "" {
+				panic(fmt.Sprintf("missing memory key of %s", chain))
+			}
+		case common.RemoteKey:
+			remoteSigner = true
+			if remoteSignerUrl == "" {
+				panic(fmt.Sprintf("missing remote signer url of %s", chain))
+			}
+			// the txs are signed for whoever answers the url, it must be authenticated
+			if parsed, err := url.Parse(remoteSignerUrl); err != nil || parsed.Scheme != "https" {
+				panic(fmt.Sprintf("remote signer url of %s should be https", chain))
+			}
+		default:
+			panic(fmt.Sprintf("unsupported key type %s of %s", keyType, chain))
+		}
+	}
+
+	if tssSigner && cfg.Endpoint == "" {
 		panic("missing tss server endpoint")
 	}
+	if (cfg.RemoteSignerCertPath == "") != (cfg.RemoteSignerKeyPath == "") {
+		panic("remote_signer_cert_path and remote_signer_key_path should be set together")
+	}
+	if remoteSigner && cfg.RemoteSignerCertPath == "" {
+		panic("missing remote_signer_cert_path and remote_signer_key_path of the remote signer")
+	}
+	if cfg.RemoteSignerTimeout < 0 {
+		panic("remote_signer_timeout should not be negative")
+	}
 
-	if cfg.KeyType == common.LocalPrivateKey && len(cfg.LocalHMACKey) == 0 {
+	// the hmac key and the admin keys are local unless they are in the aws secret
+	if cfg.KeyType != common.AWSPrivateKey && len(cfg.LocalHMACKey) == 0 {
 		panic("missing local hmac key")
 	}
-	if cfg.KeyType == common.LocalPrivateKey && len(cfg.LocalAdminApiKey) == 0 {
+	if cfg.KeyType != common.AWSPrivateKey && len(cfg.LocalAdminApiKey) == 0 {
 		panic("missing local admin api key")
 	}
-	if cfg.KeyType == common.LocalPrivateKey && len(cfg.LocalAdminSecretKey) == 0 {
+	if cfg.KeyType != common.AWSPrivateKey && len(cfg.LocalAdminSecretKey) == 0 {
 		panic("missing local admin secret key")
 	}
 
-	if cfg.KeyType == common.LocalPrivateKey && len(cfg.LocalP521PrvB64) == 0 {
+	// the keys talking to the tss server are only needed by the tss signers
+	localTSSKeys := tssSigner && cfg.KeyType != common.AWSPrivateKey
+	if localTSSKeys && len(cfg.LocalP521PrvB64) == 0 {
 		panic("missing local p521_prv_b64")
 	}
 
-	if cfg.KeyType == common.LocalPrivateKey && len(cfg.LocalP521PrvForServerPub) == 0 {
+	if localTSSKeys && len(cfg.LocalP521PrvForServerPub) == 0 {
 		panic("missing local p521_prv_for_server_pub")
 	}
 
-	if cfg.KeyType == common.LocalPrivateKey && len(cfg.LocalRSAPrvB64) == 0 {
+	if localTSSKeys && len(cfg.LocalRSAPrvB64) == 0 {
 		panic("missing local rsa_prv_b64")
 	}
 
-	if cfg.KeyType == common.LocalPrivateKey && len(cfg.LocalRSAPrvB64ForServerPub) == 0 {
+	if localTSSKeys && len(cfg.LocalRSAPrvB64ForServerPub) == 0 {
 		panic("missing local rsa_prv_b64_for_server_pub")
 	}
 
@@ -127,59 +210,232 @@ func (cfg DBConfig) Validate() {
 type ChainConfig struct {
 	BalanceMonitorInterval int64 `json:"balance_monitor_interval"`
 
-	BSCObserverFetchInterval    int64  `json:"bsc_observer_fetch_interval"`
-	BSCStartHeight              int64  `json:"bsc_start_height"`
-	BSCProvider                 string `json:"bsc_provider"`
-	BSCConfirmNum               int64  `json:"bsc_confirm_num"`
-	BSCSwapAgentAddr            string `json:"bsc_swap_agent_addr"`
-	BSCExplorerUrl              string `json:"bsc_explorer_url"`
-	BSCMaxTrackRetry            int64  `json:"bsc_max_track_retry"`
-	BSCAlertThreshold           string `json:"bsc_alert_threshold"`
-	BSCWaitMilliSecBetweenSwaps int64  `json:"bsc_wait_milli_sec_between_swaps"`
-
-	ETHObserverFetchInterval    int64  `json:"eth_observer_fetch_interval"`
-	ETHStartHeight              int64  `json:"eth_start_height"`
-	ETHProvider                 string `json:"eth_provider"`
-	ETHConfirmNum               int64  `json:"eth_confirm_num"`
+	BSCObserverFetchInterval    int64         `json:"bsc_observer_fetch_interval"`
+	BSCObserverFetchRangeSize   int64         `json:"bsc_observer_fetch_range_size"`
+	BSCStartHeight              int64         `json:"bsc_start_height"`
+	BSCProvider                 string        `json:"bsc_provider"`
+	BSCProviders                []string      `json:"bsc_providers"`
+	BSCProviderQuorum           int           `json:"bsc_provider_quorum"`
+	BSCConfirmNum               int64         `json:"bsc_confirm_num"`
+	BSCConfirmTiers             []ConfirmTier `json:"bsc_confirm_tiers"`
+	BSCSwapAgentAddr            string        `json:"bsc_swap_agent_addr"`
+	BSCExplorerUrl              string        `json:"bsc_explorer_url"`
+	BSCMaxTrackRetry            int64         `json:"bsc_max_track_retry"`
+	BSCFillTxReplaceBlocks      int64         `json:"bsc_fill_tx_replace_blocks"`
+	BSCMaxGasPrice              string        `json:"bsc_max_gas_price"`
+	BSCAlertThreshold           string        `json:"bsc_alert_threshold"`
+	BSCCriticalThreshold        string        `json:"bsc_critical_threshold"`
+	BSCBalanceFloor             string        `json:"bsc_balance_floor"`
+	BSCWaitMilliSecBetweenSwaps int64         `json:"bsc_wait_milli_sec_between_swaps"`
+	BSCFillWorkers              int           `json:"bsc_fill_workers"`
+	BSCMaxInFlightFills         int64         `json:"bsc_max_in_flight_fills"`
+
+	ETHObserverFetchInterval  int64         `json:"eth_observer_fetch_interval"`
+	ETHObserverFetchRangeSize int64         `json:"eth_observer_fetch_range_size"`
+	ETHStartHeight            int64         `json:"eth_start_height"`
+	ETHProvider               string        `json:"eth_provider"`
+	ETHProviders              []string      `json:"eth_providers"`
+	ETHProviderQuorum         int           `json:"eth_provider_quorum"`
+	ETHConfirmNum             int64         `json:"eth_confirm_num"`
+	ETHConfirmTiers           []ConfirmTier `json:"eth_confirm_tiers"`
+	// safe or finalized, the eth txs are confirmed once their blocks are labeled by the tag instead of after
+	// eth_confirm_num blocks
+	ETHFinalityTag              string `json:"eth_finality_tag"`
 	ETHSwapAgentAddr            string `json:"eth_swap_agent_addr"`
 	ETHExplorerUrl              string `json:"eth_explorer_url"`
 	ETHMaxTrackRetry            int64  `json:"eth_max_track_retry"`
+	ETHFillTxReplaceBlocks      int64  `json:"eth_fill_tx_replace_blocks"`
+	ETHMaxGasPrice              string `json:"eth_max_gas_price"`
 	ETHAlertThreshold           string `json:"eth_alert_threshold"`
+	ETHCriticalThreshold        string `json:"eth_critical_threshold"`
+	ETHBalanceFloor             string `json:"eth_balance_floor"`
 	ETHWaitMilliSecBetweenSwaps int64  `json:"eth_wait_milli_sec_between_swaps"`
+	ETHFillWorkers              int    `json:"eth_fill_workers"`
+	ETHMaxInFlightFills         int64  `json:"eth_max_in_flight_fills"`
+
+	// the usd price of one token keyed by the token address on either chain, used by the usd amount of the
+	// confirm tiers
+	TokenUSDPrices map[string]string `json:"token_usd_prices"`
+}
+
+// validateBalanceThresholds makes sure the thresholds of the tss account balance of the chain are valid amounts
+// and don't increase from the alert threshold down to the floor, an empty threshold is disabled
+func validateBalanceThresholds(chain string, alertThreshold, criticalThreshold, floor string) {
+	var last *big.Int
+	for _, threshold := range []struct {
+		name   string
+		amount string
+	}{
+		{chain + "_alert_threshold", alertThreshold},
+		{chain + "_critical_threshold", criticalThreshold},
+		{chain + "_balance_floor", floor},
+	} {
+		if threshold.amount == "" {
+			continue
+		}
+		amount, ok := big.NewInt(0).SetString(threshold.amount, 10)
+		if !ok || amount.Sign() < 0 {
+			panic(fmt.Sprintf("invalid %s: %s", threshold.name, threshold.amount))
+		}
+		if last != nil && amount.Cmp(last) > 0 {
+			panic(fmt.Sprintf("%s should not be larger than the thresholds above it", threshold.name))
+		}
+		last = amount
+	}
+}
+
+// ConfirmTier raises the confirm number of the swaps reaching the amounts. A tier without token applies to all
+// the tokens, min_amount is in the token's smallest unit and min_usd_amount is in usd. The usd amount of a token
+// without price is unknown, and the swaps of the token reach all the usd tiers.
+type ConfirmTier struct {
+	Token        string `json:"token"`
+	MinAmount    string `json:"min_amount"`
+	MinUSDAmount string `json:"min_usd_amount"`
+	ConfirmNum   int64  `json:"confirm_num"`
+}
+
+func (tier ConfirmTier) Validate(confirmNum int64) {
+	if tier.Token != "" && !ethcom.IsHexAddress(tier.Token) {
+		panic(fmt.Sprintf("invalid confirm tier token: %s", tier.Token))
+	}
+	if tier.MinAmount == "" && tier.MinUSDAmount == "" {
+		panic("min_amount and min_usd_amount of confirm tier should not be both empty")
+	}
+	if tier.MinAmount != "" {
+		if _, ok := big.NewInt(0).SetString(tier.MinAmount, 10); !ok {
+			panic(fmt.Sprintf("invalid confirm tier min_amount: %s", tier.MinAmount))
+		}
+	}
+	if tier.MinUSDAmount != "" {
+		if _, ok := big.NewFloat(0).SetString(tier.MinUSDAmount); !ok {
+			panic(fmt.Sprintf("invalid confirm tier min_usd_amount: %s", tier.MinUSDAmount))
+		}
+	}
+	if tier.ConfirmNum < confirmNum {
+		panic(fmt.Sprintf("confirm tier confirm_num should not be less than the chain confirm num %d", confirmNum))
+	}
 }
 
 func (cfg ChainConfig) Validate() {
 	if cfg.BSCStartHeight < 0 {
 		panic("bsc_start_height should not be less than 0")
 	}
-	if cfg.BSCProvider == "" {
-		panic("bsc_provider should not be empty")
+	if len(cfg.GetBSCProviders()) == 0 {
+		panic("bsc_provider and bsc_providers should not be both empty")
+	}
+	if cfg.BSCProviderQuorum < 0 || cfg.BSCProviderQuorum > len(cfg.GetBSCProviders()) {
+		panic("bsc_provider_quorum should be between 0 and the number of bsc providers")
 	}
 	if cfg.BSCConfirmNum <= 0 {
 		panic("bsc_confirm_num should be larger than 0")
 	}
+	for _, tier := range cfg.BSCConfirmTiers {
+		tier.Validate(cfg.BSCConfirmNum)
+	}
 	if !ethcom.IsHexAddress(cfg.BSCSwapAgentAddr) {
 		panic(fmt.Sprintf("invalid bsc_swap_contract_addr: %s", cfg.BSCSwapAgentAddr))
 	}
 	if cfg.BSCMaxTrackRetry <= 0 {
 		panic("bsc_max_track_retry should be larger than 0")
 	}
+	if cfg.BSCObserverFetchRangeSize < 0 {
+		panic("bsc_observer_fetch_range_size should not be less than 0")
+	}
+	if cfg.BSCFillWorkers < 0 {
+		panic("bsc_fill_workers should not be less than 0")
+	}
+	if cfg.BSCMaxInFlightFills < 0 {
+		panic("bsc_max_in_flight_fills should not be less than 0")
+	}
+	if cfg.BSCFillTxReplaceBlocks < 0 {
+		panic("bsc_fill_tx_replace_blocks should not be less than 0")
+	}
+	if cfg.BSCMaxGasPrice != "" {
+		if maxGasPrice, ok := big.NewInt(0).SetString(cfg.BSCMaxGasPrice, 10); !ok || maxGasPrice.Sign() <= 0 {
+			panic(fmt.Sprintf("invalid bsc_max_gas_price: %s", cfg.BSCMaxGasPrice))
+		}
+	}
+
+	validateBalanceThresholds("bsc", cfg.BSCAlertThreshold, cfg.BSCCriticalThreshold, cfg.BSCBalanceFloor)
 
 	if cfg.ETHStartHeight < 0 {
 		panic("bsc_start_height should not be less than 0")
 	}
-	if cfg.ETHProvider == "" {
-		panic("bsc_provider should not be empty")
+	if len(cfg.GetETHProviders()) == 0 {
+		panic("eth_provider and eth_providers should not be both empty")
+	}
+	if cfg.ETHProviderQuorum < 0 || cfg.ETHProviderQuorum > len(cfg.GetETHProviders()) {
+		panic("eth_provider_quorum should be between 0 and the number of eth providers")
 	}
 	if !ethcom.IsHexAddress(cfg.ETHSwapAgentAddr) {
 		panic(fmt.Sprintf("invalid eth_swap_contract_addr: %s", cfg.ETHSwapAgentAddr))
 	}
 	if cfg.ETHConfirmNum <= 0 {
-		panic("bsc_confirm_num should be larger than 0")
+		panic("eth_confirm_num should be larger than 0")
+	}
+	for _, tier := range cfg.ETHConfirmTiers {
+		tier.Validate(cfg.ETHConfirmNum)
+	}
+	if cfg.ETHFinalityTag != "" && cfg.ETHFinalityTag != common.FinalityTagSafe && cfg.ETHFinalityTag != common.FinalityTagFinalized {
+		panic(fmt.Sprintf("eth_finality_tag should be empty, %s or %s", common.FinalityTagSafe, common.FinalityTagFinalized))
 	}
 	if cfg.ETHMaxTrackRetry <= 0 {
 		panic("eth_max_track_retry should be larger than 0")
 	}
+	if cfg.ETHObserverFetchRangeSize < 0 {
+		panic("eth_observer_fetch_range_size should not be less than 0")
+	}
+	if cfg.ETHFillWorkers < 0 {
+		panic("eth_fill_workers should not be less than 0")
+	}
+	if cfg.ETHMaxInFlightFills < 0 {
+		panic("eth_max_in_flight_fills should not be less than 0")
+	}
+	if cfg.ETHFillTxReplaceBlocks < 0 {
+		panic("eth_fill_tx_replace_blocks should not be less than 0")
+	}
+	if cfg.ETHMaxGasPrice != "" {
+		if maxGasPrice, ok := big.NewInt(0).SetString(cfg.ETHMaxGasPrice, 10); !ok || maxGasPrice.Sign() <= 0 {
+			panic(fmt.Sprintf("invalid eth_max_gas_price: %s", cfg.ETHMaxGasPrice))
+		}
+	}
+	validateBalanceThresholds("eth", cfg.ETHAlertThreshold, cfg.ETHCriticalThreshold, cfg.ETHBalanceFloor)
+
+	if cfg.BalanceMonitorInterval < 0 {
+		panic("balance_monitor_interval should not be less than 0")
+	}
+
+	for token, price := range cfg.TokenUSDPrices {
+		if !ethcom.IsHexAddress(token) {
+			panic(fmt.Sprintf("invalid token_usd_prices token: %s", token))
+		}
+		if usdPrice, ok := big.NewFloat(0).SetString(price); !ok || usdPrice.Sign() < 0 {
+			panic(fmt.Sprintf("invalid token_usd_prices price of %s: %s", token, price))
+		}
+	}
+}
+
+// GetBSCProviders returns bsc_provider followed by bsc_providers without duplicates
+func (cfg ChainConfig) GetBSCProviders() []string {
+	return mergeProviders(cfg.BSCProvider, cfg.BSCProviders)
+}
+
+// GetETHProviders returns eth_provider followed by eth_providers without duplicates
+func (cfg ChainConfig) GetETHProviders() []string {
+	return mergeProviders(cfg.ETHProvider, cfg.ETHProviders)
+}
+
+func mergeProviders(provider string, providers []string) []string {
+	merged := make([]string, 0, len(providers)+1)
+	seen := make(map[string]bool, len(providers)+1)
+	for _, url := range append([]string{provider}, providers...) {
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		merged = append(merged, url)
+	}
+	return merged
 }
 
 type LogConfig struct {
@@ -209,6 +465,41 @@ func (cfg LogConfig) Validate() {
 
 type AdminConfig struct {
 	ListenAddr string `json:"listen_addr"`
+
+	// the keys approving the swaps above the approval thresholds of the swap pairs, the admin key approves if it
+	// is empty
+	Approvers         []ApproverConfig `json:"approvers"`
+	RequiredApprovals int              `json:"required_approvals"`
+}
+
+type ApproverConfig struct {
+	Name      string `json:"name"`
+	ApiKey    string `json:"api_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+func (cfg AdminConfig) Validate() {
+	if cfg.RequiredApprovals < 0 {
+		panic("required_approvals should not be negative")
+	}
+	if len(cfg.Approvers) == 0 && cfg.RequiredApprovals > 1 {
+		panic("required_approvals should not be larger than 1 without approvers")
+	}
+	if len(cfg.Approvers) > 0 && cfg.RequiredApprovals > len(cfg.Approvers) {
+		panic("required_approvals should not be larger than the number of approvers")
+	}
+	names := make(map[string]bool, len(cfg.Approvers))
+	apiKeys := make(map[string]bool, len(cfg.Approvers))
+	for _, approver := range cfg.Approvers {
+		if approver.Name == "" || approver.ApiKey == "" || approver.SecretKey == "" {
+			panic("name, api_key and secret_key of approver should not be empty")
+		}
+		if names[approver.Name] || apiKeys[approver.ApiKey] {
+			panic(fmt.Sprintf("duplicate approver %s", approver.Name))
+		}
+		names[approver.Name] = true
+		apiKeys[approver.ApiKey] = true
+	}
 }
 
 func ParseConfigFromFile(filePath string) *Config {
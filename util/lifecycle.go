@@ -0,0 +1,82 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Lifecycle tracks the routines of a long running component. The routines are expected to check Stopping or to
+// wait with Sleep between their units of work, so that Stop returns once the in-flight work is finished.
+type Lifecycle struct {
+	mutex  sync.RWMutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start derives the context of the component from the given one, the component stops when either is cancelled
+func (l *Lifecycle) Start(ctx context.Context) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ctx, l.cancel = context.WithCancel(ctx)
+}
+
+// Context returns the context of the component, it is done once the component is stopping
+func (l *Lifecycle) Context() context.Context {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.ctx == nil {
+		return context.Background()
+	}
+	return l.ctx
+}
+
+// Go starts a tracked routine
+func (l *Lifecycle) Go(fn func()) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		fn()
+	}()
+}
+
+// Stopping returns true if the component should not pick up new work
+func (l *Lifecycle) Stopping() bool {
+	return l.Context().Err() != nil
+}
+
+// Sleep waits for the duration, it returns false immediately if the component is stopping
+func (l *Lifecycle) Sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-l.Context().Done():
+		return false
+	}
+}
+
+// Stop cancels the context of the component and waits for the tracked routines to return within the timeout
+func (l *Lifecycle) Stop(timeout time.Duration) error {
+	l.mutex.RLock()
+	cancel := l.cancel
+	l.mutex.RUnlock()
+	if cancel != nil {
+		cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("routines are still running after %s", timeout.String())
+	}
+}